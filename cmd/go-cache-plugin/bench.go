@@ -0,0 +1,168 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/creachadair/command"
+	"github.com/creachadair/taskgroup"
+	"github.com/tailscale/go-cache-plugin/lib/server"
+)
+
+var benchFlags struct {
+	Size        byteSize `flag:"object-size,default=1M,Size of each synthetic object (with optional suffix K, M, or G)"`
+	Count       int      `flag:"count,default=100,Number of objects to write and read"`
+	Concurrency int      `flag:"concurrency,default=4,Number of requests to run concurrently"`
+}
+
+// runBench measures the latency and throughput of the storage bucket.
+func runBench(env *command.Env) error {
+	if benchFlags.Count <= 0 || benchFlags.Concurrency <= 0 || benchFlags.Size <= 0 {
+		return env.Usagef("--object-size, --count, and --concurrency must be positive")
+	}
+	ctx := env.Context()
+	cfg, err := serverConfig()
+	if err != nil {
+		return err
+	}
+	client, err := server.NewStorageClient(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	data := make([]byte, benchFlags.Size)
+	rand.Read(data) // random contents defeat any compression in transit
+	prefix := path.Join(cfg.KeyPrefix, "bench", strconv.FormatInt(time.Now().UnixNano(), 36))
+	keys := make([]string, benchFlags.Count)
+	for i := range keys {
+		keys[i] = path.Join(prefix, strconv.Itoa(i))
+	}
+
+	// Clean up after ourselves even if a phase fails, but use a fresh context
+	// so that an interrupt does not leave the objects behind.
+	defer func() {
+		dctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+		defer cancel()
+		st := benchRun(keys, func(key string) (int64, error) { return 0, client.Delete(dctx, key) })
+		if st.errors != 0 {
+			log.Printf("WARNING: %d objects under %s could not be deleted", st.errors, prefix)
+		}
+	}()
+
+	fmt.Printf("objects:   %d x %d bytes, concurrency %d\n", len(keys), len(data), benchFlags.Concurrency)
+	fmt.Printf("keys:      %s/\n", prefix)
+	put := benchRun(keys, func(key string) (int64, error) {
+		return int64(len(data)), client.Put(ctx, key, bytes.NewReader(data))
+	})
+	put.print("put")
+	get := benchRun(keys, func(key string) (int64, error) {
+		rc, _, err := client.Get(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		defer rc.Close()
+		return io.Copy(io.Discard, rc)
+	})
+	get.print("get")
+	if n := put.errors + get.errors; n != 0 {
+		return fmt.Errorf("%d requests failed", n)
+	}
+	return nil
+}
+
+// benchStats records the results of one phase of a benchmark.
+type benchStats struct {
+	latency []time.Duration // of successful requests, in increasing order
+	bytes   int64           // total bytes transferred
+	errors  int             // count of failed requests
+	elapsed time.Duration   // wall time of the whole phase
+	lastErr error
+}
+
+// benchRun calls op for each of keys, with up to --concurrency calls running
+// at once, and reports the results.
+func benchRun(keys []string, op func(key string) (int64, error)) benchStats {
+	var mu sync.Mutex
+	var st benchStats
+	start := time.Now()
+	g, run := taskgroup.New(nil).Limit(benchFlags.Concurrency)
+	for _, key := range keys {
+		run(func() error {
+			t := time.Now()
+			n, err := op(key)
+			d := time.Since(t)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				st.errors++
+				st.lastErr = err
+				return nil
+			}
+			st.latency = append(st.latency, d)
+			st.bytes += n
+			return nil
+		})
+	}
+	g.Wait()
+	st.elapsed = time.Since(start)
+	slices.Sort(st.latency)
+	return st
+}
+
+// percentile returns the latency below which the fraction q of requests
+// completed, or 0 if none succeeded.
+func (b benchStats) percentile(q float64) time.Duration {
+	if len(b.latency) == 0 {
+		return 0
+	}
+	return b.latency[int(q*float64(len(b.latency)-1))]
+}
+
+func (b benchStats) print(label string) {
+	secs := b.elapsed.Seconds()
+	fmt.Printf("%-10s p50 %v, p95 %v, p99 %v; %.1f req/s, %.2f MiB/s (%d errors)\n", label+":",
+		b.percentile(0.50).Round(time.Microsecond),
+		b.percentile(0.95).Round(time.Microsecond),
+		b.percentile(0.99).Round(time.Microsecond),
+		float64(len(b.latency))/secs, float64(b.bytes)/secs/(1<<20), b.errors)
+	if b.lastErr != nil {
+		fmt.Printf("           last error: %v\n", b.lastErr)
+	}
+}
+
+// byteSize implements [flag.Value] for a size in bytes, with an optional
+// binary suffix K, M, or G.
+type byteSize int64
+
+func (b byteSize) String() string { return strconv.FormatInt(int64(b), 10) }
+
+func (b *byteSize) Set(s string) error {
+	num, scale := strings.ToUpper(s), int64(1)
+	for i, suffix := range []string{"K", "M", "G"} {
+		if v, ok := strings.CutSuffix(num, suffix); ok {
+			num, scale = v, 1<<(10*(i+1))
+			break
+		}
+	}
+	v, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || v < 0 {
+		return fmt.Errorf("invalid size %q", s)
+	}
+	*b = byteSize(v * scale)
+	return nil
+}
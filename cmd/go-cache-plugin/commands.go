@@ -6,24 +6,35 @@ package main
 import (
 	"context"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/creachadair/command"
 	"github.com/creachadair/gocache"
 	"github.com/creachadair/taskgroup"
+	"github.com/tailscale/go-cache-plugin/lib/gobuild"
+	"github.com/tailscale/go-cache-plugin/lib/revproxy"
+	"github.com/tailscale/go-cache-plugin/lib/server"
 )
 
 var flags struct {
-	CacheDir string `flag:"cache-dir,default=$GOCACHE_DIR,Local cache directory (required)"`
+	CacheDir       string `flag:"cache-dir,default=$GOCACHE_DIR,Local cache directory (required)"`
+	CacheDirLarge  string `flag:"cache-dir-large,default=$GOCACHE_DIR_LARGE,Local directory for large build cache objects (optional; requires --large-threshold)"`
+	LargeThreshold int64  `flag:"large-threshold,default=$GOCACHE_LARGE_THRESHOLD,Stage build cache objects larger than this in --cache-dir-large (in bytes)"`
+	ResetCache     bool   `flag:"reset-cache,default=$GOCACHE_RESET_CACHE,Empty the local cache directories if their layout version does not match"`
+	LocalFS        string `flag:"local-fs,default=$GOCACHE_LOCAL_FS,Kind of filesystem holding the local cache directories (local or nfs; default local)"`
 
 	// Storage backend configuration
 	StorageBackend string `flag:"storage,default=$GOCACHE_STORAGE_BACKEND,Storage backend to use: 's3' or 'gcs'"`
@@ -34,154 +45,735 @@ var flags struct {
 	S3Region      string `flag:"region,default=$GOCACHE_S3_REGION,S3 region"`
 	S3Endpoint    string `flag:"s3-endpoint-url,default=$GOCACHE_S3_ENDPOINT_URL,S3 custom endpoint URL (if unset, use AWS default)"`
 	S3PathStyle   bool   `flag:"s3-path-style,default=$GOCACHE_S3_PATH_STYLE,S3 path-style URLs (optional)"`
+	S3Profile     string `flag:"s3-profile,default=$GOCACHE_S3_PROFILE,AWS shared config profile to use for S3 (optional)"`
 	S3Concurrency int    `flag:"u,default=$GOCACHE_S3_CONCURRENCY,Maximum concurrency for upload to S3"`
+	S3ReqPays     bool   `flag:"s3-requester-pays,default=$GOCACHE_S3_REQUESTER_PAYS,Accept request charges for requester-pays S3 buckets"`
+	S3ReadURL     string `flag:"s3-read-endpoint,default=$GOCACHE_S3_READ_ENDPOINT,S3 endpoint URL for reading objects (if unset, use --s3-endpoint-url)"`
+	S3WriteURL    string `flag:"s3-write-endpoint,default=$GOCACHE_S3_WRITE_ENDPOINT,S3 endpoint URL for writes and other requests (if unset, use --s3-endpoint-url)"`
 
 	// GCS configuration
-	GCSBucket      string `flag:"gcs-bucket,default=$GOCACHE_GCS_BUCKET,GCS bucket name"`
-	GCSKeyFile     string `flag:"gcs-key-file,default=$GOCACHE_GCS_KEY_FILE,Path to GCS service account key file"`
-	GCSConcurrency int    `flag:"gcs-concurrency,default=$GOCACHE_GCS_CONCURRENCY,Maximum concurrency for upload to GCS"`
+	GCSBucket      string        `flag:"gcs-bucket,default=$GOCACHE_GCS_BUCKET,GCS bucket name"`
+	GCSKeyFile     string        `flag:"gcs-key-file,default=$GOCACHE_GCS_KEY_FILE,Path to GCS service account key file"`
+	GCSEndpoint    string        `flag:"gcs-endpoint,default=$GOCACHE_GCS_ENDPOINT,Custom GCS API endpoint URL (for an emulator or private endpoint)"`
+	GCSConcurrency int           `flag:"gcs-concurrency,default=$GOCACHE_GCS_CONCURRENCY,Maximum concurrency for upload to GCS"`
+	GCSActionBatch time.Duration `flag:"action-batch,default=$GOCACHE_ACTION_BATCH,Batch action records and flush them at this interval (GCS only)"`
 
 	// Common configuration
-	KeyPrefix     string        `flag:"prefix,default=$GOCACHE_KEY_PREFIX,Key prefix for storage objects (optional)"`
-	MinUploadSize int64         `flag:"min-upload-size,default=$GOCACHE_MIN_SIZE,Minimum object size to upload to storage (in bytes)"`
-	Concurrency   int           `flag:"c,default=$GOCACHE_CONCURRENCY,Maximum number of concurrent requests"`
-	PrintMetrics  bool          `flag:"metrics,default=$GOCACHE_METRICS,Print summary metrics to stderr at exit"`
-	Expiration    time.Duration `flag:"expiry,default=$GOCACHE_EXPIRY,Cache expiration period (optional)"`
-	Verbose       bool          `flag:"v,default=$GOCACHE_VERBOSE,Enable verbose logging"`
-	DebugLog      int           `flag:"debug,default=$GOCACHE_DEBUG,Enable detailed per-request debug logging (noisy)"`
-}
-
-const (
-	debugBuildCache = 1 << iota
-	debugModProxy
-	debugRevProxy
-)
+	KeyPrefix         string        `flag:"prefix,default=$GOCACHE_KEY_PREFIX,Key prefix for storage objects (optional)"`
+	Namespace         string        `flag:"cache-namespace,default=$GOCACHE_NAMESPACE,Isolate build cache and module proxy entries under this namespace (e.g., the repository)"`
+	CacheSalt         string        `flag:"cache-salt,default=$GOCACHE_SALT,Start a separate generation of build cache and module proxy entries for this salt"`
+	PrefixGoVersion   bool          `flag:"key-prefix-include-goversion,default=$GOCACHE_KEY_PREFIX_INCLUDE_GOVERSION,Include the Go version in the key prefix for build cache objects"`
+	PartitionDepth    int           `flag:"key-partition-depth,default=$GOCACHE_KEY_PARTITION_DEPTH,Number of hex digits used to partition storage keys (default 2)"`
+	MirrorBucket      string        `flag:"mirror-bucket,default=$GOCACHE_MIRROR_BUCKET,Secondary bucket to replicate build cache writes to (optional)"`
+	MirrorConcurrency int           `flag:"mirror-concurrency,default=$GOCACHE_MIRROR_CONCURRENCY,Maximum concurrency for writes to the mirror bucket"`
+	MinUploadSize     int64         `flag:"min-upload-size,default=$GOCACHE_MIN_SIZE,Minimum object size to upload to storage (in bytes)"`
+	MaxUploadSize     int64         `flag:"max-object-bytes,default=$GOCACHE_MAX_OBJECT_BYTES,Maximum object size to upload to storage (in bytes; 0 means no limit)"`
+	RevalidateOutput  bool          `flag:"revalidate-outputs,default=$GOCACHE_REVALIDATE_OUTPUTS,Revalidate local copies of build outputs with conditional reads from GCS"`
+	RemoteTTL         time.Duration `flag:"remote-ttl,default=$GOCACHE_REMOTE_TTL,Treat action records in storage older than this as misses (0 means never)"`
+	ObjectRetention   time.Duration `flag:"object-retention,default=$GOCACHE_OBJECT_RETENTION,Retain build outputs in storage for this long, so they cannot be deleted (0 means no retention)"`
+	MaxClockSkew      time.Duration `flag:"max-clock-skew,default=$GOCACHE_MAX_CLOCK_SKEW,Maximum clock skew allowed for action timestamps (0 means no limit)"`
+	DownloadConc      int           `flag:"download-concurrency,default=$GOCACHE_DOWNLOAD_CONCURRENCY,Maximum concurrency for build cache reads from storage"`
+	GetTimeout        time.Duration `flag:"get-timeout,default=$GOCACHE_GET_TIMEOUT,Report reads from storage taking longer than this as misses (0 means no limit)"`
+	UploadPacing      time.Duration `flag:"upload-pacing,default=$GOCACHE_UPLOAD_PACING,Spread bursts of build cache uploads over this window (0 means no pacing)"`
+	MaxUploadBPS      int64         `flag:"max-upload-bps,default=$GOCACHE_MAX_UPLOAD_BPS,Maximum bandwidth for writes to storage (bytes per second; 0 means no limit)"`
+	UploadBufferSize  int           `flag:"upload-buffer-size,default=$GOCACHE_UPLOAD_BUFFER_SIZE,Size of the buffer for each GCS upload in flight (in bytes; default 8 MiB)"`
+	MaxDownloadBPS    int64         `flag:"max-download-bps,default=$GOCACHE_MAX_DOWNLOAD_BPS,Maximum bandwidth for reads from storage (bytes per second; 0 means no limit)"`
+	MaxRetryRate      float64       `flag:"max-retry-rate,default=$GOCACHE_MAX_RETRY_RATE,Maximum rate of retries of failed requests, shared by all requests (per second; 0 means no limit)"`
+	MaxOpenFiles      int           `flag:"max-open-files,default=$GOCACHE_MAX_OPEN_FILES,Maximum number of local cache files open at once (0 means no limit)"`
+	RemoteFirst       bool          `flag:"remote-first,default=$GOCACHE_REMOTE_FIRST,Check storage for build cache entries before the local cache directory"`
+	BreakerThreshold  int           `flag:"breaker-threshold,default=$GOCACHE_BREAKER_THRESHOLD,Consecutive storage failures before serving local-only (0 means no breaker)"`
+	BreakerWindow     time.Duration `flag:"breaker-window,default=$GOCACHE_BREAKER_WINDOW,Window in which consecutive storage failures count toward the breaker threshold"`
+	BreakerCooldown   time.Duration `flag:"breaker-cooldown,default=$GOCACHE_BREAKER_COOLDOWN,How long to serve local-only before probing storage again (default 30s)"`
+	StrictWrites      int           `flag:"strict-writes,default=$GOCACHE_STRICT_WRITES,Report build cache write errors after this many consecutive upload failures (0 means never)"`
+	NegCacheTTL       time.Duration `flag:"neg-cache-ttl,default=$GOCACHE_NEG_CACHE_TTL,Report build actions that missed in storage this recently as misses without a lookup (0 means disabled)"`
+	SyncUploads       bool          `flag:"sync-uploads,default=$GOCACHE_SYNC_UPLOADS,Wait for each upload to storage to finish before completing the write"`
+	InlineThreshold   int64         `flag:"inline-output-threshold,default=$GOCACHE_INLINE_OUTPUT_THRESHOLD,Store build outputs smaller than this many bytes inside their action records (0 means never)"`
+	CompressActions   bool          `flag:"compress-actions,default=$GOCACHE_COMPRESS_ACTIONS,Compress action records and module .info and .mod files in storage, but not outputs"`
+	VerifyDownloads   bool          `flag:"verify-downloads,default=$GOCACHE_VERIFY_DOWNLOADS,Check each output read from GCS against its stored CRC32C, and treat a mismatch as a miss"`
+	VerifyUploads     bool          `flag:"verify-uploads,default=$GOCACHE_VERIFY_UPLOADS,Read back the size of each output uploaded to GCS, and upload it again on a mismatch"`
+	VerifyMinSize     int64         `flag:"verify-min-size,default=$GOCACHE_VERIFY_MIN_SIZE,Minimum output size in bytes to verify after upload (default 1 MiB)"`
+	PinVersions       bool          `flag:"pin-versions,default=$GOCACHE_PIN_VERSIONS,Record output versions in action records and read outputs at those versions"`
+	MonotonicActions  bool          `flag:"monotonic-actions,default=$GOCACHE_MONOTONIC_ACTIONS,Replace action records in GCS only with records of later timestamps"`
+	SkipSameActions   bool          `flag:"skip-identical-actions,default=$GOCACHE_SKIP_IDENTICAL_ACTIONS,Do not rewrite action records in GCS that already refer to the same output"`
+	NegCacheSize      int           `flag:"neg-cache-size,default=$GOCACHE_NEG_CACHE_SIZE,Maximum number of missed build actions to remember (default 10000)"`
+	AdmissionPolicy   string        `flag:"admission-policy,default=$GOCACHE_ADMISSION_POLICY,Which build outputs to upload to storage (all or tinylfu; default all)"`
+	AdmissionWindow   int           `flag:"admission-window,default=$GOCACHE_ADMISSION_WINDOW,Number of recent writes the tinylfu admission policy counts (default 65536)"`
+	ActionManifest    bool          `flag:"action-manifest,default=$GOCACHE_ACTION_MANIFEST,Record each build action written to storage in a local manifest"`
+	EventLog          string        `flag:"event-log,default=$GOCACHE_EVENT_LOG,Append a JSON event for each cache lookup and write to this file"`
+	ResumeDownloads   bool          `flag:"resume-downloads,default=$GOCACHE_RESUME_DOWNLOADS,Resume interrupted reads from storage with range requests"`
+	Concurrency       int           `flag:"c,default=$GOCACHE_CONCURRENCY,Maximum number of concurrent requests"`
+	PrintMetrics      bool          `flag:"metrics,default=$GOCACHE_METRICS,Print summary metrics to stderr at exit"`
+	MetricsDumpDir    string        `flag:"metrics-dump-dir,default=$GOCACHE_METRICS_DUMP_DIR,Write snapshots of the metrics as JSON to files in this directory (optional)"`
+	MetricsDumpEvery  time.Duration `flag:"metrics-dump-interval,default=$GOCACHE_METRICS_DUMP_INTERVAL,Interval between metrics snapshots (0 means only at exit; requires --metrics-dump-dir)"`
+	PrintConfig       bool          `flag:"print-config,default=$GOCACHE_PRINT_CONFIG,Print the resolved configuration as JSON to stderr and exit (with -v, log it and continue)"`
+	Expiration        time.Duration `flag:"expiry,default=$GOCACHE_EXPIRY,Cache expiration period (optional)"`
+	PrewarmRecent     int           `flag:"prewarm-recent,default=$GOCACHE_PREWARM_RECENT,Stage outputs of the N most recent actions locally at startup"`
+	CleanupInterval   time.Duration `flag:"cleanup-interval,default=$GOCACHE_CLEANUP_INTERVAL,Interval between periodic local cache cleanups (requires --expiry)"`
+	DrainTimeout      time.Duration `flag:"drain-timeout,default=$GOCACHE_DRAIN_TIMEOUT,Maximum time to wait for pending writes to storage at exit (0 means no limit)"`
+	MaxIdleConns      int           `flag:"max-idle-conns,default=$GOCACHE_MAX_IDLE_CONNS,Maximum idle storage connections overall (default scales with concurrency)"`
+	MaxIdleConnsHost  int           `flag:"max-idle-conns-per-host,default=$GOCACHE_MAX_IDLE_CONNS_PER_HOST,Maximum idle storage connections per host (default scales with concurrency)"`
+	IdleConnTimeout   time.Duration `flag:"idle-conn-timeout,default=$GOCACHE_IDLE_CONN_TIMEOUT,How long to keep idle storage connections open"`
+	ObjectTags        tagsFlag      `flag:"object-tag,Attach this key=value tag to each stored object (repeatable)"`
+	ObjectACL         string        `flag:"object-acl,default=$GOCACHE_OBJECT_ACL,Predefined ACL for newly written objects, e.g. public-read (default: bucket default)"`
+	RequireProtocol   string        `flag:"require-protocol,default=$GOCACHE_REQUIRE_PROTOCOL,Close connections from toolchains not using this protocol version (v1 or v2)"`
+	Disabled          bool          `flag:"disabled,default=$GOCACHE_DISABLED,Disable the build cache: report a miss for every lookup and store nothing (for benchmarking)"`
+	VerifyBackend     bool          `flag:"verify-backend,default=true,Verify access to the storage bucket at startup"`
+	Verbose           bool          `flag:"v,default=$GOCACHE_VERBOSE,Enable verbose logging"`
+	LogMissSample     int           `flag:"log-miss-sample,default=$GOCACHE_LOG_MISS_SAMPLE,Log every Nth cache miss (0 to disable)"`
+	DebugLog          int           `flag:"debug,default=$GOCACHE_DEBUG,Enable detailed per-request debug logging (noisy)"`
+}
 
 // runDirect runs a cache communicating on stdin/stdout, for use as a direct
 // GOCACHEPROG plugin.
 func runDirect(env *command.Env) error {
-	s, _, err := initCacheServer(env)
+	if flags.PrintConfig {
+		if exit, err := printConfig(false); exit || err != nil {
+			return err
+		}
+	}
+	dump, err := newMetricsDumper(false)
+	if err != nil {
+		return err
+	}
+	s, err := newServer(env)
 	if err != nil {
 		return err
 	}
-	if err := s.Run(env.Context(), os.Stdin, os.Stdout); err != nil {
-		return fmt.Errorf("cache server exited with error: %w", err)
+	dump.start(s)
+	ctx, cancel := signal.NotifyContext(env.Context(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	serr := s.ServeConn(ctx, os.Stdin, os.Stdout)
+	if err := shutdown(s, vprintf); err != nil {
+		vprintf("server close: %v (ignored)", err)
+	}
+	dump.stop()
+	if serr != nil {
+		return fmt.Errorf("cache server exited with error: %w", serr)
 	}
 	if flags.Verbose || flags.PrintMetrics {
-		fmt.Fprintln(os.Stderr, s.Metrics())
+		fmt.Fprintln(os.Stderr, s.CacheMetrics())
 	}
 	return nil
 }
 
 var serveFlags struct {
-	Plugin   int    `flag:"plugin,default=$GOCACHE_PLUGIN,Plugin service port (required)"`
-	HTTP     string `flag:"http,default=$GOCACHE_HTTP,HTTP service address ([host]:port)"`
-	ModProxy bool   `flag:"modproxy,default=$GOCACHE_MODPROXY,Enable a Go module proxy (requires --http)"`
-	RevProxy string `flag:"revproxy,default=$GOCACHE_REVPROXY,Reverse proxy these hosts (comma-separated; requires --http)"`
-	SumDB    string `flag:"sumdb,default=$GOCACHE_SUMDB,SumDB servers to proxy for (comma-separated)"`
-}
+	Plugin     int           `flag:"plugin,default=$GOCACHE_PLUGIN,Plugin service port (required unless --unix-socket is set)"`
+	UnixSocket string        `flag:"unix-socket,default=$GOCACHE_UNIX_SOCKET,Plugin service Unix socket path (optional)"`
+	HTTP       string        `flag:"http,default=$GOCACHE_HTTP,HTTP service address ([host]:port)"`
+	ModHTTP    string        `flag:"modproxy-http,default=$GOCACHE_MODPROXY_HTTP,Serve the module proxy at this address instead of --http ([host]:port; optional)"`
+	RevHTTP    string        `flag:"revproxy-http,default=$GOCACHE_REVPROXY_HTTP,Serve the reverse proxy at this address instead of --http ([host]:port; optional)"`
+	ModProxy   bool          `flag:"modproxy,default=$GOCACHE_MODPROXY,Enable a Go module proxy (requires --http)"`
+	RevProxy   string        `flag:"revproxy,default=$GOCACHE_REVPROXY,Reverse proxy these hosts (comma-separated; requires --http)"`
+	SumDB      string        `flag:"sumdb,default=$GOCACHE_SUMDB,SumDB servers to proxy for (comma-separated)"`
+	Revalidate time.Duration `flag:"revalidate,default=$GOCACHE_REVALIDATE,Revalidate local proxy cache entries against storage after this age (optional)"`
+	MutableTTL time.Duration `flag:"modproxy-mutable-ttl,default=$GOCACHE_MODPROXY_MUTABLE_TTL,Maximum age of cached module proxy answers that can change, such as @latest (optional)"`
+	NamedKeys  bool          `flag:"modproxy-readable-keys,default=$GOCACHE_MODPROXY_READABLE_KEYS,Store module proxy objects under keys named by module path and version"`
+	ModRetries int           `flag:"modproxy-retries,default=$GOCACHE_MODPROXY_RETRIES,Retry transient upstream module proxy failures this many times (optional)"`
+	ModBackoff time.Duration `flag:"modproxy-retry-backoff,default=$GOCACHE_MODPROXY_RETRY_BACKOFF,Initial delay between upstream module proxy retries (default 250ms)"`
+	RevGroups  string        `flag:"revproxy-groups,default=$GOCACHE_REVPROXY_GROUPS,Reverse proxy these hosts with separate caches (name[:revalidate]=host+host,...; requires --http)"`
+	RevGoDL    bool          `flag:"revproxy-go-downloads,default=$GOCACHE_REVPROXY_GO_DOWNLOADS,Cache downloads of the Go toolchain from go.dev/dl (requires --http)"`
+	RevBypass  bool          `flag:"revproxy-allow-bypass,default=$GOCACHE_REVPROXY_ALLOW_BYPASS,Allow reverse proxy clients to bypass cached copies"`
+
+	RevMaxConns     int           `flag:"revproxy-max-conns-per-host,default=$GOCACHE_REVPROXY_MAX_CONNS_PER_HOST,Maximum reverse proxy connections per target (0 for no limit)"`
+	RevIdleTimeout  time.Duration `flag:"revproxy-idle-conn-timeout,default=$GOCACHE_REVPROXY_IDLE_CONN_TIMEOUT,How long to keep idle reverse proxy connections open"`
+	RevHeaderTime   time.Duration `flag:"revproxy-header-timeout,default=$GOCACHE_REVPROXY_HEADER_TIMEOUT,Maximum wait for response headers from a target (0 for no limit)"`
+	RevOriginTime   time.Duration `flag:"revproxy-origin-timeout,default=$GOCACHE_REVPROXY_ORIGIN_TIMEOUT,Maximum time for a request forwarded to a target (0 for no limit)"`
+	RevDisableHTTP2 bool          `flag:"revproxy-disable-http2,default=$GOCACHE_REVPROXY_DISABLE_HTTP2,Use only HTTP/1.1 for reverse proxy connections to targets"`
 
-func noopClose(context.Context) error { return nil }
+	RevAuth    string `flag:"revproxy-auth,default=$GOCACHE_REVPROXY_AUTH,Headers to send to reverse proxy targets (host=Name:VAR,...; value from $VAR)"`
+	RevSignAWS string `flag:"revproxy-sign-aws,default=$GOCACHE_REVPROXY_SIGN_AWS,Sign requests to these reverse proxy targets with AWS credentials (host[=region],...)"`
+	RevNoTrust bool   `flag:"revproxy-no-trust-install,default=$GOCACHE_REVPROXY_NO_TRUST_INSTALL,Do not add the reverse proxy signing cert to the system trust store"`
+	RevCAFile  string `flag:"revproxy-ca-file,default=$GOCACHE_REVPROXY_CA_FILE,Write the reverse proxy signing cert to this file (optional)"`
+	RevCAKey   string `flag:"revproxy-ca-key-file,default=$GOCACHE_REVPROXY_CA_KEY_FILE,Keep a persistent reverse proxy signing cert, with its private key in this file (optional)"`
+	TLSMinVer  string `flag:"tls-min-version,default=$GOCACHE_TLS_MIN_VERSION,Minimum TLS version accepted by the reverse proxy from clients (default 1.2)"`
+	TLSCiphers string `flag:"tls-cipher-suites,default=$GOCACHE_TLS_CIPHER_SUITES,TLS 1.2 cipher suites accepted by the reverse proxy from clients (name,...; optional)"`
+
+	AdminToken  string `flag:"admin-token,default=$GOCACHE_ADMIN_TOKEN,Bearer token required for administrative HTTP endpoints"`
+	BrowseCache bool   `flag:"browse-cache,default=$GOCACHE_BROWSE_CACHE,Serve the local cache directory read-only at /cache/ (requires --http and --admin-token)"`
+	DebugAuth   bool   `flag:"debug-auth,default=$GOCACHE_DEBUG_AUTH,Require --admin-token for the /debug endpoints"`
+	ProxyAuth   string `flag:"proxy-auth-file,default=$GOCACHE_PROXY_AUTH_FILE,Require credentials listed in this file for the module and reverse proxies (optional)"`
+}
 
 // runServe runs a cache communicating over a local TCP socket.
 func runServe(env *command.Env) error {
-	if serveFlags.Plugin <= 0 {
-		return env.Usagef("you must provide a --plugin port")
+	if flags.PrintConfig {
+		if exit, err := printConfig(true); exit || err != nil {
+			return err
+		}
+	}
+	if serveFlags.Plugin <= 0 && serveFlags.UnixSocket == "" {
+		return env.Usagef("you must provide a --plugin port or a --unix-socket path")
+	} else if serveFlags.HTTP == "" && serveFlags.ModProxy {
+		return env.Usagef("you must set --http to enable --modproxy")
+	} else if serveFlags.HTTP == "" && serveFlags.RevProxy != "" {
+		return env.Usagef("you must set --http to enable --revproxy")
+	} else if serveFlags.HTTP == "" && serveFlags.RevGroups != "" {
+		return env.Usagef("you must set --http to enable --revproxy-groups")
+	} else if serveFlags.HTTP == "" && serveFlags.RevGoDL {
+		return env.Usagef("you must set --http to enable --revproxy-go-downloads")
+	} else if serveFlags.HTTP == "" && serveFlags.BrowseCache {
+		return env.Usagef("you must set --http to enable --browse-cache")
+	} else if serveFlags.AdminToken == "" && serveFlags.BrowseCache {
+		return env.Usagef("you must set --admin-token to enable --browse-cache")
+	} else if serveFlags.AdminToken == "" && serveFlags.DebugAuth {
+		return env.Usagef("you must set --admin-token to enable --debug-auth")
+	}
+	dump, err := newMetricsDumper(true)
+	if err != nil {
+		return err
 	}
 
 	// Initialize the cache server. Unlike a direct server, only close down and
 	// wait for cache cleanup when the whole process exits.
-	s, storageClient, err := initCacheServer(env)
+	s, err := newServer(env)
 	if err != nil {
 		return err
 	}
-	closeHook := s.Close
-	s.Close = noopClose
+	dump.start(s)
 
-	// Listen for connections from the Go toolchain on the specified socket.
-	lst, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", serveFlags.Plugin))
-	if err != nil {
-		return fmt.Errorf("listen: %w", err)
+	// Listen for connections from the Go toolchain on the specified sockets.
+	// The HTTP service, if any, is not affected: it listens only at --http.
+	var lsts []net.Listener
+	closeAll := func() {
+		for _, lst := range lsts {
+			lst.Close()
+		}
+	}
+	if serveFlags.Plugin > 0 {
+		lst, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", serveFlags.Plugin))
+		if err != nil {
+			s.Shutdown(context.Background())
+			return fmt.Errorf("listen: %w", err)
+		}
+		lsts = append(lsts, lst)
 	}
-	log.Printf("plugin listening at %q", lst.Addr())
+	if serveFlags.UnixSocket != "" {
+		lst, err := listenUnix(serveFlags.UnixSocket)
+		if err != nil {
+			closeAll()
+			s.Shutdown(context.Background())
+			return fmt.Errorf("listen: %w", err)
+		}
+		lsts = append(lsts, lst)
+	}
+	for _, lst := range lsts {
+		log.Printf("plugin listening at %q", lst.Addr())
+	}
+	lst := mergeListeners(lsts...)
 
 	ctx, cancel := signal.NotifyContext(env.Context(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
-	var g taskgroup.Group
-	g.Run(func() {
-		<-ctx.Done()
-		log.Printf("closing plugin listener")
-		lst.Close()
-	})
+	serr := s.Serve(ctx, lst)
+	if err := shutdown(s, log.Printf); err != nil {
+		log.Printf("server close: %v (ignored)", err)
+	}
+	dump.stop()
+	return serr
+}
+
+// shutdown shuts down s, logging progress to logf, and waits for pending
+// writes to storage for up to --drain-timeout.
+func shutdown(s *server.Server, logf func(string, ...any)) error {
+	ctx := gocache.WithLogf(context.Background(), logf)
+	if flags.DrainTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, flags.DrainTimeout)
+		defer cancel()
+	}
+	return s.Shutdown(ctx)
+}
 
-	// If a module proxy is enabled, start it.
-	modProxy, modCleanup, err := initModProxy(env.SetContext(ctx), storageClient)
+// newServer constructs a cache server from the command-line flags, and
+// publishes its metrics.
+func newServer(env *command.Env) (*server.Server, error) {
+	if flags.CacheDir == "" {
+		return nil, env.Usagef("you must provide a --cache-dir")
+	} else if flags.MinUploadSize < 0 {
+		return nil, env.Usagef("--min-upload-size must not be negative (got %d)", flags.MinUploadSize)
+	} else if flags.MaxUploadSize < 0 {
+		return nil, env.Usagef("--max-object-bytes must not be negative (got %d)", flags.MaxUploadSize)
+	} else if flags.MaxUploadSize > 0 && flags.MaxUploadSize < flags.MinUploadSize {
+		return nil, env.Usagef("--max-object-bytes (%d) must not be less than --min-upload-size (%d)",
+			flags.MaxUploadSize, flags.MinUploadSize)
+	} else if flags.Expiration < 0 {
+		return nil, env.Usagef("--expiry must not be negative (got %v)", flags.Expiration)
+	} else if flags.PartitionDepth < 0 || flags.PartitionDepth > 8 {
+		return nil, env.Usagef("--key-partition-depth must be between 1 and 8 (got %d)", flags.PartitionDepth)
+	} else if flags.GCSActionBatch > 0 && flags.GCSBucket == "" {
+		return nil, env.Usagef("you must set --gcs-bucket to enable --action-batch")
+	} else if flags.VerifyUploads && flags.GCSBucket == "" {
+		return nil, env.Usagef("you must set --gcs-bucket to enable --verify-uploads")
+	} else if flags.MonotonicActions && flags.GCSBucket == "" {
+		return nil, env.Usagef("you must set --gcs-bucket to enable --monotonic-actions")
+	} else if flags.VerifyDownloads && flags.GCSBucket == "" {
+		return nil, env.Usagef("you must set --gcs-bucket to enable --verify-downloads")
+	} else if flags.SkipSameActions && flags.GCSBucket == "" {
+		return nil, env.Usagef("you must set --gcs-bucket to enable --skip-identical-actions")
+	}
+	cfg, err := serverConfig()
+	if err != nil {
+		return nil, err
+	}
+	s, err := server.New(env.Context(), cfg)
 	if err != nil {
-		lst.Close()
-		return fmt.Errorf("module proxy: %w", err)
+		return nil, err
 	}
-	defer modCleanup()
+	s.Metrics().Do(func(kv expvar.KeyValue) { expvar.Publish(kv.Key, kv.Value) })
+	return s, nil
+}
 
-	// If a reverse proxy is enabled, start it.
-	revProxy, err := initRevProxy(env.SetContext(ctx), storageClient, &g)
+// serverConfig returns a server configuration based on the flags. It reports
+// an error if the key prefix is an invalid template.
+func serverConfig() (server.Config, error) {
+	var goVersion string
+	if flags.PrefixGoVersion {
+		goVersion = runtime.Version()
+	}
+	keyPrefix, err := resolveKeyPrefix(flags.KeyPrefix, os.Getenv)
 	if err != nil {
-		lst.Close()
-		return fmt.Errorf("reverse proxy: %w", err)
+		return server.Config{}, err
+	} else if keyPrefix != flags.KeyPrefix {
+		log.Printf("key prefix: %q", keyPrefix)
 	}
+	revAuth, err := parseAuthHeaders(serveFlags.RevAuth, os.Getenv)
+	if err != nil {
+		return server.Config{}, err
+	}
+	revSign, err := parseSignAWS(serveFlags.RevSignAWS)
+	if err != nil {
+		return server.Config{}, err
+	}
+	revGroups, err := parseRevProxyGroups(serveFlags.RevGroups)
+	if err != nil {
+		return server.Config{}, err
+	}
+	if serveFlags.RevGoDL {
+		revGroups = append(revGroups, server.GoDownloadsGroup())
+	}
+	return server.Config{
+		CacheDir:       flags.CacheDir,
+		CacheDirLarge:  flags.CacheDirLarge,
+		LargeThreshold: flags.LargeThreshold,
+		ResetCache:     flags.ResetCache,
+		LocalFS:        flags.LocalFS,
+
+		S3Bucket:      flags.S3Bucket,
+		S3Region:      flags.S3Region,
+		S3Endpoint:    flags.S3Endpoint,
+		S3PathStyle:   flags.S3PathStyle,
+		S3Profile:     flags.S3Profile,
+		S3Concurrency: flags.S3Concurrency,
+
+		S3ReadEndpoint:  flags.S3ReadURL,
+		S3WriteEndpoint: flags.S3WriteURL,
+
+		S3RequesterPays: flags.S3ReqPays,
+
+		GCSBucket:      flags.GCSBucket,
+		GCSKeyFile:     flags.GCSKeyFile,
+		GCSEndpoint:    flags.GCSEndpoint,
+		GCSConcurrency: flags.GCSConcurrency,
+		GCSActionBatch: flags.GCSActionBatch,
+
+		KeyPrefix:           keyPrefix,
+		Namespace:           flags.Namespace,
+		CacheSalt:           flags.CacheSalt,
+		GoVersion:           goVersion,
+		PartitionDepth:      flags.PartitionDepth,
+		MirrorBucket:        flags.MirrorBucket,
+		MirrorConcurrency:   flags.MirrorConcurrency,
+		MinUploadSize:       flags.MinUploadSize,
+		MaxUploadSize:       flags.MaxUploadSize,
+		RevalidateOutputs:   flags.RevalidateOutput,
+		DownloadConcurrency: flags.DownloadConc,
+		GetTimeout:          flags.GetTimeout,
+		ResumeDownloads:     flags.ResumeDownloads,
+		RemoteFirst:         flags.RemoteFirst,
+		UploadPacing:        flags.UploadPacing,
+		MaxUploadBPS:        flags.MaxUploadBPS,
+		MaxDownloadBPS:      flags.MaxDownloadBPS,
+		MaxRetryRate:        flags.MaxRetryRate,
+		UploadBufferSize:    flags.UploadBufferSize,
+		MaxOpenFiles:        flags.MaxOpenFiles,
+		MaxClockSkew:        flags.MaxClockSkew,
+		RemoteTTL:           flags.RemoteTTL,
+		ObjectRetention:     flags.ObjectRetention,
+		Concurrency:         flags.Concurrency,
+		Expiration:          flags.Expiration,
+		CleanupInterval:     flags.CleanupInterval,
+		BreakerThreshold:    flags.BreakerThreshold,
+		BreakerWindow:       flags.BreakerWindow,
+		BreakerCooldown:     flags.BreakerCooldown,
+		StrictWrites:        flags.StrictWrites,
+		SyncUploads:         flags.SyncUploads,
+		InlineThreshold:     flags.InlineThreshold,
+		CompressActions:     flags.CompressActions,
+		VerifyUploads:       flags.VerifyUploads,
+		VerifyDownloads:     flags.VerifyDownloads,
+		VerifyMinSize:       flags.VerifyMinSize,
+		NegCacheTTL:         flags.NegCacheTTL,
+		NegCacheSize:        flags.NegCacheSize,
+		AdmissionPolicy:     flags.AdmissionPolicy,
+		AdmissionWindow:     flags.AdmissionWindow,
+		PinVersions:         flags.PinVersions,
+		MonotonicActions:    flags.MonotonicActions,
+		SkipSameActions:     flags.SkipSameActions,
+		ActionManifest:      flags.ActionManifest,
+		EventLog:            flags.EventLog,
+		PrewarmRecent:       flags.PrewarmRecent,
+
+		MaxIdleConns:        flags.MaxIdleConns,
+		MaxIdleConnsPerHost: flags.MaxIdleConnsHost,
+		IdleConnTimeout:     flags.IdleConnTimeout,
+
+		ObjectTags:      flags.ObjectTags,
+		ObjectACL:       flags.ObjectACL,
+		Disabled:        flags.Disabled,
+		RequireProtocol: flags.RequireProtocol,
+		VerifyBackend:   flags.VerifyBackend,
+
+		HTTPAddr:   serveFlags.HTTP,
+		ModProxy:   serveFlags.ModProxy,
+		SumDB:      splitList(serveFlags.SumDB),
+		RevProxy:   splitList(serveFlags.RevProxy),
+		Revalidate: serveFlags.Revalidate,
+
+		ModProxyAddr: serveFlags.ModHTTP,
+		RevProxyAddr: serveFlags.RevHTTP,
+
+		ModProxyMutableTTL:   serveFlags.MutableTTL,
+		ModProxyReadableKeys: serveFlags.NamedKeys,
+		ModProxyRetries:      serveFlags.ModRetries,
+		ModProxyRetryBackoff: serveFlags.ModBackoff,
+
+		RevProxyAllowBypass: serveFlags.RevBypass,
+
+		RevProxyMaxConnsPerHost: serveFlags.RevMaxConns,
+		RevProxyIdleConnTimeout: serveFlags.RevIdleTimeout,
+		RevProxyHeaderTimeout:   serveFlags.RevHeaderTime,
+		RevProxyOriginTimeout:   serveFlags.RevOriginTime,
+		RevProxyDisableHTTP2:    serveFlags.RevDisableHTTP2,
+		RevProxyAuth:            revAuth,
+		RevProxySignAWS:         revSign,
+		RevProxyGroups:          revGroups,
+		RevProxyNoTrustInstall:  serveFlags.RevNoTrust,
+		RevProxyCAFile:          serveFlags.RevCAFile,
+		RevProxyCAKeyFile:       serveFlags.RevCAKey,
+		RevProxyTLSMinVersion:   serveFlags.TLSMinVer,
+		RevProxyTLSCipherSuites: splitList(serveFlags.TLSCiphers),
+
+		AdminToken:    serveFlags.AdminToken,
+		BrowseCache:   serveFlags.BrowseCache,
+		DebugAuth:     serveFlags.DebugAuth,
+		ProxyAuthFile: serveFlags.ProxyAuth,
+
+		Logf:          log.Printf,
+		Verbose:       flags.Verbose,
+		LogMissSample: flags.LogMissSample,
+		DebugLog:      flags.DebugLog,
+	}, nil
+}
+
+// tagsFlag implements [flag.Value] to collect repeated key=value tags.
+type tagsFlag map[string]string
+
+func (t tagsFlag) String() string {
+	tags := make([]string, 0, len(t))
+	for k, v := range t {
+		tags = append(tags, k+"="+v)
+	}
+	sort.Strings(tags)
+	return strings.Join(tags, ",")
+}
+
+func (t *tagsFlag) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("invalid tag %q (want key=value)", s)
+	}
+	if *t == nil {
+		*t = make(tagsFlag)
+	}
+	(*t)[k] = v
+	return nil
+}
+
+// listFlag implements [flag.Value] to collect repeated string values.
+type listFlag []string
+
+func (l listFlag) String() string { return strings.Join(l, ",") }
+
+func (l *listFlag) Set(s string) error {
+	if s == "" {
+		return errors.New("empty value")
+	}
+	*l = append(*l, s)
+	return nil
+}
+
+var fsckFlags struct {
+	Repair bool          `flag:"repair,Delete dangling actions and orphan outputs"`
+	DryRun bool          `flag:"dry-run,With --repair, report what would be deleted without deleting"`
+	MinAge time.Duration `flag:"min-age,default=1h,Skip objects younger than this, which may be in flight"`
+	Local  bool          `flag:"local,Also check the local cache directories (--cache-dir and --cache-dir-large)"`
+
+	Protect listFlag `flag:"gc-protect-prefix,Never delete objects whose key has this prefix (repeatable)"`
+}
 
-	// If an HTTP server is enabled, start it up with debug routes
-	// and whatever other services were requested.
-	if serveFlags.HTTP != "" {
-		srv := &http.Server{
-			Addr:    serveFlags.HTTP,
-			Handler: makeHandler(modProxy, revProxy),
+// runFsck checks the consistency of the build cache in the storage bucket.
+func runFsck(env *command.Env) error {
+	ctx := env.Context()
+	cfg, err := serverConfig()
+	if err != nil {
+		return err
+	}
+	client, err := server.NewStorageClient(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var localDirs []string
+	if fsckFlags.Local {
+		if flags.CacheDir == "" {
+			return env.Usagef("you must provide a --cache-dir to check it")
+		}
+		localDirs = append(localDirs, flags.CacheDir)
+		if flags.CacheDirLarge != "" {
+			localDirs = append(localDirs, flags.CacheDirLarge)
+		}
+	}
+	f := &gobuild.Fsck{
+		Client:      client,
+		LocalDirs:   localDirs,
+		KeyPrefix:   cfg.BuildKeyPrefix(),
+		MinAge:      fsckFlags.MinAge,
+		Repair:      fsckFlags.Repair,
+		DryRun:      fsckFlags.DryRun,
+		Protect:     fsckFlags.Protect,
+		Concurrency: flags.Concurrency,
+		Logf:        log.Printf,
+	}
+	start := time.Now()
+	st, err := f.Run(ctx)
+	if err != nil {
+		return err
+	}
+	if cfg.Namespace != "" {
+		fmt.Printf("namespace: %s\n", cfg.Namespace)
+	}
+	fmt.Printf("actions:   %d (%d invalid, %d unreadable, %d dangling, %d dangling in batches)\n",
+		st.Actions, st.Invalid, st.ReadErrors, st.Dangling, st.DanglingBatch)
+	fmt.Printf("outputs:   %d (%d bytes)\n", st.Outputs, st.OutputBytes)
+	fmt.Printf("orphans:   %d (%d bytes)\n", st.Orphans, st.OrphanBytes)
+	if fsckFlags.Local {
+		fmt.Printf("local:     %d actions (%d dangling), %d outputs (%d orphans, %d bytes)\n",
+			st.LocalActions, st.LocalDangling, st.LocalOutputs, st.LocalOrphans, st.LocalOrphanBytes)
+	}
+	fmt.Printf("skipped:   %d (younger than %v)\n", st.Skipped, fsckFlags.MinAge)
+	if fsckFlags.Repair {
+		fmt.Printf("protected: %d (%d with unreadable tags)\n", st.Protected, st.PinErrors)
+	}
+	if fsckFlags.Repair && !fsckFlags.DryRun {
+		fmt.Printf("deleted:   %d (%d errors)\n", st.Deleted, st.DeleteErrors)
+		fmt.Printf("retained:  %d\n", st.Retained)
+	}
+	fmt.Printf("elapsed:   %v\n", time.Since(start).Round(time.Millisecond))
+	if st.DeleteErrors != 0 {
+		return fmt.Errorf("%d objects could not be deleted", st.DeleteErrors)
+	}
+	return nil
+}
+
+var exportFlags struct {
+	Out    string `flag:"out,default=-,Write the archive to this file (- for stdout)"`
+	Local  bool   `flag:"local,default=true,Export the local cache directory"`
+	Remote bool   `flag:"remote,Export the build cache in the storage bucket"`
+}
+
+var importFlags struct {
+	In     string `flag:"in,default=-,Read the archive from this file (- for stdin)"`
+	Local  bool   `flag:"local,default=true,Import into the local cache directory"`
+	Remote bool   `flag:"remote,Import into the build cache in the storage bucket"`
+}
+
+// newArchive returns an archive for the local directory and the storage
+// bucket, as selected. The caller must call the returned close function when
+// the archive is no longer needed.
+func newArchive(env *command.Env, local, remote bool) (*gobuild.Archive, func(), error) {
+	if !local && !remote {
+		return nil, nil, env.Usagef("at least one of --local or --remote must be true")
+	}
+	cfg, err := serverConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	a := &gobuild.Archive{KeyPrefix: cfg.BuildKeyPrefix(), Logf: vprintf}
+	if local {
+		if flags.CacheDir == "" {
+			return nil, nil, env.Usagef("you must provide a --cache-dir")
 		}
-		g.Go(srv.ListenAndServe)
-		vprintf("HTTP server listening at %q", serveFlags.HTTP)
-		g.Run(func() {
-			<-ctx.Done()
-			vprintf("stopping HTTP service")
-			srv.Shutdown(context.Background())
-		})
+		a.Dir = flags.CacheDir
 	}
+	if !remote {
+		return a, func() {}, nil
+	}
+	client, err := server.NewStorageClient(env.Context(), cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	a.Client = client
+	return a, func() { client.Close() }, nil
+}
 
-	for {
-		conn, err := lst.Accept()
+// runExport writes an archive of the build cache.
+func runExport(env *command.Env) error {
+	a, done, err := newArchive(env, exportFlags.Local, exportFlags.Remote)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	out := os.Stdout
+	if exportFlags.Out != "-" {
+		out, err = os.Create(exportFlags.Out)
 		if err != nil {
-			if !errors.Is(err, net.ErrClosed) {
-				log.Printf("accept failed: %v, exiting server loop", err)
-			}
-			break
+			return err
 		}
-		log.Printf("new client connection")
-		g.Go(func() error {
-			defer func() {
-				log.Printf("client connection closed")
-				conn.Close()
-			}()
-			return s.Run(ctx, conn, conn)
-		})
 	}
-	log.Printf("server loop exited, waiting for client exit")
-	g.Wait()
-	if closeHook != nil {
-		ctx := gocache.WithLogf(context.Background(), log.Printf)
-		if err := closeHook(ctx); err != nil {
-			log.Printf("server close: %v (ignored)", err)
+	start := time.Now()
+	st, err := a.Export(env.Context(), out)
+	if err == nil && out != os.Stdout {
+		err = out.Close()
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("exported %d local files (%d bytes), %d remote objects (%d bytes) in %v",
+		st.LocalFiles, st.LocalBytes, st.RemoteObjects, st.RemoteBytes, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// runImport loads an archive of the build cache.
+func runImport(env *command.Env) error {
+	a, done, err := newArchive(env, importFlags.Local, importFlags.Remote)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	in := os.Stdin
+	if importFlags.In != "-" {
+		in, err = os.Open(importFlags.In)
+		if err != nil {
+			return err
 		}
+		defer in.Close()
+	}
+	start := time.Now()
+	st, err := a.Import(env.Context(), in)
+	if err != nil {
+		return err
 	}
+	log.Printf("imported %d local files (%d bytes), %d remote objects (%d bytes), skipped %d in %v",
+		st.LocalFiles, st.LocalBytes, st.RemoteObjects, st.RemoteBytes, st.Skipped, time.Since(start).Round(time.Millisecond))
 	return nil
 }
 
+// splitList splits a comma-separated list, or returns nil if s is empty.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// parseAuthHeaders parses a comma-separated list of reverse proxy auth headers,
+// each of the form "host=Name:VAR", where the value of the header is taken
+// from the environment variable VAR via getenv, so that the secret does not
+// appear on the command line. It returns nil if s is empty.
+func parseAuthHeaders(s string, getenv func(string) string) (map[string]revproxy.AuthHeader, error) {
+	if s == "" {
+		return nil, nil
+	}
+	out := make(map[string]revproxy.AuthHeader)
+	for _, entry := range strings.Split(s, ",") {
+		host, spec, ok1 := strings.Cut(entry, "=")
+		name, env, ok2 := strings.Cut(spec, ":")
+		if !ok1 || !ok2 || host == "" || name == "" || env == "" {
+			return nil, fmt.Errorf("invalid reverse proxy auth %q (want host=Name:VAR)", entry)
+		}
+		value := getenv(env)
+		if value == "" {
+			return nil, fmt.Errorf("reverse proxy auth for %q: environment variable %s is not set", host, env)
+		}
+		out[host] = revproxy.AuthHeader{Name: name, Value: value}
+	}
+	return out, nil
+}
+
+// parseSignAWS parses a comma-separated list of reverse proxy targets whose
+// requests are signed with AWS credentials, each of the form "host" or
+// "host=region". It returns a map from host to region, with "" for a host
+// without a region, or nil if s is empty.
+func parseSignAWS(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	out := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		host, region, _ := strings.Cut(entry, "=")
+		if host == "" {
+			return nil, fmt.Errorf("invalid reverse proxy signing entry %q (want host[=region])", entry)
+		} else if _, ok := out[host]; ok {
+			return nil, fmt.Errorf("duplicate reverse proxy signing entry for %q", host)
+		}
+		out[host] = region
+	}
+	return out, nil
+}
+
+// parseRevProxyGroups parses a comma-separated list of reverse proxy groups,
+// each of the form "name=host+host" or "name:revalidate=host+host", where
+// revalidate is a duration overriding --revalidate for the group. It returns
+// nil if s is empty.
+func parseRevProxyGroups(s string) ([]server.RevProxyGroup, error) {
+	var out []server.RevProxyGroup
+	for _, entry := range splitList(s) {
+		spec, hosts, ok := strings.Cut(entry, "=")
+		if !ok || hosts == "" {
+			return nil, fmt.Errorf("invalid reverse proxy group %q (want name=host+host)", entry)
+		}
+		g := server.RevProxyGroup{Targets: strings.Split(hosts, "+")}
+		if name, age, ok := strings.Cut(spec, ":"); ok {
+			d, err := time.ParseDuration(age)
+			if err != nil {
+				return nil, fmt.Errorf("reverse proxy group %q: invalid revalidate age: %w", name, err)
+			}
+			g.Name, g.Revalidate = name, d
+		} else {
+			g.Name = spec
+		}
+		if slices.Contains(g.Targets, "") {
+			return nil, fmt.Errorf("reverse proxy group %q has an empty host", g.Name)
+		}
+		out = append(out, g)
+	}
+	return out, nil
+}
+
 // runConnect implements a direct cache proxy by connecting to a remote server.
 func runConnect(env *command.Env, plugin string) error {
-	port, err := strconv.Atoi(plugin)
-	if err != nil {
-		return fmt.Errorf("invalid plugin port: %w", err)
+	network, addr := "unix", plugin
+	if port, err := strconv.Atoi(plugin); err == nil {
+		network, addr = "tcp", fmt.Sprintf(":%d", port)
+	} else if !strings.Contains(plugin, "/") {
+		return fmt.Errorf("invalid plugin port or socket path: %q", plugin)
 	}
 
-	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", port))
+	conn, err := net.Dial(network, addr)
 	if err != nil {
 		return fmt.Errorf("dial: %w", err)
 	}
@@ -189,7 +781,7 @@ func runConnect(env *command.Env, plugin string) error {
 	vprintf("connected to %q", conn.RemoteAddr())
 
 	out := taskgroup.Go(func() error {
-		defer conn.(*net.TCPConn).CloseWrite() // let the server finish
+		defer conn.(interface{ CloseWrite() error }).CloseWrite() // let the server finish
 		return copy(conn, os.Stdin)
 	})
 	if rerr := copy(os.Stdout, conn); rerr != nil {
@@ -0,0 +1,96 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// secretFlags are the names of flags whose values are credentials, and are
+// redacted from the resolved configuration.
+var secretFlags = map[string]bool{
+	"admin-token": true,
+}
+
+// urlFlags are the names of flags whose values are URLs, which may carry a
+// password that is redacted from the resolved configuration.
+var urlFlags = map[string]bool{
+	"s3-endpoint-url": true,
+}
+
+// printConfig implements the --print-config flag. With --verbose, it logs the
+// resolved configuration and reports false, so that the caller proceeds to
+// start up. Otherwise, it writes the configuration to stderr and reports
+// true, meaning the caller should exit. If serve is true, the configuration
+// includes the settings of the serve command.
+func printConfig(serve bool) (exit bool, _ error) {
+	cfg, err := resolvedConfig(serve, os.Getenv)
+	if err != nil {
+		return false, err
+	}
+	if flags.Verbose {
+		log.Printf("resolved configuration: %s", cfg)
+		return false, nil
+	}
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	os.Stderr.Write(append(data, '\n'))
+	return true, nil
+}
+
+// resolvedConfig returns the effective settings of the flags, keyed by flag
+// name, as they are after defaults are taken from the environment and the key
+// prefix template is expanded via getenv. The values of secret flags are
+// redacted; files named by flags, such as key files, are not read, so only
+// their paths are included. If serve is true, the settings of the serve
+// command are included too.
+func resolvedConfig(serve bool, getenv func(string) string) (json.RawMessage, error) {
+	cfg := make(map[string]any)
+	addFlags(cfg, &flags)
+	if serve {
+		addFlags(cfg, &serveFlags)
+	}
+	prefix, err := resolveKeyPrefix(flags.KeyPrefix, getenv)
+	if err != nil {
+		return nil, err
+	}
+	cfg["prefix"] = prefix
+	return json.Marshal(cfg) // N.B. map keys are sorted
+}
+
+// addFlags adds the values of the flag fields of *v, which must be a pointer
+// to a struct with flax field tags, to cfg.
+func addFlags(cfg map[string]any, v any) {
+	rv := reflect.ValueOf(v).Elem()
+	rt := rv.Type()
+	for i := range rt.NumField() {
+		tag, ok := rt.Field(i).Tag.Lookup("flag")
+		if !ok {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		val := rv.Field(i).Interface()
+		switch t := val.(type) {
+		case time.Duration:
+			val = t.String()
+		case string:
+			if t == "" {
+				break
+			} else if secretFlags[name] {
+				val = "[redacted]"
+			} else if u, err := url.Parse(t); err == nil && urlFlags[name] {
+				val = u.Redacted()
+			}
+		}
+		cfg[name] = val
+	}
+}
@@ -20,7 +20,302 @@ See also "help environment".
 The plugin requires credentials to access S3. If you are running in AWS, it can
 get credentials from the instance metadata service; otherwise you will need to
 plumb AWS environment variables (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY,
-AWS_ENDPOINT_URL) or set up a configuration file.
+AWS_ENDPOINT_URL) or set up a configuration file. To use a named profile from
+the configuration file, set --s3-profile.
+
+To read from S3 through a different endpoint than the one written to, for
+example a transfer-accelerated endpoint or a replica close to the builders,
+set --s3-read-endpoint. Reads of build cache entries and module proxy files
+then use that endpoint, while uploads, and requests that check the state of
+objects before writing them, use --s3-write-endpoint. Each defaults to
+--s3-endpoint-url. A replica may lag behind the bucket it copies, so an entry
+written recently may be missed there and rebuilt. The --mirror-bucket is only
+written, so it uses --s3-write-endpoint.
+
+A build output read from GCS may already be in the local cache, as when the
+action that staged it was pruned but the output was not. With
+--revalidate-outputs, the plugin records the etag of each output it reads from
+GCS, and reads the output again only if its etag has changed; otherwise it
+keeps the local copy, at the cost of one metadata request. The etags are kept
+in the "etag" subdirectory of the cache directory, and are removed by the
+periodic cleanup. This does not apply to reads with --resume-downloads or
+--verify-downloads. The get_notmodified metric counts the transfers saved.
+
+To reach GCS through a different endpoint, such as a private Google API
+endpoint, set --gcs-endpoint to its URL. To use an emulator such as
+fake-gcs-server, set STORAGE_EMULATOR_HOST to its address, as the GCS client
+library expects, or set --gcs-endpoint to a plain "http://" URL. In either
+case the plugin sends no credentials, and --gcs-key-file is ignored.
+
+If several Go toolchain versions share a bucket, set
+--key-prefix-include-goversion to store build cache entries under a separate
+prefix for each version. The version is the one the plugin itself was built
+with, so build (or "go run") the plugin with each toolchain that uses it.
+Toolchains with different versions do not read each other's entries, so each
+version starts with a cold cache. The module proxy and reverse proxy are not
+affected, and remain shared across versions.
+
+The local cache directory may be a tmpfs, for speed, but large build outputs
+can fill it. To avoid this, set --cache-dir-large to a directory on disk, and
+--large-threshold to a size in bytes: build cache objects larger than that are
+staged in --cache-dir-large instead of --cache-dir. Lookups check both, and
+--expiry cleans both. The module and reverse proxy caches always use
+--cache-dir.
+
+The layout of the local cache directory is versioned, and the version is
+recorded in a "layout-version" file at the top of --cache-dir. At startup, a
+directory with an older layout is migrated in place. If the directory has a
+newer layout, written by a later version of the plugin, or cannot be migrated,
+the plugin refuses to start rather than misread it. With --reset-cache, it
+instead empties the local cache directories and starts afresh, refilling them
+from storage as they are used.
+
+By default, the build cache checks the local cache directory for each entry
+before it checks storage. With --remote-first, it checks storage first, and
+uses the local directory only for entries not found there. This can help when
+the local directory is usually cold (as in a fresh container), or is slow to
+check (as on a network filesystem). It hurts when the local directory is warm
+and fast (as on a local SSD), since every hit then reads from storage. Compare
+the get_local_hit, get_fault_hit, and get_local_fallback metrics to decide.
+
+The local cache directory may be shared by several hosts on NFS, in place of
+a bucket or in front of one. In that case, set --local-fs=nfs on every host.
+Outputs are always added to the directory by writing a file with a unique
+name and renaming it into place, which NFS does atomically, so concurrent
+writers do not see each other's partial files. With --local-fs=nfs, in
+addition:
+
+ - Files staged under fixed names, such as the partial downloads kept by
+   --resume-downloads, are scoped to the host, so two hosts never write the
+   same one.
+ - Because NFS clients cache file attributes, a host may find an action whose
+   output another host has removed, or whose contents it does not yet see in
+   full. The build cache checks that each output it reports exists with the
+   expected size, and treats one that does not as a miss, reading it again
+   from storage. These are counted in the get_local_stale metric.
+
+An output with the right size but the wrong contents is not detected. Since
+outputs are named by the hash of their contents, this happens only if a file
+is damaged, and the toolchain does not catch it in general either: it checks
+the hash only of the small outputs it reads into memory, not of the files it
+uses directly, such as compiled packages. The module and reverse proxy caches
+do not check their files.
+
+To keep builds moving when storage is down, set --breaker-threshold to the
+number of consecutive storage failures (within --breaker-window, if set) after
+which the build cache stops using storage. While the breaker is open, reads
+from storage report a miss at once and uploads are dropped, so builds use the
+local cache only. After --breaker-cooldown, a single request probes storage,
+and if it succeeds the cache resumes normal operation. The breaker_state and
+breaker_open metrics report its state and how often it has opened.
+
+Uploads to storage happen in the background, and by default a failed upload
+is logged but does not fail the build, so a broken bucket can go unnoticed.
+To catch this in CI, set --strict-writes to a number of consecutive failed
+uploads after which the build cache reports an error to the toolchain for
+each write, failing the build. It keeps trying to upload, and stops reporting
+errors once an upload succeeds. The put_fail_streak metric reports the current
+number of consecutive failures, for alerting. While the breaker is open, no
+uploads are attempted, so they do not count as failures.
+
+With --sync-uploads, each write waits for its upload to finish instead of
+leaving it in the background. Writes are slower, but nothing is left to
+upload at exit, so exit is quick and an abrupt exit loses nothing. Combined
+with --strict-writes, a failed upload is reported by the write that made it
+rather than by a later one. Writes to the module proxy also wait, and report
+a failed upload at once.
+
+Each build action is normally stored as two objects, the action record and
+its output, so reading or writing it takes two requests. Most outputs are
+small, so to halve the requests for them, set --inline-output-threshold to a
+size in bytes, such as 16384: an output smaller than that is stored inside
+its action record, and larger outputs are stored separately as before. Reads
+handle either form, so the setting can be changed at any time, but older
+versions of this program treat an inline record as a miss.
+
+Action records, and the .info and .mod files of the module proxy, are small
+text that compresses well, while outputs and module zips often do not. Set
+--compress-actions to compress only the former with gzip, where that makes
+them smaller; outputs and zips are stored as they are. Compressed objects
+are recognized when read, so the setting can be changed at any time, but
+older versions of this program cannot read them. With --action-batch, the
+batched records are not compressed.
+
+Objects in the bucket live until something removes them, such as a bucket
+lifecycle rule or "fsck --repair". To bound how stale a remote entry can be,
+set --remote-ttl to a duration such as 168h: a build action whose record in
+storage was written longer ago than that is treated as a miss, so the
+toolchain rebuilds it and the write replaces the record. Each record is also
+tagged with its expiry time as gocache-expires, for use by bucket rules and
+other tools. Entries already in the local cache are not affected.
+
+To keep build outputs from being deleted, for example the outputs of release
+builds kept for compliance, set --object-retention to a duration such as
+8760h. Each output object is then written with a retention period
+that the bucket enforces: in GCS, object retention in unlocked mode, which
+the bucket must have enabled; in S3, Object Lock in governance mode, which
+the bucket must have enabled, and which also enables versioning. Until the
+period ends, GCS refuses to delete or replace the object, and S3 refuses to
+delete or replace the locked version, though a delete without a version only
+hides it behind a delete marker. Action records, and outputs written inline
+in them, are not retained, since the cache replaces them as it runs. The
+mirror bucket, if any, is not affected. Deletes refused by the bucket are
+counted as retained by "fsck --repair" and "migrate --delete", rather than
+reported as errors.
+
+With GCS storage, --verify-uploads makes each write read back the metadata
+of the output it uploaded, and upload it again once if the stored size does
+not match the local copy; if the second upload does not match either, the
+action is not written, so the output is never reported as cached. This
+catches truncated uploads at the cost of an extra request per upload, so
+only outputs of at least --verify-min-size bytes (default 1 MiB) are checked.
+Likewise, --verify-downloads makes each read check the output it fetched
+against the CRC32C that GCS recorded for it, and treat a mismatch, meaning
+the bytes were corrupted in transit, as a miss rather than stage them. This
+costs no extra requests. The get_crc_mismatch metric counts the failures.
+
+On a cold cache, a build looks up many actions that are not in storage, and
+may look up the same ones more than once. To save the repeated round trips,
+set --neg-cache-ttl to a short duration, such as a few minutes: an action
+that missed in storage is then reported as a miss at once, without a lookup,
+until that time has passed or the action is written. The cache remembers at
+most --neg-cache-size actions. Since the cache is local to the plugin, an
+action written meanwhile by another builder is not seen until its entry
+expires. The get_neg_cache_hit metric counts the lookups saved.
+
+Many build outputs are written once and never read again, yet each is
+uploaded and takes space in the bucket. With --admission-policy=tinylfu, an
+output is uploaded only the second time it is written within about the last
+--admission-window writes; the first time, it is kept in the local cache only.
+The counts are estimated in a fixed-size sketch, of about 4 bytes per write
+in the window (256 KiB by default), so a few outputs written once may still
+be uploaded. The put_admission_skip metric counts the outputs not uploaded.
+This trades hit ratio for storage and upload bandwidth: the first reuse of
+each output by another builder is a miss, and outputs of actions that change
+on every build are never uploaded. Since the counts are kept by the plugin,
+this suits a long-running "serve" plugin shared by many builds better than a
+short-lived direct one.
+
+When several builders write to one bucket, a reader may fetch an output while
+another builder is replacing it. With --pin-versions, each action record also
+records the version of its output (the generation in GCS, or the version ID
+in S3), and reads fetch that exact version. This costs one more request per
+upload. Old versions are kept only if versioning is enabled on the bucket;
+if the pinned version is gone, the current output is read, as before. The
+get_pinned and get_pin_missing metrics count both cases. Records with
+versions are not understood by older releases of the plugin, which treat
+them as misses, so enable this only once all readers are updated.
+
+Similarly, when builders race to write the record of an action whose output
+is not reproducible, the last write wins, even if it holds an older output.
+With GCS storage, --monotonic-actions makes each write read the current
+record first, and replace it only if the new record has a later timestamp,
+with a precondition on the generation read so that a concurrent update is
+not lost. Writes skipped because a newer record was stored are counted in
+the action_cas_conflict metric. This costs two more requests per write.
+
+Conversely, when builds are reproducible, most action records written to GCS
+repeat a record that is already there. With --skip-identical-actions, each
+write first reads the stored record, and is skipped if it refers to the same
+output, counted in the put_action_skip metric. A record older than a day, or
+half of --remote-ttl if that is sooner, is rewritten anyway, so that its age
+does not cause it to expire or be deleted by age-based cleanup while still in
+use. This has no effect with S3 or --action-batch.
+
+To keep an audit log of which output each build action produced, set
+--action-manifest. Each action written to storage is then appended, as a line
+of JSON, to action-manifest.jsonl in the cache directory. The manifest is not
+used to serve requests, and grows until you remove it. To look up an action:
+
+   go-cache-plugin inspect-action --cache-dir=/tmp/gocache <action-id>
+
+To analyze cache effectiveness over time, set --event-log to the path of a
+file. Each lookup and write of the build cache and the module proxy then
+appends a line of JSON to the file, of the form:
+
+   {"time":"2024-01-02T15:04:05.123Z","class":"action","op":"get",
+    "key":"<action-id>","result":"hit","bytes":1234,"latency_ms":1.5}
+
+The class is "action" for the build cache and "module" for the module proxy,
+the op is "get" or "put", and the result is "hit" or "miss" for a get, "ok"
+for a put, or "error" with an "error" field describing it. Bytes are omitted
+if unknown. Events are written in the background: if the writer falls behind,
+events are dropped and counted in the events_dropped metric rather than
+slowing the build. Unlike the debug logs, the file is meant for programs.
+
+To keep the metrics of a run after the process exits, for example from a CI
+job, set --metrics-dump-dir to a directory. A snapshot of the metrics is then
+written there as a JSON file named by the current time, metrics-<time>.json,
+when the server shuts down, and also every --metrics-dump-interval if that is
+set. Each snapshot records the start time of the process and a hash of its
+resolved configuration (see --print-config), so that snapshots of runs with
+different settings can be told apart.
+
+Reads from storage are not limited in time by default, so a stuck read can
+hold up a build indefinitely. Set --get-timeout to bound them: a read of a
+build cache entry or module proxy file that takes longer is abandoned and
+reported as a miss, trading a rebuild (or a fetch from upstream) for bounded
+latency. The get_timeout metrics count how often this happens. Puts have a
+separate, fixed timeout of one minute.
+
+The key prefix (--prefix) may be a template, expanded at startup with fields
+describing the CI build, taken from the environment variables of common CI
+systems (GitHub Actions, GitLab, Buildkite, CircleCI, Jenkins):
+
+   {{.Branch}}   the branch being built
+   {{.Commit}}   the commit being built
+   {{.PR}}       the pull or merge request number
+   {{.Repo}}     the repository
+
+Other environment variables are available as {{env "NAME"}}. For example,
+--prefix='builds/{{.Branch}}' keeps a separate cache for each branch. A field
+that is not set in the environment expands to an empty string, and empty path
+elements are removed. The expanded prefix is logged at startup.
+
+If several repositories share a bucket, set --cache-namespace (for example, to
+the repository name from the CI environment) to store the build cache and
+module proxy entries of each under a separate prefix. This keeps the entries
+of one repository from displacing those of another, and lets "fsck", "export",
+and "import" operate on a single namespace. The cost is that repositories no
+longer share results: a dependency built by one is built again by the next.
+The reverse proxy is not affected, and remains shared.
+
+To start a clean generation of the cache without a new bucket, for example
+after changing build flags (such as -trimpath or build tags) in a way the Go
+cache keys do not account for, or after a bad entry was stored, set
+--cache-salt to a new value. The salt is hashed into the prefix of the build
+cache and module proxy keys, after any namespace, so lookups under the new
+salt do not see entries stored under the old one, and the cache starts cold.
+The old entries are left in the bucket: to roll back, restore the old salt.
+Local cache entries stored under a different salt are discarded at startup.
+The reverse proxy is not affected. Expire old generations with bucket
+lifecycle rules if they are no longer wanted.
+
+To apply a predefined ACL to the objects the plugin writes, set --object-acl,
+using either the S3 or the GCS spelling (e.g., "public-read" or "publicRead").
+This is meant for a bucket that doubles as a public mirror. It affects only
+objects written after it is set; existing objects keep their ACLs. Be careful:
+with a public ACL, anyone can read the build outputs and proxied modules in
+the bucket, which may include private code. The plugin logs a warning at
+startup when a public ACL is in effect.
+
+Each upload to GCS in flight holds a buffer of --upload-buffer-size bytes
+(default 8 MiB), so uploads use that much memory times the number in flight
+(for the build cache, at most --gcs-concurrency).
+On a host with little memory, a smaller buffer keeps a burst of large uploads
+from exhausting it, at some cost in throughput: objects larger than the buffer
+are sent in more, smaller requests. A larger buffer helps throughput on fast
+links with plenty of memory. Uploads to S3 stream from the staged file on
+disk, and are not affected.
+
+Requests to storage that fail with a transient error are retried by the
+storage client, and with --modproxy-retries, so are requests to the upstream
+module proxy. When a backend falters for everyone at once, these retries add
+to its load just when it can least bear it. To prevent that, set
+--max-retry-rate to cap the rate of retries across the whole process, in
+retries per second. A request that fails while the budget is spent fails at
+once instead of retrying; the retry_budget metrics count retries allowed and
+dropped.
 
 See also: "help environment".
 Related:  "direct-mode", "serve-mode", "module-proxy", "reverse-proxy".`,
@@ -36,27 +331,119 @@ settings can be set via environment variables as well as flags.
    Flag (global)        Variable                 Format      Default
    --------------------------------------------------------------------
     --cache-dir         GOCACHE_DIR              path        (required)
+    --cache-dir-large   GOCACHE_DIR_LARGE        path        "" (use --cache-dir)
+    --large-threshold   GOCACHE_LARGE_THRESHOLD  int64       0
+    --reset-cache       GOCACHE_RESET_CACHE      bool        false
+    --local-fs          GOCACHE_LOCAL_FS         string      "local"
     --bucket            GOCACHE_S3_BUCKET        string      (required)
     --region            GOCACHE_S3_REGION        string      based on bucket
     --s3-path-style     GOCACHE_S3_PATH_STYLE    bool        false
     --s3-endpoint-url   GOCACHE_S3_ENDPOINT_URL  string      ""
+    --s3-read-endpoint  GOCACHE_S3_READ_ENDPOINT string      "" (--s3-endpoint-url)
+    --s3-write-endpoint GOCACHE_S3_WRITE_ENDPOINT string     "" (--s3-endpoint-url)
+    --s3-profile        GOCACHE_S3_PROFILE       string      "" (AWS default)
+    --s3-requester-pays GOCACHE_S3_REQUESTER_PAYS bool       false
+    --gcs-endpoint      GOCACHE_GCS_ENDPOINT     string      "" (GCS default)
     --prefix            GOCACHE_KEY_PREFIX       string      ""
+    --cache-namespace   GOCACHE_NAMESPACE        string      "" (shared)
+    --cache-salt        GOCACHE_SALT             string      "" (none)
+    --key-partition-depth GOCACHE_KEY_PARTITION_DEPTH int    2
+    --key-prefix-include-goversion GOCACHE_KEY_PREFIX_INCLUDE_GOVERSION bool false
+    --mirror-bucket     GOCACHE_MIRROR_BUCKET    string      ""
+    --mirror-concurrency GOCACHE_MIRROR_CONCURRENCY int      runtime.NumCPU
     --min-upload-size   GOCACHE_MIN_SIZE         int64       0
+    --max-object-bytes  GOCACHE_MAX_OBJECT_BYTES int64       0 (no limit)
     --metrics           GOCACHE_METRICS          bool        false
+    --print-config      GOCACHE_PRINT_CONFIG     bool        false
     --expiry            GOCACHE_EXPIRY           duration    0
+    --cleanup-interval  GOCACHE_CLEANUP_INTERVAL duration    0 (only at exit)
+    --drain-timeout     GOCACHE_DRAIN_TIMEOUT    duration    0 (no limit)
+    --prewarm-recent    GOCACHE_PREWARM_RECENT   int         0 (disabled)
+    --action-batch      GOCACHE_ACTION_BATCH     duration    0 (GCS only; disabled)
+    --revalidate-outputs GOCACHE_REVALIDATE_OUTPUTS bool     false (GCS only)
+    --object-tag        (none)                   key=value   (repeatable)
+    --object-acl        GOCACHE_OBJECT_ACL       string      "" (bucket default)
+    --disabled          GOCACHE_DISABLED         bool        false
+    --require-protocol  GOCACHE_REQUIRE_PROTOCOL string      "" (any)
+    --verify-backend    (none)                   bool        true
+    --max-idle-conns    GOCACHE_MAX_IDLE_CONNS   int         2 * concurrency
+    --max-idle-conns-per-host GOCACHE_MAX_IDLE_CONNS_PER_HOST int 2 * concurrency
+    --idle-conn-timeout GOCACHE_IDLE_CONN_TIMEOUT duration   90s
+    --max-clock-skew    GOCACHE_MAX_CLOCK_SKEW   duration    0 (no limit)
+    --remote-ttl        GOCACHE_REMOTE_TTL       duration    0 (never)
+    --object-retention  GOCACHE_OBJECT_RETENTION duration    0 (none)
+    --download-concurrency GOCACHE_DOWNLOAD_CONCURRENCY int  runtime.NumCPU
+    --get-timeout       GOCACHE_GET_TIMEOUT      duration    0 (no limit)
+    --resume-downloads  GOCACHE_RESUME_DOWNLOADS bool        false
+    --remote-first      GOCACHE_REMOTE_FIRST     bool        false
+    --upload-pacing     GOCACHE_UPLOAD_PACING    duration    0 (disabled)
+    --breaker-threshold GOCACHE_BREAKER_THRESHOLD int        0 (disabled)
+    --breaker-window    GOCACHE_BREAKER_WINDOW   duration    0 (no window)
+    --breaker-cooldown  GOCACHE_BREAKER_COOLDOWN duration    30s
+    --strict-writes     GOCACHE_STRICT_WRITES    int         0 (disabled)
+    --sync-uploads      GOCACHE_SYNC_UPLOADS     bool        false
+    --inline-output-threshold GOCACHE_INLINE_OUTPUT_THRESHOLD int64 0 (disabled)
+    --compress-actions  GOCACHE_COMPRESS_ACTIONS bool        false
+    --verify-uploads    GOCACHE_VERIFY_UPLOADS   bool        false
+    --verify-downloads  GOCACHE_VERIFY_DOWNLOADS bool        false
+    --verify-min-size   GOCACHE_VERIFY_MIN_SIZE  int64       1048576 (1 MiB)
+    --neg-cache-ttl     GOCACHE_NEG_CACHE_TTL    duration    0 (disabled)
+    --neg-cache-size    GOCACHE_NEG_CACHE_SIZE   int         10000
+    --admission-policy  GOCACHE_ADMISSION_POLICY string      "all"
+    --admission-window  GOCACHE_ADMISSION_WINDOW int         65536
+    --pin-versions      GOCACHE_PIN_VERSIONS     bool        false
+    --monotonic-actions GOCACHE_MONOTONIC_ACTIONS bool       false
+    --skip-identical-actions GOCACHE_SKIP_IDENTICAL_ACTIONS bool false
+    --action-manifest   GOCACHE_ACTION_MANIFEST  bool        false
+    --event-log         GOCACHE_EVENT_LOG        string      "" (disabled)
+    --metrics-dump-dir  GOCACHE_METRICS_DUMP_DIR string      "" (disabled)
+    --metrics-dump-interval GOCACHE_METRICS_DUMP_INTERVAL duration 0 (only at exit)
+    --max-upload-bps    GOCACHE_MAX_UPLOAD_BPS   int         0 (no limit)
+    --upload-buffer-size GOCACHE_UPLOAD_BUFFER_SIZE int      8388608 (8 MiB)
+    --max-download-bps  GOCACHE_MAX_DOWNLOAD_BPS int         0 (no limit)
+    --max-retry-rate    GOCACHE_MAX_RETRY_RATE   float       0 (no limit)
+    --max-open-files    GOCACHE_MAX_OPEN_FILES   int         0 (no limit)
     -c                  GOCACHE_CONCURRENCY      int         runtime.NumCPU
     -u                  GOCACHE_S3_CONCURRENCY   duration    runtime.NumCPU
     -v                  GOCACHE_VERBOSE          bool        false
+    --log-miss-sample   GOCACHE_LOG_MISS_SAMPLE  int         0 (disabled)
     --debug             GOCACHE_DEBUG            int         0 (see "help debug")
 
    --------------------------------------------------------------------
    Flag (serve)         Variable                 Format      Default
    --------------------------------------------------------------------
-    --plugin            GOCACHE_PLUGIN           port        (required)
+    --plugin            GOCACHE_PLUGIN           port        (required unless --unix-socket)
+    --unix-socket       GOCACHE_UNIX_SOCKET      path        ""
     --http              GOCACHE_HTTP             [host]:port ""
+    --modproxy-http     GOCACHE_MODPROXY_HTTP    [host]:port "" (use --http)
+    --revproxy-http     GOCACHE_REVPROXY_HTTP    [host]:port "" (use --http)
     --modproxy          GOCACHE_MODPROXY         bool        false
     --revproxy          GOCACHE_REVPROXY         host,...    ""
     --sumdb             GOCACHE_SUMDB            host,...    ""
+    --revalidate        GOCACHE_REVALIDATE       duration    0 (never)
+    --modproxy-mutable-ttl GOCACHE_MODPROXY_MUTABLE_TTL duration 0 (never expire)
+    --modproxy-readable-keys GOCACHE_MODPROXY_READABLE_KEYS bool false
+    --modproxy-retries  GOCACHE_MODPROXY_RETRIES int         0 (no retries)
+    --modproxy-retry-backoff GOCACHE_MODPROXY_RETRY_BACKOFF duration 250ms
+    --revproxy-groups   GOCACHE_REVPROXY_GROUPS  name[:age]=host+host,... ""
+    --revproxy-go-downloads GOCACHE_REVPROXY_GO_DOWNLOADS bool false
+    --revproxy-allow-bypass GOCACHE_REVPROXY_ALLOW_BYPASS bool false
+    --revproxy-max-conns-per-host GOCACHE_REVPROXY_MAX_CONNS_PER_HOST int 0 (no limit)
+    --revproxy-idle-conn-timeout GOCACHE_REVPROXY_IDLE_CONN_TIMEOUT duration 90s
+    --revproxy-header-timeout GOCACHE_REVPROXY_HEADER_TIMEOUT duration 0 (no limit)
+    --revproxy-origin-timeout GOCACHE_REVPROXY_ORIGIN_TIMEOUT duration 0 (no limit)
+    --revproxy-disable-http2 GOCACHE_REVPROXY_DISABLE_HTTP2 bool false
+    --revproxy-auth     GOCACHE_REVPROXY_AUTH    host=Name:VAR,... ""
+    --revproxy-sign-aws GOCACHE_REVPROXY_SIGN_AWS host[=region],... ""
+    --revproxy-no-trust-install GOCACHE_REVPROXY_NO_TRUST_INSTALL bool false
+    --revproxy-ca-file  GOCACHE_REVPROXY_CA_FILE string      ""
+    --revproxy-ca-key-file GOCACHE_REVPROXY_CA_KEY_FILE string ""
+    --tls-min-version   GOCACHE_TLS_MIN_VERSION  string      1.2
+    --tls-cipher-suites GOCACHE_TLS_CIPHER_SUITES name,...   ""
+    --admin-token       GOCACHE_ADMIN_TOKEN      string      ""
+    --browse-cache      GOCACHE_BROWSE_CACHE     bool        false
+    --debug-auth        GOCACHE_DEBUG_AUTH       bool        false
+    --proxy-auth-file   GOCACHE_PROXY_AUTH_FILE  string      ""
 
 See also: "help configure".`,
 	},
@@ -90,8 +477,40 @@ You can then use the "connect" subcommand to wire up the toolchain:
 
   export GOCACHEPROG="go-cache-plugin connect $PORT"
 
+To keep the build cache off the network, or where TCP ports are hard to
+allocate, the server can listen on a Unix domain socket instead of, or in
+addition to, the plugin port:
+
+  go-cache-plugin serve ... --unix-socket=/run/gocache/plugin.sock
+  export GOCACHEPROG="go-cache-plugin connect /run/gocache/plugin.sock"
+
+The socket is created so that only the user running the server can connect,
+and is removed when the server exits. A stale socket left by a server that
+did not exit cleanly is replaced. The HTTP service, including the module and
+reverse proxies, is not served on the socket: it listens only at --http,
+since the toolchain and other clients reach the proxies by host and port.
+
+By default, the proxies share the --http listener with the /debug endpoints.
+To expose the proxies to other hosts while keeping the debug endpoints (and
+the cache browser) private, set --modproxy-http and --revproxy-http to give
+the proxies addresses of their own:
+
+  go-cache-plugin serve ... --http=localhost:5970 \
+     --modproxy --modproxy-http=:5971 \
+     --revproxy=$HOSTS --revproxy-http=:5972
+
+A proxy given its own address is served only there, without the debug
+endpoints. If both proxies are given the same address, they share it.
+--http is still required.
+
 In this mode, the server must have credentials to access to S3, but the
-toolchain process does not need AWS credentials.`,
+toolchain process does not need AWS credentials.
+
+On SIGINT or SIGTERM, the server stops accepting requests and waits for writes
+to storage that are still in progress. To bound this wait, for example to fit
+within the termination grace period of a container, set --drain-timeout.
+Writes still in progress when it expires are abandoned, and their number is
+logged.`,
 	},
 	{
 		Name: "module-proxy",
@@ -115,6 +534,39 @@ The proxy path for a given sumdb (e.g., sum.golang.org) has this format:
 
    export GOSUMDB="sum.golang.org http://localhost:5970/mod/sumdb/sum.golang.org"
 
+The files of a specific module version (e.g., "@v/v1.2.3.zip") never change,
+and are cached indefinitely. By default, so are the answers to queries that
+change as new versions are published, such as "@latest", "@v/list", and the
+latest sum DB tree. To fetch those again once they reach a certain age, set
+--modproxy-mutable-ttl:
+
+   go-cache-plugin serve ... --modproxy --modproxy-mutable-ttl=10m
+
+With this set, mutable answers are kept only in the local cache directory and
+are not written to storage. The get_mutable_hit, get_mutable_stale, and
+get_immutable_hit metrics report how each kind of request was served.
+
+If the upstream proxy fails intermittently, set --modproxy-retries to retry
+requests that fail with a network error or a 429 or 5xx status, with a delay
+of --modproxy-retry-backoff before the first retry, doubled for each one after
+that. Responses meaning "not found" (404 and 410) are never retried.
+
+By default, module proxy objects are stored in the bucket under a digest of
+their names. To store them under legible keys instead, so that the files of a
+module can be inspected or deleted by name, set --modproxy-readable-keys:
+
+   <prefix>/module/cloud.google.com/go/@v/v0.1.0.zip
+
+With this set, objects stored under digest keys are still found, so it can be
+turned on for an existing bucket. Turning it off again is also safe, but
+objects written under readable keys are no longer found, and are fetched again
+from upstream when needed.
+
+For clients that send "Accept-Encoding: gzip", responses other than module
+zip files and sum DB tiles, which do not compress, are compressed in transit.
+Files are still cached uncompressed. The modproxy_gzip metrics report how many
+responses were compressed, and their sizes before and after.
+
 See also: https://proxy.golang.org/`,
 	},
 	{
@@ -132,10 +584,111 @@ When this is enabled, you can configure this address as an HTTP proxy:
 
    HTTPS_PROXY=localhost:5970 curl https://api.example.com/foo
 
+To keep the caches of unrelated targets apart, set --revproxy-groups. Each
+group has a name, an optional revalidation age that replaces --revalidate for
+the group, and a list of hosts separated by "+":
+
+   go-cache-plugin serve ... \
+      --http=localhost:5970 \
+      --revproxy-groups='pkgs:1h=dl.example.com+cdn.example.com,images=img.example.com'
+
+Responses from the hosts of a group are cached under revproxy/group/<name>, in
+the local cache directory and in storage, so one group can be purged without
+touching the others. Its metrics are published as revcache_<name>. The hosts
+in --revproxy share the default cache, as before. A host may be listed only
+once across --revproxy and all groups.
+
+To cache downloads of the Go toolchain, set --revproxy-go-downloads. This adds
+a preset group named "godl" for go.dev and dl.google.com, so that a runner
+fetching https://go.dev/dl/go1.24.4.linux-amd64.tar.gz through the proxy
+downloads each release only once. These servers do not mark their archives
+immutable, so the group overrides their caching policy: the archives and
+checksum files under dl.google.com/go/ are kept for good, and the release
+index (https://go.dev/dl/?mode=json) is kept in memory for five minutes, so
+new releases appear promptly. Archives are stored and served byte for byte
+as received, so they match their published SHA-256 checksums. Neither host
+may then be listed in --revproxy or another group.
+
 The proxy supports both HTTP and HTTPS backends. For HTTPS proxy targets, the
 server generates its own TLS certificate, and tries to install a custom signing
 cert so that other tools will validate it. The ability to do this varies by
-system and configuration, however.`,
+system and configuration, however.
+
+On shared or hardened hosts where the system trust store must not be changed,
+set --revproxy-no-trust-install. The signing cert is then written to the file
+named by --revproxy-ca-file (default <cache-dir>/revproxy-ca.crt) and logged
+at startup, and it is up to you to make clients trust it. For Go programs and
+many other tools on Linux, you can append it to a copy of the system bundle
+and point SSL_CERT_FILE at the result:
+
+   cat /etc/ssl/certs/ca-certificates.crt <cache-dir>/revproxy-ca.crt > bundle.crt
+   export SSL_CERT_FILE=$PWD/bundle.crt
+
+Setting --revproxy-ca-file without --revproxy-no-trust-install writes the file
+in addition to installing the cert.
+
+By default, the signing cert is generated anew at each start, so clients must
+trust a new cert after every restart, and each restart adds another cert to
+the system trust store. To keep one signing cert across restarts, set
+--revproxy-ca-key-file to the path of a file for its private key. The cert is
+then read from --revproxy-ca-file (default <cache-dir>/revproxy-ca.crt) and
+the key from --revproxy-ca-key-file; if neither exists, a new cert valid for
+five years is generated and saved to them, with the key file readable only by
+its owner. A cert already present in the system trust store is not added
+again. The server certs issued from it are still short-lived, and generated
+at each start. Keep the key file private: anyone who has it can impersonate
+any of the proxied hosts to clients that trust the cert.
+
+Clients connecting to the proxy over HTTPS must use TLS 1.2 or later. To
+change the minimum, set --tls-min-version to 1.0, 1.1, 1.2, or 1.3. To
+restrict the cipher suites offered for TLS 1.2, set --tls-cipher-suites to a
+comma-separated list of suite names, for example:
+
+   --tls-cipher-suites=TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+
+Only suites without known security problems are accepted. The suites of TLS
+1.3 are fixed, and are not affected by this setting.
+
+To cache responses from a target that requires credentials, such as an
+authenticated package registry, set --revproxy-auth. Each entry names a
+target, a header, and an environment variable holding the header value:
+
+   export REGISTRY_TOKEN='Bearer ...'
+   go-cache-plugin serve ... \
+      --revproxy=registry.example.com \
+      --revproxy-auth='registry.example.com=Authorization:REGISTRY_TOKEN'
+
+The proxy adds the header to each request it forwards to that target. The
+value is not part of any cache key, and is never logged. The header is removed
+from responses, and credentials and cookies in responses are never cached.
+
+To cache from a private S3 bucket served over HTTP, such as an apt or yum
+repository hosted as a static website, set --revproxy-sign-aws. The proxy
+signs each request it forwards to the listed targets with AWS Signature
+Version 4, using the AWS credentials of the server (including --s3-profile).
+Give the region of the bucket after "=", unless it is the default region of
+your AWS configuration:
+
+   go-cache-plugin serve ... \
+      --revproxy=apt.example.com \
+      --revproxy-sign-aws='apt.example.com=us-west-2'
+
+Each request is signed just before it is sent, so no request is sent with a
+stale signature. As with --revproxy-auth, the signature is not part of any
+cache key. A target may not have both a header and signing.
+
+HEAD requests for objects cached in memory or on local disk are answered by
+the proxy, with the cached headers and size, without contacting the target.
+Other HEAD requests are forwarded, and their responses are not cached.
+
+Concurrent requests for the same uncached object are coalesced: only one is
+forwarded to the target, and the others wait for it and are served from the
+cached response (reported as "X-Cache: hit, coalesced").
+
+To debug problems with a target, set --revproxy-allow-bypass. A client can
+then force a fresh fetch from the target by setting the request header
+"X-Cache-Bypass: 1" or "Cache-Control: no-cache". The new response replaces
+the cached copy for later requests.`,
 	},
 	{
 		Name: "debug",
@@ -148,6 +701,36 @@ cache plugin. The value of the flag is a bit mask of:
    2:  Go module proxy and sum database
    4:  HTTP reverse proxy
 
-The default is 0 (no debug logging).`,
+The default is 0 (no debug logging).
+
+Responses from the module proxy and reverse proxy include an X-Cache header
+reporting whether they were served from the cache. When debug logging is
+enabled for a proxy, its responses also include an X-Cache-Key header giving
+the storage key of the cached object.
+
+For a cheaper signal when investigating a poor hit ratio, --log-miss-sample=N
+logs every Nth cache miss in the build cache and module proxy, with the ID or
+name that missed and whether it missed only locally (local-miss) or also in
+cloud storage (fault-miss). A build cache miss may also be reported because
+the read from storage timed out (timeout), or because the action record in
+storage was malformed (corrupt), for example by an interrupted write. A
+corrupt record is replaced when the toolchain puts the rebuilt action.
+
+To find where an entry that missed should be in the bucket, query the server
+at /debug/keys with an action ID, output ID, or module file name:
+
+   curl 'localhost:5970/debug/keys?action=<id>'
+   curl 'localhost:5970/debug/keys?module=golang.org/x/mod/@v/v0.1.0.zip'
+
+It reports the storage keys the server reads, in order, as JSON, the first
+being the key it writes. Storage is not consulted.
+
+To check which settings are in effect, --print-config writes the resolved
+configuration to stderr as JSON, with each flag's value after defaults from
+the environment are applied and the key prefix template is expanded, and
+exits. With -v, it logs the configuration at startup and continues instead.
+Secrets such as --admin-token are redacted, as are passwords in URLs. Files
+named by flags (such as --gcs-key-file) are shown by path; their contents are
+never read or printed.`,
 	},
 }
@@ -0,0 +1,52 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/creachadair/command"
+	"github.com/tailscale/go-cache-plugin/lib/gobuild"
+	"github.com/tailscale/go-cache-plugin/lib/server"
+)
+
+// runInspectAction reports the entries of the local action manifest for the
+// specified action ID.
+func runInspectAction(env *command.Env, actionID string) error {
+	if flags.CacheDir == "" {
+		return env.Usagef("you must provide a --cache-dir")
+	}
+	path := filepath.Join(flags.CacheDir, server.ActionManifestFile)
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("no action manifest in %s (see --action-manifest)", flags.CacheDir)
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	actionID = strings.ToLower(actionID)
+	var found int
+	if err := gobuild.ScanManifest(f, func(e gobuild.ManifestEntry) error {
+		if e.ActionID != actionID {
+			return nil
+		}
+		found++
+		fmt.Printf("%s  output %s  size %d  mtime %s\n", e.Time.Format(time.RFC3339),
+			e.OutputID, e.Size, e.ModTime.Format(time.RFC3339Nano))
+		return nil
+	}); err != nil {
+		return fmt.Errorf("read %s: %w", path, err)
+	}
+	if found == 0 {
+		return fmt.Errorf("action %s is not in the manifest", actionID)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"sync"
+)
+
+// listenUnix listens for build cache connections on a Unix domain socket at
+// path. The socket is accessible only to the current user, and is removed
+// when the listener is closed.
+//
+// A stale socket left at path by a server that is no longer running is
+// replaced. It is an error if path exists and is not a socket, or if another
+// server is still listening on it.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("another server is listening at %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("remove stale socket: %w", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	lst, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		lst.Close()
+		return nil, fmt.Errorf("set socket permissions: %w", err)
+	}
+	return lst, nil
+}
+
+// mergeListeners returns a [net.Listener] that accepts connections from all
+// of lsts. Closing it closes all of lsts. Its address is that of lsts[0].
+func mergeListeners(lsts ...net.Listener) net.Listener {
+	if len(lsts) == 1 {
+		return lsts[0]
+	}
+	m := &multiListener{
+		lsts:   lsts,
+		conns:  make(chan net.Conn),
+		errc:   make(chan error, len(lsts)),
+		closed: make(chan struct{}),
+	}
+	for _, lst := range lsts {
+		go m.accept(lst)
+	}
+	return m
+}
+
+// multiListener is a [net.Listener] that merges the connections accepted by
+// several other listeners.
+type multiListener struct {
+	lsts   []net.Listener
+	conns  chan net.Conn
+	errc   chan error
+	closed chan struct{}
+	once   sync.Once
+}
+
+// accept forwards connections from lst to m until lst fails or m is closed.
+func (m *multiListener) accept(lst net.Listener) {
+	for {
+		conn, err := lst.Accept()
+		if err != nil {
+			m.errc <- err
+			return
+		}
+		select {
+		case m.conns <- conn:
+		case <-m.closed:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// Accept implements part of [net.Listener]. It reports the first error from
+// any of the underlying listeners.
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.conns:
+		return conn, nil
+	case err := <-m.errc:
+		return nil, err
+	case <-m.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close implements part of [net.Listener].
+func (m *multiListener) Close() error {
+	var errs []error
+	m.once.Do(func() {
+		close(m.closed)
+		for _, lst := range m.lsts {
+			errs = append(errs, lst.Close())
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// Addr implements part of [net.Listener].
+func (m *multiListener) Addr() net.Addr { return m.lsts[0].Addr() }
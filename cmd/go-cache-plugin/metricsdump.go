@@ -0,0 +1,129 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/creachadair/atomicfile"
+	"github.com/tailscale/go-cache-plugin/lib/server"
+)
+
+// metricsTimeFormat is the format of the timestamps in the names of metrics
+// snapshot files. It sorts lexically in time order.
+const metricsTimeFormat = "20060102T150405.000000000Z"
+
+// A metricsDumper implements the --metrics-dump-dir flag, writing snapshots
+// of the server metrics to files in a directory, so that they survive the
+// process. A nil *metricsDumper is valid, and writes nothing.
+type metricsDumper struct {
+	dir        string
+	started    time.Time
+	configHash string
+
+	s     *server.Server
+	stopc chan struct{}
+	wg    sync.WaitGroup
+}
+
+// newMetricsDumper returns a dumper for the directory named by the
+// --metrics-dump-dir flag, creating it if necessary, or nil if the flag is
+// not set. If serve is true, the configuration hash recorded in each snapshot
+// covers the settings of the serve command too.
+func newMetricsDumper(serve bool) (*metricsDumper, error) {
+	if flags.MetricsDumpDir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(flags.MetricsDumpDir, 0755); err != nil {
+		return nil, fmt.Errorf("metrics dump directory: %w", err)
+	}
+	cfg, err := resolvedConfig(serve, os.Getenv)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(cfg)
+	return &metricsDumper{
+		dir:        flags.MetricsDumpDir,
+		started:    time.Now(),
+		configHash: hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+// start begins writing snapshots of the metrics of s every
+// --metrics-dump-interval, if it is positive. Otherwise, only the final
+// snapshot is written by stop.
+func (d *metricsDumper) start(s *server.Server) {
+	if d == nil {
+		return
+	}
+	d.s = s
+	d.stopc = make(chan struct{})
+	if flags.MetricsDumpEvery <= 0 {
+		return
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		t := time.NewTicker(flags.MetricsDumpEvery)
+		defer t.Stop()
+		for {
+			select {
+			case <-d.stopc:
+				return
+			case <-t.C:
+				if err := d.write(false); err != nil {
+					log.Printf("metrics dump: %v (ignored)", err)
+				}
+			}
+		}
+	}()
+}
+
+// stop stops periodic snapshots and writes a final one. It should be called
+// after the server has shut down, so that the snapshot includes the writes
+// drained at exit.
+func (d *metricsDumper) stop() {
+	if d == nil || d.s == nil {
+		return
+	}
+	close(d.stopc)
+	d.wg.Wait()
+	if err := d.write(true); err != nil {
+		log.Printf("metrics dump: %v (ignored)", err)
+	}
+}
+
+// write writes a snapshot of the current metrics to a new file in d.dir,
+// named by the current time.
+func (d *metricsDumper) write(final bool) error {
+	now := time.Now().UTC()
+	data, err := json.MarshalIndent(struct {
+		Time       time.Time       `json:"time"`
+		Start      time.Time       `json:"start"`
+		ConfigHash string          `json:"config_hash"`
+		Final      bool            `json:"final"`
+		Server     json.RawMessage `json:"server"`
+		Cache      json.RawMessage `json:"cache"`
+	}{
+		Time:       now,
+		Start:      d.started.UTC(),
+		ConfigHash: d.configHash,
+		Final:      final,
+		Server:     json.RawMessage(d.s.Metrics().String()),
+		Cache:      json.RawMessage(d.s.CacheMetrics().String()),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(d.dir, "metrics-"+now.Format(metricsTimeFormat)+".json")
+	return atomicfile.WriteData(name, append(data, '\n'), 0644)
+}
@@ -0,0 +1,166 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/creachadair/command"
+	"github.com/creachadair/taskgroup"
+	"github.com/tailscale/go-cache-plugin/lib/revproxy"
+	"github.com/tailscale/go-cache-plugin/lib/server"
+)
+
+var migrateFlags struct {
+	From   string `flag:"from,Key prefix to copy objects from (required)"`
+	To     string `flag:"to,Key prefix to copy objects to (required)"`
+	Delete bool   `flag:"delete,Delete each original once it has been copied"`
+	DryRun bool   `flag:"dry-run,Report what would be copied without copying"`
+}
+
+// runMigrateKeys copies the objects under one key prefix to another.
+func runMigrateKeys(env *command.Env) error {
+	from := strings.Trim(path.Clean("/"+migrateFlags.From), "/")
+	to := strings.Trim(path.Clean("/"+migrateFlags.To), "/")
+	if from == "" || to == "" {
+		return env.Usagef("you must provide non-empty --from and --to prefixes")
+	} else if within(from, to) || within(to, from) {
+		return env.Usagef("the --from and --to prefixes must not contain one another")
+	}
+
+	ctx := env.Context()
+	cfg, err := serverConfig()
+	if err != nil {
+		return err
+	}
+	client, err := server.NewStorageClient(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	m := &migration{client: client, from: from + "/", to: to + "/"}
+	m.stat, _ = client.(revproxy.StatClient)
+	n := flags.Concurrency
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+
+	start := time.Now()
+	g, run := taskgroup.New(nil).Limit(n)
+	lerr := client.List(ctx, m.from, func(oi revproxy.ObjectInfo) error {
+		m.listed++
+		run(func() error { m.migrate(ctx, oi); return nil })
+		return nil
+	})
+	g.Wait()
+	if lerr != nil {
+		return fmt.Errorf("list %s: %w", m.from, lerr)
+	}
+
+	verb := "copied:"
+	if migrateFlags.DryRun {
+		verb = "to copy:"
+	}
+	fmt.Printf("listed:    %d (under %s)\n", m.listed, m.from)
+	fmt.Printf("%-10s %d (%d bytes, to %s)\n", verb, m.copied, m.copiedBytes, m.to)
+	fmt.Printf("present:   %d (already copied)\n", m.present)
+	if migrateFlags.Delete && !migrateFlags.DryRun {
+		fmt.Printf("deleted:   %d (%d retained)\n", m.deleted, m.retained)
+	}
+	fmt.Printf("elapsed:   %v\n", time.Since(start).Round(time.Millisecond))
+	if m.failed != 0 {
+		return fmt.Errorf("%d objects could not be migrated", m.failed)
+	}
+	return nil
+}
+
+// A migration copies the objects under one key prefix to another.
+type migration struct {
+	client   revproxy.ListClient
+	stat     revproxy.StatClient // nil if the client cannot stat objects
+	from, to string              // key prefixes, with a trailing slash
+
+	mu          sync.Mutex
+	listed      int   // objects found under from
+	copied      int   // objects copied (or to be copied, in a dry run)
+	copiedBytes int64 // total size of the objects copied
+	present     int   // objects already present under to
+	deleted     int   // originals deleted
+	retained    int   // originals not deleted because the bucket retains them
+	failed      int   // objects that could not be copied or deleted
+}
+
+// migrate copies the object described by oi to the target prefix, and deletes
+// the original if --delete is set. Objects already present at the target with
+// the same size are not copied again, so that an interrupted migration can be
+// resumed.
+func (m *migration) migrate(ctx context.Context, oi revproxy.ObjectInfo) {
+	dst := m.to + strings.TrimPrefix(oi.Key, m.from)
+	if m.stat != nil {
+		if di, err := m.stat.Stat(ctx, dst); err == nil && di.Size == oi.Size {
+			m.count(&m.present)
+			m.deleteOriginal(ctx, oi.Key)
+			return
+		}
+	}
+	if migrateFlags.DryRun {
+		vprintf("copy %s to %s", oi.Key, dst)
+		m.addCopied(oi.Size)
+		return
+	}
+	if err := m.client.Copy(ctx, oi.Key, dst); err != nil {
+		log.Printf("copy %s: %v", oi.Key, err)
+		m.count(&m.failed)
+		return
+	}
+	m.addCopied(oi.Size)
+	m.deleteOriginal(ctx, oi.Key)
+}
+
+// deleteOriginal deletes the object with the given key, if --delete is set and
+// this is not a dry run.
+func (m *migration) deleteOriginal(ctx context.Context, key string) {
+	if !migrateFlags.Delete || migrateFlags.DryRun {
+		return
+	}
+	if err := m.client.Delete(ctx, key); errors.Is(err, revproxy.ErrRetained) {
+		vprintf("not deleting %s: retained by the bucket", key)
+		m.count(&m.retained)
+		return
+	} else if err != nil {
+		log.Printf("delete %s: %v", key, err)
+		m.count(&m.failed)
+		return
+	}
+	m.count(&m.deleted)
+}
+
+// count increments *v, which must be one of the counters of m.
+func (m *migration) count(v *int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	*v++
+}
+
+// addCopied counts a copied object of the given size.
+func (m *migration) addCopied(size int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.copied++
+	m.copiedBytes += size
+}
+
+// within reports whether key is prefix or lies under it, as a path.
+func within(key, prefix string) bool {
+	return key == prefix || strings.HasPrefix(key, prefix+"/")
+}
@@ -0,0 +1,84 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// ciInfo is the data available to a key prefix template. Each field is taken
+// from the first of several well-known CI environment variables that is set,
+// and is empty if none is set.
+type ciInfo struct {
+	Branch string // the branch being built
+	Commit string // the commit being built
+	PR     string // the pull or merge request number, if any
+	Repo   string // the repository, as "owner/name" where available
+}
+
+// newCIInfo returns the CI metadata available from getenv.
+func newCIInfo(getenv func(string) string) ciInfo {
+	first := func(keys ...string) string {
+		for _, key := range keys {
+			if v := getenv(key); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	ci := ciInfo{
+		Branch: first(
+			"GITHUB_HEAD_REF",                     // GitHub Actions, pull requests
+			"CI_MERGE_REQUEST_SOURCE_BRANCH_NAME", // GitLab, merge requests
+			"CI_COMMIT_BRANCH",                    // GitLab
+			"BUILDKITE_BRANCH",                    // Buildkite
+			"CIRCLE_BRANCH",                       // CircleCI
+			"BRANCH_NAME",                         // Jenkins
+		),
+		Commit: first("GITHUB_SHA", "CI_COMMIT_SHA", "BUILDKITE_COMMIT", "CIRCLE_SHA1", "GIT_COMMIT"),
+		PR:     first("CI_MERGE_REQUEST_IID", "CIRCLE_PR_NUMBER", "CHANGE_ID"),
+		Repo:   first("GITHUB_REPOSITORY", "CI_PROJECT_PATH", "BUILDKITE_PIPELINE_SLUG"),
+	}
+
+	// GitHub Actions reports the branch of a push, and the number of a pull
+	// request, only as part of GITHUB_REF.
+	ref := getenv("GITHUB_REF")
+	if b, ok := strings.CutPrefix(ref, "refs/heads/"); ok && ci.Branch == "" {
+		ci.Branch = b
+	} else if pr, ok := strings.CutPrefix(ref, "refs/pull/"); ok && ci.PR == "" {
+		ci.PR, _, _ = strings.Cut(pr, "/")
+	}
+	if v := getenv("BUILDKITE_PULL_REQUEST"); v != "" && v != "false" && ci.PR == "" {
+		ci.PR = v
+	}
+	if ci.Repo == "" && getenv("CIRCLE_PROJECT_REPONAME") != "" {
+		ci.Repo = path.Join(getenv("CIRCLE_PROJECT_USERNAME"), getenv("CIRCLE_PROJECT_REPONAME"))
+	}
+	return ci
+}
+
+// resolveKeyPrefix expands prefix as a template, if it contains one, with the
+// fields of [ciInfo] and an "env" function that returns the value of an
+// environment variable, all taken from getenv. A prefix without a template is
+// returned unchanged. It reports an error if the template is invalid or refers
+// to a field that does not exist.
+func resolveKeyPrefix(prefix string, getenv func(string) string) (string, error) {
+	if !strings.Contains(prefix, "{{") {
+		return prefix, nil
+	}
+	t, err := template.New("prefix").Option("missingkey=error").Funcs(template.FuncMap{
+		"env": getenv,
+	}).Parse(prefix)
+	if err != nil {
+		return "", fmt.Errorf("invalid key prefix template: %w", err)
+	}
+	var sb strings.Builder
+	if err := t.Execute(&sb, newCIInfo(getenv)); err != nil {
+		return "", fmt.Errorf("invalid key prefix template: %w", err)
+	}
+	return strings.Trim(path.Clean("/"+sb.String()), "/"), nil
+}
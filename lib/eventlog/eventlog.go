@@ -0,0 +1,178 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package eventlog records a structured event for each cache operation, for
+// offline analysis of cache effectiveness.
+//
+// A [Log] writes one [Event] per line as a JSON object. Recording an event
+// never blocks the operation that reports it: events are buffered, and if the
+// buffer is full, the event is dropped and counted instead.
+//
+// This is distinct from the request logs of the caches, which are meant to be
+// read by people while debugging, and are written synchronously.
+package eventlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"expvar"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultBufferSize is the number of events a log buffers if its buffer size
+// is not set.
+const DefaultBufferSize = 4096
+
+// An Event records one cache operation. Its JSON encoding is the schema of
+// the log:
+//
+//	{"time":"2024-01-02T15:04:05.123Z","class":"action","op":"get",
+//	 "key":"<action-id>","result":"hit","bytes":1234,"latency_ms":1.5}
+type Event struct {
+	Time    time.Time `json:"time"`            // when the operation began
+	Class   string    `json:"class"`           // the kind of key: "action" or "module"
+	Op      string    `json:"op"`              // "get" or "put"
+	Key     string    `json:"key"`             // the action ID or module file name
+	Result  string    `json:"result"`          // "hit" or "miss" for a get, "ok" for a put, or "error"
+	Bytes   int64     `json:"bytes,omitempty"` // the size of the object, if known
+	Latency float64   `json:"latency_ms"`      // the duration of the operation in milliseconds
+	Error   string    `json:"error,omitempty"` // the error reported, if the result is "error"
+}
+
+// Key classes reported in [Event.Class].
+const (
+	ClassAction = "action" // a build action and its output
+	ClassModule = "module" // a file served by the module proxy
+)
+
+// A Log writes events to a writer in the background. It is safe for
+// concurrent use.
+//
+// A nil *Log is valid, and discards all events.
+type Log struct {
+	w      io.Writer
+	events chan Event
+	done   chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+
+	written expvar.Int // events written to the log
+	dropped expvar.Int // events dropped because the buffer was full
+	failed  expvar.Int // events that could not be written
+}
+
+// New returns a log that writes events to w, buffering up to size events. If
+// size is zero or negative, it uses DefaultBufferSize. If w is an
+// [io.Closer], it is closed by [Log.Close].
+func New(w io.Writer, size int) *Log {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	l := &Log{w: w, events: make(chan Event, size), done: make(chan struct{})}
+	go l.run()
+	return l
+}
+
+// Open returns a log that appends events to the file at path, creating it if
+// it does not exist, buffering up to size events as for [New].
+func Open(path string, size int) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return New(f, size), nil
+}
+
+// Add records e, if there is room in the buffer. It does not wait: if the
+// buffer is full, or the log is closed, the event is dropped.
+func (l *Log) Add(e Event) {
+	if l == nil {
+		return
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		l.dropped.Add(1)
+		return
+	}
+	select {
+	case l.events <- e:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+// Record adds an event for an operation of the given class and op on key,
+// that began at start and finished now with the given result. If err is
+// non-nil, the result is "error".
+func (l *Log) Record(class, op, key, result string, size int64, start time.Time, err error) {
+	if l == nil {
+		return
+	}
+	e := Event{
+		Time:    start,
+		Class:   class,
+		Op:      op,
+		Key:     key,
+		Result:  result,
+		Bytes:   size,
+		Latency: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		e.Result, e.Error = "error", err.Error()
+	}
+	l.Add(e)
+}
+
+// Close stops the log from accepting events, waits for the events already
+// buffered to be written, and closes the underlying writer if it is an
+// [io.Closer]. After Close, further events are dropped.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.events)
+	}
+	l.mu.Unlock()
+	<-l.done
+	if c, ok := l.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Metrics returns a map of log metrics. The caller is responsible for
+// publishing these metrics.
+func (l *Log) Metrics() *expvar.Map {
+	m := new(expvar.Map)
+	m.Set("events_written", &l.written)
+	m.Set("events_dropped", &l.dropped)
+	m.Set("events_failed", &l.failed)
+	return m
+}
+
+// run writes buffered events to l.w until l.events is closed. Output is
+// flushed whenever the buffer is drained, so the log stays current.
+func (l *Log) run() {
+	defer close(l.done)
+	bw := bufio.NewWriter(l.w)
+	enc := json.NewEncoder(bw)
+	for e := range l.events {
+		if err := enc.Encode(e); err != nil {
+			l.failed.Add(1)
+		} else {
+			l.written.Add(1)
+		}
+		if len(l.events) == 0 {
+			bw.Flush()
+		}
+	}
+	bw.Flush()
+}
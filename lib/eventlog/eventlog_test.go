@@ -0,0 +1,114 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package eventlog_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tailscale/go-cache-plugin/lib/eventlog"
+)
+
+func readEvents(t *testing.T, r io.Reader) []eventlog.Event {
+	t.Helper()
+	var evs []eventlog.Event
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		var e eventlog.Event
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Errorf("Decode event %q: %v", sc.Text(), err)
+			continue
+		}
+		evs = append(evs, e)
+	}
+	if err := sc.Err(); err != nil {
+		t.Errorf("Read events: %v", err)
+	}
+	return evs
+}
+
+func TestLog(t *testing.T) {
+	t.Run("Nil", func(t *testing.T) {
+		var l *eventlog.Log
+		l.Add(eventlog.Event{Op: "get"})
+		l.Record(eventlog.ClassAction, "get", "x", "hit", 1, time.Now(), nil)
+		if err := l.Close(); err != nil {
+			t.Errorf("Close: unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Write", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "events.jsonl")
+		l, err := eventlog.Open(path, 0)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		start := time.Now()
+		l.Record(eventlog.ClassAction, "get", "a1", "hit", 100, start, nil)
+		l.Record(eventlog.ClassModule, "put", "m@v1.zip", "ok", 0, start, errors.New("bad"))
+		if err := l.Close(); err != nil {
+			t.Fatalf("Close: unexpected error: %v", err)
+		}
+		l.Record(eventlog.ClassAction, "get", "a2", "miss", 0, start, nil) // dropped
+
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("Open log: %v", err)
+		}
+		defer f.Close()
+		evs := readEvents(t, f)
+		if len(evs) != 2 {
+			t.Fatalf("Got %d events, want 2: %+v", len(evs), evs)
+		}
+		if e := evs[0]; e.Class != "action" || e.Op != "get" || e.Key != "a1" || e.Result != "hit" || e.Bytes != 100 || e.Error != "" {
+			t.Errorf("Event 0: got %+v", e)
+		} else if !e.Time.Equal(start) || e.Latency < 0 {
+			t.Errorf("Event 0: time %v latency %v, want %v and non-negative", e.Time, e.Latency, start)
+		}
+		if e := evs[1]; e.Class != "module" || e.Op != "put" || e.Result != "error" || e.Error != "bad" {
+			t.Errorf("Event 1: got %+v", e)
+		}
+
+		m := l.Metrics()
+		if got := m.Get("events_written").String(); got != "2" {
+			t.Errorf("events_written: got %s, want 2", got)
+		}
+		if got := m.Get("events_dropped").String(); got != "1" {
+			t.Errorf("events_dropped: got %s, want 1", got)
+		}
+	})
+
+	t.Run("Drop", func(t *testing.T) {
+		// The writer blocks until the test reads from it, so the buffer fills
+		// and later events are dropped without blocking Add.
+		pr, pw := io.Pipe()
+		l := eventlog.New(pw, 1)
+		const n = 10
+		for i := range n {
+			l.Add(eventlog.Event{Op: "get", Key: strconv.Itoa(i)})
+		}
+		m := l.Metrics()
+		dropped, _ := strconv.Atoi(m.Get("events_dropped").String())
+		if dropped < n-2 {
+			t.Errorf("events_dropped: got %d, want at least %d", dropped, n-2)
+		}
+
+		done := make(chan []eventlog.Event)
+		go func() { done <- readEvents(t, pr) }()
+		if err := l.Close(); err != nil {
+			t.Fatalf("Close: unexpected error: %v", err)
+		}
+		evs := <-done
+		if len(evs)+dropped != n {
+			t.Errorf("Got %d events and %d dropped, want %d in all", len(evs), dropped, n)
+		}
+	})
+}
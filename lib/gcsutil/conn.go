@@ -0,0 +1,87 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gcsutil
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Bounds on the delay between attempts to replace a failed storage client.
+// The delay doubles with each attempt, and starts over from the minimum once
+// attempts have stopped for a while.
+const (
+	minReconnectDelay = 1 * time.Second
+	maxReconnectDelay = 1 * time.Minute
+)
+
+// A conn holds the storage client shared by a [Client] and its copies, and
+// replaces it if it fails in a way it will not recover from by itself.
+type conn struct {
+	dial   func(context.Context) (*storage.Client, error)
+	client atomic.Pointer[storage.Client]
+
+	mu    sync.Mutex
+	last  time.Time     // time of the last attempt to reconnect
+	delay time.Duration // minimum time after last before the next attempt
+
+	reconnects expvar.Int // count of storage clients replaced
+}
+
+// reconnect replaces the storage client if err reports that it has failed
+// (see isClientError). Attempts are spaced with exponential backoff, and the
+// mutex ensures that callers failing concurrently make only one attempt.
+//
+// The old client is not closed, since requests in flight may still be using
+// it. It holds no resources beyond its connections, which are released when
+// they become idle.
+func (c *conn) reconnect(err error, logf func(string, ...any)) {
+	if !isClientError(err) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	since := now.Sub(c.last)
+	if since < c.delay {
+		return // too soon since the last attempt
+	} else if since > 2*maxReconnectDelay {
+		c.delay = minReconnectDelay
+	} else {
+		c.delay = min(2*c.delay, maxReconnectDelay)
+	}
+	c.last = now
+
+	// N.B. The client may retain the context for refreshing credentials, so
+	// it must not be canceled.
+	client, derr := c.dial(context.Background())
+	if derr != nil {
+		logf("[gcs] reconnect after client failure failed: %v (next attempt in %v)", derr, c.delay)
+		return
+	}
+	c.client.Store(client)
+	c.reconnects.Add(1)
+	logf("[gcs] reconnected after client failure: %v", err)
+}
+
+// isClientError reports whether err means that the storage client itself has
+// failed, rather than the request it was making: its credentials could not be
+// refreshed, or its transport was shut down.
+func isClientError(err error) bool {
+	if err == nil {
+		return false
+	}
+	// Token refresh errors from the oauth2 and auth libraries both include
+	// this phrase.
+	return errors.Is(err, net.ErrClosed) || strings.Contains(err.Error(), "cannot fetch token")
+}
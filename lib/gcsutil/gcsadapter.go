@@ -17,13 +17,28 @@ func NewGCSAdapter(client *Client) *GCSAdapter {
 	return &GCSAdapter{Client: client}
 }
 
-var _ revproxy.CacheClient = (*GCSAdapter)(nil)
+var (
+	_ revproxy.ConditionalClient = (*GCSAdapter)(nil)
+	_ revproxy.ListClient        = (*GCSAdapter)(nil)
+	_ revproxy.StatClient        = (*GCSAdapter)(nil)
+	_ revproxy.TypedClient       = (*GCSAdapter)(nil)
+)
 
 // Get retrieves the object with the given key from GCS.
 func (a *GCSAdapter) Get(ctx context.Context, key string) (io.ReadCloser, int64, error) {
 	return a.Client.Get(ctx, key)
 }
 
+// GetCond retrieves the object with the given key from GCS, unless it matches etag.
+func (a *GCSAdapter) GetCond(ctx context.Context, key, etag string) (io.ReadCloser, int64, string, error) {
+	return a.Client.GetCond(ctx, key, etag)
+}
+
+// GetRange retrieves part of the object with the given key from GCS.
+func (a *GCSAdapter) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	return a.Client.GetRange(ctx, key, offset, length)
+}
+
 // GetData returns the complete content of the object with the given key from GCS.
 func (a *GCSAdapter) GetData(ctx context.Context, key string) ([]byte, error) {
 	return a.Client.GetData(ctx, key)
@@ -34,11 +49,47 @@ func (a *GCSAdapter) Put(ctx context.Context, key string, data io.Reader) error
 	return a.Client.Put(ctx, key, data)
 }
 
+// PutType writes the data from the provided reader to the object with the
+// given key in GCS, with the specified content type.
+func (a *GCSAdapter) PutType(ctx context.Context, key, contentType string, data io.Reader) error {
+	return a.Client.PutType(ctx, key, contentType, data)
+}
+
 // PutCond performs a conditional put operation for the object with the given key in GCS.
 func (a *GCSAdapter) PutCond(ctx context.Context, key, contentHash string, data io.Reader) (bool, error) {
 	return a.Client.PutCond(ctx, key, contentHash, data)
 }
 
+// List calls f for each object in GCS whose key has the given prefix.
+func (a *GCSAdapter) List(ctx context.Context, prefix string, f func(revproxy.ObjectInfo) error) error {
+	return a.Client.List(ctx, prefix, f)
+}
+
+// Delete removes the object with the given key from GCS.
+func (a *GCSAdapter) Delete(ctx context.Context, key string) error {
+	return a.Client.Delete(ctx, key)
+}
+
+// Copy copies the object with key srcKey to dstKey within the GCS bucket.
+func (a *GCSAdapter) Copy(ctx context.Context, srcKey, dstKey string) error {
+	return a.Client.Copy(ctx, srcKey, dstKey)
+}
+
+// ObjectTags returns the tags of the object with the given key from GCS.
+func (a *GCSAdapter) ObjectTags(ctx context.Context, key string) (map[string]string, error) {
+	return a.Client.ObjectTags(ctx, key)
+}
+
+// SetObjectTag sets one tag of the object with the given key in GCS.
+func (a *GCSAdapter) SetObjectTag(ctx context.Context, key, name, value string) error {
+	return a.Client.SetObjectTag(ctx, key, name, value)
+}
+
+// Stat reports the metadata of the object with the given key in GCS.
+func (a *GCSAdapter) Stat(ctx context.Context, key string) (revproxy.ObjectInfo, error) {
+	return a.Client.Stat(ctx, key)
+}
+
 // Close closes the GCS client and releases resources.
 func (a *GCSAdapter) Close() error {
 	return a.Client.Close()
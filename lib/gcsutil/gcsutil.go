@@ -5,44 +5,135 @@
 package gcsutil
 
 import (
+	"bytes"
 	"context"
+	"encoding/hex"
+	"errors"
+	"expvar"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/fs"
+	"maps"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/tailscale/go-cache-plugin/lib/retrybudget"
+	"github.com/tailscale/go-cache-plugin/lib/revproxy"
 	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
 // Client is a wrapper for Google Cloud Storage operations.
 type Client struct {
-	client *storage.Client
+	// Tags, if non-empty, are attached as custom metadata to each object
+	// written by the client, e.g., for cost allocation or lifecycle rules.
+	Tags map[string]string
+
+	// ACL, if non-empty, is the name of a predefined ACL applied to each
+	// object written by the client, for example "publicRead". If empty,
+	// objects get the default ACL of the bucket.
+	ACL string
+
+	// ChunkSize, if positive, is the size in bytes of the buffer each upload
+	// fills before it sends a chunk to storage. Objects smaller than one
+	// chunk are sent in a single request. If zero, the library default of
+	// 16 MiB is used; if negative, uploads are not chunked, and are not
+	// retried if they fail partway.
+	ChunkSize int
+
+	// Retention, if positive, is how long each object written by the client
+	// is retained, during which GCS refuses to delete or replace it. The
+	// bucket must have object retention enabled. Retention is set in unlocked
+	// mode, so an administrator can still shorten or remove it.
+	Retention time.Duration
+
+	// RetryBudget, if non-nil, is drawn on by each retry of a failed request.
+	// If it is spent, the request fails instead of being retried.
+	RetryBudget *retrybudget.Budget
+
+	// Logf, if non-nil, is used to log reconnections of the client.
+	Logf func(string, ...any)
+
+	conn   *conn // shared by copies of the client
 	bucket string
 }
 
 // NewClient creates a new GCS client targeting the specified bucket.
 func NewClient(ctx context.Context, bucket string, opts ...option.ClientOption) (*Client, error) {
-	client, err := storage.NewClient(ctx, opts...)
+	return NewClientFunc(ctx, bucket, func(context.Context) ([]option.ClientOption, error) {
+		return opts, nil
+	})
+}
+
+// NewClientFunc is as NewClient, but calls opts to obtain the options for
+// each underlying storage client it creates. If the storage client fails in a
+// way it will not recover from, such as when its credentials can no longer be
+// refreshed, the client replaces it, so options with state of their own, such
+// as an authenticated HTTP client, should be constructed afresh by each call.
+func NewClientFunc(ctx context.Context, bucket string, opts func(context.Context) ([]option.ClientOption, error)) (*Client, error) {
+	dial := func(ctx context.Context) (*storage.Client, error) {
+		o, err := opts(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return storage.NewClient(ctx, o...)
+	}
+	client, err := dial(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("create GCS client: %w", err)
 	}
-	return &Client{
-		client: client,
-		bucket: bucket,
-	}, nil
+	cn := &conn{dial: dial}
+	cn.client.Store(client)
+	return &Client{conn: cn, bucket: bucket}, nil
+}
+
+// Metrics returns a map of client metrics, which are shared by copies of the
+// client. The caller is responsible to publish these metrics as desired.
+func (c *Client) Metrics() *expvar.Map {
+	m := new(expvar.Map)
+	m.Set("client_reconnect", &c.conn.reconnects)
+	return m
+}
+
+// WithTags returns a copy of c that attaches the specified tags to each
+// object it writes, in addition to the tags of c. Where keys overlap, tags
+// takes precedence. The copy shares the underlying storage client with c, and
+// does not need to be closed separately.
+func (c *Client) WithTags(tags map[string]string) *Client {
+	cp := *c
+	cp.Tags = maps.Clone(c.Tags)
+	if cp.Tags == nil {
+		cp.Tags = make(map[string]string, len(tags))
+	}
+	maps.Copy(cp.Tags, tags)
+	return &cp
+}
+
+// WithRetention returns a copy of c that retains each object it writes for d
+// (see Client.Retention). The copy shares the underlying storage client with
+// c, and does not need to be closed separately.
+func (c *Client) WithRetention(d time.Duration) *Client {
+	cp := *c
+	cp.Retention = d
+	return &cp
 }
 
 // Get retrieves the object with the given key from GCS.
 // The caller must close the returned reader when done.
 func (c *Client) Get(ctx context.Context, key string) (io.ReadCloser, int64, error) {
-	obj := c.client.Bucket(c.bucket).Object(key)
+	obj := c.bucketHandle().Object(key)
 	attrs, err := obj.Attrs(ctx)
 	if err != nil {
 		if err == storage.ErrObjectNotExist {
 			return nil, 0, fs.ErrNotExist
 		}
-		return nil, 0, err
+		return nil, 0, c.classify(err)
 	}
 
 	r, err := obj.NewReader(ctx)
@@ -50,12 +141,79 @@ func (c *Client) Get(ctx context.Context, key string) (io.ReadCloser, int64, err
 		if err == storage.ErrObjectNotExist {
 			return nil, 0, fs.ErrNotExist
 		}
-		return nil, 0, err
+		return nil, 0, c.classify(err)
 	}
 
 	return r, attrs.Size, nil
 }
 
+// GetChecksum is as Get, but also reports the CRC32C of the object, as
+// recorded by GCS when it was written. The caller must close the returned
+// reader when done.
+func (c *Client) GetChecksum(ctx context.Context, key string) (io.ReadCloser, int64, uint32, error) {
+	obj := c.bucketHandle().Object(key)
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			return nil, 0, 0, fs.ErrNotExist
+		}
+		return nil, 0, 0, c.classify(err)
+	}
+
+	// Read the generation we checked, so the checksum matches the contents.
+	r, err := obj.Generation(attrs.Generation).NewReader(ctx)
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			return nil, 0, 0, fs.ErrNotExist
+		}
+		return nil, 0, 0, c.classify(err)
+	}
+	return r, attrs.Size, attrs.CRC32C, nil
+}
+
+// GetCond retrieves the object with the given key from GCS, unless etag is
+// non-empty and matches the current etag of the object, in which case it
+// reports [revproxy.ErrNotModified] without reading the contents. On success,
+// it also returns the current etag of the object.
+// The caller must close the returned reader when done.
+func (c *Client) GetCond(ctx context.Context, key, etag string) (io.ReadCloser, int64, string, error) {
+	obj := c.bucketHandle().Object(key)
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			return nil, 0, "", fs.ErrNotExist
+		}
+		return nil, 0, "", c.classify(err)
+	}
+	if etag != "" && attrs.Etag == etag {
+		return nil, 0, "", revproxy.ErrNotModified
+	}
+
+	// Read the generation we checked, so the etag matches the contents.
+	r, err := obj.Generation(attrs.Generation).NewReader(ctx)
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			return nil, 0, "", fs.ErrNotExist
+		}
+		return nil, 0, "", c.classify(err)
+	}
+	return r, attrs.Size, attrs.Etag, nil
+}
+
+// GetRange retrieves length bytes of the object with the given key from GCS,
+// starting at offset, or the rest of the object if length < 0.
+// The caller must close the returned reader when done.
+func (c *Client) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	r, err := c.bucketHandle().Object(key).NewRangeReader(ctx, offset, length)
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			return nil, fs.ErrNotExist
+		}
+		return nil, c.classify(err)
+	}
+	return r, nil
+}
+
 // GetData returns the complete content of the object with the given key.
 func (c *Client) GetData(ctx context.Context, key string) ([]byte, error) {
 	r, _, err := c.Get(ctx, key)
@@ -67,41 +225,337 @@ func (c *Client) GetData(ctx context.Context, key string) ([]byte, error) {
 }
 
 // Put writes the data from the provided reader to the object with the given key.
+// The upload is checked by GCS against the CRC32C of data; if they do not
+// match, Put reports an error wrapping [revproxy.ErrChecksumMismatch].
 func (c *Client) Put(ctx context.Context, key string, data io.Reader) error {
-	w := c.client.Bucket(c.bucket).Object(key).NewWriter(ctx)
-	_, err := io.Copy(w, data)
-	if err != nil {
-		w.Close()
-		return err
-	}
-	return w.Close()
+	return c.write(ctx, c.bucketHandle().Object(key), "", data)
+}
+
+// PutType is as Put, but sets the content type of the object to contentType.
+// If contentType is empty, GCS infers the content type from the data.
+func (c *Client) PutType(ctx context.Context, key, contentType string, data io.Reader) error {
+	return c.write(ctx, c.bucketHandle().Object(key), contentType, data)
 }
 
 // PutCond performs a conditional put operation for the object with the given key.
 // It only writes the data if the object doesn't exist or has a different content hash.
+// The content hash matches either the etag of the object or the hex-encoded
+// MD5 digest of its contents, as computed by an S3 etag reader; GCS etags
+// identify versions rather than contents, so only the latter dedups objects
+// written by another client. Tags are not considered in the comparison, so an existing object with the
+// same content is not rewritten to update its tags.
+//
+// The write is made with a precondition that the object is still as it was
+// when checked, so that if another writer stores it first, only one upload
+// succeeds. The loser reports an error wrapping [revproxy.ErrPutRace].
 func (c *Client) PutCond(ctx context.Context, key, contentHash string, data io.Reader) (bool, error) {
-	obj := c.client.Bucket(c.bucket).Object(key)
+	obj := c.bucketHandle().Object(key)
 	attrs, err := obj.Attrs(ctx)
-	if err == nil && attrs.Etag == contentHash {
+	var cond storage.Conditions
+	if err == nil && (attrs.Etag == contentHash || len(attrs.MD5) != 0 && hex.EncodeToString(attrs.MD5) == contentHash) {
 		// Object exists with same hash, no need to upload
 		return false, nil
+	} else if err == nil {
+		cond.GenerationMatch = attrs.Generation // replace only the version we checked
+	} else if errors.Is(err, storage.ErrObjectNotExist) {
+		cond.DoesNotExist = true
+	}
+	if cond != (storage.Conditions{}) {
+		obj = obj.If(cond)
 	}
 
-	w := obj.NewWriter(ctx)
-	_, err = io.Copy(w, data)
+	if err := c.write(ctx, obj, "", data); isPreconditionFailed(err) {
+		return false, fmt.Errorf("object %q: %w", key, revproxy.ErrPutRace)
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// PutVersion writes the data from the provided reader to the object with the
+// given key, only if its current generation is version, as reported by Stat,
+// or if version is empty, only if the object does not exist. Otherwise it
+// reports an error wrapping [revproxy.ErrPutRace].
+func (c *Client) PutVersion(ctx context.Context, key, version string, data io.Reader) error {
+	cond := storage.Conditions{DoesNotExist: true}
+	if version != "" {
+		gen, err := strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid generation %q for %q", version, key)
+		}
+		cond = storage.Conditions{GenerationMatch: gen}
+	}
+	err := c.write(ctx, c.bucketHandle().Object(key).If(cond), "", data)
+	if isPreconditionFailed(err) {
+		return fmt.Errorf("object %q: %w", key, revproxy.ErrPutRace)
+	}
+	return err
+}
+
+// write writes data to obj, sending its CRC32C so that GCS rejects the upload
+// if the contents are corrupted in transit.
+func (c *Client) write(ctx context.Context, obj *storage.ObjectHandle, contentType string, data io.Reader) error {
+	data, sum, err := checksum(data)
 	if err != nil {
+		return err
+	}
+	w := c.newWriter(ctx, obj)
+	w.CRC32C, w.SendCRC32C = sum, true
+	w.ContentType = contentType
+	if _, err := io.Copy(w, data); err != nil {
 		w.Close()
-		return false, err
+		return c.classify(err)
 	}
 	if err := w.Close(); err != nil {
-		return false, err
+		if isChecksumError(err) {
+			return fmt.Errorf("object %q: %w: %w", obj.ObjectName(), revproxy.ErrChecksumMismatch, err)
+		}
+		return c.classify(err)
 	}
-	return true, nil
+	return nil
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksum returns the CRC32C of the contents of data, along with a reader
+// for those contents. If data is seekable, it is rewound after reading and
+// returned; otherwise its contents are buffered in memory.
+func checksum(data io.Reader) (io.Reader, uint32, error) {
+	h := crc32.New(castagnoli)
+	if s, ok := data.(io.ReadSeeker); ok {
+		pos, err := s.Seek(0, io.SeekCurrent)
+		if err == nil {
+			if _, err := io.Copy(h, s); err != nil {
+				return nil, 0, err
+			} else if _, err := s.Seek(pos, io.SeekStart); err != nil {
+				return nil, 0, fmt.Errorf("[unexpected] seek failed: %w", err)
+			}
+			return s, h.Sum32(), nil
+		}
+	}
+	buf, err := io.ReadAll(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	h.Write(buf)
+	return bytes.NewReader(buf), h.Sum32(), nil
+}
+
+// isChecksumError reports whether err is GCS rejecting an upload because its
+// contents did not match the checksum sent with it.
+func isChecksumError(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusBadRequest &&
+		(strings.Contains(gerr.Message, "CRC32C") || strings.Contains(gerr.Message, "MD5"))
+}
+
+// isPreconditionFailed reports whether err is GCS refusing a write because
+// the object did not satisfy the conditions of the request.
+func isPreconditionFailed(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed
+}
+
+// List calls f for each object in the bucket whose key has the given prefix,
+// in lexicographic order by key. If f reports an error, List stops and returns
+// that error.
+func (c *Client) List(ctx context.Context, prefix string, f func(revproxy.ObjectInfo) error) error {
+	it := c.bucketHandle().Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return nil
+		} else if err != nil {
+			return c.check(err)
+		}
+		if err := f(revproxy.ObjectInfo{
+			Key:     attrs.Name,
+			Size:    attrs.Size,
+			ModTime: attrs.Updated,
+		}); err != nil {
+			return err
+		}
+	}
+}
+
+// Delete removes the object with the given key. It is not an error if the
+// object does not exist. If the object is under a retention period or hold,
+// Delete reports an error wrapping [revproxy.ErrRetained].
+func (c *Client) Delete(ctx context.Context, key string) error {
+	err := c.bucketHandle().Object(key).Delete(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil
+	}
+	return c.classify(err)
+}
+
+// Copy copies the object with key srcKey to dstKey, without transferring its
+// contents through the client. If c has tags, they replace the metadata of
+// the copy; otherwise the metadata of the source are kept.
+// If srcKey is not found, the error satisfies [fs.ErrNotExist].
+func (c *Client) Copy(ctx context.Context, srcKey, dstKey string) error {
+	return c.CopyFrom(ctx, c, srcKey, dstKey)
+}
+
+// CopyFrom is as Copy, but copies the object with key srcKey from the bucket
+// of src, which may differ from the bucket of c.
+func (c *Client) CopyFrom(ctx context.Context, src *Client, srcKey, dstKey string) error {
+	cp := c.bucketHandle().Object(dstKey).CopierFrom(src.bucketHandle().Object(srcKey))
+	if len(c.Tags) != 0 {
+		cp.Metadata = c.Tags
+	}
+	cp.PredefinedACL = c.ACL
+	if _, err := cp.Run(ctx); err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return fs.ErrNotExist
+		}
+		return c.check(err)
+	}
+	return nil
+}
+
+// ObjectTags returns the custom metadata of the object with the given key.
+func (c *Client) ObjectTags(ctx context.Context, key string) (map[string]string, error) {
+	attrs, err := c.bucketHandle().Object(key).Attrs(ctx)
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			return nil, fs.ErrNotExist
+		}
+		return nil, c.check(err)
+	}
+	return attrs.Metadata, nil
+}
+
+// SetObjectTag sets the custom metadata entry with the given name to value on
+// the object with the given key, keeping its other entries.
+func (c *Client) SetObjectTag(ctx context.Context, key, name, value string) error {
+	_, err := c.bucketHandle().Object(key).Update(ctx, storage.ObjectAttrsToUpdate{
+		Metadata: map[string]string{name: value},
+	})
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			return fs.ErrNotExist
+		}
+		return c.check(err)
+	}
+	return nil
+}
+
+// Stat reports the metadata of the object with the given key, without reading
+// its contents. If the key is not found, the error satisfies [fs.ErrNotExist].
+func (c *Client) Stat(ctx context.Context, key string) (revproxy.ObjectInfo, error) {
+	attrs, err := c.bucketHandle().Object(key).Attrs(ctx)
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			return revproxy.ObjectInfo{}, fs.ErrNotExist
+		}
+		return revproxy.ObjectInfo{}, c.classify(err)
+	}
+	return revproxy.ObjectInfo{
+		Key:     key,
+		Size:    attrs.Size,
+		ModTime: attrs.Updated,
+		Version: strconv.FormatInt(attrs.Generation, 10),
+	}, nil
+}
+
+// GetVersion retrieves the given generation of the object with the given key
+// from GCS, where version is the generation in decimal, as reported by Stat.
+// Generations other than the live one are kept only if object versioning is
+// enabled on the bucket. The caller must close the returned reader when done.
+func (c *Client) GetVersion(ctx context.Context, key, version string) (io.ReadCloser, int64, error) {
+	gen, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid generation %q for %q", version, key)
+	}
+	r, err := c.bucketHandle().Object(key).Generation(gen).NewReader(ctx)
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			return nil, 0, fs.ErrNotExist
+		}
+		return nil, 0, c.classify(err)
+	}
+	return r, r.Attrs.Size, nil
+}
+
+// newWriter returns a writer for obj that attaches the tags, ACL, and
+// retention of c, and uses its chunk size.
+func (c *Client) newWriter(ctx context.Context, obj *storage.ObjectHandle) *storage.Writer {
+	w := obj.NewWriter(ctx)
+	if len(c.Tags) != 0 {
+		w.Metadata = c.Tags
+	}
+	w.PredefinedACL = c.ACL
+	if c.Retention > 0 {
+		w.Retention = &storage.ObjectRetention{
+			Mode:        "Unlocked",
+			RetainUntil: time.Now().Add(c.Retention),
+		}
+	}
+	if c.ChunkSize > 0 {
+		w.ChunkSize = c.ChunkSize
+	} else if c.ChunkSize < 0 {
+		w.ChunkSize = 0
+	}
+	return w
+}
+
+// Verify checks that the bucket exists and is accessible with the credentials
+// of the client. If not, the error reports whether the bucket was not found,
+// access was denied, or the service could not be reached.
+func (c *Client) Verify(ctx context.Context) error {
+	_, err := c.bucketHandle().Attrs(ctx)
+	if err == nil {
+		return nil
+	} else if errors.Is(err, storage.ErrBucketNotExist) {
+		return fmt.Errorf("bucket %q not found", c.bucket)
+	}
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		switch gerr.Code {
+		case http.StatusNotFound:
+			return fmt.Errorf("bucket %q not found", c.bucket)
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return fmt.Errorf("access denied to bucket %q: %w", c.bucket, err)
+		}
+	}
+	return fmt.Errorf("unable to reach bucket %q (network error?): %w", c.bucket, err)
 }
 
 // Close closes the GCS client and releases resources.
 func (c *Client) Close() error {
-	return c.client.Close()
+	return c.conn.client.Load().Close()
+}
+
+// bucketHandle returns a handle for the bucket of c, whose retries draw on
+// the retry budget of c, if any.
+func (c *Client) bucketHandle() *storage.BucketHandle {
+	b := c.conn.client.Load().Bucket(c.bucket)
+	if c.RetryBudget == nil {
+		return b
+	}
+	return b.Retryer(storage.WithErrorFunc(func(err error) bool {
+		return storage.ShouldRetry(err) && c.RetryBudget.Allow()
+	}))
+}
+
+// check reports err unchanged, after replacing the storage client if err means
+// the client has failed (see conn.reconnect).
+func (c *Client) check(err error) error {
+	if err != nil {
+		c.conn.reconnect(err, c.logf)
+	}
+	return err
+}
+
+// classify is as the function classify, but also checks err for a failure of
+// the storage client.
+func (c *Client) classify(err error) error { return classify(c.check(err)) }
+
+func (c *Client) logf(msg string, args ...any) {
+	if c.Logf != nil {
+		c.Logf(msg, args...)
+	}
 }
 
 // IsNotExist reports whether err indicates that a file or directory does not exist.
@@ -114,3 +568,57 @@ func IsNotExist(err error) bool {
 	}
 	return false
 }
+
+// Errors reported by the client for failed requests wrap one of these classes,
+// if applicable, so that they can be checked with errors.Is. They are the same
+// as the corresponding errors of [revproxy].
+var (
+	ErrAccessDenied = revproxy.ErrAccessDenied
+	ErrThrottled    = revproxy.ErrThrottled
+	ErrTimeout      = revproxy.ErrTimeout
+	ErrRetained     = revproxy.ErrRetained
+)
+
+// classify returns err wrapped with its class of storage error, if it belongs
+// to one, or otherwise err unchanged.
+func classify(err error) error {
+	var gerr *googleapi.Error
+	var nerr net.Error
+	switch {
+	case err == nil:
+		return nil
+	case IsRateLimited(err):
+		return fmt.Errorf("%w: %w", ErrThrottled, err)
+	case isRetained(err):
+		return fmt.Errorf("%w: %w", ErrRetained, err)
+	case errors.As(err, &gerr) && (gerr.Code == http.StatusUnauthorized || gerr.Code == http.StatusForbidden):
+		return fmt.Errorf("%w: %w", ErrAccessDenied, err)
+	case errors.As(err, &gerr) && (gerr.Code == http.StatusRequestTimeout || gerr.Code == http.StatusGatewayTimeout),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &nerr) && nerr.Timeout():
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	return err
+}
+
+// isRetained reports whether err is GCS refusing to delete or replace an
+// object because of a retention policy, object retention, or hold. GCS reports
+// these as access errors, distinguished only by their message.
+func isRetained(err error) bool {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) || gerr.Code != http.StatusForbidden {
+		return false
+	}
+	msg := strings.ToLower(gerr.Message)
+	return strings.Contains(msg, "retention") || strings.Contains(msg, "hold")
+}
+
+// IsRateLimited reports whether err indicates that GCS throttled the request,
+// with a 429 (Too Many Requests) or 503 (Service Unavailable) status.
+func IsRateLimited(err error) bool {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return gerr.Code == http.StatusTooManyRequests || gerr.Code == http.StatusServiceUnavailable
+	}
+	return false
+}
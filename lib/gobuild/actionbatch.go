@@ -0,0 +1,369 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/fs"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/creachadair/gocache"
+	"github.com/tailscale/go-cache-plugin/lib/revproxy"
+)
+
+// DefaultActionBatchLimit is the maximum number of action records kept in
+// each batch object, if no other limit is specified.
+const DefaultActionBatchLimit = 10000
+
+// An actionBatcher buffers action records in memory and periodically writes
+// them to storage as a single batch object per partition, rather than one
+// object per action.
+//
+// Each batch object contains one line per action, in the format:
+//
+//	<action-id> <output-id> <timestamp>
+//
+// Flushing a partition merges the pending records with the current contents
+// of the batch object, so records written by other clients are preserved. If
+// the client is a [revproxy.SwapClient], the write is conditioned on the
+// version of the object read, and retried if another client wrote it in the
+// meantime. Otherwise, when two clients flush the same partition
+// concurrently, the last writer wins, and the records lost are reported as
+// cache misses.
+//
+// A batch object holds at most limit records. When a flush would exceed it,
+// the records with the oldest timestamps are dropped, and later read as
+// misses.
+type actionBatcher struct {
+	client   Client
+	batchKey func(part string) string // storage key for a partition
+	interval time.Duration            // flush and index refresh interval
+	depth    int                      // partition depth, as for partitionDepth
+	limit    int                      // maximum records per batch object
+
+	mu      sync.Mutex
+	pending map[string]map[string]string // partition → action ID → record
+	index   map[string]*batchIndex       // partition → loaded batch index
+
+	stop context.CancelFunc
+	done chan struct{}
+
+	batchWrite    expvar.Int // count of batch objects written
+	batchError    expvar.Int // count of errors reading or writing batch objects
+	batchHit      expvar.Int // count of actions found in a batch index
+	batchConflict expvar.Int // count of batch writes retried after a concurrent write
+	batchEvict    expvar.Int // count of records dropped to respect the limit
+}
+
+// batchIndex is a cached copy of the contents of a batch object.
+type batchIndex struct {
+	loaded  time.Time
+	records map[string]string // action ID → record
+}
+
+// newActionBatcher returns a batcher that writes to client every interval.
+// Partitions use the given depth (see partitionDepth). If limit is zero or
+// negative, DefaultActionBatchLimit is used.
+func newActionBatcher(client Client, interval time.Duration, depth, limit int, batchKey func(string) string) *actionBatcher {
+	if limit <= 0 {
+		limit = DefaultActionBatchLimit
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &actionBatcher{
+		client:   client,
+		batchKey: batchKey,
+		interval: interval,
+		depth:    partitionDepth(depth),
+		limit:    limit,
+		pending:  make(map[string]map[string]string),
+		index:    make(map[string]*batchIndex),
+		stop:     cancel,
+		done:     make(chan struct{}),
+	}
+	go b.run(ctx)
+	return b
+}
+
+// partitions returns the partitions in which the record for actionID may be
+// found, in order of preference. The first is the one it is written to; as
+// for readKeys, the partition at the default depth is also included if it
+// differs, so that batches written before a change of depth remain readable.
+func (b *actionBatcher) partitions(actionID string) []string {
+	parts := []string{actionID[:b.depth]}
+	if b.depth != DefaultPartitionDepth {
+		parts = append(parts, actionID[:DefaultPartitionDepth])
+	}
+	return parts
+}
+
+// add buffers the action record for actionID to be written at the next flush.
+func (b *actionBatcher) add(actionID, outputID string, mtime time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	part := b.partitions(actionID)[0]
+	if b.pending[part] == nil {
+		b.pending[part] = make(map[string]string)
+	}
+	b.pending[part][actionID] = formatAction(outputID, mtime, "")
+}
+
+// lookup reports the action record for actionID from the batch index, if it
+// is present. A missing or stale index for a partition is re-read from
+// storage.
+func (b *actionBatcher) lookup(ctx context.Context, actionID string) ([]byte, bool, error) {
+	for _, part := range b.partitions(actionID) {
+		rec, ok, err := b.lookupPart(ctx, part, actionID)
+		if err != nil || ok {
+			return rec, ok, err
+		}
+	}
+	return nil, false, nil
+}
+
+func (b *actionBatcher) lookupPart(ctx context.Context, part, actionID string) ([]byte, bool, error) {
+	b.mu.Lock()
+	if rec, ok := b.pending[part][actionID]; ok {
+		b.mu.Unlock()
+		b.batchHit.Add(1)
+		return []byte(rec), true, nil
+	}
+	idx := b.index[part]
+	b.mu.Unlock()
+
+	if idx == nil || time.Since(idx.loaded) > b.interval {
+		recs, _, err := b.load(ctx, part)
+		if err != nil {
+			return nil, false, err
+		}
+		idx = &batchIndex{loaded: time.Now(), records: recs}
+		b.mu.Lock()
+		b.index[part] = idx
+		b.mu.Unlock()
+	}
+	rec, ok := idx.records[actionID]
+	if ok {
+		b.batchHit.Add(1)
+	}
+	return []byte(rec), ok, nil
+}
+
+// load reads the batch object for the specified partition, and reports its
+// version if the client is a [revproxy.SwapClient]. A missing object is
+// treated as empty, with an empty version.
+func (b *actionBatcher) load(ctx context.Context, part string) (map[string]string, string, error) {
+	key := b.batchKey(part)
+	var data []byte
+	var version string
+	var err error
+	if sc, ok := b.client.(revproxy.SwapClient); ok {
+		var info revproxy.ObjectInfo
+		info, err = sc.Stat(ctx, key)
+		if err == nil {
+			version = info.Version
+			data, err = readVersion(ctx, sc, key, version)
+		}
+	} else {
+		data, err = b.client.GetData(ctx, key)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return make(map[string]string), "", nil
+	} else if err != nil {
+		b.batchError.Add(1)
+		return nil, "", fmt.Errorf("[gcs] read action batch %s: %w", part, err)
+	}
+	return parseActionBatch(data), version, nil
+}
+
+// flush writes all pending records to storage. Partitions that could not be
+// written are retained for the next flush.
+func (b *actionBatcher) flush(ctx context.Context) error {
+	b.mu.Lock()
+	pending := b.pending
+	b.pending = make(map[string]map[string]string)
+	b.mu.Unlock()
+
+	var errs []error
+	for _, part := range slices.Sorted(maps.Keys(pending)) {
+		recs := pending[part]
+		merged, err := b.writePartition(ctx, part, recs)
+		if err != nil {
+			errs = append(errs, err)
+			b.requeue(part, recs)
+			continue
+		}
+		b.batchWrite.Add(1)
+		b.mu.Lock()
+		b.index[part] = &batchIndex{loaded: time.Now(), records: merged}
+		b.mu.Unlock()
+	}
+	b.pruneIndex()
+	return errors.Join(errs...)
+}
+
+// writePartition merges recs into the batch object for part, and returns the
+// records written. If the client supports it, the write is conditioned on the
+// version read, and retried if it races with another writer.
+func (b *actionBatcher) writePartition(ctx context.Context, part string, recs map[string]string) (map[string]string, error) {
+	key := b.batchKey(part)
+	sc, canSwap := b.client.(revproxy.SwapClient)
+	for range maxSwapAttempts {
+		merged, version, err := b.load(ctx, part)
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(merged, recs)
+		b.evict(merged)
+		data := bytes.NewReader(formatActionBatch(merged))
+		if !canSwap {
+			err = b.client.Put(ctx, key, data)
+		} else if err = sc.PutVersion(ctx, key, version, data); errors.Is(err, revproxy.ErrPutRace) {
+			b.batchConflict.Add(1)
+			continue // another client wrote the batch; merge with its records
+		}
+		if err != nil {
+			b.batchError.Add(1)
+			return nil, fmt.Errorf("[gcs] write action batch %s: %w", part, err)
+		}
+		return merged, nil
+	}
+	b.batchError.Add(1)
+	return nil, fmt.Errorf("[gcs] write action batch %s: %w", part, revproxy.ErrPutRace)
+}
+
+// evict removes the records with the oldest timestamps from recs until it has
+// no more than b.limit records. Records that cannot be parsed go first.
+func (b *actionBatcher) evict(recs map[string]string) {
+	excess := len(recs) - b.limit
+	if excess <= 0 {
+		return
+	}
+	type entry struct {
+		id    string
+		mtime int64
+	}
+	entries := make([]entry, 0, len(recs))
+	for id, rec := range recs {
+		var ts int64 // unparseable records sort first
+		if _, mtime, err := parseAction([]byte(rec)); err == nil {
+			ts = mtime.UnixNano()
+		}
+		entries = append(entries, entry{id, ts})
+	}
+	slices.SortFunc(entries, func(a, b entry) int {
+		if c := cmp.Compare(a.mtime, b.mtime); c != 0 {
+			return c
+		}
+		return strings.Compare(a.id, b.id)
+	})
+	for _, e := range entries[:excess] {
+		delete(recs, e.id)
+	}
+	b.batchEvict.Add(int64(excess))
+}
+
+// pruneIndex discards cached batch indexes that are too old to be used, so
+// that the memory held is bounded by the partitions recently used.
+func (b *actionBatcher) pruneIndex() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for part, idx := range b.index {
+		if time.Since(idx.loaded) > b.interval {
+			delete(b.index, part)
+		}
+	}
+}
+
+// requeue restores recs to the pending set for part, without replacing any
+// records added since they were removed.
+func (b *actionBatcher) requeue(part string, recs map[string]string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cur := b.pending[part]
+	if cur == nil {
+		b.pending[part] = recs
+		return
+	}
+	for id, rec := range recs {
+		if _, ok := cur[id]; !ok {
+			cur[id] = rec
+		}
+	}
+}
+
+// run flushes pending records every interval until ctx ends.
+func (b *actionBatcher) run(ctx context.Context) {
+	defer close(b.done)
+	t := time.NewTicker(b.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			fctx, cancel := context.WithTimeout(ctx, 1*time.Minute)
+			if err := b.flush(fctx); err != nil {
+				gocache.Logf(ctx, "%v", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// close stops the periodic flush and writes any remaining pending records.
+func (b *actionBatcher) close(ctx context.Context) error {
+	b.stop()
+	<-b.done
+	return b.flush(ctx)
+}
+
+func (b *actionBatcher) setMetrics(m *expvar.Map) {
+	m.Set("action_batch_write", &b.batchWrite)
+	m.Set("action_batch_error", &b.batchError)
+	m.Set("action_batch_hit", &b.batchHit)
+	m.Set("action_batch_conflict", &b.batchConflict)
+	m.Set("action_batch_evict", &b.batchEvict)
+}
+
+// parseActionBatch parses the contents of a batch object. Malformed lines are
+// ignored.
+func parseActionBatch(data []byte) map[string]string {
+	out := make(map[string]string)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		id, rec, ok := strings.Cut(sc.Text(), " ")
+		if ok && id != "" {
+			out[id] = rec
+		}
+	}
+	return out
+}
+
+// formatActionBatch encodes recs as the contents of a batch object.
+func formatActionBatch(recs map[string]string) []byte {
+	var buf bytes.Buffer
+	for _, id := range slices.Sorted(maps.Keys(recs)) {
+		fmt.Fprintf(&buf, "%s %s\n", id, recs[id])
+	}
+	return buf.Bytes()
+}
+
+// formatAction encodes an action record in the format read by parseAction.
+// If version is non-empty, the record pins that version of the output object
+// (see parseActionVersion).
+func formatAction(outputID string, mtime time.Time, version string) string {
+	if version != "" {
+		return fmt.Sprintf("%s %d %s", outputID, mtime.UnixNano(), version)
+	}
+	return fmt.Sprintf("%s %d", outputID, mtime.UnixNano())
+}
@@ -0,0 +1,190 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"bytes"
+	"context"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/tailscale/go-cache-plugin/lib/memcache"
+)
+
+func TestActionBatchFormat(t *testing.T) {
+	mtime := time.Unix(1700000000, 12345)
+	recs := map[string]string{
+		"aa01": formatAction(testID("1"), mtime, ""),
+		"aa02": formatAction(testID("2"), mtime, ""),
+	}
+	data := formatActionBatch(recs)
+	t.Logf("Batch:\n%s", data)
+
+	got := parseActionBatch(append(data, "bogus\n"...))
+	if !maps.Equal(got, recs) {
+		t.Errorf("Parse: got %v, want %v", got, recs)
+	}
+
+	outputID, gotTime, err := parseAction([]byte(got["aa02"]))
+	if err != nil {
+		t.Fatalf("Parse action: unexpected error: %v", err)
+	}
+	if outputID != testID("2") || !gotTime.Equal(mtime) {
+		t.Errorf("Parse action: got (%q, %v), want (%q, %v)", outputID, gotTime, testID("2"), mtime)
+	}
+}
+
+func TestParseAction(t *testing.T) {
+	mtime := time.Unix(1700000000, 12345)
+	out := testID("f")
+	if _, _, err := parseAction([]byte(formatAction(out, mtime, ""))); err != nil {
+		t.Errorf("Parse valid action: unexpected error: %v", err)
+	}
+	id, got, version, err := parseActionVersion([]byte(formatAction(out, mtime, "1234")))
+	if err != nil {
+		t.Errorf("Parse pinned action: unexpected error: %v", err)
+	} else if id != out || !got.Equal(mtime) || version != "1234" {
+		t.Errorf("Parse pinned action: got (%q, %v, %q), want (%q, %v, %q)", id, got, version, out, mtime, "1234")
+	}
+
+	tests := []struct {
+		name, input string
+	}{
+		{"Empty", ""},
+		{"Blank", " \n"},
+		{"NoTimestamp", out},
+		{"TruncatedAfterOutput", out + " "},
+		{"BadTimestamp", out + " 17000x"},
+		{"NonHexOutput", "output-id 1700000000000012345"},
+		{"OddHexOutput", "ff0 1700000000000012345"},
+		{"ShortOutput", "ab 1700000000000012345"},
+		{"ExtraFields", out + " 1700000000000012345 1234 extra"},
+	}
+	for _, tc := range tests {
+		if id, _, err := parseAction([]byte(tc.input)); err == nil {
+			t.Errorf("Parse %s (%q): got output %q, want error", tc.name, tc.input, id)
+		} else {
+			t.Logf("Parse %s: %v", tc.name, err)
+		}
+	}
+}
+
+func TestActionBatchConflict(t *testing.T) {
+	ctx := context.Background()
+	mc := new(memcache.Client)
+	key := func(part string) string { return "action-batch/" + part }
+	b := newActionBatcher(mc, time.Hour, 0, 0, key)
+	defer b.close(ctx)
+
+	// Before the first conditional write, another client writes the batch.
+	// The write must be retried with both records.
+	mtime := time.Unix(1700000000, 0)
+	other, mine := testID("a"), "aa"+testID("b")[2:]
+	var raced bool
+	mc.Fault = func(op, _ string) error {
+		if op == "PutVersion" && !raced {
+			raced = true
+			mc.Put(ctx, key("aa"), bytes.NewReader(formatActionBatch(map[string]string{
+				other: formatAction(testID("1"), mtime, ""),
+			})))
+		}
+		return nil
+	}
+	b.add(mine, testID("2"), mtime)
+	if err := b.flush(ctx); err != nil {
+		t.Fatalf("Flush: unexpected error: %v", err)
+	}
+	if got := b.batchConflict.Value(); got != 1 {
+		t.Errorf("Conflicts: got %d, want 1", got)
+	}
+	data, err := mc.GetData(ctx, key("aa"))
+	if err != nil {
+		t.Fatalf("GetData: %v", err)
+	}
+	got := parseActionBatch(data)
+	if _, ok := got[other]; !ok {
+		t.Errorf("Batch lost the record of the other client: %v", got)
+	}
+	if _, ok := got[mine]; !ok {
+		t.Errorf("Batch lost the flushed record: %v", got)
+	}
+}
+
+func TestActionBatchEvict(t *testing.T) {
+	b := &actionBatcher{limit: 2}
+	recs := map[string]string{
+		"aa01": formatAction(testID("1"), time.Unix(1700000000, 0), ""),
+		"aa02": formatAction(testID("2"), time.Unix(1700000002, 0), ""),
+		"aa03": formatAction(testID("3"), time.Unix(1700000001, 0), ""),
+		"aa04": "bogus",
+	}
+	b.evict(recs)
+	want := []string{"aa02", "aa03"}
+	if got := slices.Sorted(maps.Keys(recs)); !slices.Equal(got, want) {
+		t.Errorf("Evict: got %v, want %v", got, want)
+	}
+	if got := b.batchEvict.Value(); got != 2 {
+		t.Errorf("Evictions: got %d, want 2", got)
+	}
+}
+
+func TestActionBatchLimit(t *testing.T) {
+	ctx := context.Background()
+	mc := new(memcache.Client)
+	b := newActionBatcher(mc, time.Hour, 0, 2, func(part string) string { return "action-batch/" + part })
+	defer b.close(ctx)
+
+	ids := []string{"aa" + testID("1")[2:], "aa" + testID("2")[2:], "aa" + testID("3")[2:]}
+	for i, id := range ids {
+		b.add(id, testID("f"), time.Unix(int64(1700000000+i), 0))
+	}
+	if err := b.flush(ctx); err != nil {
+		t.Fatalf("Flush: unexpected error: %v", err)
+	}
+	data, err := mc.GetData(ctx, "action-batch/aa")
+	if err != nil {
+		t.Fatalf("GetData: %v", err)
+	}
+	got := parseActionBatch(data)
+	if len(got) != 2 {
+		t.Errorf("Batch has %d records, want 2", len(got))
+	}
+	if _, ok := got[ids[0]]; ok {
+		t.Error("Batch kept the oldest record, want it dropped")
+	}
+	if got := b.batchEvict.Value(); got != 1 {
+		t.Errorf("Evictions: got %d, want 1", got)
+	}
+}
+
+func TestActionBatchDepth(t *testing.T) {
+	ctx := context.Background()
+	mc := new(memcache.Client)
+	key := func(part string) string { return "action-batch/" + part }
+	mtime := time.Unix(1700000000, 0)
+
+	// A batch written at the default depth.
+	oldID := testID("a")
+	mc.Put(ctx, key("aa"), bytes.NewReader(formatActionBatch(map[string]string{
+		oldID: formatAction(testID("1"), mtime, ""),
+	})))
+
+	b := newActionBatcher(mc, time.Hour, 4, 0, key)
+	defer b.close(ctx)
+	newID := testID("b")
+	b.add(newID, testID("2"), mtime)
+	if err := b.flush(ctx); err != nil {
+		t.Fatalf("Flush: unexpected error: %v", err)
+	}
+	if keys := mc.Keys(); !slices.Contains(keys, key("bbbb")) {
+		t.Errorf("Keys: got %q, want %q", keys, key("bbbb"))
+	}
+	for _, id := range []string{oldID, newID} {
+		if _, ok, err := b.lookup(ctx, id); err != nil || !ok {
+			t.Errorf("Lookup %s: got (%v, %v), want found", id[:4], ok, err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"hash/maphash"
+	"math/bits"
+	"sync"
+)
+
+// DefaultAdmissionWindow is the number of observations an admission filter
+// counts before it ages its counts, if its window is not set.
+const DefaultAdmissionWindow = 1 << 16
+
+// admissionDepth is the number of rows in the sketch of an admission filter.
+// Each observation updates one counter per row, and the estimate for a key is
+// the least of its counters, so more rows mean fewer overestimates.
+const admissionDepth = 4
+
+// An admissionFilter estimates how often each key has been observed recently,
+// and admits a key once it has been observed twice. It is used to skip
+// uploading objects seen only once, which are unlikely ever to be read.
+//
+// The counts are kept in a count-min sketch, in the manner of TinyLFU: each
+// key updates one small counter in each of several rows, chosen by hashing,
+// and its estimated count is the least of these. Collisions can only inflate
+// an estimate, so the filter may admit a key seen once. After window
+// observations, all counters are halved, so that keys seen long ago are
+// forgotten; a key seen twice is rejected only if the counters were halved
+// between its observations.
+//
+// The sketch has admissionDepth rows of one byte per counter, with at least
+// window counters per row, so its size is about 4*window bytes.
+//
+// A nil *admissionFilter is valid, and admits every key.
+type admissionFilter struct {
+	seed   maphash.Seed
+	window int
+
+	mu    sync.Mutex
+	rows  [admissionDepth][]uint8
+	mask  uint64
+	added int // observations since the counters were last halved
+}
+
+// newAdmissionFilter returns an admission filter that ages its counts every
+// window observations. If window is zero or negative, it returns nil.
+func newAdmissionFilter(window int) *admissionFilter {
+	if window <= 0 {
+		return nil
+	}
+	width := 1 << bits.Len(uint(window-1)) // the least power of 2 ≥ window
+	f := &admissionFilter{
+		seed:   maphash.MakeSeed(),
+		window: window,
+		mask:   uint64(width - 1),
+	}
+	for i := range f.rows {
+		f.rows[i] = make([]uint8, width)
+	}
+	return f
+}
+
+// admit records an observation of key, and reports whether key has now been
+// observed at least twice within the window.
+func (f *admissionFilter) admit(key string) bool {
+	if f == nil {
+		return true
+	}
+	// Derive the index in each row from two halves of one hash.
+	h := maphash.String(f.seed, key)
+	h1, h2 := h&0xffffffff, h>>32|1
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var idx [admissionDepth]uint64
+	est := uint8(255)
+	for i := range f.rows {
+		idx[i] = (h1 + uint64(i)*h2) & f.mask
+		est = min(est, f.rows[i][idx[i]])
+	}
+
+	// Increment only the counters at the estimate ("conservative update"),
+	// which reduces the overestimates caused by collisions.
+	if est < 255 {
+		for i := range f.rows {
+			if f.rows[i][idx[i]] == est {
+				f.rows[i][idx[i]]++
+			}
+		}
+	}
+	if f.added++; f.added >= f.window {
+		f.ageLocked()
+	}
+	return est >= 1
+}
+
+// ageLocked halves all the counters of f. The caller must hold f.mu.
+func (f *admissionFilter) ageLocked() {
+	for _, row := range f.rows {
+		for j := range row {
+			row[j] >>= 1
+		}
+	}
+	f.added = 0
+}
@@ -0,0 +1,74 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestAdmissionFilter(t *testing.T) {
+	t.Run("Nil", func(t *testing.T) {
+		f := newAdmissionFilter(0)
+		if f != nil {
+			t.Fatalf("newAdmissionFilter(0): got %v, want nil", f)
+		}
+		if !f.admit("a") {
+			t.Error("Nil filter rejected a, want admit")
+		}
+	})
+
+	t.Run("SecondSight", func(t *testing.T) {
+		f := newAdmissionFilter(1000)
+		if f.admit("a") {
+			t.Error("First admit(a): got true, want false")
+		}
+		if !f.admit("a") {
+			t.Error("Second admit(a): got false, want true")
+		}
+		if f.admit("b") {
+			t.Error("First admit(b): got true, want false")
+		}
+	})
+
+	t.Run("Few", func(t *testing.T) {
+		// With few keys relative to the window, collisions are rare, so few
+		// keys seen once should be admitted.
+		const n = 100
+		f := newAdmissionFilter(1 << 14)
+		var admitted int
+		for i := range n {
+			if f.admit("key-" + strconv.Itoa(i)) {
+				admitted++
+			}
+		}
+		if admitted > n/10 {
+			t.Errorf("Admitted %d of %d distinct keys, want at most %d", admitted, n, n/10)
+		}
+	})
+
+	t.Run("Age", func(t *testing.T) {
+		f := newAdmissionFilter(1000)
+		age := func() {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			f.ageLocked()
+		}
+
+		// A key seen once is forgotten when the counters age.
+		f.admit("a")
+		age()
+		if f.admit("a") {
+			t.Error("admit(a) after aging: got true, want false")
+		}
+
+		// A key seen more often is remembered through one aging.
+		f.admit("b")
+		f.admit("b")
+		age()
+		if !f.admit("b") {
+			t.Error("admit(b) after aging: got false, want true")
+		}
+	})
+}
@@ -0,0 +1,232 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/creachadair/atomicfile"
+	"github.com/tailscale/go-cache-plugin/lib/revproxy"
+)
+
+// Archive exports and imports a build cache as a tar archive, for moving a
+// cache between environments that do not share a storage bucket.
+//
+// An archive contains the action and output files of the local cache
+// directory under "local/", with their paths relative to the directory, and
+// the build cache objects of the bucket under "remote/", with their keys
+// relative to the key prefix. Other files in the directory, such as the
+// module and reverse proxy caches and the marker files recording its layout,
+// belong to the environment and are not exported, and Import skips entries
+// for them. Modification times are preserved for local files. Objects in
+// storage get a new modification time when imported, but the action records
+// keep their original timestamps.
+type Archive struct {
+	// Dir, if non-empty, is the path of the local cache directory. If empty,
+	// local files are not exported or imported.
+	Dir string
+
+	// Client, if non-nil, is the storage client for the bucket. If nil,
+	// remote objects are not exported or imported.
+	Client revproxy.ListClient
+
+	// KeyPrefix is the key prefix of the build cache in the bucket, if any.
+	// Objects imported into a bucket are written under this prefix, which
+	// need not match the prefix they were exported from.
+	KeyPrefix string
+
+	// Logf, if non-nil, is used to report progress. If nil, these reports are
+	// discarded.
+	Logf func(string, ...any)
+}
+
+// ArchiveStats is a summary of the results from [Archive.Export] and
+// [Archive.Import].
+type ArchiveStats struct {
+	LocalFiles    int   // local files exported or imported
+	LocalBytes    int64 // total size of local files
+	RemoteObjects int   // remote objects exported or imported
+	RemoteBytes   int64 // total size of remote objects
+	Skipped       int   // archive entries not imported
+}
+
+// The kinds of build cache entries included in an archive, as subdirectories
+// of the local cache directory, and as key prefixes in the bucket.
+var (
+	archiveLocalKinds  = []string{"action", "output"}
+	archiveRemoteKinds = []string{"action", "action-batch", "output"}
+)
+
+// isLocalEntry reports whether rel, a slash-separated path relative to the
+// local cache directory, names an action or output file, as
+// "action/<xx>/<id>" where xx is the first two digits of id.
+func isLocalEntry(rel string) bool {
+	parts := strings.Split(rel, "/")
+	return len(parts) == 3 && slices.Contains(archiveLocalKinds, parts[0]) &&
+		validID(parts[2]) && parts[1] == parts[2][:2]
+}
+
+// isRemoteEntry reports whether rel, a slash-separated key relative to the
+// key prefix, names a build cache object.
+func isRemoteEntry(rel string) bool {
+	kind, _, _ := strings.Cut(rel, "/")
+	return slices.Contains(archiveRemoteKinds, kind)
+}
+
+// Export writes an archive of the local cache directory and the remote build
+// cache to w. The caller is responsible for closing w, if necessary.
+func (a *Archive) Export(ctx context.Context, w io.Writer) (ArchiveStats, error) {
+	var stats ArchiveStats
+	tw := tar.NewWriter(w)
+
+	if a.Dir != "" {
+		for _, kind := range archiveLocalKinds {
+			if err := walkLocal(filepath.Join(a.Dir, kind), func(p string, fi fs.FileInfo) error {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				rel, err := filepath.Rel(a.Dir, p)
+				if err != nil {
+					return err
+				}
+				rel = filepath.ToSlash(rel)
+				if !isLocalEntry(rel) {
+					return nil // not a cache entry, e.g., a temporary file
+				}
+				f, err := os.Open(p)
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil // removed since it was listed
+				} else if err != nil {
+					return err
+				}
+				defer f.Close()
+				if err := writeEntry(tw, path.Join("local", rel), fi.Size(), fi.ModTime(), f); err != nil {
+					return fmt.Errorf("export %s: %w", p, err)
+				}
+				stats.LocalFiles++
+				stats.LocalBytes += fi.Size()
+				return nil
+			}); err != nil {
+				return stats, fmt.Errorf("export local: %w", err)
+			}
+		}
+		a.logf("exported %d local files (%d bytes)", stats.LocalFiles, stats.LocalBytes)
+	}
+
+	if a.Client != nil {
+		for _, kind := range archiveRemoteKinds {
+			prefix := path.Join(a.KeyPrefix, kind) + "/"
+			if err := a.Client.List(ctx, prefix, func(oi revproxy.ObjectInfo) error {
+				rc, _, err := a.Client.Get(ctx, oi.Key)
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil // removed since it was listed
+				} else if err != nil {
+					return err
+				}
+				defer rc.Close()
+				name := path.Join("remote", kind, strings.TrimPrefix(oi.Key, prefix))
+				if err := writeEntry(tw, name, oi.Size, oi.ModTime, rc); err != nil {
+					return fmt.Errorf("export %s: %w", oi.Key, err)
+				}
+				stats.RemoteObjects++
+				stats.RemoteBytes += oi.Size
+				return nil
+			}); err != nil {
+				return stats, fmt.Errorf("export remote: %w", err)
+			}
+		}
+		a.logf("exported %d remote objects (%d bytes)", stats.RemoteObjects, stats.RemoteBytes)
+	}
+	return stats, tw.Close()
+}
+
+// Import reads an archive from r, and writes its contents into the local
+// cache directory and the bucket, according to the settings of a. Entries for
+// a destination that is not set, and entries that are not build cache
+// entries, are skipped. Existing files and objects with the same names are
+// replaced.
+func (a *Archive) Import(ctx context.Context, r io.Reader) (ArchiveStats, error) {
+	var stats ArchiveStats
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return stats, nil
+		} else if err != nil {
+			return stats, fmt.Errorf("read archive: %w", err)
+		} else if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			stats.Skipped++
+			continue
+		}
+
+		// Reject names that would escape the destination.
+		where, rel, _ := strings.Cut(hdr.Name, "/")
+		if !filepath.IsLocal(rel) {
+			return stats, fmt.Errorf("invalid archive entry %q", hdr.Name)
+		}
+
+		switch {
+		case where == "local" && a.Dir != "" && isLocalEntry(rel):
+			dst := filepath.Join(a.Dir, filepath.FromSlash(rel))
+			if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return stats, err
+			}
+			if _, err := atomicfile.WriteAll(dst, tr, 0644); err != nil {
+				return stats, fmt.Errorf("import %s: %w", hdr.Name, err)
+			}
+			if err := os.Chtimes(dst, hdr.ModTime, hdr.ModTime); err != nil {
+				return stats, fmt.Errorf("import %s: %w", hdr.Name, err)
+			}
+			stats.LocalFiles++
+			stats.LocalBytes += hdr.Size
+
+		case where == "remote" && a.Client != nil && isRemoteEntry(rel):
+			key := path.Join(a.KeyPrefix, rel)
+			if err := a.Client.Put(ctx, key, tr); err != nil {
+				return stats, fmt.Errorf("import %s: %w", hdr.Name, err)
+			}
+			stats.RemoteObjects++
+			stats.RemoteBytes += hdr.Size
+
+		default:
+			stats.Skipped++
+		}
+	}
+}
+
+// writeEntry writes a regular file entry to tw with the given name, size, and
+// modification time, and the contents read from r.
+func writeEntry(tw *tar.Writer, name string, size int64, mtime time.Time, r io.Reader) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  mtime,
+	}); err != nil {
+		return err
+	}
+	_, err := io.CopyN(tw, r, size)
+	return err
+}
+
+func (a *Archive) logf(msg string, args ...any) {
+	if a.Logf != nil {
+		a.Logf(msg, args...)
+	}
+}
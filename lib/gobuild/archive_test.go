@@ -0,0 +1,114 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchiveLocal(t *testing.T) {
+	src := t.TempDir()
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	actionID, outputID := testID("a"), testID("c")
+	files := map[string]string{
+		"action/aa/" + actionID:           "action record",
+		"output/cc/" + outputID:           "output data",
+		"output/cc/" + outputID + ".etag": "sidecar",     // not exported
+		"partial/" + outputID:             "incomplete",  // not exported
+		"module/cache/download/x/@v/v1.0": "module data", // not exported
+		"revproxy/ab/" + actionID:         "proxy data",  // not exported
+		"layout-version":                  "marker",      // not exported
+	}
+	for name, data := range files {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		} else if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		} else if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	var buf bytes.Buffer
+	est, err := (&Archive{Dir: src}).Export(ctx, &buf)
+	if err != nil {
+		t.Fatalf("Export: unexpected error: %v", err)
+	}
+	if est.LocalFiles != 2 {
+		t.Errorf("Export: got %d files, want 2", est.LocalFiles)
+	}
+
+	dst := t.TempDir()
+	ist, err := (&Archive{Dir: dst}).Import(ctx, &buf)
+	if err != nil {
+		t.Fatalf("Import: unexpected error: %v", err)
+	}
+	if ist != est {
+		t.Errorf("Import stats: got %+v, want %+v", ist, est)
+	}
+	for name, want := range files {
+		p := filepath.Join(dst, filepath.FromSlash(name))
+		data, err := os.ReadFile(p)
+		if !isLocalEntry(name) {
+			if err == nil {
+				t.Errorf("File %q was imported, but should not have been", name)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("Read %q: %v", name, err)
+			continue
+		}
+		if got := string(data); got != want {
+			t.Errorf("File %q: got %q, want %q", name, got, want)
+		}
+		if fi, err := os.Stat(p); err != nil {
+			t.Errorf("Stat %q: %v", name, err)
+		} else if !fi.ModTime().Equal(mtime) {
+			t.Errorf("File %q: got mtime %v, want %v", name, fi.ModTime(), mtime)
+		}
+	}
+}
+
+func TestArchiveImportSkip(t *testing.T) {
+	actionID := testID("a")
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{
+		"local/layout-version",
+		"local/cache-salt",
+		"local/module/cache/download/x/@v/list",
+		"local/action/bb/" + actionID, // wrong partition
+		"local/action/aa/" + actionID,
+	} {
+		if err := writeEntry(tw, name, 4, time.Now(), strings.NewReader("data")); err != nil {
+			t.Fatalf("Write %q: %v", name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	st, err := (&Archive{Dir: dst}).Import(context.Background(), &buf)
+	if err != nil {
+		t.Fatalf("Import: unexpected error: %v", err)
+	}
+	if st.LocalFiles != 1 || st.Skipped != 4 {
+		t.Errorf("Import: got %+v, want 1 file and 4 skipped", st)
+	}
+	for _, name := range []string{"layout-version", "cache-salt", "module", "action/bb"} {
+		if _, err := os.Stat(filepath.Join(dst, filepath.FromSlash(name))); err == nil {
+			t.Errorf("Entry %q was imported, but should not have been", name)
+		}
+	}
+}
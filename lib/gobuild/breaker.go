@@ -0,0 +1,171 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// A Breaker is a circuit breaker for requests to storage. When storage is
+// unhealthy, it lets a cache skip storage entirely rather than wait for each
+// request to fail, so that builds proceed with the local cache alone.
+//
+// The breaker starts closed, allowing all requests. After Threshold
+// consecutive failures within Window, it opens: requests are refused for
+// Cooldown, during which reads report a miss and writes are dropped. After
+// the cooldown, a single request is allowed through as a probe. If the probe
+// succeeds, the breaker closes again; otherwise it stays open for another
+// cooldown.
+//
+// A nil *Breaker is valid, and allows all requests.
+type Breaker struct {
+	// Threshold is the number of consecutive failures that open the breaker.
+	// If zero or negative, it uses DefaultBreakerThreshold.
+	Threshold int
+
+	// Window is the longest span of time over which consecutive failures
+	// count toward Threshold. If zero or negative, failures count regardless
+	// of when they occur.
+	Window time.Duration
+
+	// Cooldown is how long the breaker stays open before it allows a probe.
+	// If zero or negative, it uses DefaultBreakerCooldown.
+	Cooldown time.Duration
+
+	// Logf, if non-nil, is used to log changes of state.
+	Logf func(string, ...any)
+
+	mu        sync.Mutex
+	failures  int       // consecutive failures while closed
+	first     time.Time // time of the first of the current failures
+	openUntil time.Time // if non-zero, the breaker is open until this time
+	probing   bool      // a probe is in progress
+
+	opened   expvar.Int // count of times the breaker opened
+	rejected expvar.Int // count of requests refused while open
+}
+
+// Defaults for the settings of a [Breaker].
+const (
+	DefaultBreakerThreshold = 5
+	DefaultBreakerCooldown  = 30 * time.Second
+)
+
+// errBreakerOpen is reported in place of a read from storage while the
+// breaker is open. It satisfies [fs.ErrNotExist], so it is handled as a miss.
+var errBreakerOpen = fmt.Errorf("storage unavailable (circuit open): %w", fs.ErrNotExist)
+
+// Allow reports whether a request to storage may be sent. If it reports true,
+// the caller must report the outcome of the request to Done.
+func (b *Breaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return true // closed
+	} else if b.probing || time.Now().Before(b.openUntil) {
+		b.rejected.Add(1)
+		return false
+	}
+	b.probing = true // let one request through to test the waters
+	return true
+}
+
+// Done reports the outcome of a request allowed by Allow. A request that
+// found nothing (reporting [fs.ErrNotExist]) succeeded. A request canceled by
+// its caller neither succeeded nor failed.
+func (b *Breaker) Done(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if errors.Is(err, context.Canceled) {
+		b.probing = false
+		return
+	} else if err == nil || errors.Is(err, fs.ErrNotExist) {
+		if !b.openUntil.IsZero() {
+			b.logf("storage circuit closed")
+		}
+		b.failures, b.openUntil, b.probing = 0, time.Time{}, false
+		return
+	}
+
+	now := time.Now()
+	if b.probing {
+		b.probing = false
+		b.openUntil = now.Add(b.cooldown())
+		b.logf("storage circuit probe failed: %v (open for %v)", err, b.cooldown())
+		return
+	} else if !b.openUntil.IsZero() {
+		return // already open, from a request that began before it opened
+	}
+	if b.failures == 0 || (b.Window > 0 && now.Sub(b.first) > b.Window) {
+		b.failures, b.first = 0, now
+	}
+	b.failures++
+	if b.failures >= b.threshold() {
+		b.failures = 0
+		b.openUntil = now.Add(b.cooldown())
+		b.opened.Add(1)
+		b.logf("WARNING: storage circuit open after %d consecutive failures, last: %v (serving local only for %v)",
+			b.threshold(), err, b.cooldown())
+	}
+}
+
+// State reports the current state of the breaker: "closed", "open", or
+// "half-open" (after the cooldown, awaiting a probe).
+func (b *Breaker) State() string {
+	if b == nil {
+		return "closed"
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.openUntil.IsZero():
+		return "closed"
+	case time.Now().Before(b.openUntil):
+		return "open"
+	default:
+		return "half-open"
+	}
+}
+
+// setMetrics adds the metrics of b to m, if b is non-nil.
+func (b *Breaker) setMetrics(m *expvar.Map) {
+	if b == nil {
+		return
+	}
+	m.Set("breaker_state", expvar.Func(func() any { return b.State() }))
+	m.Set("breaker_open", &b.opened)
+	m.Set("breaker_reject", &b.rejected)
+}
+
+func (b *Breaker) threshold() int {
+	if b.Threshold <= 0 {
+		return DefaultBreakerThreshold
+	}
+	return b.Threshold
+}
+
+func (b *Breaker) cooldown() time.Duration {
+	if b.Cooldown <= 0 {
+		return DefaultBreakerCooldown
+	}
+	return b.Cooldown
+}
+
+func (b *Breaker) logf(msg string, args ...any) {
+	if b.Logf != nil {
+		b.Logf(msg, args...)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	errFail := errors.New("storage is down")
+	b := &Breaker{Threshold: 3, Cooldown: 50 * time.Millisecond, Logf: t.Logf}
+
+	check := func(want string) {
+		t.Helper()
+		if got := b.State(); got != want {
+			t.Errorf("State: got %q, want %q", got, want)
+		}
+	}
+
+	// Misses and cancellations do not count as failures.
+	for _, err := range []error{errFail, errFail, fs.ErrNotExist, errFail, context.Canceled, errFail} {
+		if !b.Allow() {
+			t.Fatalf("Allow: got false, want true while closed")
+		}
+		b.Done(err)
+	}
+	check("closed")
+
+	// The next failure reaches the threshold.
+	b.Allow()
+	b.Done(errFail)
+	check("open")
+	if b.Allow() {
+		t.Error("Allow: got true, want false while open")
+	}
+	if n := b.opened.Value(); n != 1 {
+		t.Errorf("Opened: got %d, want 1", n)
+	}
+	if n := b.rejected.Value(); n != 1 {
+		t.Errorf("Rejected: got %d, want 1", n)
+	}
+
+	// After the cooldown, exactly one probe is allowed. If it fails, the
+	// breaker opens again.
+	time.Sleep(60 * time.Millisecond)
+	check("half-open")
+	if !b.Allow() {
+		t.Fatal("Allow: got false, want a probe after cooldown")
+	}
+	if b.Allow() {
+		t.Error("Allow: got true, want false while probing")
+	}
+	b.Done(errFail)
+	check("open")
+
+	// A successful probe closes the breaker.
+	time.Sleep(60 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("Allow: got false, want a probe after cooldown")
+	}
+	b.Done(nil)
+	check("closed")
+	if n := b.opened.Value(); n != 1 {
+		t.Errorf("Opened: got %d, want 1", n)
+	}
+
+	// A nil breaker allows everything.
+	var nb *Breaker
+	if !nb.Allow() {
+		t.Error("Allow: got false from nil breaker")
+	}
+	nb.Done(errFail)
+}
+
+func TestBreakerWindow(t *testing.T) {
+	errFail := errors.New("storage is down")
+	b := &Breaker{Threshold: 2, Window: 20 * time.Millisecond}
+
+	b.Done(errFail)
+	time.Sleep(30 * time.Millisecond)
+	b.Done(errFail) // the first failure is outside the window
+	if got := b.State(); got != "closed" {
+		t.Errorf("State: got %q, want closed", got)
+	}
+	b.Done(errFail)
+	if got := b.State(); got != "open" {
+		t.Errorf("State: got %q, want open", got)
+	}
+}
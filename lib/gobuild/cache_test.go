@@ -0,0 +1,1151 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/cachedir"
+	"github.com/tailscale/go-cache-plugin/lib/eventlog"
+	"github.com/tailscale/go-cache-plugin/lib/memcache"
+)
+
+// testCache is the part of the cache implementations exercised by
+// TestCacheStorage.
+type testCache interface {
+	Get(context.Context, string) (string, string, error)
+	Put(context.Context, gocache.Object) (string, error)
+	Close(context.Context) error
+	SetMetrics(context.Context, *expvar.Map)
+	Pending() int
+	Prefetch(context.Context, []string) (PrefetchStats, error)
+}
+
+// truncClient is a memcache.Client whose conditional writes store all but the
+// last byte of the object, to simulate a truncated upload.
+type truncClient struct {
+	*memcache.Client
+}
+
+func (c truncClient) PutCond(ctx context.Context, key, etag string, data io.Reader) (bool, error) {
+	buf, err := io.ReadAll(data)
+	if err != nil {
+		return false, err
+	}
+	return c.Client.PutCond(ctx, key, etag, bytes.NewReader(buf[:max(len(buf)-1, 0)]))
+}
+
+// badCRCClient is a memcache.Client that reports the wrong checksum for each
+// object, to simulate contents corrupted in transit.
+type badCRCClient struct {
+	*memcache.Client
+}
+
+func (c badCRCClient) GetChecksum(ctx context.Context, key string) (io.ReadCloser, int64, uint32, error) {
+	rc, size, crc, err := c.Client.GetChecksum(ctx, key)
+	return rc, size, crc + 1, err
+}
+
+func TestCacheStorage(t *testing.T) {
+	const (
+		actionID = "a1b2c3d4e5f6a1b2c3d4e5f6a1b2c3d4e5f6a1b2c3d4e5f6a1b2c3d4e5f6a1b2"
+		outputID = "0f1e2d3c4b5a0f1e2d3c4b5a0f1e2d3c4b5a0f1e2d3c4b5a0f1e2d3c4b5a0f1e"
+		content  = "the output of a build action"
+		prefix   = "test"
+	)
+	errFail := errors.New("storage is on fire")
+
+	backends := []struct {
+		name string
+		kind string // the name of the backend in metrics
+		open func(local *cachedir.Dir, client Client) testCache
+	}{
+		{"GCS", "gcs", func(local *cachedir.Dir, client Client) testCache {
+			return &GCSCache{Local: local, GCSClient: client, KeyPrefix: prefix}
+		}},
+		{"S3", "s3", func(local *cachedir.Dir, client Client) testCache {
+			return &S3Cache{Local: local, S3Client: client, KeyPrefix: prefix}
+		}},
+	}
+
+	// newCache returns a cache of the given backend, with an empty local
+	// directory, backed by client, and its metrics.
+	newCache := func(t *testing.T, open func(*cachedir.Dir, Client) testCache, client Client) (testCache, *expvar.Map) {
+		t.Helper()
+		local, err := cachedir.New(t.TempDir())
+		if err != nil {
+			t.Fatalf("Create local cache: %v", err)
+		}
+		var m expvar.Map
+		c := open(local, client)
+		c.SetMetrics(context.Background(), &m)
+		return c, &m
+	}
+	metric := func(m *expvar.Map, name string) string {
+		if v := m.Get(name); v != nil {
+			return v.String()
+		}
+		return "<missing>"
+	}
+	putContent := func(t *testing.T, c testCache, content string) {
+		t.Helper()
+		if _, err := c.Put(context.Background(), gocache.Object{
+			ActionID: actionID,
+			OutputID: outputID,
+			Size:     int64(len(content)),
+			Body:     strings.NewReader(content),
+			ModTime:  time.Now(),
+		}); err != nil {
+			t.Fatalf("Put: unexpected error: %v", err)
+		}
+		if err := c.Close(context.Background()); err != nil {
+			t.Fatalf("Close: unexpected error: %v", err)
+		}
+	}
+	put := func(t *testing.T, c testCache) {
+		t.Helper()
+		putContent(t, c, content)
+	}
+
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			t.Run("Miss", func(t *testing.T) {
+				c, m := newCache(t, b.open, new(memcache.Client))
+				outID, diskPath, err := c.Get(ctx, actionID)
+				if err != nil || outID != "" || diskPath != "" {
+					t.Errorf("Get: got (%q, %q, %v), want a miss", outID, diskPath, err)
+				}
+				if got := metric(m, "get_fault_miss"); got != "1" {
+					t.Errorf("get_fault_miss: got %s, want 1", got)
+				}
+			})
+
+			t.Run("PutHit", func(t *testing.T) {
+				mc := new(memcache.Client)
+				c, m := newCache(t, b.open, mc)
+				put(t, c)
+
+				want := []string{
+					path.Join(prefix, "action", actionID[:2], actionID),
+					path.Join(prefix, "output", outputID[:2], outputID),
+				}
+				if got := mc.Keys(); !slices.Equal(got, want) {
+					t.Errorf("Storage keys: got %q, want %q", got, want)
+				}
+				if got := metric(m, "put_"+b.kind+"_object"); got != "1" {
+					t.Errorf("put_%s_object: got %s, want 1", b.kind, got)
+				}
+
+				// A cache with an empty local directory fetches from storage.
+				c2, m2 := newCache(t, b.open, mc)
+				outID, diskPath, err := c2.Get(ctx, actionID)
+				if err != nil {
+					t.Fatalf("Get: unexpected error: %v", err)
+				} else if outID != outputID {
+					t.Errorf("Get: output ID is %q, want %q", outID, outputID)
+				}
+				if data, err := os.ReadFile(diskPath); err != nil {
+					t.Errorf("Read object: %v", err)
+				} else if string(data) != content {
+					t.Errorf("Object: got %q, want %q", data, content)
+				}
+				if got := metric(m2, "get_fault_hit"); got != "1" {
+					t.Errorf("get_fault_hit: got %s, want 1", got)
+				}
+
+				// Having staged it, a second read is a local hit.
+				if _, _, err := c2.Get(ctx, actionID); err != nil {
+					t.Fatalf("Get: unexpected error: %v", err)
+				}
+				if got := metric(m2, "get_local_hit"); got != "1" {
+					t.Errorf("get_local_hit: got %s, want 1", got)
+				}
+			})
+
+			t.Run("Dedup", func(t *testing.T) {
+				mc := new(memcache.Client)
+				c, _ := newCache(t, b.open, mc)
+				put(t, c)
+
+				// Storing the same object again does not upload it.
+				c2, m2 := newCache(t, b.open, mc)
+				put(t, c2)
+				if got := metric(m2, "put_"+b.kind+"_found"); got != "1" {
+					t.Errorf("put_%s_found: got %s, want 1", b.kind, got)
+				}
+				if got := metric(m2, "put_"+b.kind+"_object"); got != "0" {
+					t.Errorf("put_%s_object: got %s, want 0", b.kind, got)
+				}
+			})
+
+			t.Run("Prefetch", func(t *testing.T) {
+				mc := new(memcache.Client)
+				c, _ := newCache(t, b.open, mc)
+				put(t, c)
+
+				// A cache with an empty local directory stages the action, and
+				// counts the missing and invalid ones as misses.
+				c2, m2 := newCache(t, b.open, mc)
+				missing := strings.Repeat("0", len(actionID))
+				st, err := c2.Prefetch(ctx, []string{actionID, missing, "bogus"})
+				if err != nil {
+					t.Fatalf("Prefetch: unexpected error: %v", err)
+				}
+				if want := (PrefetchStats{Hits: 1, Misses: 2}); st != want {
+					t.Errorf("Prefetch: got %+v, want %+v", st, want)
+				}
+				if got := metric(m2, "prefetch_hit"); got != "1" {
+					t.Errorf("prefetch_hit: got %s, want 1", got)
+				}
+				if got := metric(m2, "prefetch_miss"); got != "2" {
+					t.Errorf("prefetch_miss: got %s, want 2", got)
+				}
+
+				// The build then finds it locally.
+				if outID, _, err := c2.Get(ctx, actionID); err != nil || outID != outputID {
+					t.Fatalf("Get: got (%q, %v), want %q", outID, err, outputID)
+				}
+				if got := metric(m2, "get_local_hit"); got != "1" {
+					t.Errorf("get_local_hit: got %s, want 1", got)
+				}
+
+				// A canceled prefetch stages nothing.
+				c3, _ := newCache(t, b.open, mc)
+				cctx, cancel := context.WithCancel(ctx)
+				cancel()
+				if st, err := c3.Prefetch(cctx, []string{actionID}); err == nil || st.Hits != 0 {
+					t.Errorf("Prefetch canceled: got (%+v, %v), want no hits and an error", st, err)
+				}
+			})
+
+			t.Run("Empty", func(t *testing.T) {
+				mc := new(memcache.Client)
+				c, m := newCache(t, b.open, mc)
+				putContent(t, c, "")
+				if got := metric(m, "put_"+b.kind+"_object"); got != "1" {
+					t.Errorf("put_%s_object: got %s, want 1", b.kind, got)
+				}
+
+				// An empty object is a hit, not a miss, and is staged as an
+				// empty file.
+				c2, m2 := newCache(t, b.open, mc)
+				outID, diskPath, err := c2.Get(ctx, actionID)
+				if err != nil {
+					t.Fatalf("Get: unexpected error: %v", err)
+				} else if outID != outputID || diskPath == "" {
+					t.Fatalf("Get: got (%q, %q), want a hit for %q", outID, diskPath, outputID)
+				}
+				if fi, err := os.Stat(diskPath); err != nil {
+					t.Errorf("Stat object: %v", err)
+				} else if fi.Size() != 0 {
+					t.Errorf("Object size: got %d, want 0", fi.Size())
+				}
+				if got := metric(m2, "get_fault_hit"); got != "1" {
+					t.Errorf("get_fault_hit: got %s, want 1", got)
+				}
+
+				// Storing it again does not upload it.
+				c3, m3 := newCache(t, b.open, mc)
+				putContent(t, c3, "")
+				if got := metric(m3, "put_"+b.kind+"_found"); got != "1" {
+					t.Errorf("put_%s_found: got %s, want 1", b.kind, got)
+				}
+			})
+
+			t.Run("ObjectError", func(t *testing.T) {
+				mc := new(memcache.Client)
+				c, _ := newCache(t, b.open, mc)
+				put(t, c)
+
+				// The action is present but its object cannot be read, which
+				// is an error rather than a miss.
+				mc.Fault = func(op, key string) error {
+					if strings.Contains(key, "/output/") {
+						return errFail
+					}
+					return nil
+				}
+				c2, _ := newCache(t, b.open, mc)
+				if _, _, err := c2.Get(ctx, actionID); !errors.Is(err, errFail) {
+					t.Errorf("Get: got error %v, want %v", err, errFail)
+				}
+			})
+
+			t.Run("PutError", func(t *testing.T) {
+				mc := &memcache.Client{Fault: func(string, string) error { return errFail }}
+				c, m := newCache(t, b.open, mc)
+
+				// Failed uploads do not fail the put, which is still stored
+				// locally.
+				if _, err := c.Put(ctx, gocache.Object{
+					ActionID: actionID,
+					OutputID: outputID,
+					Size:     int64(len(content)),
+					Body:     strings.NewReader(content),
+				}); err != nil {
+					t.Fatalf("Put: unexpected error: %v", err)
+				}
+				if err := c.Close(ctx); err != nil {
+					t.Errorf("Close: unexpected error: %v", err)
+				}
+				if got := metric(m, "put_"+b.kind+"_error"); got != "1" {
+					t.Errorf("put_%s_error: got %s, want 1", b.kind, got)
+				}
+				if keys := mc.Keys(); len(keys) != 0 {
+					t.Errorf("Storage keys: got %q, want none", keys)
+				}
+			})
+
+			t.Run("GetTimeout", func(t *testing.T) {
+				mc := new(memcache.Client)
+				c, _ := newCache(t, b.open, mc)
+				put(t, c)
+
+				// A read from storage that outlasts the timeout is a miss.
+				mc.Fault = func(string, string) error {
+					time.Sleep(50 * time.Millisecond)
+					return nil
+				}
+				c2, m2 := newCache(t, b.open, mc)
+				switch c := c2.(type) {
+				case *GCSCache:
+					c.GetTimeout = time.Millisecond
+				case *S3Cache:
+					c.GetTimeout = time.Millisecond
+				}
+				outID, diskPath, err := c2.Get(ctx, actionID)
+				if err != nil || outID != "" || diskPath != "" {
+					t.Errorf("Get: got (%q, %q, %v), want a miss", outID, diskPath, err)
+				}
+				if got := metric(m2, "get_timeout"); got != "1" {
+					t.Errorf("get_timeout: got %s, want 1", got)
+				}
+				if got := metric(m2, "op_timeout"); got != "1" {
+					t.Errorf("op_timeout: got %s, want 1", got)
+				}
+			})
+
+			t.Run("ContextErrors", func(t *testing.T) {
+				// An upload that times out is not counted as a storage error.
+				mc := &memcache.Client{Fault: func(string, string) error { return context.DeadlineExceeded }}
+				c, m := newCache(t, b.open, mc)
+				put(t, c)
+				if got := metric(m, "put_"+b.kind+"_error"); got != "0" {
+					t.Errorf("put_%s_error: got %s, want 0", b.kind, got)
+				}
+				if got := metric(m, "op_timeout"); got != "1" {
+					t.Errorf("op_timeout: got %s, want 1", got)
+				}
+
+				// A read abandoned by the client is counted as canceled.
+				mc.Fault = func(string, string) error { return context.Canceled }
+				c2, m2 := newCache(t, b.open, mc)
+				if _, _, err := c2.Get(ctx, actionID); !errors.Is(err, context.Canceled) {
+					t.Errorf("Get: got error %v, want %v", err, context.Canceled)
+				}
+				if got := metric(m2, "op_canceled"); got != "1" {
+					t.Errorf("op_canceled: got %s, want 1", got)
+				}
+				if got := metric(m2, "op_timeout"); got != "0" {
+					t.Errorf("op_timeout: got %s, want 0", got)
+				}
+			})
+
+			t.Run("CorruptAction", func(t *testing.T) {
+				mc := new(memcache.Client)
+				c, _ := newCache(t, b.open, mc)
+				put(t, c)
+
+				// Replace the action record with one truncated by an
+				// interrupted write, which is a miss rather than an error.
+				key := path.Join(prefix, "action", actionID[:2], actionID)
+				if err := mc.Put(ctx, key, strings.NewReader(outputID[:10])); err != nil {
+					t.Fatalf("Put action: %v", err)
+				}
+				c2, m2 := newCache(t, b.open, mc)
+				outID, diskPath, err := c2.Get(ctx, actionID)
+				if err != nil || outID != "" || diskPath != "" {
+					t.Errorf("Get: got (%q, %q, %v), want a miss", outID, diskPath, err)
+				}
+				if got := metric(m2, "action_corrupt"); got != "1" {
+					t.Errorf("action_corrupt: got %s, want 1", got)
+				}
+
+				// Putting the action again repairs the record.
+				put(t, c2)
+				c3, _ := newCache(t, b.open, mc)
+				if outID, _, err := c3.Get(ctx, actionID); err != nil || outID != outputID {
+					t.Errorf("Get: got (%q, %v), want hit for %q", outID, err, outputID)
+				}
+			})
+
+			t.Run("NegCache", func(t *testing.T) {
+				var reads atomic.Int64
+				mc := &memcache.Client{Fault: func(op, key string) error {
+					if strings.HasPrefix(op, "Get") && strings.Contains(key, "/action/") {
+						reads.Add(1)
+					}
+					return nil
+				}}
+				c, m := newCache(t, b.open, mc)
+
+				// Read storage first, so that each Get reads the action.
+				switch c := c.(type) {
+				case *GCSCache:
+					c.NegCacheTTL = time.Minute
+					c.RemoteFirst = true
+				case *S3Cache:
+					c.NegCacheTTL = time.Minute
+					c.RemoteFirst = true
+				}
+
+				// A repeated miss does not consult storage again.
+				for range 3 {
+					if outID, _, err := c.Get(ctx, actionID); err != nil || outID != "" {
+						t.Errorf("Get: got (%q, %v), want a miss", outID, err)
+					}
+				}
+				if got := reads.Load(); got != 1 {
+					t.Errorf("Action reads: got %d, want 1", got)
+				}
+				if got := metric(m, "get_neg_cache_hit"); got != "2" {
+					t.Errorf("get_neg_cache_hit: got %s, want 2", got)
+				}
+
+				// A put clears the negative entry, so the action is read again.
+				put(t, c)
+				if outID, _, err := c.Get(ctx, actionID); err != nil || outID != outputID {
+					t.Errorf("Get: got (%q, %v), want hit for %q", outID, err, outputID)
+				}
+				if got := reads.Load(); got < 2 {
+					t.Errorf("Action reads after put: got %d, want at least 2", got)
+				}
+			})
+
+			t.Run("PinVersions", func(t *testing.T) {
+				mc := new(memcache.Client)
+				c, _ := newCache(t, b.open, mc)
+				switch c := c.(type) {
+				case *GCSCache:
+					c.PinVersions = true
+				case *S3Cache:
+					c.PinVersions = true
+				}
+				put(t, c)
+
+				// The action record pins the version of the output.
+				key := path.Join(prefix, "output", outputID[:2], outputID)
+				info, err := mc.Stat(ctx, key)
+				if err != nil {
+					t.Fatalf("Stat output: %v", err)
+				}
+				data, err := mc.GetData(ctx, path.Join(prefix, "action", actionID[:2], actionID))
+				if err != nil {
+					t.Fatalf("Get action: %v", err)
+				}
+				if _, _, version, err := parseActionVersion(data); err != nil || version != info.Version {
+					t.Errorf("Action version: got %q, %v; want %q", version, err, info.Version)
+				}
+
+				c2, m2 := newCache(t, b.open, mc)
+				if outID, _, err := c2.Get(ctx, actionID); err != nil || outID != outputID {
+					t.Errorf("Get: got (%q, %v), want hit for %q", outID, err, outputID)
+				}
+				if got := metric(m2, "get_pinned"); got != "1" {
+					t.Errorf("get_pinned: got %s, want 1", got)
+				}
+
+				// Once the pinned version is replaced, the current object is
+				// read instead.
+				if err := mc.Put(ctx, key, strings.NewReader(content)); err != nil {
+					t.Fatalf("Put output: %v", err)
+				}
+				c3, m3 := newCache(t, b.open, mc)
+				if outID, _, err := c3.Get(ctx, actionID); err != nil || outID != outputID {
+					t.Errorf("Get: got (%q, %v), want hit for %q", outID, err, outputID)
+				}
+				if got := metric(m3, "get_pin_missing"); got != "1" {
+					t.Errorf("get_pin_missing: got %s, want 1", got)
+				}
+			})
+
+			t.Run("StrictWrites", func(t *testing.T) {
+				mc := &memcache.Client{Fault: func(string, string) error { return errFail }}
+				c, m := newCache(t, b.open, mc)
+				switch c := c.(type) {
+				case *GCSCache:
+					c.StrictWrites = 1
+				case *S3Cache:
+					c.StrictWrites = 1
+				}
+				putObj := func(content string) error {
+					_, err := c.Put(ctx, gocache.Object{
+						ActionID: actionID,
+						OutputID: outputID,
+						Size:     int64(len(content)),
+						Body:     strings.NewReader(content),
+					})
+					for c.Pending() != 0 {
+						time.Sleep(time.Millisecond) // wait for the upload
+					}
+					return err
+				}
+
+				// The first failure is not yet reported.
+				if err := putObj(content); err != nil {
+					t.Fatalf("Put: unexpected error: %v", err)
+				}
+				if got := metric(m, "put_fail_streak"); got != "1" {
+					t.Errorf("put_fail_streak: got %s, want 1", got)
+				}
+
+				// Once the limit is reached, Put reports an error.
+				if err := putObj(content); err == nil {
+					t.Error("Put: got nil error, want failure")
+				}
+
+				// A successful upload clears the error.
+				mc.Fault = nil
+				putObj(content)
+				if got := metric(m, "put_fail_streak"); got != "0" {
+					t.Errorf("put_fail_streak: got %s, want 0", got)
+				}
+				if err := putObj(content); err != nil {
+					t.Errorf("Put: unexpected error: %v", err)
+				}
+			})
+
+			t.Run("SyncUploads", func(t *testing.T) {
+				mc := &memcache.Client{Fault: func(string, string) error { return errFail }}
+				c, _ := newCache(t, b.open, mc)
+				switch c := c.(type) {
+				case *GCSCache:
+					c.StrictWrites, c.SyncUploads = 1, true
+				case *S3Cache:
+					c.StrictWrites, c.SyncUploads = 1, true
+				}
+				putObj := func() error {
+					_, err := c.Put(ctx, gocache.Object{
+						ActionID: actionID,
+						OutputID: outputID,
+						Size:     int64(len(content)),
+						Body:     strings.NewReader(content),
+					})
+					if n := c.Pending(); n != 0 {
+						t.Errorf("Pending after Put: got %d, want 0", n)
+					}
+					return err
+				}
+
+				// The failure is reported by the Put that caused it.
+				if err := putObj(); err == nil {
+					t.Error("Put: got nil error, want failure")
+				}
+
+				// Once Put returns, the upload is in storage.
+				mc.Fault = nil
+				if err := putObj(); err != nil {
+					t.Fatalf("Put: unexpected error: %v", err)
+				}
+				if keys := mc.Keys(); len(keys) != 2 {
+					t.Errorf("Keys after Put: got %q, want an action and an output", keys)
+				}
+			})
+
+			t.Run("VerifyUploads", func(t *testing.T) {
+				if b.kind != "gcs" {
+					t.Skip("Upload verification is only supported by GCS")
+				}
+				mc := new(memcache.Client)
+				c, m := newCache(t, b.open, truncClient{mc})
+				c.(*GCSCache).VerifyUploads = true
+				c.(*GCSCache).VerifyMinSize = 1
+				put(t, c)
+
+				// The truncated upload was caught and uploaded again.
+				for name, want := range map[string]string{
+					"put_verify_fail":  "1",
+					"put_verify_retry": "1",
+					"put_gcs_action":   "1",
+				} {
+					if got := metric(m, name); got != want {
+						t.Errorf("%s: got %s, want %s", name, got, want)
+					}
+				}
+				data, err := mc.GetData(ctx, path.Join(prefix, "output", outputID[:2], outputID))
+				if err != nil {
+					t.Fatalf("Read output: %v", err)
+				} else if string(data) != content {
+					t.Errorf("Output: got %q, want %q", data, content)
+				}
+
+				// Outputs below the minimum size are not verified.
+				c2, m2 := newCache(t, b.open, truncClient{new(memcache.Client)})
+				c2.(*GCSCache).VerifyUploads = true
+				put(t, c2)
+				if got := metric(m2, "put_verify_fail"); got != "0" {
+					t.Errorf("put_verify_fail: got %s, want 0", got)
+				}
+			})
+
+			t.Run("MonotonicActions", func(t *testing.T) {
+				if b.kind != "gcs" {
+					t.Skip("Monotonic actions are only supported by GCS")
+				}
+				const otherID = "1f1e2d3c4b5a0f1e2d3c4b5a0f1e2d3c4b5a0f1e2d3c4b5a0f1e2d3c4b5a0f1e"
+				mc := new(memcache.Client)
+				now := time.Now()
+				putAt := func(outputID string, mtime time.Time) *expvar.Map {
+					t.Helper()
+					c, m := newCache(t, b.open, mc)
+					c.(*GCSCache).MonotonicActions = true
+					if _, err := c.Put(ctx, gocache.Object{
+						ActionID: actionID,
+						OutputID: outputID,
+						Size:     int64(len(content)),
+						Body:     strings.NewReader(content),
+						ModTime:  mtime,
+					}); err != nil {
+						t.Fatalf("Put: unexpected error: %v", err)
+					}
+					if err := c.Close(ctx); err != nil {
+						t.Fatalf("Close: unexpected error: %v", err)
+					}
+					return m
+				}
+				stored := func() string {
+					t.Helper()
+					data, err := mc.GetData(ctx, path.Join(prefix, "action", actionID[:2], actionID))
+					if err != nil {
+						t.Fatalf("Read action: %v", err)
+					}
+					id, _, err := parseAction(data)
+					if err != nil {
+						t.Fatalf("Parse action: %v", err)
+					}
+					return id
+				}
+
+				putAt(outputID, now)
+
+				// An older record does not replace a newer one.
+				m := putAt(otherID, now.Add(-time.Hour))
+				if got := stored(); got != outputID {
+					t.Errorf("Stored output: got %q, want %q", got, outputID)
+				}
+				if got := metric(m, "action_cas_conflict"); got != "1" {
+					t.Errorf("action_cas_conflict: got %s, want 1", got)
+				}
+
+				// A newer record does.
+				m = putAt(otherID, now.Add(time.Hour))
+				if got := stored(); got != otherID {
+					t.Errorf("Stored output: got %q, want %q", got, otherID)
+				}
+				if got := metric(m, "action_cas_conflict"); got != "0" {
+					t.Errorf("action_cas_conflict: got %s, want 0", got)
+				}
+			})
+
+			t.Run("SkipSameActions", func(t *testing.T) {
+				if b.kind != "gcs" {
+					t.Skip("Skipping identical actions is only supported by GCS")
+				}
+				const otherID = "1f1e2d3c4b5a0f1e2d3c4b5a0f1e2d3c4b5a0f1e2d3c4b5a0f1e2d3c4b5a0f1e"
+				mc := new(memcache.Client)
+				now := time.Now()
+				putAt := func(outputID string, mtime time.Time) string {
+					t.Helper()
+					c, m := newCache(t, b.open, mc)
+					c.(*GCSCache).SkipSameActions = true
+					if _, err := c.Put(ctx, gocache.Object{
+						ActionID: actionID,
+						OutputID: outputID,
+						Size:     int64(len(content)),
+						Body:     strings.NewReader(content),
+						ModTime:  mtime,
+					}); err != nil {
+						t.Fatalf("Put: unexpected error: %v", err)
+					}
+					if err := c.Close(ctx); err != nil {
+						t.Fatalf("Close: unexpected error: %v", err)
+					}
+					return metric(m, "put_action_skip")
+				}
+				stored := func() (string, time.Time) {
+					t.Helper()
+					data, err := mc.GetData(ctx, path.Join(prefix, "action", actionID[:2], actionID))
+					if err != nil {
+						t.Fatalf("Read action: %v", err)
+					}
+					id, mtime, err := parseAction(data)
+					if err != nil {
+						t.Fatalf("Parse action: %v", err)
+					}
+					return id, mtime
+				}
+
+				if got := putAt(outputID, now); got != "0" {
+					t.Errorf("First put: put_action_skip got %s, want 0", got)
+				}
+				_, first := stored()
+
+				// The same output is not written again.
+				if got := putAt(outputID, now.Add(time.Minute)); got != "1" {
+					t.Errorf("Same output: put_action_skip got %s, want 1", got)
+				}
+				if _, mtime := stored(); !mtime.Equal(first) {
+					t.Errorf("Stored time: got %v, want %v", mtime, first)
+				}
+
+				// A different output is.
+				if got := putAt(otherID, now); got != "0" {
+					t.Errorf("Other output: put_action_skip got %s, want 0", got)
+				}
+				if id, _ := stored(); id != otherID {
+					t.Errorf("Stored output: got %q, want %q", id, otherID)
+				}
+
+				// So is the same output, if the stored record is old enough that
+				// it should be refreshed.
+				putAt(outputID, now.Add(-2*DefaultActionRefresh))
+				if got := putAt(outputID, now); got != "0" {
+					t.Errorf("Stale record: put_action_skip got %s, want 0", got)
+				}
+				if _, mtime := stored(); now.Sub(mtime) > time.Minute {
+					t.Errorf("Stored time: got %v, want about %v", mtime, now)
+				}
+			})
+
+			t.Run("Events", func(t *testing.T) {
+				var buf bytes.Buffer
+				events := eventlog.New(&buf, 0)
+				c, _ := newCache(t, b.open, new(memcache.Client))
+				switch c := c.(type) {
+				case *GCSCache:
+					c.Events = events
+				case *S3Cache:
+					c.Events = events
+				}
+				if _, _, err := c.Get(ctx, actionID); err != nil {
+					t.Fatalf("Get: unexpected error: %v", err)
+				}
+				put(t, c)
+				if _, _, err := c.Get(ctx, actionID); err != nil {
+					t.Fatalf("Get: unexpected error: %v", err)
+				}
+				if err := events.Close(); err != nil {
+					t.Fatalf("Close events: %v", err)
+				}
+
+				type result struct {
+					Op, Result string
+					Bytes      int64
+				}
+				want := []result{{"get", "miss", 0}, {"put", "ok", int64(len(content))}, {"get", "hit", int64(len(content))}}
+				var got []result
+				dec := json.NewDecoder(&buf)
+				for dec.More() {
+					var e eventlog.Event
+					if err := dec.Decode(&e); err != nil {
+						t.Fatalf("Decode event: %v", err)
+					} else if e.Class != eventlog.ClassAction || e.Key != actionID {
+						t.Errorf("Event: got class %q key %q, want %q, %q", e.Class, e.Key, eventlog.ClassAction, actionID)
+					}
+					got = append(got, result{e.Op, e.Result, e.Bytes})
+				}
+				if !slices.Equal(got, want) {
+					t.Errorf("Events: got %+v, want %+v", got, want)
+				}
+			})
+
+			t.Run("Inline", func(t *testing.T) {
+				mc := new(memcache.Client)
+				c, m := newCache(t, b.open, mc)
+				setThreshold := func(c testCache, n int64) {
+					switch c := c.(type) {
+					case *GCSCache:
+						c.InlineThreshold = n
+					case *S3Cache:
+						c.InlineThreshold = n
+					}
+				}
+				setThreshold(c, int64(len(content))+1)
+				put(t, c)
+
+				// The output is stored in the action record, with no object.
+				want := []string{path.Join(prefix, "action", actionID[:2], actionID)}
+				if got := mc.Keys(); !slices.Equal(got, want) {
+					t.Errorf("Storage keys: got %q, want %q", got, want)
+				}
+				if got := metric(m, "put_inline"); got != "1" {
+					t.Errorf("put_inline: got %s, want 1", got)
+				}
+
+				// A cache that does not write inline still reads the record.
+				c2, m2 := newCache(t, b.open, mc)
+				outID, diskPath, err := c2.Get(ctx, actionID)
+				if err != nil {
+					t.Fatalf("Get: unexpected error: %v", err)
+				} else if outID != outputID {
+					t.Errorf("Get: output ID is %q, want %q", outID, outputID)
+				}
+				if data, err := os.ReadFile(diskPath); err != nil {
+					t.Errorf("Read object: %v", err)
+				} else if string(data) != content {
+					t.Errorf("Object: got %q, want %q", data, content)
+				}
+				if got := metric(m2, "get_inline"); got != "1" {
+					t.Errorf("get_inline: got %s, want 1", got)
+				}
+
+				// An output at the threshold is stored separately.
+				mc2 := new(memcache.Client)
+				c3, _ := newCache(t, b.open, mc2)
+				setThreshold(c3, int64(len(content)))
+				put(t, c3)
+				if keys := mc2.Keys(); len(keys) != 2 {
+					t.Errorf("Keys after Put: got %q, want an action and an output", keys)
+				}
+			})
+
+			t.Run("VerifyDownloads", func(t *testing.T) {
+				if b.kind != "gcs" {
+					t.Skip("Download verification is only supported by GCS")
+				}
+				mc := new(memcache.Client)
+				c, _ := newCache(t, b.open, mc)
+				put(t, c)
+
+				// Matching contents are staged as usual.
+				c2, m2 := newCache(t, b.open, mc)
+				c2.(*GCSCache).VerifyDownloads = true
+				if outID, _, err := c2.Get(ctx, actionID); err != nil || outID != outputID {
+					t.Errorf("Get: got (%q, %v), want %q", outID, err, outputID)
+				}
+				if got := metric(m2, "get_crc_mismatch"); got != "0" {
+					t.Errorf("get_crc_mismatch: got %s, want 0", got)
+				}
+
+				// Mismatched contents are a miss.
+				c3, m3 := newCache(t, b.open, badCRCClient{mc})
+				c3.(*GCSCache).VerifyDownloads = true
+				if outID, _, err := c3.Get(ctx, actionID); err != nil || outID != "" {
+					t.Errorf("Get: got (%q, %v), want a miss", outID, err)
+				}
+				if got := metric(m3, "get_crc_mismatch"); got != "1" {
+					t.Errorf("get_crc_mismatch: got %s, want 1", got)
+				}
+			})
+
+			t.Run("RemoteTTL", func(t *testing.T) {
+				mc := new(memcache.Client)
+				c, _ := newCache(t, b.open, mc)
+				if _, err := c.Put(ctx, gocache.Object{
+					ActionID: actionID,
+					OutputID: outputID,
+					Size:     int64(len(content)),
+					Body:     strings.NewReader(content),
+					ModTime:  time.Now().Add(-2 * time.Hour),
+				}); err != nil {
+					t.Fatalf("Put: unexpected error: %v", err)
+				}
+				if err := c.Close(ctx); err != nil {
+					t.Fatalf("Close: unexpected error: %v", err)
+				}
+				setTTL := func(c testCache, ttl time.Duration) {
+					switch c := c.(type) {
+					case *GCSCache:
+						c.RemoteTTL = ttl
+					case *S3Cache:
+						c.RemoteTTL = ttl
+					}
+				}
+
+				// A cache with a shorter TTL ignores the record.
+				c2, m2 := newCache(t, b.open, mc)
+				setTTL(c2, time.Hour)
+				if outID, _, err := c2.Get(ctx, actionID); err != nil || outID != "" {
+					t.Errorf("Get expired: got (%q, %v), want a miss", outID, err)
+				}
+				if got := metric(m2, "get_ttl_expired"); got != "1" {
+					t.Errorf("get_ttl_expired: got %s, want 1", got)
+				}
+
+				// A cache with a longer TTL finds it.
+				c3, m3 := newCache(t, b.open, mc)
+				setTTL(c3, 3*time.Hour)
+				if outID, _, err := c3.Get(ctx, actionID); err != nil || outID != outputID {
+					t.Errorf("Get fresh: got (%q, %v), want %q", outID, err, outputID)
+				}
+				if got := metric(m3, "get_ttl_expired"); got != "0" {
+					t.Errorf("get_ttl_expired: got %s, want 0", got)
+				}
+			})
+
+			t.Run("CompressActions", func(t *testing.T) {
+				mc := new(memcache.Client)
+				c, m := newCache(t, b.open, mc)
+				switch c := c.(type) {
+				case *GCSCache:
+					c.InlineThreshold, c.CompressActions = 1<<20, true
+				case *S3Cache:
+					c.InlineThreshold, c.CompressActions = 1<<20, true
+				}
+				text := strings.Repeat("all work and no play ", 100)
+				putContent(t, c, text)
+
+				// The record, with its output inline, is stored compressed.
+				key := path.Join(prefix, "action", actionID[:2], actionID)
+				if data, err := mc.GetData(ctx, key); err != nil {
+					t.Fatalf("GetData %q: %v", key, err)
+				} else if !bytes.HasPrefix(data, gzipMagic) {
+					t.Errorf("Action record is not compressed: %q", data)
+				} else if len(data) >= len(text) {
+					t.Errorf("Action record is %d bytes, want fewer than %d", len(data), len(text))
+				}
+				if got := metric(m, "put_action_compressed"); got != "1" {
+					t.Errorf("put_action_compressed: got %s, want 1", got)
+				}
+
+				// A cache that does not compress still reads the record.
+				c2, _ := newCache(t, b.open, mc)
+				outID, diskPath, err := c2.Get(ctx, actionID)
+				if err != nil {
+					t.Fatalf("Get: unexpected error: %v", err)
+				} else if outID != outputID {
+					t.Errorf("Get: output ID is %q, want %q", outID, outputID)
+				}
+				if data, err := os.ReadFile(diskPath); err != nil {
+					t.Errorf("Read object: %v", err)
+				} else if string(data) != text {
+					t.Errorf("Object: got %d bytes, want %d", len(data), len(text))
+				}
+			})
+
+			t.Run("Concurrent", func(t *testing.T) {
+				var reads atomic.Int64
+				mc := &memcache.Client{Fault: func(op, key string) error {
+					if strings.HasPrefix(op, "Get") && strings.Contains(key, "/output/") {
+						reads.Add(1)
+					}
+					return nil
+				}}
+				c, _ := newCache(t, b.open, mc)
+				put(t, c)
+
+				// Many requests for the same action on an empty local cache
+				// fault in its output once, and all see the staged copy.
+				c2, m2 := newCache(t, b.open, mc)
+				const n = 32
+				var wg sync.WaitGroup
+				for range n {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						outID, diskPath, err := c2.Get(ctx, actionID)
+						if err != nil || outID != outputID {
+							t.Errorf("Get: got (%q, %v), want hit for %q", outID, err, outputID)
+						} else if data, err := os.ReadFile(diskPath); err != nil || string(data) != content {
+							t.Errorf("Read object: got (%q, %v), want %q", data, err, content)
+						}
+					}()
+				}
+				wg.Wait()
+				if got := reads.Load(); got != 1 {
+					t.Errorf("Output reads: got %d, want 1", got)
+				}
+				if got := metric(m2, "get_fault_hit"); got != "1" {
+					t.Errorf("get_fault_hit: got %s, want 1", got)
+				}
+			})
+
+			t.Run("SlowFault", func(t *testing.T) {
+				otherAction, otherOutput := "b0"+actionID[2:], "c0"+outputID[2:]
+				mc := new(memcache.Client)
+				c, _ := newCache(t, b.open, mc)
+				put(t, c)
+				c, _ = newCache(t, b.open, mc)
+				if _, err := c.Put(ctx, gocache.Object{
+					ActionID: otherAction,
+					OutputID: otherOutput,
+					Size:     int64(len(content)),
+					Body:     strings.NewReader(content),
+					ModTime:  time.Now(),
+				}); err != nil {
+					t.Fatalf("Put: unexpected error: %v", err)
+				} else if err := c.Close(ctx); err != nil {
+					t.Fatalf("Close: unexpected error: %v", err)
+				}
+
+				// Stall the read of the first output until the test is done.
+				started, release := make(chan struct{}), make(chan struct{})
+				var once sync.Once
+				mc.Fault = func(op, key string) error {
+					if strings.HasPrefix(op, "Get") && strings.HasSuffix(key, "/"+outputID) {
+						once.Do(func() { close(started) })
+						<-release
+					}
+					return nil
+				}
+
+				// Put all actions in one staging shard, so that a fault holding
+				// the lock for its action would block the other.
+				c2, _ := newCache(t, b.open, mc)
+				switch c := c2.(type) {
+				case *GCSCache:
+					c.DownloadConcurrency = 2
+					c.stage.Shards = 1
+				case *S3Cache:
+					c.DownloadConcurrency = 2
+					c.stage.Shards = 1
+				}
+				done := make(chan error, 1)
+				go func() {
+					_, _, err := c2.Get(ctx, actionID)
+					done <- err
+				}()
+				<-started
+
+				// While the first fault is stalled, a fault of another action
+				// proceeds.
+				if outID, _, err := c2.Get(ctx, otherAction); err != nil || outID != otherOutput {
+					t.Errorf("Get other: got (%q, %v), want %q", outID, err, otherOutput)
+				}
+				close(release)
+				if err := <-done; err != nil {
+					t.Errorf("Get: unexpected error: %v", err)
+				}
+			})
+
+			t.Run("Admission", func(t *testing.T) {
+				mc := new(memcache.Client)
+				c, m := newCache(t, b.open, mc)
+				switch c := c.(type) {
+				case *GCSCache:
+					c.AdmissionWindow = 100
+				case *S3Cache:
+					c.AdmissionWindow = 100
+				}
+
+				// The first Put of an object keeps it local only.
+				put(t, c)
+				if keys := mc.Keys(); len(keys) != 0 {
+					t.Errorf("Keys after first Put: got %q, want none", keys)
+				}
+				if got := metric(m, "put_admission_skip"); got != "1" {
+					t.Errorf("put_admission_skip: got %s, want 1", got)
+				}
+
+				// The second is written to storage.
+				put(t, c)
+				if keys := mc.Keys(); len(keys) != 2 {
+					t.Errorf("Keys after second Put: got %q, want an action and an output", keys)
+				}
+				if got := metric(m, "put_admission_skip"); got != "1" {
+					t.Errorf("put_admission_skip: got %s, want 1", got)
+				}
+			})
+
+			t.Run("SharedLocal", func(t *testing.T) {
+				c, m := newCache(t, b.open, new(memcache.Client))
+				switch c := c.(type) {
+				case *GCSCache:
+					c.SharedLocal = true
+				case *S3Cache:
+					c.SharedLocal = true
+				}
+				put(t, c)
+				_, diskPath, err := c.Get(ctx, actionID)
+				if err != nil {
+					t.Fatalf("Get: unexpected error: %v", err)
+				}
+				if got := metric(m, "get_local_hit"); got != "1" {
+					t.Errorf("get_local_hit: got %s, want 1", got)
+				}
+
+				// Simulate another host removing the output: the local hit is
+				// not reported, and the output is fetched again from storage.
+				if err := os.Remove(diskPath); err != nil {
+					t.Fatalf("Remove output: %v", err)
+				}
+				outID, diskPath, err := c.Get(ctx, actionID)
+				if err != nil || outID != outputID {
+					t.Fatalf("Get: got (%q, %v), want hit for %q", outID, err, outputID)
+				}
+				if data, err := os.ReadFile(diskPath); err != nil {
+					t.Errorf("Read object: %v", err)
+				} else if string(data) != content {
+					t.Errorf("Object: got %q, want %q", data, content)
+				}
+				if got := metric(m, "get_fault_hit"); got != "1" {
+					t.Errorf("get_fault_hit: got %s, want 1", got)
+				}
+			})
+
+			t.Run("RevalidateOutputs", func(t *testing.T) {
+				if b.kind != "gcs" {
+					t.Skip("Output revalidation is only supported by GCS")
+				}
+				mc := new(memcache.Client)
+				c, _ := newCache(t, b.open, mc)
+				put(t, c)
+
+				// With RemoteFirst, each Get reads from storage. The first
+				// stages the output and records its etag, so the second finds
+				// the local copy current and does not transfer it.
+				c2, m2 := newCache(t, b.open, mc)
+				c2.(*GCSCache).RemoteFirst = true
+				c2.(*GCSCache).ETagDir = t.TempDir()
+				get := func(want string) {
+					t.Helper()
+					outID, diskPath, err := c2.Get(ctx, actionID)
+					if err != nil || outID != outputID {
+						t.Fatalf("Get: got (%q, %v), want %q", outID, err, outputID)
+					}
+					if data, err := os.ReadFile(diskPath); err != nil {
+						t.Errorf("Read object: %v", err)
+					} else if string(data) != want {
+						t.Errorf("Object: got %q, want %q", data, want)
+					}
+				}
+				get(content)
+				if got := metric(m2, "get_notmodified"); got != "0" {
+					t.Errorf("get_notmodified: got %s, want 0", got)
+				}
+				get(content)
+				if got := metric(m2, "get_notmodified"); got != "1" {
+					t.Errorf("get_notmodified: got %s, want 1", got)
+				}
+
+				// Once the object changes, it is transferred again.
+				const changed = "a different output"
+				key := path.Join(prefix, "output", outputID[:2], outputID)
+				if err := mc.Put(ctx, key, strings.NewReader(changed)); err != nil {
+					t.Fatalf("Put %q: %v", key, err)
+				}
+				get(changed)
+				if got := metric(m2, "get_notmodified"); got != "1" {
+					t.Errorf("get_notmodified: got %s, want 1", got)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// errCRCMismatch is reported by a reader from newCRCReader whose contents do
+// not match the expected checksum.
+var errCRCMismatch = errors.New("CRC32C mismatch")
+
+// crcTable is the CRC32C (Castagnoli) table used by GCS checksums.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// newCRCReader returns a reader for the size bytes of rc that computes their
+// CRC32C as they are read. When all of them have been read, or rc reports
+// io.EOF, it reports an error wrapping errCRCMismatch if the checksum is not
+// want. The error is reported with the last bytes, so a reader that consumes
+// the contents, such as the local cache, fails rather than commit corrupted
+// contents. Closing the result closes rc.
+func newCRCReader(rc io.ReadCloser, size int64, want uint32) *crcReader {
+	return &crcReader{rc: rc, h: crc32.New(crcTable), size: size, want: want}
+}
+
+type crcReader struct {
+	rc   io.ReadCloser
+	h    hash.Hash32
+	size int64 // bytes expected
+	nr   int64 // bytes read so far
+	want uint32
+
+	// mismatch is the error reported at the end of the contents, if they did
+	// not match. It is kept so that the caller can recognize the failure
+	// however the consumer of the reader reports it.
+	mismatch error
+}
+
+func (c *crcReader) Read(data []byte) (int, error) {
+	if c.mismatch != nil {
+		return 0, c.mismatch
+	}
+	nr, err := c.rc.Read(data)
+	c.h.Write(data[:nr])
+	c.nr += int64(nr)
+	if err == io.EOF || (nr > 0 && c.nr == c.size) {
+		if got := c.h.Sum32(); got != c.want {
+			c.mismatch = fmt.Errorf("%w: got %08x, want %08x", errCRCMismatch, got, c.want)
+			return nr, c.mismatch
+		}
+	}
+	return nr, err
+}
+
+func (c *crcReader) Close() error { return c.rc.Close() }
@@ -0,0 +1,42 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"errors"
+	"hash/crc32"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCRCReader(t *testing.T) {
+	const text = "the quick brown fox jumps over the lazy dog"
+	crc := crc32.Checksum([]byte(text), crcTable)
+	open := func(want uint32) *crcReader {
+		return newCRCReader(io.NopCloser(strings.NewReader(text)), int64(len(text)), want)
+	}
+
+	// Matching contents read through as usual.
+	if data, err := io.ReadAll(open(crc)); err != nil || string(data) != text {
+		t.Errorf("Read matching: got (%q, %v), want (%q, nil)", data, err, text)
+	}
+
+	// A mismatch is reported as an error.
+	if _, err := io.ReadAll(open(crc + 1)); !errors.Is(err, errCRCMismatch) {
+		t.Errorf("Read mismatched: got error %v, want %v", err, errCRCMismatch)
+	}
+
+	// A reader that stops at the expected size sees the mismatch with the
+	// last bytes, before EOF. CopyN drops the error in that case, so it is
+	// also recorded.
+	r := open(crc + 1)
+	io.CopyN(io.Discard, r, int64(len(text)))
+	if !errors.Is(r.mismatch, errCRCMismatch) {
+		t.Errorf("Mismatch: got %v, want %v", r.mismatch, errCRCMismatch)
+	}
+	if _, err := r.Read(make([]byte, 1)); !errors.Is(err, errCRCMismatch) {
+		t.Errorf("Read after mismatch: got error %v, want %v", err, errCRCMismatch)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/cachedir"
+)
+
+// DirCleaner prunes stale entries from local build cache directories, using
+// [cachedir.Dir.PruneEntries]: an action is stale if it was not written
+// within the expiration period, and an output is removed only once no
+// remaining action refers to it. Other files in the directories, such as the
+// module and reverse proxy caches, are not touched. Scratch directories, such
+// as the directory of partial downloads, are cleaned by age instead.
+//
+// A DirCleaner can prune periodically (see [DirCleaner.Run]) as well as on
+// demand (see [DirCleaner.Sweep]). Concurrent sweeps are serialized, so it is
+// safe to run a final sweep at shutdown while a periodic sweep may still be in
+// progress.
+type DirCleaner struct {
+	// Dirs are the local cache directories to prune, such as the primary
+	// directory and the directory for large objects (see
+	// [GCSCache.LocalLarge]). Nil entries are ignored.
+	Dirs []*cachedir.Dir
+
+	// Scratch, if non-empty, lists the paths of directories of scratch files,
+	// such as partial downloads (see [GCSCache.ResumeDir]). A scratch file is
+	// removed once it has not been modified within the expiration period.
+	Scratch []string
+
+	// Expiration is the age beyond which an action or scratch file is stale.
+	// If zero or negative, sweeps do nothing.
+	Expiration time.Duration
+
+	mu sync.Mutex // serializes sweeps
+
+	cleanupFiles expvar.Int // count of actions, outputs, and scratch files pruned
+	cleanupBytes expvar.Int // total bytes of outputs and scratch files pruned
+}
+
+// Sweep prunes each of the directories once. If another sweep is in progress,
+// Sweep waits for it to finish first.
+func (c *DirCleaner) Sweep(ctx context.Context) error {
+	if c.Expiration <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	start := time.Now()
+	var total cachedir.Stats
+	var errs []error
+	for _, dir := range c.Dirs {
+		if dir == nil {
+			continue
+		}
+		st, err := dir.PruneEntries(ctx, c.Expiration)
+		c.cleanupFiles.Add(int64(st.ActionsPruned + st.ObjectsPruned))
+		c.cleanupBytes.Add(st.BytesPruned)
+		total.Actions += st.Actions
+		total.ActionsPruned += st.ActionsPruned
+		total.Objects += st.Objects
+		total.ObjectsPruned += st.ObjectsPruned
+		total.BytesPruned += st.BytesPruned
+		errs = append(errs, err)
+	}
+	cutoff := start.Add(-c.Expiration)
+	var nfiles, nbytes int64
+	for _, dir := range c.Scratch {
+		n, b, err := sweepScratch(ctx, dir, cutoff)
+		nfiles += n
+		nbytes += b
+		errs = append(errs, err)
+	}
+	c.cleanupFiles.Add(nfiles)
+	c.cleanupBytes.Add(nbytes)
+	gocache.Logf(ctx, "cleanup: pruned %d of %d actions and %d of %d outputs (%d bytes), and %d scratch files (%d bytes), older than %v (%v elapsed)",
+		total.ActionsPruned, total.Actions, total.ObjectsPruned, total.Objects, total.BytesPruned,
+		nfiles, nbytes, c.Expiration, time.Since(start).Round(time.Millisecond))
+	return errors.Join(errs...)
+}
+
+// sweepScratch removes files under dir last modified before cutoff, and
+// reports the number and total size of the files removed.
+func sweepScratch(ctx context.Context, dir string, cutoff time.Time) (nfiles, nbytes int64, _ error) {
+	err := filepath.WalkDir(dir, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil // removed out from under us, OK
+			}
+			return err
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		} else if !de.Type().IsRegular() {
+			return nil
+		}
+		fi, err := de.Info()
+		if err != nil || !fi.ModTime().Before(cutoff) {
+			return nil // gone, or not yet stale
+		}
+		if err := os.Remove(path); err == nil {
+			nfiles++
+			nbytes += fi.Size()
+		}
+		return nil
+	})
+	return nfiles, nbytes, err
+}
+
+// Run sweeps the directories every interval until ctx ends. Errors from
+// individual sweeps are logged but do not stop the loop.
+func (c *DirCleaner) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := c.Sweep(ctx); err != nil && ctx.Err() == nil {
+				gocache.Logf(ctx, "cleanup: %v", err)
+			}
+		}
+	}
+}
+
+// SetMetrics adds the cleaner metrics to m.
+func (c *DirCleaner) SetMetrics(_ context.Context, m *expvar.Map) {
+	m.Set("local_cleanup_files", &c.cleanupFiles)
+	m.Set("local_cleanup_bytes", &c.cleanupBytes)
+}
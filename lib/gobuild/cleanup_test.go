@@ -0,0 +1,86 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"context"
+	"expvar"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/cachedir"
+)
+
+// testID returns a valid action or output ID made by repeating digit.
+func testID(digit string) string { return strings.Repeat(digit, 64) }
+
+func TestDirCleaner(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	dir, err := cachedir.New(root)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	old := time.Now().Add(-time.Hour)
+	put := func(actionID, outputID, data string) {
+		t.Helper()
+		if _, err := dir.Put(ctx, gocache.Object{
+			ActionID: actionID,
+			OutputID: outputID,
+			Size:     int64(len(data)),
+			Body:     strings.NewReader(data),
+			ModTime:  old, // as for an output faulted in from storage
+		}); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	stale, live := testID("1"), testID("2")
+	put(testID("a"), stale, "stale")
+	put(testID("b"), live, "live")
+	if err := os.Chtimes(filepath.Join(root, "action", "aa", testID("a")), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	scratch := t.TempDir()
+	oldPart, newPart := filepath.Join(scratch, "old"), filepath.Join(scratch, "new")
+	for _, path := range []string{oldPart, newPart} {
+		if err := os.WriteFile(path, []byte("partial"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(oldPart, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &DirCleaner{Dirs: []*cachedir.Dir{dir, nil}, Scratch: []string{scratch}, Expiration: time.Minute}
+	m := new(expvar.Map)
+	c.SetMetrics(ctx, m)
+	if err := c.Sweep(ctx); err != nil {
+		t.Fatalf("Sweep: unexpected error: %v", err)
+	}
+
+	// The output of the recent action is old, but still referenced, so it
+	// must be kept.
+	if _, path, err := dir.Get(ctx, testID("b")); err != nil || path == "" {
+		t.Errorf("Get live action: got (%q, %v), want a hit", path, err)
+	}
+	if _, path, err := dir.Get(ctx, testID("a")); err != nil || path != "" {
+		t.Errorf("Get stale action: got (%q, %v), want a miss", path, err)
+	}
+	for path, want := range map[string]bool{oldPart: false, newPart: true} {
+		if _, err := os.Stat(path); (err == nil) != want {
+			t.Errorf("Stat %s: got %v, want exists=%v", path, err, want)
+		}
+	}
+	if got := m.Get("local_cleanup_files").String(); got != "3" {
+		t.Errorf("local_cleanup_files: got %s, want 3", got)
+	}
+	if got := m.Get("local_cleanup_bytes").String(); got != "12" {
+		t.Errorf("local_cleanup_bytes: got %s, want 12", got)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"context"
+	"time"
+
+	"github.com/tailscale/go-cache-plugin/lib/gcsutil"
+	"github.com/tailscale/go-cache-plugin/lib/revproxy"
+	"github.com/tailscale/go-cache-plugin/lib/s3util"
+)
+
+// Client is the storage client used by [GCSCache] and [S3Cache] to read and
+// write entries in the backing store. It is implemented by [*gcsutil.Client]
+// and [*s3util.Client]. Tests can use an in-memory implementation, such as
+// the one in package memcache, in their place.
+type Client interface {
+	revproxy.CacheClient
+
+	// List calls f for each object whose key has the given prefix, in
+	// lexicographic order by key. If f reports an error, List stops and
+	// returns that error.
+	List(ctx context.Context, prefix string, f func(revproxy.ObjectInfo) error) error
+}
+
+var (
+	_ Client = (*gcsutil.Client)(nil)
+	_ Client = (*s3util.Client)(nil)
+
+	_ revproxy.VersionedClient = (*gcsutil.Client)(nil)
+	_ revproxy.VersionedClient = (*s3util.Client)(nil)
+
+	_ revproxy.SwapClient     = (*gcsutil.Client)(nil)
+	_ revproxy.ChecksumClient = (*gcsutil.Client)(nil)
+)
+
+// withTags returns a client like c that attaches tags to each object it
+// writes, if c supports object tags. Otherwise it returns c unchanged.
+func withTags(c Client, tags map[string]string) Client {
+	switch t := c.(type) {
+	case *gcsutil.Client:
+		return t.WithTags(tags)
+	case *s3util.Client:
+		return t.WithTags(tags)
+	}
+	return c
+}
+
+// withRetention returns a client like c that retains each object it writes
+// for d, if d is positive and c supports retention. Otherwise it returns c
+// unchanged.
+func withRetention(c Client, d time.Duration) Client {
+	if d <= 0 {
+		return c
+	}
+	switch t := c.(type) {
+	case *gcsutil.Client:
+		return t.WithRetention(d)
+	case *s3util.Client:
+		return t.WithRetention(d)
+	}
+	return c
+}
@@ -0,0 +1,52 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"bytes"
+	"compress/gzip"
+	"expvar"
+	"fmt"
+	"io"
+)
+
+// gzipMagic begins every gzip stream. A plain action record begins with an
+// output ID or with inlinePrefix, so a compressed record is recognized by its
+// first bytes, and plain and compressed records can be read alike.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// encodeAction returns record as it is to be stored. If compress is true and
+// compressing record with gzip makes it smaller, it returns the compressed
+// record and counts it in gz. Otherwise it returns record unchanged, and
+// counts it in plain.
+func encodeAction(record []byte, compress bool, gz, plain *expvar.Int) []byte {
+	if compress {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write(record)
+		if err := w.Close(); err == nil && buf.Len() < len(record) {
+			gz.Add(1)
+			return buf.Bytes()
+		}
+	}
+	plain.Add(1)
+	return record
+}
+
+// decodeAction returns the plain contents of a stored action record, which
+// may have been compressed by encodeAction.
+func decodeAction(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, gzipMagic) {
+		return data, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("compressed action record: %w", err)
+	}
+	plain, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("compressed action record: %w", err)
+	}
+	return plain, nil
+}
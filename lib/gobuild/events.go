@@ -0,0 +1,34 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"os"
+	"time"
+
+	"github.com/creachadair/gocache"
+	"github.com/tailscale/go-cache-plugin/lib/eventlog"
+)
+
+// recordGet adds an event to l for a Get of actionID that began at start and
+// reported diskPath and err. A hit reports the size of the staged output.
+func recordGet(l *eventlog.Log, actionID, diskPath string, start time.Time, err error) {
+	if l == nil {
+		return
+	}
+	result, size := "miss", int64(0)
+	if diskPath != "" {
+		result = "hit"
+		if fi, err := os.Stat(diskPath); err == nil {
+			size = fi.Size()
+		}
+	}
+	l.Record(eventlog.ClassAction, "get", actionID, result, size, start, err)
+}
+
+// recordPut adds an event to l for a Put of obj that began at start and
+// reported err.
+func recordPut(l *eventlog.Log, obj gocache.Object, start time.Time, err error) {
+	l.Record(eventlog.ClassAction, "put", obj.ActionID, "ok", obj.Size, start, err)
+}
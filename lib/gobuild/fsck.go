@@ -0,0 +1,452 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/creachadair/taskgroup"
+	"github.com/tailscale/go-cache-plugin/lib/revproxy"
+)
+
+// Fsck checks the consistency of a build cache stored in a bucket, using the
+// layout described by [GCSCache] and [S3Cache]. It finds two kinds of
+// problems:
+//
+//   - A dangling action is an action record whose output object is missing,
+//     for example because it was removed by a bucket lifecycle rule. A
+//     dangling action causes a cache read to fail rather than miss.
+//
+//   - An orphan output is an output object that no action record refers to.
+//     An orphan output cannot be read by the cache, and only wastes space.
+//
+// An action record holding its output inline (see [GCSCache.InlineThreshold])
+// needs no output object, so it is never dangling, and does not count as a
+// reference to an output object with the same ID.
+//
+// Records in batch objects (see [GCSCache.ActionBatch]) are checked and count
+// as references to their outputs, but dangling batch records are only
+// reported, not repaired.
+//
+// If an action record cannot be read, the output it refers to is unknown, so
+// orphan outputs are reported but not deleted in that run. Dangling actions
+// are still repaired.
+//
+// Protection takes precedence over repair: an object matching Protect, or
+// tagged with [PinTag], is never deleted, even if it is a problem. Such
+// objects are still reported, and counted as protected. An object whose tags
+// cannot be read is also counted as protected, since it may be pinned. An
+// object the bucket refuses to delete because of a retention period or hold
+// (see [revproxy.ErrRetained]) is counted as retained rather than as an error.
+type Fsck struct {
+	// Client is the storage client for the bucket to check. It must be non-nil.
+	Client revproxy.ListClient
+
+	// KeyPrefix is the key prefix of the cache in the bucket, if any.
+	KeyPrefix string
+
+	// MinAge, if positive, is the minimum age of an object to be considered a
+	// problem. Younger objects are skipped, to avoid racing with a cache that
+	// is writing an output and its action concurrently.
+	MinAge time.Duration
+
+	// Repair, if true, deletes dangling actions and orphan outputs.
+	Repair bool
+
+	// DryRun, if true, makes Repair log the objects it would delete without
+	// deleting them.
+	DryRun bool
+
+	// Protect, if non-empty, are key prefixes of objects that Repair must not
+	// delete. The prefixes are matched against the full key in the bucket,
+	// including KeyPrefix.
+	Protect []string
+
+	// LocalDirs, if non-empty, are local cache directories to check along
+	// with the bucket, such as the --cache-dir of a server. Each must have the
+	// layout of a [cachedir.Dir]: a local action whose output file is missing
+	// is dangling, and a local output no local action refers to is an orphan.
+	// MinAge, Repair, and DryRun apply to them as to the bucket, but Protect
+	// and pins do not.
+	//
+	// A server faulting in an output from the bucket writes the output before
+	// its action, and gives it the modification time of the remote entry, so
+	// an output may briefly look like an old orphan. Repair local directories
+	// only while no server is using them.
+	LocalDirs []string
+
+	// Concurrency, if positive, is the maximum number of concurrent reads
+	// and deletions. If zero or negative, it uses runtime.NumCPU.
+	Concurrency int
+
+	// Logf, if non-nil, is used to report each problem found, and the repairs
+	// made. If nil, these reports are discarded.
+	Logf func(string, ...any)
+}
+
+// FsckStats is a summary of the results from [Fsck.Run].
+type FsckStats struct {
+	Actions       int   // action records found (including batches)
+	Outputs       int   // output objects found
+	OutputBytes   int64 // total size of output objects
+	Invalid       int   // action records that could not be parsed
+	ReadErrors    int   // action records that could not be read
+	Inline        int   // action records holding their output inline
+	Dangling      int   // action records whose output is missing
+	DanglingBatch int   // dangling action records in batch objects
+	Orphans       int   // output objects with no action
+	OrphanBytes   int64 // total size of orphan outputs
+	Skipped       int   // objects skipped because they are younger than MinAge
+	Protected     int   // objects not deleted because they are protected or pinned
+	PinErrors     int   // protected objects whose pin tag could not be read
+	Retained      int   // objects not deleted because the bucket retains them
+	Deleted       int   // objects deleted by repair
+	DeleteErrors  int   // objects that could not be deleted
+
+	LocalActions     int   // action files found in LocalDirs
+	LocalOutputs     int   // output files found in LocalDirs
+	LocalDangling    int   // local action files whose output is missing
+	LocalOrphans     int   // local output files with no action
+	LocalOrphanBytes int64 // total size of local orphan outputs
+}
+
+// Run checks the bucket and, if f.Repair is true, deletes the problems found.
+// It reports an error only if the bucket could not be read; problems with
+// individual objects are logged and counted in the stats.
+func (f *Fsck) Run(ctx context.Context) (FsckStats, error) {
+	var stats FsckStats
+
+	// Enumerate the outputs. The ID of an object is the last element of its
+	// key, regardless of the partition depth used to write it.
+	type object struct {
+		key  string
+		size int64
+		old  bool
+	}
+	now := time.Now()
+	isOld := func(t time.Time) bool { return f.MinAge <= 0 || now.Sub(t) >= f.MinAge }
+
+	outputs := make(map[string][]object)
+	if err := f.Client.List(ctx, path.Join(f.KeyPrefix, "output")+"/", func(oi revproxy.ObjectInfo) error {
+		id := path.Base(oi.Key)
+		outputs[id] = append(outputs[id], object{key: oi.Key, size: oi.Size, old: isOld(oi.ModTime)})
+		stats.Outputs++
+		stats.OutputBytes += oi.Size
+		return nil
+	}); err != nil {
+		return stats, fmt.Errorf("list outputs: %w", err)
+	}
+
+	// Enumerate the actions, and read each to find the output it refers to.
+	var actions []revproxy.ObjectInfo
+	if err := f.Client.List(ctx, path.Join(f.KeyPrefix, "action")+"/", func(oi revproxy.ObjectInfo) error {
+		actions = append(actions, oi)
+		return nil
+	}); err != nil {
+		return stats, fmt.Errorf("list actions: %w", err)
+	}
+	stats.Actions = len(actions)
+
+	var mu sync.Mutex
+	used := make(map[string]bool) // output IDs referenced by some action
+	var dangling []string         // keys of dangling actions to delete
+
+	g, start := taskgroup.New(nil).Limit(concurrency(f.Concurrency))
+	for _, oi := range actions {
+		start(func() error {
+			data, err := f.Client.GetData(ctx, oi.Key)
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil // removed since it was listed
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				stats.ReadErrors++
+				f.logf("read action %s: %v (skipped)", oi.Key, err)
+				return nil
+			}
+			outputID, _, _, _, inline, err := parseAnyAction(data)
+			if err != nil {
+				stats.Invalid++
+				f.logf("invalid action %s: %v", oi.Key, err)
+			} else if inline {
+				stats.Inline++
+				return nil
+			} else if _, ok := outputs[outputID]; ok {
+				used[outputID] = true
+				return nil
+			} else {
+				stats.Dangling++
+				f.logf("dangling action %s: output %s not found", oi.Key, outputID)
+			}
+			if isOld(oi.ModTime) {
+				dangling = append(dangling, oi.Key)
+			} else {
+				stats.Skipped++
+			}
+			return nil
+		})
+	}
+	g.Wait()
+
+	// Check the records in batch objects.
+	if err := f.Client.List(ctx, path.Join(f.KeyPrefix, "action-batch")+"/", func(oi revproxy.ObjectInfo) error {
+		data, err := f.Client.GetData(ctx, oi.Key)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("read batch %s: %w", oi.Key, err)
+		}
+		for actionID, rec := range parseActionBatch(data) {
+			stats.Actions++
+			outputID, _, err := parseAction([]byte(rec))
+			if err != nil {
+				stats.Invalid++
+				f.logf("invalid action %s in batch %s: %v", actionID, oi.Key, err)
+			} else if _, ok := outputs[outputID]; ok {
+				used[outputID] = true
+			} else {
+				stats.DanglingBatch++
+				f.logf("dangling action %s in batch %s: output %s not found", actionID, oi.Key, outputID)
+			}
+		}
+		return nil
+	}); err != nil {
+		return stats, fmt.Errorf("list action batches: %w", err)
+	}
+
+	// Any output not used by some action is an orphan.
+	var orphans []string
+	for id, objs := range outputs {
+		if used[id] {
+			continue
+		}
+		for _, obj := range objs {
+			stats.Orphans++
+			stats.OrphanBytes += obj.size
+			f.logf("orphan output %s (%d bytes)", obj.key, obj.size)
+			if obj.old {
+				orphans = append(orphans, obj.key)
+			} else {
+				stats.Skipped++
+			}
+		}
+	}
+
+	if err := f.checkLocal(ctx, &stats, isOld); err != nil {
+		return stats, err
+	}
+	if !f.Repair {
+		return stats, nil
+	}
+	if stats.ReadErrors != 0 {
+		// An unread action may refer to any of the orphans, so deleting them
+		// could lose a live output.
+		f.logf("not deleting %d orphan outputs: %d actions could not be read", len(orphans), stats.ReadErrors)
+		orphans = nil
+	}
+
+	// Delete dangling actions before orphan outputs. The order does not matter
+	// for correctness, but a dangling action is the more harmful problem.
+	for _, key := range append(dangling, orphans...) {
+		if f.isProtected(key) {
+			stats.Protected++
+			f.logf("not deleting %s: protected", key)
+			continue
+		}
+		start(func() error {
+			tags, err := f.Client.ObjectTags(ctx, key)
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil // removed since it was listed
+			} else if err != nil || tags[PinTag] == "true" {
+				mu.Lock()
+				defer mu.Unlock()
+				stats.Protected++
+				if err != nil {
+					// Without the tags we cannot tell whether the object is
+					// pinned, so leave it alone.
+					stats.PinErrors++
+					f.logf("not deleting %s: read tags: %v", key, err)
+				} else {
+					f.logf("not deleting %s: pinned", key)
+				}
+				return nil
+			}
+			if f.DryRun {
+				f.logf("would delete %s", key)
+				return nil
+			}
+			err = f.Client.Delete(ctx, key)
+			mu.Lock()
+			defer mu.Unlock()
+			if errors.Is(err, revproxy.ErrRetained) {
+				stats.Retained++
+				f.logf("not deleting %s: retained by the bucket", key)
+			} else if err != nil {
+				stats.DeleteErrors++
+				f.logf("delete %s: %v", key, err)
+			} else {
+				stats.Deleted++
+				f.logf("deleted %s", key)
+			}
+			return nil
+		})
+	}
+	g.Wait()
+	return stats, nil
+}
+
+// checkLocal checks the local cache directories of f, updating stats, and if
+// f.Repair is true, deletes the problems found. It reports an error only if
+// a directory could not be read.
+func (f *Fsck) checkLocal(ctx context.Context, stats *FsckStats, isOld func(time.Time) bool) error {
+	for _, dir := range f.LocalDirs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// List the outputs before the actions, so that an output and action
+		// written during the check look dangling rather than orphaned: that
+		// is the harmless mistake, since the action is then only a miss.
+		type file struct {
+			path string
+			size int64
+			old  bool
+		}
+		outputs := make(map[string]file)
+		if err := walkLocal(filepath.Join(dir, "output"), func(path string, fi fs.FileInfo) error {
+			outputs[filepath.Base(path)] = file{path: path, size: fi.Size(), old: isOld(fi.ModTime())}
+			stats.LocalOutputs++
+			return nil
+		}); err != nil {
+			return fmt.Errorf("list local outputs: %w", err)
+		}
+
+		used := make(map[string]bool)
+		var unread int
+		var remove []string
+		if err := walkLocal(filepath.Join(dir, "action"), func(path string, fi fs.FileInfo) error {
+			stats.LocalActions++
+			data, err := os.ReadFile(path)
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil // removed since it was listed
+			} else if err != nil {
+				unread++
+				f.logf("read local action %s: %v (skipped)", path, err)
+				return nil
+			}
+			outputID, _, _ := strings.Cut(strings.TrimSpace(string(data)), " ")
+			if _, ok := outputs[outputID]; ok {
+				used[outputID] = true
+				return nil
+			}
+			stats.LocalDangling++
+			f.logf("dangling local action %s: output %s not found", path, outputID)
+			if isOld(fi.ModTime()) {
+				remove = append(remove, path)
+			} else {
+				stats.Skipped++
+			}
+			return nil
+		}); err != nil {
+			return fmt.Errorf("list local actions: %w", err)
+		}
+
+		var orphans []string
+		for id, out := range outputs {
+			if used[id] {
+				continue
+			}
+			stats.LocalOrphans++
+			stats.LocalOrphanBytes += out.size
+			f.logf("orphan local output %s (%d bytes)", out.path, out.size)
+			if out.old {
+				orphans = append(orphans, out.path)
+			} else {
+				stats.Skipped++
+			}
+		}
+		if !f.Repair {
+			continue
+		}
+		if unread != 0 {
+			f.logf("not deleting %d orphan outputs in %s: %d actions could not be read", len(orphans), dir, unread)
+			orphans = nil
+		}
+		for _, path := range append(remove, orphans...) {
+			if f.DryRun {
+				f.logf("would delete %s", path)
+			} else if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				stats.DeleteErrors++
+				f.logf("delete %s: %v", path, err)
+			} else {
+				stats.Deleted++
+				f.logf("deleted %s", path)
+			}
+		}
+	}
+	return nil
+}
+
+// walkLocal calls f for each regular file under root. It is not an error if
+// root, or a directory under it, does not exist or is removed during the walk.
+func walkLocal(root string, f func(string, fs.FileInfo) error) error {
+	return filepath.WalkDir(root, func(path string, de fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // nothing there to report
+		} else if err != nil {
+			return err
+		} else if !de.Type().IsRegular() {
+			return nil
+		}
+		fi, err := de.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // removed since it was listed
+		} else if err != nil {
+			return err
+		}
+		return f(path, fi)
+	})
+}
+
+// PinEntry sets the [PinTag] of the stored build cache entry of the given
+// kind ("action" or "output") and ID to "true" if pinned is true, or "false"
+// otherwise, and returns the key of the object tagged. The keys are those
+// reported by [StorageKeys] for prefix and depth; the first one found is
+// tagged. If the entry is not found, the error satisfies [fs.ErrNotExist].
+func PinEntry(ctx context.Context, client revproxy.ListClient, prefix, kind, id string, depth int, pinned bool) (string, error) {
+	keys, err := StorageKeys(prefix, kind, id, depth)
+	if err != nil {
+		return "", err
+	}
+	return getFirst(keys, func(key string) (string, error) {
+		return key, client.SetObjectTag(ctx, key, PinTag, strconv.FormatBool(pinned))
+	})
+}
+
+// isProtected reports whether key matches one of the prefixes in f.Protect.
+func (f *Fsck) isProtected(key string) bool {
+	for _, pfx := range f.Protect {
+		if strings.HasPrefix(key, pfx) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Fsck) logf(msg string, args ...any) {
+	if f.Logf != nil {
+		f.Logf(msg, args...)
+	}
+}
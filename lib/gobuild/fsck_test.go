@@ -0,0 +1,180 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tailscale/go-cache-plugin/lib/memcache"
+)
+
+func fsckKey(kind, id string) string { return path.Join("pfx", kind, id[:2], id) }
+
+func TestFsckPinned(t *testing.T) {
+	ctx := context.Background()
+	mc := new(memcache.Client)
+	put := func(key, data string) {
+		t.Helper()
+		if err := mc.Put(ctx, key, strings.NewReader(data)); err != nil {
+			t.Fatalf("Put %q: %v", key, err)
+		}
+	}
+	used, pinned, unreadable, orphan := testID("1"), testID("2"), testID("3"), testID("4")
+	put(fsckKey("action", testID("a")), formatAction(used, time.Now(), ""))
+	for _, id := range []string{used, pinned, unreadable, orphan} {
+		put(fsckKey("output", id), "output "+id)
+	}
+	if key, err := PinEntry(ctx, mc, "pfx", "output", pinned, 0, true); err != nil {
+		t.Fatalf("PinEntry: unexpected error: %v", err)
+	} else if want := fsckKey("output", pinned); key != want {
+		t.Errorf("PinEntry: got key %q, want %q", key, want)
+	}
+	mc.Fault = func(op, key string) error {
+		if op == "ObjectTags" && key == fsckKey("output", unreadable) {
+			return errors.New("tags are unavailable")
+		}
+		return nil
+	}
+
+	f := &Fsck{Client: mc, KeyPrefix: "pfx", Repair: true, Logf: t.Logf}
+	st, err := f.Run(ctx)
+	if err != nil {
+		t.Fatalf("Run: unexpected error: %v", err)
+	}
+	if st.Orphans != 3 || st.Deleted != 1 || st.Protected != 2 || st.PinErrors != 1 {
+		t.Errorf("Run: got %+v, want 3 orphans, 1 deleted, 2 protected, 1 pin error", st)
+	}
+	keys := mc.Keys()
+	for _, id := range []string{used, pinned, unreadable} {
+		if !slices.Contains(keys, fsckKey("output", id)) {
+			t.Errorf("Output %s was deleted, want it kept", id[:4])
+		}
+	}
+	if slices.Contains(keys, fsckKey("output", orphan)) {
+		t.Errorf("Output %s was kept, want it deleted", orphan[:4])
+	}
+}
+
+func TestPinEntry(t *testing.T) {
+	ctx := context.Background()
+	mc := new(memcache.Client)
+	id := testID("5")
+
+	// An entry written at the default depth is found at a deeper depth.
+	key := fsckKey("output", id)
+	if err := mc.Put(ctx, key, strings.NewReader("data")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	for _, pinned := range []bool{true, false} {
+		got, err := PinEntry(ctx, mc, "pfx", "output", id, 4, pinned)
+		if err != nil {
+			t.Fatalf("PinEntry %v: unexpected error: %v", pinned, err)
+		} else if got != key {
+			t.Errorf("PinEntry %v: got key %q, want %q", pinned, got, key)
+		}
+		tags, err := mc.ObjectTags(ctx, key)
+		if err != nil {
+			t.Fatalf("ObjectTags: %v", err)
+		}
+		if want := map[bool]string{true: "true", false: "false"}[pinned]; tags[PinTag] != want {
+			t.Errorf("PinEntry %v: got tag %q, want %q", pinned, tags[PinTag], want)
+		}
+	}
+
+	if _, err := PinEntry(ctx, mc, "pfx", "action", id, 0, true); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("PinEntry missing: got %v, want %v", err, fs.ErrNotExist)
+	}
+	if _, err := PinEntry(ctx, mc, "pfx", "output", "bogus", 0, true); err == nil {
+		t.Error("PinEntry invalid ID: got nil error, want error")
+	}
+}
+
+func TestFsckReadError(t *testing.T) {
+	ctx := context.Background()
+	mc := new(memcache.Client)
+	live, orphan := testID("1"), testID("2")
+	mc.Put(ctx, fsckKey("action", testID("a")), strings.NewReader(formatAction(live, time.Now(), "")))
+	mc.Put(ctx, fsckKey("action", testID("b")), strings.NewReader(formatAction(testID("9"), time.Now(), "")))
+	mc.Put(ctx, fsckKey("output", live), strings.NewReader("live"))
+	mc.Put(ctx, fsckKey("output", orphan), strings.NewReader("orphan"))
+
+	// The action referring to the live output cannot be read, so the live
+	// output looks like an orphan. It must not be deleted.
+	mc.Fault = func(op, key string) error {
+		if op == "GetData" && key == fsckKey("action", testID("a")) {
+			return errors.New("transient failure")
+		}
+		return nil
+	}
+	f := &Fsck{Client: mc, KeyPrefix: "pfx", Repair: true, Logf: t.Logf}
+	st, err := f.Run(ctx)
+	if err != nil {
+		t.Fatalf("Run: unexpected error: %v", err)
+	}
+	if st.ReadErrors != 1 || st.Orphans != 2 || st.Dangling != 1 || st.Deleted != 1 {
+		t.Errorf("Run: got %+v, want 1 read error, 2 orphans, 1 dangling, 1 deleted", st)
+	}
+	keys := mc.Keys()
+	for _, id := range []string{live, orphan} {
+		if !slices.Contains(keys, fsckKey("output", id)) {
+			t.Errorf("Output %s was deleted, want it kept", id[:4])
+		}
+	}
+	if slices.Contains(keys, fsckKey("action", testID("b"))) {
+		t.Error("Dangling action was kept, want it deleted")
+	}
+}
+
+func TestFsckLocal(t *testing.T) {
+	dir := t.TempDir()
+	write := func(kind, id, data string) string {
+		t.Helper()
+		path := filepath.Join(dir, kind, id[:2], id)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	live, orphan := testID("1"), testID("2")
+	write("action", testID("a"), live+" 4\n")
+	dangling := write("action", testID("b"), testID("9")+" 4\n")
+	liveOut := write("output", live, "live")
+	orphanOut := write("output", orphan, "orphan")
+
+	f := &Fsck{Client: new(memcache.Client), LocalDirs: []string{dir}, Logf: t.Logf}
+	st, err := f.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run: unexpected error: %v", err)
+	}
+	if st.LocalActions != 2 || st.LocalOutputs != 2 || st.LocalDangling != 1 || st.LocalOrphans != 1 || st.LocalOrphanBytes != 6 {
+		t.Errorf("Check: got %+v, want 2 actions, 2 outputs, 1 dangling, 1 orphan of 6 bytes", st)
+	}
+	if st.Deleted != 0 {
+		t.Errorf("Check: deleted %d, want 0 without repair", st.Deleted)
+	}
+
+	f.Repair = true
+	if st, err := f.Run(context.Background()); err != nil {
+		t.Fatalf("Repair: unexpected error: %v", err)
+	} else if st.Deleted != 2 {
+		t.Errorf("Repair: deleted %d, want 2", st.Deleted)
+	}
+	for path, want := range map[string]bool{liveOut: true, orphanOut: false, dangling: false} {
+		if _, err := os.Stat(path); (err == nil) != want {
+			t.Errorf("Stat %s: got %v, want exists=%v", path, err, want)
+		}
+	}
+}
@@ -4,24 +4,31 @@
 package gobuild
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"expvar"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path"
-	"runtime"
+	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/creachadair/atomicfile"
 	"github.com/creachadair/gocache"
 	"github.com/creachadair/gocache/cachedir"
 	"github.com/creachadair/taskgroup"
+	"github.com/tailscale/go-cache-plugin/lib/eventlog"
 	"github.com/tailscale/go-cache-plugin/lib/gcsutil"
+	"github.com/tailscale/go-cache-plugin/lib/keylock"
 	"github.com/tailscale/go-cache-plugin/lib/revproxy"
 	"github.com/tailscale/go-cache-plugin/lib/s3util"
+	"golang.org/x/sync/semaphore"
 )
 
 // GCSCache implements callbacks for a gocache.Server using a GCS bucket for
@@ -40,13 +47,50 @@ import (
 //
 // The object and action IDs are encoded as lower-case hexadecimal strings,
 // with "<xx>" denoting the first two bytes of the ID to partition the space.
+// The length of the partition can be changed by setting PartitionDepth.
 //
 // The contents of each action file have the format:
 //
-//	<output-id> <timestamp>
+//	<output-id> <timestamp> [<version>]
 //
 // where the object ID is hex encoded and the timestamp is Unix nanoseconds.
+// The version, the generation of the output object, is present only if
+// PinVersions is set.
 // The object file contains just the binary data of the object.
+//
+// If InlineThreshold is set, an action whose output is smaller than the
+// threshold is stored in a single action file, with no output file:
+//
+//	inline <output-id> <timestamp> <size>
+//	<contents>
+//
+// where the first line is terminated by a newline, and the size is the length
+// in bytes of the contents that follow it. Reads handle either format.
+// Each file is tagged with its kind (see KindTag), in addition to any tags
+// set on the storage client.
+//
+// If CompressActions is set, action files are compressed with gzip, unless
+// that would not make them smaller. Output files are not compressed. Reads
+// recognize a compressed action file by its gzip header, so they handle
+// either form, whether or not CompressActions is set.
+//
+// If ActionBatch is set, action records are instead buffered and written in
+// batches, with one object per partition, using the same partition depth:
+//
+//	[<prefix>/]action-batch/<xx>
+//
+// Each line of a batch object has the format:
+//
+//	<action-id> <output-id> <timestamp>
+//
+// Batch objects are updated with a read-modify-write conditioned on the
+// generation read, so concurrent writers do not lose each other's records,
+// and hold at most ActionBatchLimit records, dropping the oldest.
+//
+// Reads consult the batch object for the partition first, and then fall back
+// to the per-action layout, so a batching cache can read actions written by
+// a cache that does not batch. The converse is not true: a cache that does not
+// batch will not see actions written in batches.
 type GCSCache struct {
 	// Local is the local cache directory where actions and objects are staged.
 	// It must be non-nil. A local stage is required because the Go toolchain
@@ -54,156 +98,750 @@ type GCSCache struct {
 	// It is safe to use a tmpfs directory.
 	Local *cachedir.Dir
 
-	// GCSClient is the GCS client used to read and write cache entries to the
-	// backing store. It must be non-nil.
-	GCSClient *gcsutil.Client
+	// LocalLarge, if non-nil, is a second local directory where objects larger
+	// than LargeThreshold bytes are staged instead of Local. This allows Local
+	// to be a small, fast directory (such as a tmpfs) without the risk of
+	// filling it with large objects. Lookups check Local first, then
+	// LocalLarge.
+	LocalLarge *cachedir.Dir
+
+	// LargeThreshold is the size in bytes above which objects are staged in
+	// LocalLarge. It is ignored if LocalLarge is nil.
+	LargeThreshold int64
+
+	// GCSClient is the client used to read and write cache entries to the
+	// backing store. It must be non-nil. It is normally a [*gcsutil.Client];
+	// other implementations do not support object tags or copying to Mirror.
+	GCSClient Client
 
 	// KeyPrefix, if non-empty, is prepended to each key stored into GCS, with an
 	// intervening slash.
 	KeyPrefix string
 
+	// PartitionDepth, if positive, is the number of leading hex digits of each
+	// action and output ID used to partition keys. If zero or negative, it
+	// uses DefaultPartitionDepth. When reading, entries stored at the default
+	// depth are also found, to allow migrating an existing bucket.
+	PartitionDepth int
+
 	// MinUploadSize, if positive, defines a minimum object size in bytes below
 	// which the cache will not write the object to GCS.
 	MinUploadSize int64
 
+	// MaxUploadSize, if positive, defines a maximum object size in bytes above
+	// which the cache will not write the object to GCS. Such objects are still
+	// staged locally, so the build can proceed.
+	MaxUploadSize int64
+
+	// StrictWrites, if positive, is the number of consecutive background
+	// writes to GCS that may fail before Put reports an error to the
+	// toolchain, so that a broken bucket fails the build rather than going
+	// unnoticed. Put still stores each object locally and tries to upload it,
+	// and reports success again once an upload succeeds. If zero or negative,
+	// failed uploads are logged but otherwise ignored.
+	StrictWrites int
+
+	// SyncUploads, if true, makes Put wait for its write to GCS to finish
+	// before it returns, rather than leaving the write in the background.
+	// Writes still wait for a slot among UploadConcurrency. This slows Put,
+	// but leaves nothing to lose on an abrupt exit, and lets StrictWrites
+	// report a failed write from the Put that made it.
+	SyncUploads bool
+
+	// InlineThreshold, if positive, is the size in bytes below which an output
+	// is written inside its action record rather than as a separate object,
+	// so that reading or writing the action takes one request instead of two.
+	// Larger outputs are stored as separate objects. It is ignored if
+	// ActionBatch is set.
+	InlineThreshold int64
+
+	// CompressActions, if true, compresses action records with gzip before
+	// they are written to GCS, if that makes them smaller. Outputs, which are
+	// often compressed already, are written as they are. Compressed records
+	// are read whether or not this is set. Batched records (see ActionBatch)
+	// are not compressed.
+	CompressActions bool
+
+	// MonotonicActions, if true, makes Put replace an existing action record
+	// in GCS only if the new record has a later timestamp, so that when
+	// concurrent writers of a nondeterministic action race, the record never
+	// goes back to an older output. The record is replaced with a precondition
+	// on the generation that was read, so a concurrent update is not lost.
+	// It has no effect unless GCSClient implements [revproxy.SwapClient], and
+	// is ignored if ActionBatch is set.
+	MonotonicActions bool
+
+	// SkipSameActions, if true, makes Put read the existing action record
+	// in GCS before writing one, and skip the write if the record refers to
+	// the same output, as it does when a deterministic build reproduces an
+	// action. Reads cost less than writes, and are not limited to one per
+	// second per object. A record older than DefaultActionRefresh, or half of
+	// RemoteTTL if that is sooner, is rewritten anyway, so that its age does
+	// not make it expire or be removed by age-based cleanup while it is still
+	// in use. It is ignored if ActionBatch is set.
+	SkipSameActions bool
+
+	// VerifyUploads, if true, makes Put read back the metadata of each output
+	// object it uploads to GCS, to confirm that the stored object has the
+	// size of the local copy. If not, Put uploads the object once more, and
+	// if that also fails verification, does not write the action. This costs
+	// a request per upload, and has no effect unless GCSClient implements
+	// [revproxy.StatClient].
+	VerifyUploads bool
+
+	// VerifyMinSize, if positive, is the size in bytes below which uploads
+	// are not verified, to limit the cost of VerifyUploads. If zero or
+	// negative, it uses DefaultVerifyMinSize.
+	VerifyMinSize int64
+
+	// VerifyDownloads, if true, makes Get check each output it reads from GCS
+	// against the CRC32C that GCS recorded when the object was written, and
+	// stage it in Local only if they match. A mismatch, meaning the contents
+	// were corrupted in transit, is reported as a miss. This costs no extra
+	// requests, and has no effect unless GCSClient implements
+	// [revproxy.ChecksumClient]. Outputs read with ResumeDir or at a pinned
+	// version (see PinVersions) are not checked.
+	VerifyDownloads bool
+
+	// GetTimeout, if positive, bounds the time Get spends reading an entry
+	// from GCS, including staging it locally. A read that takes longer is
+	// abandoned and reported as a miss, so that the toolchain rebuilds the
+	// action rather than waiting indefinitely for a stuck read. If zero or
+	// negative, reads are bounded only by the context of the request.
+	GetTimeout time.Duration
+
+	// MaxClockSkew, if positive, is the maximum difference from the current
+	// time allowed for the timestamp of an action. When writing, a timestamp
+	// further in the past or future is replaced by the current time; when
+	// reading, so is a timestamp further in the future. This keeps a host with
+	// a bad clock from confusing age-based cleanup on other hosts.
+	MaxClockSkew time.Duration
+
+	// Retention, if positive, is how long each output object written to GCS
+	// is retained by the bucket, which refuses to delete or replace it until
+	// then (see the Retention field of the storage client). Action records,
+	// and outputs stored inline in them, are not retained, since the cache
+	// replaces them as it runs. If zero or negative, objects are not retained.
+	Retention time.Duration
+
+	// RemoteTTL, if positive, is how long an action record in GCS stays
+	// fresh. Get treats a record whose timestamp is older than this as a miss,
+	// even though it is present, so the toolchain rebuilds the action and its
+	// Put replaces the record. Records are also tagged with their expiry time
+	// (see ExpiresTag). A local copy is not affected; see Local for how local
+	// files are cleaned up. If zero or negative, records do not expire.
+	RemoteTTL time.Duration
+
+	// Logf, if non-nil, is used to write warnings about conditions an operator
+	// may want to investigate. If nil, these warnings are discarded.
+	Logf func(string, ...any)
+
+	// LogMissSample, if positive, enables a sampled log of cache misses: every
+	// LogMissSample-th miss is logged to Logf, with its action ID, the output
+	// ID if known, and whether it missed only locally (local-miss) or also in
+	// GCS (fault-miss). If zero or negative, misses are not logged.
+	LogMissSample int
+
 	// UploadConcurrency, if positive, defines the maximum number of concurrent
 	// tasks for writing cache entries to GCS.  If zero or negative, it uses
 	// runtime.NumCPU.
 	UploadConcurrency int
 
+	// ETagDir, if non-empty, is a directory where the etag of each output
+	// staged from GCS is recorded, with the path of its local copy. When the
+	// output is faulted in again while the copy is still present, as with
+	// RemoteFirst, or after the action that staged it was pruned, Get reads
+	// it conditionally, and if the object has not changed stages the action
+	// without transferring the object again. It has no effect unless
+	// GCSClient implements [revproxy.ConditionalClient], and does not apply
+	// to outputs read with ResumeDir or VerifyDownloads, or at a pinned
+	// version. The directory must exist.
+	ETagDir string
+
+	// DownloadConcurrency, if positive, defines the maximum number of
+	// concurrent reads from GCS to fault in cache entries. If zero or negative,
+	// it uses runtime.NumCPU. Reads beyond the limit wait for a slot.
+	DownloadConcurrency int
+
+	// ResumeDir, if non-empty, is a directory where objects read from GCS are
+	// staged before they are added to Local. If a read is interrupted, the
+	// partial object is kept there, and a later read of the same object
+	// resumes where it stopped. The directory must exist.
+	ResumeDir string
+
+	// SharedLocal, if true, means that Local and LocalLarge are shared with
+	// processes on other hosts, as on a network filesystem such as NFS, whose
+	// weaker consistency may let this host see a file that another host has
+	// removed, or not yet see all of its contents. Get then checks each local
+	// file before it reports a hit, and treats a file that is missing or the
+	// wrong size as a miss; Put checks the file it staged, and reports an
+	// error if it does not match.
+	SharedLocal bool
+
+	// Mirror, if non-nil, is a client for a secondary bucket to which all
+	// objects and actions written to GCS are also replicated, asynchronously
+	// and on a best-effort basis. Failures writing to the mirror are logged
+	// but do not affect the primary operation. The mirror is never read.
+	Mirror *gcsutil.Client
+
+	// MirrorConcurrency, if positive, defines the maximum number of concurrent
+	// tasks for writing to the mirror. If zero or negative, it uses
+	// runtime.NumCPU.
+	MirrorConcurrency int
+
+	// ActionBatch, if positive, enables batched action records. Action writes
+	// are buffered in memory and flushed to storage at this interval, as a
+	// single object per partition. Cached batch indexes are also refreshed no
+	// more often than this interval.
+	ActionBatch time.Duration
+
+	// ActionBatchLimit, if positive, is the maximum number of action records
+	// kept in each batch object, if ActionBatch is set. When a batch would
+	// exceed it, the oldest records are dropped. If zero or negative, it uses
+	// DefaultActionBatchLimit.
+	ActionBatchLimit int
+
+	// RemoteFirst, if true, makes Get read the action record from GCS before
+	// checking Local, and fault in its output without checking for a local
+	// copy. Local is consulted only if the action is not found in GCS, for
+	// example because its output was too small to upload.
+	//
+	// This helps when Local is usually cold, as in a fresh container, or is
+	// slower to check than GCS, as on a network filesystem. It hurts when
+	// Local is warm and fast, as on a local SSD, since every hit then costs a
+	// round trip to GCS and a transfer of the output. Compare get_local_hit
+	// with get_fault_hit, and get_local_fallback, to decide.
+	RemoteFirst bool
+
+	// UploadPacing, if positive, spreads bursts of background writes to GCS
+	// over time: when other writes are already pending, each write waits for
+	// a random delay of up to UploadPacing before it starts. This reduces the
+	// chance of tripping the request rate limits of the bucket, at the cost
+	// of some latency. Close still waits for all writes to finish.
+	UploadPacing time.Duration
+
+	// OpenFiles, if non-nil, limits the number of files the cache holds open
+	// at once in the local directory, including objects staged for upload.
+	// Operations beyond the limit wait for a slot. The same semaphore may be
+	// shared with other caches to apply a single limit across all of them.
+	OpenFiles *semaphore.Weighted
+
+	// Breaker, if non-nil, is a circuit breaker for requests to GCS. While it
+	// is open, Get reports a miss for entries not found locally, and Put keeps
+	// new entries local only, without waiting for GCS to fail.
+	Breaker *Breaker
+
+	// NegCacheTTL, if positive, enables a negative cache of actions recently
+	// found missing from GCS: for NegCacheTTL after a miss, Get reports a miss
+	// for the same action without a round trip to GCS. This saves repeated
+	// lookups of the same missing action within a build, at the cost of
+	// missing an action written meanwhile by another client. A Put of the
+	// action clears its entry. If zero or negative, misses are not cached.
+	NegCacheTTL time.Duration
+
+	// NegCacheSize, if positive, is the maximum number of actions held in the
+	// negative cache, the oldest being discarded first. If zero or negative,
+	// it uses DefaultNegCacheSize. It is ignored unless NegCacheTTL > 0.
+	NegCacheSize int
+
+	// AdmissionWindow, if positive, enables an admission filter for uploads:
+	// an object is written to GCS only the second time it is Put within
+	// about AdmissionWindow Puts, so that objects produced once and never
+	// again, which are unlikely to be read, do not take space in the bucket.
+	// The counts are estimated in a sketch of about 4*AdmissionWindow bytes.
+	// Skipped objects are kept in Local. This trades hits on the first reuse
+	// of each object, by other clients, for less storage and upload traffic.
+	AdmissionWindow int
+
+	// PinVersions, if true, records in each action record written to GCS the
+	// version of its output object, and makes Get read that version of the
+	// output, so that a reader never sees an object that a concurrent writer
+	// is replacing. If the pinned version is no longer available, for example
+	// because the bucket does not keep old versions, Get reads the current
+	// object. It has no effect unless GCSClient implements
+	// [revproxy.VersionedClient]. Records written in batches are not pinned.
+	PinVersions bool
+
+	// Manifest, if non-nil, records each action written to GCS, or added to
+	// a batch, with the output it produced (see [Manifest]).
+	Manifest *Manifest
+
+	// Events, if non-nil, records an event for each Get and Put, for analysis
+	// of cache effectiveness (see [eventlog.Log]).
+	Events *eventlog.Log
+
 	// Tracks tasks pushing cache writes to GCS.
 	initOnce sync.Once
 	push     *taskgroup.Group
 	start    func(taskgroup.Task)
+	batch    *actionBatcher // nil unless ActionBatch > 0
+
+	// Limits concurrent reads faulting in cache entries.
+	fetch *semaphore.Weighted
+
+	neg    *negCache        // actions recently missing from storage; nil if disabled
+	admit  *admissionFilter // objects seen recently; nil if disabled
+	stage  keylock.Set      // serializes staging of each action locally by Put
+	faults faultGroup       // shares concurrent faults of each action by Get
 
-	getLocalHit  expvar.Int // count of Get hits in the local cache
-	getFaultHit  expvar.Int // count of Get hits faulted in from GCS
-	getFaultMiss expvar.Int // count of Get faults that were misses
-	putSkipSmall expvar.Int // count of "small" objects not written to GCS
-	putGCSFound  expvar.Int // count of objects not written to GCS because they were already present
-	putGCSAction expvar.Int // count of actions written to GCS
-	putGCSObject expvar.Int // count of objects written to GCS
-	putGCSError  expvar.Int // count of errors writing to GCS
+	// Tracks tasks replicating cache writes to the mirror.
+	mirror      *taskgroup.Group
+	startMirror func(taskgroup.Task)
+
+	pending atomic.Int64 // count of background writes in progress
+	misses  missSampler  // counts misses for LogMissSample
+
+	getLocalHit   expvar.Int // count of Get hits in the local cache
+	getLocalStale expvar.Int // count of local files that failed the SharedLocal check
+	getFaultHit   expvar.Int // count of Get hits faulted in from GCS
+	getFaultMiss  expvar.Int // count of Get faults that were misses
+	getFallback   expvar.Int // count of RemoteFirst misses that hit in the local cache
+	getNotMod     expvar.Int // count of Get faults whose local copy of the output was revalidated
+	getThrottled  expvar.Int // count of Get faults that waited for a download slot
+	getTimeout    expvar.Int // count of Get faults abandoned after GetTimeout
+	getNegHit     expvar.Int // count of Get misses answered by the negative cache
+	getPinned     expvar.Int // count of Get faults that read the pinned version of the output
+	getInline     expvar.Int // count of Get faults whose output was inline in the action
+	getPinMissing expvar.Int // count of Get faults whose pinned version was not available
+	getCRCBad     expvar.Int // count of Get faults whose output did not match its CRC32C
+	prefetchHit   expvar.Int // count of prefetched actions whose outputs are local
+	prefetchMiss  expvar.Int // count of prefetched actions not found or failed
+	fdWait        expvar.Int // count of file operations that waited for an open-file slot
+	actionBadTime expvar.Int // count of action timestamps outside MaxClockSkew
+	actionCorrupt expvar.Int // count of malformed action records treated as misses
+	getTTLExpired expvar.Int // count of action records older than RemoteTTL treated as misses
+	putSkipSmall  expvar.Int // count of "small" objects not written to GCS
+	putSkipLarge  expvar.Int // count of "large" objects not written to GCS
+	putAdmitSkip  expvar.Int // count of objects not written to GCS on their first sight
+	putGCSFound   expvar.Int // count of objects not written to GCS because they were already present
+	putGCSAction  expvar.Int // count of actions written to GCS
+	putActionSkip expvar.Int // count of actions not written to GCS because an identical record was present
+	putInline     expvar.Int // count of actions written to GCS with their output inline
+	putGCSObject  expvar.Int // count of objects written to GCS
+	putGCSError   expvar.Int // count of errors writing to GCS
+	putActionGzip expvar.Int // count of action records written to GCS compressed
+	putActionRaw  expvar.Int // count of action records written to GCS uncompressed
+	putRateLimit  expvar.Int // count of writes to GCS rejected by rate limiting (429 or 503)
+	putIntegrity  expvar.Int // count of writes rejected by GCS for a checksum mismatch
+	putCondRace   expvar.Int // count of conditional writes that lost a race with another writer
+	actionCAS     expvar.Int // count of action writes skipped because a newer record was stored
+	putVerifyFail expvar.Int // count of uploaded objects that failed verification
+	putReupload   expvar.Int // count of objects uploaded again after failing verification
+	putFailStreak failStreak // count of consecutive background writes that failed
+	opErr         ctxErrors  // count of operations that timed out or were canceled
+	mirrorObject  expvar.Int // count of objects written to the mirror
+	mirrorAction  expvar.Int // count of actions written to the mirror
+	mirrorError   expvar.Int // count of errors writing to the mirror
 }
 
 var _ revproxy.Storage = (*GCSCache)(nil)
 
 func (s *GCSCache) init() {
 	s.initOnce.Do(func() {
-		s.push, s.start = taskgroup.New(nil).Limit(s.uploadConcurrency())
+		var start func(taskgroup.Task)
+		s.push, start = taskgroup.New(nil).Limit(s.uploadConcurrency())
+		s.start = countTasks(start, &s.pending)
+		s.fetch = semaphore.NewWeighted(int64(concurrency(s.DownloadConcurrency)))
+		s.neg = newNegCache(s.NegCacheTTL, s.NegCacheSize)
+		s.admit = newAdmissionFilter(s.AdmissionWindow)
+		if s.Mirror != nil {
+			var start func(taskgroup.Task)
+			s.mirror, start = taskgroup.New(nil).Limit(concurrency(s.MirrorConcurrency))
+			s.startMirror = countTasks(start, &s.pending)
+		}
+		if s.ActionBatch > 0 {
+			s.batch = newActionBatcher(withTags(s.GCSClient, actionTags), s.ActionBatch, s.PartitionDepth, s.ActionBatchLimit, s.actionBatchKey)
+		}
 	})
 }
 
 // Get implements the corresponding callback of the cache protocol.
-func (s *GCSCache) Get(ctx context.Context, actionID string) (outputID, diskPath string, _ error) {
+func (s *GCSCache) Get(ctx context.Context, actionID string) (outputID, diskPath string, err error) {
+	start := time.Now()
+	outputID, diskPath, err = s.get(ctx, actionID)
+	s.opErr.note(err)
+	recordGet(s.Events, actionID, diskPath, start, err)
+	return outputID, diskPath, err
+}
+
+func (s *GCSCache) get(ctx context.Context, actionID string) (outputID, diskPath string, _ error) {
 	s.init()
 
-	objID, diskPath, err := s.Local.Get(ctx, actionID)
-	if err == nil && objID != "" && diskPath != "" {
-		s.getLocalHit.Add(1)
-		return objID, diskPath, nil // cache hit, OK
+	if !s.RemoteFirst {
+		if objID, diskPath, err := s.getLocal(ctx, actionID); err != nil || objID != "" {
+			return objID, diskPath, err // cache hit, OK
+		}
 	}
 
-	// Reaching here, either we got a cache miss or an error reading from local.
-	// Try reading the action from GCS.
-	action, err := s.GCSClient.GetData(ctx, s.actionKey(actionID))
-	if err != nil {
+	// Concurrent requests for the same action share one fault, so that they
+	// do not each read it from GCS.
+	return s.faults.do(ctx, actionID, func(ctx context.Context) (string, string, error) {
+		return s.fault(ctx, actionID)
+	})
+}
+
+// fault reads the action record for actionID from GCS, and stages it and its
+// output in the local cache. Requests for the same action must not call fault
+// concurrently (see faultGroup).
+func (s *GCSCache) fault(ctx context.Context, actionID string) (outputID, diskPath string, _ error) {
+	// Check again for a local copy, which a fault that ended just before this
+	// one began may have staged.
+	if !s.RemoteFirst {
+		if objID, diskPath, err := s.getLocal(ctx, actionID); err != nil || objID != "" {
+			return objID, diskPath, err
+		}
+	}
+
+	// Reaching here, either we got a cache miss or an error reading from local,
+	// or we did not check local first. Unless the action recently missed in
+	// GCS, wait for a slot to read from GCS, and hold it until the result is
+	// staged.
+	negHit := s.neg.has(actionID)
+	if !negHit {
+		if err := acquire(ctx, s.fetch, &s.getThrottled); err != nil {
+			return "", "", err
+		}
+		defer s.fetch.Release(1)
+	}
+
+	// Bound the time spent reading from GCS, if requested. The original
+	// context still governs the local cache.
+	gctx, cancel := getContext(ctx, s.GetTimeout)
+	defer cancel()
+
+	// Try reading the action from GCS, unless it recently missed there or GCS
+	// is known to be unhealthy.
+	var action []byte
+	err := errBreakerOpen
+	if negHit {
+		s.getNegHit.Add(1)
+		err = errNegCached
+	} else if s.Breaker.Allow() {
+		action, err = s.getAction(gctx, actionID)
+		s.Breaker.Done(err)
+		if errors.Is(err, fs.ErrNotExist) {
+			s.neg.add(actionID)
+		}
+	}
+	if isTimeout(ctx, gctx, err) {
+		s.getTimeout.Add(1)
+		s.opErr.timeout.Add(1)
+		s.logMiss(actionID, "", missTime)
+		return "", "", nil // treat as a miss, so the build proceeds
+	} else if err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
+			if s.RemoteFirst {
+				objID, diskPath, err := s.getLocal(ctx, actionID)
+				if err != nil {
+					return "", "", err
+				} else if objID != "" {
+					s.getFallback.Add(1)
+					return objID, diskPath, nil
+				}
+			}
 			s.getFaultMiss.Add(1)
+			s.logMiss(actionID, "", missFault)
 			return "", "", nil // cache miss, OK
 		}
 		return "", "", fmt.Errorf("[gcs] read action %s: %w", actionID, err)
 	}
 
-	// We got an action hit remotely, try to update the local copy.
-	outputID, mtime, err := parseAction(action)
+	// We got an action hit remotely, try to update the local copy. The record
+	// may hold the output inline, in which case it is staged from there.
+	outputID, mtime, version, body, inline, err := parseAnyAction(action)
 	if err != nil {
-		return "", "", err
+		// A record damaged by an interrupted write is a miss, so the toolchain
+		// rebuilds the action and its put replaces the record.
+		s.actionCorrupt.Add(1)
+		s.logMiss(actionID, "", missCorrupt)
+		s.logf("[gcs] action %s: %v (treating as miss)", actionID, err)
+		return "", "", nil
 	}
+	mtime = s.checkTime(actionID, mtime, false)
+	if expired(mtime, s.RemoteTTL) {
+		s.getTTLExpired.Add(1)
+		s.logMiss(actionID, outputID, missExpired)
+		return "", "", nil
+	}
+	s.logMiss(actionID, outputID, missLocal)
 
-	object, size, err := s.GCSClient.Get(ctx, s.outputKey(outputID))
+	// Hold a file slot for the local copy, and another for the staged copy
+	// if reads are resumable, until the object is added to Local.
+	nfiles := int64(1)
+	if s.ResumeDir != "" && !inline {
+		nfiles = 2
+	}
+	release, err := holdFiles(ctx, s.OpenFiles, nfiles, &s.fdWait)
 	if err != nil {
-		// At this point we know the action exists, so if we can't read the
-		// object report it as an error rather than a cache miss.
-		return "", "", fmt.Errorf("[gcs] read object %s: %w", outputID, err)
+		return "", "", err
+	}
+	defer release()
+
+	var object io.ReadCloser
+	var size int64
+	var checked *crcReader // set if the output is verified (see VerifyDownloads)
+	var etag string        // set if the output is revalidated (see ETagDir)
+	var notModified bool   // set if the local copy of the output was current
+	if inline {
+		// The output is held in the record, so there is no object to read.
+		object, size = io.NopCloser(bytes.NewReader(body)), int64(len(body))
+		s.getInline.Add(1)
+	} else {
+		// If the action pins a version of its output, read that version, so
+		// that a write of the object in progress is not seen half done.
+		var pinned bool
+		object, size, pinned, err = getVersion(gctx, s.GCSClient, s.outputKey(outputID), version, &s.getPinMissing)
+		if !pinned {
+			object, err = getFirst(s.outputReadKeys(outputID), func(key string) (io.ReadCloser, error) {
+				if s.ResumeDir != "" {
+					f, n, err := revproxy.GetResumable(gctx, s.GCSClient, key, s.resumePath(outputID))
+					size = n
+					return f, err
+				}
+				if cc, ok := s.GCSClient.(revproxy.ChecksumClient); ok && s.VerifyDownloads {
+					rc, n, crc, err := cc.GetChecksum(gctx, key)
+					size = n
+					if err != nil {
+						return nil, err
+					}
+					checked = newCRCReader(rc, n, crc)
+					return checked, nil
+				}
+				if cc, ok := s.GCSClient.(revproxy.ConditionalClient); ok && s.ETagDir != "" {
+					stagedTag, stagedPath := s.readETag(outputID)
+					rc, n, tag, err := cc.GetCond(gctx, key, stagedTag)
+					if errors.Is(err, revproxy.ErrNotModified) {
+						if f, fi, err := openStaged(stagedPath); err == nil {
+							size, etag, notModified = fi.Size(), stagedTag, true
+							return f, nil
+						}
+						// The local copy went away meanwhile; read the object.
+						rc, n, tag, err = cc.GetCond(gctx, key, "")
+					}
+					size, etag = n, tag
+					return rc, err
+				}
+				rc, n, err := s.GCSClient.Get(gctx, key)
+				size = n
+				return rc, err
+			})
+		} else if err == nil {
+			s.getPinned.Add(1)
+		}
+		s.Breaker.Done(err)
+		if isTimeout(ctx, gctx, err) {
+			s.getTimeout.Add(1)
+			s.opErr.timeout.Add(1)
+			s.logMiss(actionID, outputID, missTime)
+			return "", "", nil
+		} else if err != nil {
+			// At this point we know the action exists, so if we can't read the
+			// object report it as an error rather than a cache miss.
+			return "", "", fmt.Errorf("[gcs] read object %s: %w", outputID, err)
+		}
+		if s.ResumeDir != "" {
+			defer os.Remove(s.resumePath(outputID))
+		}
 	}
 	defer object.Close()
 	s.getFaultHit.Add(1)
 
 	// Now we should have the body; poke it into the local cache.  Preserve the
 	// modification timestamp recorded with the original action.
-	diskPath, err = s.Local.Put(ctx, gocache.Object{
+	local := stageDir(s.Local, s.LocalLarge, s.LargeThreshold, size)
+	diskPath, err = local.Put(gctx, gocache.Object{
 		ActionID: actionID,
 		OutputID: outputID,
 		Size:     size,
 		Body:     object,
 		ModTime:  mtime,
 	})
+	if isTimeout(ctx, gctx, err) {
+		s.getTimeout.Add(1)
+		s.opErr.timeout.Add(1)
+		s.logMiss(actionID, outputID, missTime)
+		return "", "", nil
+	} else if checked != nil && checked.mismatch != nil {
+		if err == nil {
+			os.Remove(diskPath) // staged despite the mismatch; do not serve it
+		}
+		s.getCRCBad.Add(1)
+		s.logf("[gcs] output %s for action %s: %v (treating as miss)", outputID, actionID, checked.mismatch)
+		return "", "", nil
+	} else if err == nil && s.SharedLocal && !checkStaged(diskPath, size) {
+		s.getLocalStale.Add(1)
+		s.logf("[gcs] staged output %s for action %s does not have size %d (treating as miss)", outputID, actionID, size)
+		return "", "", nil
+	}
+	if err == nil && etag != "" {
+		if notModified {
+			s.getNotMod.Add(1)
+		}
+		s.writeETag(outputID, etag, diskPath)
+	}
 	return outputID, diskPath, err
 }
 
+// getLocal reads the action record for actionID from the local cache, and
+// reports the output ID and path if found, or empty strings if not. Errors
+// reading the local cache are treated as misses.
+func (s *GCSCache) getLocal(ctx context.Context, actionID string) (outputID, diskPath string, _ error) {
+	release, err := holdFiles(ctx, s.OpenFiles, 1, &s.fdWait)
+	if err != nil {
+		return "", "", err
+	}
+	defer release()
+	objID, diskPath, err := getTiered(ctx, s.Local, s.LocalLarge, actionID)
+	if err == nil && objID != "" && diskPath != "" {
+		if s.SharedLocal && !checkStaged(diskPath, -1) {
+			s.getLocalStale.Add(1)
+			return "", "", nil
+		}
+		s.getLocalHit.Add(1)
+		return objID, diskPath, nil
+	}
+	return "", "", nil
+}
+
 // Put implements the corresponding callback of the cache protocol.
-func (s *GCSCache) Put(ctx context.Context, obj gocache.Object) (diskPath string, _ error) {
+func (s *GCSCache) Put(ctx context.Context, obj gocache.Object) (diskPath string, err error) {
+	start := time.Now()
+	diskPath, err = s.put(ctx, obj)
+	s.opErr.note(err)
+	recordPut(s.Events, obj, start, err)
+	return diskPath, err
+}
+
+func (s *GCSCache) put(ctx context.Context, obj gocache.Object) (string, error) {
 	s.init()
 
 	etr := s3util.NewETagReader(obj.Body)
 	obj.Body = etr
 
-	diskPath, err := s.Local.Put(ctx, obj)
+	// Stage the output under the lock for its action, so that concurrent
+	// Puts of the action take turns. A fault of the action by Get may stage
+	// it meanwhile, but each file is replaced atomically, so either copy is
+	// complete.
+	unlock, err := s.stage.Lock(ctx, obj.ActionID)
+	if err != nil {
+		return "", err
+	}
+	release, err := holdFiles(ctx, s.OpenFiles, 1, &s.fdWait)
+	if err != nil {
+		unlock()
+		return "", err
+	}
+	diskPath, err := stageDir(s.Local, s.LocalLarge, s.LargeThreshold, obj.Size).Put(ctx, obj)
+	release()
+	unlock()
 	if err != nil {
 		return "", err // don't bother trying to forward it to the remote
+	} else if s.SharedLocal && !checkStaged(diskPath, obj.Size) {
+		s.getLocalStale.Add(1)
+		return "", fmt.Errorf("[gcs] staged output %s does not have size %d", obj.OutputID, obj.Size)
 	}
+	s.neg.remove(obj.ActionID)
 	if obj.Size < s.MinUploadSize {
 		s.putSkipSmall.Add(1)
 		return diskPath, nil // don't bother uploading this, it's too small
 	}
+	if s.MaxUploadSize > 0 && obj.Size > s.MaxUploadSize {
+		s.putSkipLarge.Add(1)
+		s.logf("WARNING: [gcs] not uploading object %s for action %s: size %d exceeds limit %d",
+			obj.OutputID, obj.ActionID, obj.Size, s.MaxUploadSize)
+		return diskPath, nil // too large, keep it local only
+	}
+	if !s.admit.admit(obj.OutputID) {
+		s.putAdmitSkip.Add(1)
+		return diskPath, nil // not seen before, keep it local only for now
+	}
+
+	// Try to push the record to GCS in the background, or wait for it if
+	// uploads are synchronous.
+	runTask(s.start, s.SyncUploads, func() (err error) {
+		if !s.Breaker.Allow() {
+			return nil // GCS is unhealthy, keep the entry local only
+		}
+		defer func() { s.putFailStreak.note(err) }()
+		pace(s.UploadPacing, &s.pending)
 
-	// Try to push the record to GCS in the background.
-	s.start(func() error {
 		// Override the context with a separate timeout in case GCS is farkakte.
 		sctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 1*time.Minute)
 		defer cancel()
 
 		// Stage 1: Maybe write the object. Do this before writing the action
-		// record so we are less likely to get a spurious miss later.
-		f, err := os.Open(diskPath)
-		if err != nil {
-			s.putGCSError.Add(1)
-			gocache.Logf(ctx, "[gcs] open local object %s: %v", obj.OutputID, err)
-			return err
-		}
-		defer f.Close()
-		fi, err := f.Stat()
-		if err != nil {
-			s.putGCSError.Add(1)
-			gocache.Logf(ctx, "[gcs] stat local object %s: %v", obj.OutputID, err)
-			return err
+		// record so we are less likely to get a spurious miss later. A small
+		// output is instead read to be written inline in the action record.
+		inline := s.batch == nil && obj.Size < s.InlineThreshold
+		var data []byte
+		var mtime time.Time
+		if inline {
+			data, mtime, err = readInline(sctx, diskPath, s.OpenFiles, &s.fdWait)
+			if err != nil {
+				gocache.Logf(ctx, "[gcs] read local object %s: %v", obj.OutputID, err)
+				return err
+			}
+		} else {
+			mtime, err = s.maybePutObject(sctx, obj.OutputID, diskPath, etr.ETag())
+			s.Breaker.Done(err)
+			if err != nil {
+				return err
+			}
 		}
+		mtime = s.checkTime(obj.ActionID, mtime, true)
+		s.mirrorPut(ctx, obj.OutputID, obj.ActionID, diskPath, etr.ETag(), mtime)
 
-		// Use PutCond to check if object already exists
-		written, err := s.GCSClient.PutCond(sctx, s.outputKey(obj.OutputID), etr.ETag(), f)
-
-		if err != nil {
-			s.putGCSError.Add(1)
-			gocache.Logf(ctx, "[gcs] put object %s: %v", obj.OutputID, err)
-			return err
+		// Stage 2: Write the action record, or add it to a batch.
+		if s.batch != nil {
+			s.batch.add(obj.ActionID, obj.OutputID, mtime)
+			s.putGCSAction.Add(1)
+			recordAction(s.Manifest, obj, mtime, s.logf)
+			return nil
 		}
-		if written {
-			s.putGCSObject.Add(1) // Actually uploaded
+		var record []byte
+		if inline {
+			record = formatInlineAction(obj.OutputID, mtime, data)
 		} else {
-			s.putGCSFound.Add(1) // Duplicate found, skipped upload
+			var version string
+			if s.PinVersions {
+				version = objectVersion(sctx, s.GCSClient, s.outputKey(obj.OutputID), s.logf)
+			}
+			record = []byte(formatAction(obj.OutputID, mtime, version))
 		}
-
-		// Stage 2: Write the action record.
-		if err := s.GCSClient.Put(sctx, s.actionKey(obj.ActionID),
-			strings.NewReader(fmt.Sprintf("%s %d", obj.OutputID, fi.ModTime().UnixNano()))); err != nil {
+		if s.SkipSameActions && s.identicalAction(sctx, obj.ActionID, record) {
+			s.putActionSkip.Add(1)
+			recordAction(s.Manifest, obj, mtime, s.logf)
+			return nil
+		}
+		record = encodeAction(record, s.CompressActions, &s.putActionGzip, &s.putActionRaw)
+		if s.MonotonicActions {
+			err = s.putActionMonotonic(sctx, obj.ActionID, mtime, record)
+		} else {
+			err = withTags(s.GCSClient, recordTags(mtime, s.RemoteTTL)).Put(sctx, s.actionKey(obj.ActionID), bytes.NewReader(record))
+		}
+		s.Breaker.Done(err)
+		if err != nil {
+			if errors.Is(err, revproxy.ErrChecksumMismatch) {
+				s.putIntegrity.Add(1)
+			} else if errors.Is(err, revproxy.ErrThrottled) {
+				s.putRateLimit.Add(1)
+			} else {
+				s.opErr.note(err)
+			}
 			gocache.Logf(ctx, "[gcs] write action %s: %v", obj.ActionID, err)
 			return err
 		}
 		s.putGCSAction.Add(1)
+		if inline {
+			s.putInline.Add(1)
+		}
+		recordAction(s.Manifest, obj, mtime, s.logf)
 		return nil
 	})
 
+	if err := s.putFailStreak.check(s.StrictWrites); err != nil {
+		return "", fmt.Errorf("[gcs] %w", err)
+	}
 	return diskPath, nil
 }
 
@@ -215,19 +853,375 @@ func (s *GCSCache) Close(ctx context.Context) error {
 		s.push.Wait()
 		gocache.Logf(ctx, "uploads complete (%v elapsed)", time.Since(wstart).Round(10*time.Microsecond))
 	}
-	return s.GCSClient.Close()
+	var berr, merr error
+	if s.batch != nil {
+		berr = s.batch.close(ctx)
+	}
+	if s.mirror != nil {
+		gocache.Logf(ctx, "waiting for mirror writes...")
+		s.mirror.Wait()
+		merr = s.Mirror.Close()
+	}
+	return errors.Join(berr, merr, s.GCSClient.Close())
 }
 
+// Pending reports the number of writes to storage, including the mirror,
+// that have been started in the background and have not yet finished.
+func (s *GCSCache) Pending() int { return int(s.pending.Load()) }
+
 // SetMetrics implements the corresponding server callback.
 func (s *GCSCache) SetMetrics(_ context.Context, m *expvar.Map) {
 	m.Set("get_local_hit", &s.getLocalHit)
+	m.Set("get_local_stale", &s.getLocalStale)
 	m.Set("get_fault_hit", &s.getFaultHit)
 	m.Set("get_fault_miss", &s.getFaultMiss)
+	m.Set("get_local_fallback", &s.getFallback)
+	m.Set("get_notmodified", &s.getNotMod)
+	m.Set("get_throttled", &s.getThrottled)
+	m.Set("get_timeout", &s.getTimeout)
+	m.Set("get_neg_cache_hit", &s.getNegHit)
+	m.Set("get_pinned", &s.getPinned)
+	m.Set("get_inline", &s.getInline)
+	m.Set("get_pin_missing", &s.getPinMissing)
+	m.Set("prefetch_hit", &s.prefetchHit)
+	m.Set("prefetch_miss", &s.prefetchMiss)
+	m.Set("fd_wait", &s.fdWait)
+	m.Set("action_bad_timestamp", &s.actionBadTime)
+	m.Set("action_corrupt", &s.actionCorrupt)
+	m.Set("get_ttl_expired", &s.getTTLExpired)
 	m.Set("put_skip_small", &s.putSkipSmall)
+	m.Set("put_skip_large", &s.putSkipLarge)
+	m.Set("put_admission_skip", &s.putAdmitSkip)
 	m.Set("put_gcs_found", &s.putGCSFound)
 	m.Set("put_gcs_action", &s.putGCSAction)
+	m.Set("put_action_skip", &s.putActionSkip)
+	m.Set("put_inline", &s.putInline)
 	m.Set("put_gcs_object", &s.putGCSObject)
 	m.Set("put_gcs_error", &s.putGCSError)
+	m.Set("put_action_compressed", &s.putActionGzip)
+	m.Set("put_action_plain", &s.putActionRaw)
+	m.Set("put_rate_limited", &s.putRateLimit)
+	m.Set("put_integrity_fail", &s.putIntegrity)
+	m.Set("put_cond_race", &s.putCondRace)
+	m.Set("action_cas_conflict", &s.actionCAS)
+	m.Set("put_verify_fail", &s.putVerifyFail)
+	m.Set("get_crc_mismatch", &s.getCRCBad)
+	m.Set("put_verify_retry", &s.putReupload)
+	m.Set("put_fail_streak", &s.putFailStreak)
+	s.opErr.setMetrics(m)
+	s.Breaker.setMetrics(m)
+	m.Set("mirror_object", &s.mirrorObject)
+	m.Set("mirror_action", &s.mirrorAction)
+	m.Set("mirror_error", &s.mirrorError)
+	if s.ActionBatch > 0 {
+		s.init()
+		s.batch.setMetrics(m)
+	}
+}
+
+// maybePutObject writes the specified object contents to GCS if there is not
+// already a matching key with the same etag. It returns the modified time of
+// the object file, whether or not it was sent to GCS.
+func (s *GCSCache) maybePutObject(ctx context.Context, outputID, diskPath, etag string) (time.Time, error) {
+	release, err := holdFiles(ctx, s.OpenFiles, 1, &s.fdWait)
+	if err != nil {
+		if !s.opErr.note(err) {
+			s.putGCSError.Add(1)
+		}
+		return time.Time{}, err
+	}
+	defer release()
+	f, err := os.Open(diskPath)
+	if err != nil {
+		s.putGCSError.Add(1)
+		gocache.Logf(ctx, "[gcs] open local object %s: %v", outputID, err)
+		return time.Time{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		s.putGCSError.Add(1)
+		gocache.Logf(ctx, "[gcs] stat local object %s: %v", outputID, err)
+		return time.Time{}, err
+	}
+
+	// Use PutCond to check if object already exists
+	written, err := withRetention(withTags(s.GCSClient, outputTags), s.Retention).PutCond(ctx, s.outputKey(outputID), etag, f)
+	if errors.Is(err, revproxy.ErrPutRace) {
+		// Another writer stored the object while we were checking for it.
+		s.putCondRace.Add(1)
+		s.putGCSFound.Add(1)
+		return fi.ModTime(), nil
+	} else if errors.Is(err, revproxy.ErrChecksumMismatch) {
+		s.putIntegrity.Add(1)
+		s.logf("WARNING: [gcs] object %s corrupted in transit: %v", outputID, err)
+		return time.Time{}, err
+	} else if err != nil {
+		if errors.Is(err, revproxy.ErrThrottled) {
+			s.putRateLimit.Add(1)
+		}
+		if !s.opErr.note(err) {
+			s.putGCSError.Add(1)
+		}
+		gocache.Logf(ctx, "[gcs] put object %s: %v", outputID, err)
+		return time.Time{}, err
+	}
+	if written {
+		s.putGCSObject.Add(1) // Actually uploaded
+		if s.VerifyUploads && fi.Size() >= s.verifyMinSize() {
+			if err := s.verifyUpload(ctx, outputID, f, fi.Size()); err != nil {
+				return time.Time{}, err
+			}
+		}
+	} else {
+		s.putGCSFound.Add(1) // Duplicate found, skipped upload
+	}
+	return fi.ModTime(), nil
+}
+
+// maxSwapAttempts is the number of times putActionMonotonic, or a flush of an
+// action batch, tries to replace an object that other writers keep replacing
+// first.
+const maxSwapAttempts = 3
+
+// putActionMonotonic writes record, with timestamp mtime, as the action record
+// for actionID, unless GCS already has a record for the action at least as
+// new. If another writer replaces the record between the check and the
+// write, it checks again.
+func (s *GCSCache) putActionMonotonic(ctx context.Context, actionID string, mtime time.Time, record []byte) error {
+	client := withTags(s.GCSClient, recordTags(mtime, s.RemoteTTL))
+	sc, ok := client.(revproxy.SwapClient)
+	if !ok {
+		return client.Put(ctx, s.actionKey(actionID), bytes.NewReader(record))
+	}
+	key := s.actionKey(actionID)
+	for range maxSwapAttempts {
+		var version string
+		if info, err := sc.Stat(ctx, key); err == nil {
+			cur, err := readVersion(ctx, sc, key, info.Version)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue // replaced since we checked
+			} else if err != nil {
+				return err
+			}
+			// A record that cannot be parsed is replaced.
+			if _, ctime, _, _, _, err := parseAnyAction(cur); err == nil {
+				if ctime.After(mtime) {
+					s.actionCAS.Add(1)
+					return nil
+				} else if ctime.Equal(mtime) {
+					return nil // already stored
+				}
+			}
+			version = info.Version
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		err := sc.PutVersion(ctx, key, version, bytes.NewReader(record))
+		if !errors.Is(err, revproxy.ErrPutRace) {
+			return err
+		}
+		s.putCondRace.Add(1)
+	}
+	return fmt.Errorf("action %s: %w", actionID, revproxy.ErrPutRace)
+}
+
+// readVersion reads the given version of the object at key.
+func readVersion(ctx context.Context, c revproxy.VersionedClient, key, version string) ([]byte, error) {
+	rc, _, err := c.GetVersion(ctx, key, version)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// DefaultVerifyMinSize is the size in bytes below which uploads are not
+// verified, if VerifyUploads is set and VerifyMinSize is not.
+const DefaultVerifyMinSize = 1 << 20
+
+// DefaultActionRefresh is the age after which an action record is rewritten
+// even if it is identical, if SkipSameActions is set.
+const DefaultActionRefresh = 24 * time.Hour
+
+// actionRefresh returns the age after which an identical action record is
+// rewritten (see SkipSameActions).
+func (s *GCSCache) actionRefresh() time.Duration {
+	if s.RemoteTTL > 0 {
+		return min(s.RemoteTTL/2, DefaultActionRefresh)
+	}
+	return DefaultActionRefresh
+}
+
+// identicalAction reports whether GCS has an action record for actionID that
+// refers to the same output as record, in the same form, and is younger than
+// actionRefresh. If the existing record cannot be read, it reports false, so
+// that the caller writes the record.
+func (s *GCSCache) identicalAction(ctx context.Context, actionID string, record []byte) bool {
+	cur, err := s.GCSClient.GetData(ctx, s.actionKey(actionID))
+	if err != nil {
+		return false
+	}
+	curID, curTime, curVersion, _, curInline, err := parseAnyAction(cur)
+	if err != nil {
+		return false
+	}
+	newID, _, newVersion, _, newInline, err := parseAnyAction(record)
+	if err != nil {
+		return false
+	}
+	return curID == newID && curVersion == newVersion && curInline == newInline &&
+		time.Since(curTime) < s.actionRefresh()
+}
+
+func (s *GCSCache) verifyMinSize() int64 {
+	if s.VerifyMinSize > 0 {
+		return s.VerifyMinSize
+	}
+	return DefaultVerifyMinSize
+}
+
+// verifyUpload checks that the output object for outputID in GCS has the
+// given size, the size of the local copy f. If not, it uploads f once more,
+// and reports an error if the object still does not match.
+func (s *GCSCache) verifyUpload(ctx context.Context, outputID string, f *os.File, size int64) error {
+	sc, ok := s.GCSClient.(revproxy.StatClient)
+	if !ok {
+		return nil // verification is not supported
+	}
+	key := s.outputKey(outputID)
+	check := func() error {
+		info, err := sc.Stat(ctx, key)
+		if err != nil {
+			return err
+		} else if info.Size != size {
+			return fmt.Errorf("stored object has %d bytes, want %d", info.Size, size)
+		}
+		return nil
+	}
+	err := check()
+	if err == nil {
+		return nil
+	}
+	s.putVerifyFail.Add(1)
+	s.logf("WARNING: [gcs] object %s failed verification: %v (uploading again)", outputID, err)
+
+	s.putReupload.Add(1)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := withRetention(withTags(s.GCSClient, outputTags), s.Retention).Put(ctx, key, f); err != nil {
+		if !s.opErr.note(err) {
+			s.putGCSError.Add(1)
+		}
+		gocache.Logf(ctx, "[gcs] put object %s: %v", outputID, err)
+		return err
+	}
+	if err := check(); err != nil {
+		s.putVerifyFail.Add(1)
+		return fmt.Errorf("[gcs] object %s failed verification: %w", outputID, err)
+	}
+	return nil
+}
+
+// mirrorPut enqueues a task to replicate the specified object and its action
+// record to the mirror, if one is configured. Actions are always written to
+// the mirror in the per-action layout, even if batching is enabled.
+func (s *GCSCache) mirrorPut(ctx context.Context, outputID, actionID, diskPath, etag string, mtime time.Time) {
+	if s.mirror == nil {
+		return
+	}
+	s.startMirror(func() error {
+		mctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 1*time.Minute)
+		defer cancel()
+
+		if written, err := s.mirrorOutput(mctx, outputID, diskPath, etag); err != nil {
+			s.mirrorError.Add(1)
+			gocache.Logf(ctx, "[gcs] mirror: put object %s: %v", outputID, err)
+			return nil
+		} else if written {
+			s.mirrorObject.Add(1)
+		}
+		if err := s.Mirror.WithTags(actionTags).Put(mctx, s.actionKey(actionID), strings.NewReader(formatAction(outputID, mtime, ""))); err != nil {
+			s.mirrorError.Add(1)
+			gocache.Logf(ctx, "[gcs] mirror: write action %s: %v", actionID, err)
+			return nil
+		}
+		s.mirrorAction.Add(1)
+		return nil
+	})
+}
+
+// getAction reads the action record for actionID from GCS, consulting the
+// batch index first if batching is enabled. If the action is not found, the
+// error satisfies [fs.ErrNotExist].
+func (s *GCSCache) getAction(ctx context.Context, actionID string) ([]byte, error) {
+	if s.batch != nil {
+		rec, ok, err := s.batch.lookup(ctx, actionID)
+		if err != nil {
+			return nil, err
+		} else if ok {
+			return rec, nil
+		}
+	}
+	return getFirst(s.actionReadKeys(actionID), func(key string) ([]byte, error) {
+		return s.GCSClient.GetData(ctx, key)
+	})
+}
+
+// mirrorOutput writes the specified output object to the mirror from its local
+// copy at diskPath. If the local copy is gone, for example because it expired
+// while the write was queued, the object is copied from the primary bucket by
+// the server instead. It reports whether the object was written.
+func (s *GCSCache) mirrorOutput(ctx context.Context, outputID, diskPath, etag string) (bool, error) {
+	key := s.outputKey(outputID)
+	release, err := holdFiles(ctx, s.OpenFiles, 1, &s.fdWait)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+	f, err := os.Open(diskPath)
+	if src, ok := s.GCSClient.(*gcsutil.Client); ok && errors.Is(err, fs.ErrNotExist) {
+		return true, s.Mirror.WithTags(outputTags).CopyFrom(ctx, src, key, key)
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	written, err := s.Mirror.WithTags(outputTags).PutCond(ctx, key, etag, f)
+	if errors.Is(err, revproxy.ErrPutRace) {
+		s.putCondRace.Add(1)
+		return false, nil
+	}
+	return written, err
+}
+
+// checkTime returns the timestamp t of the action record for actionID, or the
+// current time if t is not within MaxClockSkew (see clampTime).
+func (s *GCSCache) checkTime(actionID string, t time.Time, past bool) time.Time {
+	ct, ok := clampTime(t, s.MaxClockSkew, past)
+	if !ok {
+		s.actionBadTime.Add(1)
+		s.logf("WARNING: [gcs] action %s has timestamp %v, more than %v from now (using current time)",
+			actionID, t.Format(time.RFC3339), s.MaxClockSkew)
+	}
+	return ct
+}
+
+// logMiss logs a cache miss for actionID, if it is selected by the sampler.
+// If the output ID is not known, outputID == "".
+func (s *GCSCache) logMiss(actionID, outputID, reason string) {
+	if s.misses.sample(s.LogMissSample) {
+		if outputID == "" {
+			outputID = "-"
+		}
+		s.logf("[gcs] sampled miss: action %s output %s (%s)", actionID, outputID, reason)
+	}
+}
+
+func (s *GCSCache) logf(msg string, args ...any) {
+	if s.Logf != nil {
+		s.Logf(msg, args...)
+	}
 }
 
 // makeKey assembles a complete key from the specified parts, including the key
@@ -236,12 +1230,68 @@ func (s *GCSCache) makeKey(parts ...string) string {
 	return path.Join(s.KeyPrefix, path.Join(parts...))
 }
 
-func (s *GCSCache) actionKey(id string) string { return s.makeKey("action", id[:2], id) }
-func (s *GCSCache) outputKey(id string) string { return s.makeKey("output", id[:2], id) }
+func (s *GCSCache) actionKey(id string) string {
+	return s.makeKey("action", id[:partitionDepth(s.PartitionDepth)], id)
+}
+
+func (s *GCSCache) outputKey(id string) string {
+	return s.makeKey("output", id[:partitionDepth(s.PartitionDepth)], id)
+}
+
+func (s *GCSCache) actionReadKeys(id string) []string {
+	return readKeys(s.KeyPrefix, "action", id, s.PartitionDepth)
+}
+
+func (s *GCSCache) outputReadKeys(id string) []string {
+	return readKeys(s.KeyPrefix, "output", id, s.PartitionDepth)
+}
+
+func (s *GCSCache) actionBatchKey(part string) string { return s.makeKey("action-batch", part) }
+
+// resumePath returns the path in ResumeDir where outputID is staged.
+func (s *GCSCache) resumePath(outputID string) string { return filepath.Join(s.ResumeDir, outputID) }
+
+func (s *GCSCache) etagPath(outputID string) string { return filepath.Join(s.ETagDir, outputID) }
+
+// readETag reports the etag and local path recorded for outputID in ETagDir,
+// or empty strings if there is no record.
+func (s *GCSCache) readETag(outputID string) (etag, path string) {
+	data, err := os.ReadFile(s.etagPath(outputID))
+	if err != nil {
+		return "", ""
+	}
+	etag, path, ok := strings.Cut(strings.TrimSuffix(string(data), "\n"), " ")
+	if !ok || etag == "" || path == "" {
+		return "", ""
+	}
+	return etag, path
+}
 
-func (s *GCSCache) uploadConcurrency() int {
-	if s.UploadConcurrency <= 0 {
-		return runtime.NumCPU()
+// writeETag records in ETagDir the etag of outputID and the path of its local
+// copy. Errors are logged, but otherwise ignored: without a record, the next
+// fault of the output reads it unconditionally.
+func (s *GCSCache) writeETag(outputID, etag, diskPath string) {
+	if err := atomicfile.WriteData(s.etagPath(outputID), []byte(etag+" "+diskPath+"\n"), 0644); err != nil {
+		s.logf("[gcs] record etag of output %s: %v", outputID, err)
 	}
-	return s.UploadConcurrency
 }
+
+// openStaged opens the local copy of an output at path, which must be a
+// regular file.
+func openStaged(path string) (*os.File, fs.FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	} else if !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	return f, fi, nil
+}
+
+func (s *GCSCache) uploadConcurrency() int { return concurrency(s.UploadConcurrency) }
@@ -0,0 +1,109 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// inlinePrefix marks an action record that holds its output inline.
+const inlinePrefix = "inline "
+
+// formatInlineAction encodes an action record holding the contents of its
+// output, in the format read by parseInlineAction:
+//
+//	inline <output-id> <timestamp> <size>\n<contents>
+//
+// A reader that does not understand this format finds no valid output ID in
+// the record, and treats it as corrupt, that is, as a miss.
+func formatInlineAction(outputID string, mtime time.Time, data []byte) []byte {
+	head := fmt.Sprintf("%s%s %d %d\n", inlinePrefix, outputID, mtime.UnixNano(), len(data))
+	return append([]byte(head), data...)
+}
+
+// parseInlineAction parses an action record written by formatInlineAction.
+// It reports ok == false if data is not an inline record, in which case it
+// should be parsed with parseActionVersion. It reports an error if the record
+// is inline but malformed, for example if it was truncated by an interrupted
+// write.
+func parseInlineAction(data []byte) (outputID string, mtime time.Time, body []byte, ok bool, _ error) {
+	rest, ok := bytes.CutPrefix(data, []byte(inlinePrefix))
+	if !ok {
+		return "", time.Time{}, nil, false, nil
+	}
+	head, body, ok := bytes.Cut(rest, []byte("\n"))
+	if !ok {
+		return "", time.Time{}, nil, true, errors.New("inline action record has no contents")
+	}
+	fs := strings.Fields(string(head))
+	if len(fs) != 3 {
+		return "", time.Time{}, nil, true, errors.New("invalid inline action record")
+	}
+	if !validID(fs[0]) {
+		return "", time.Time{}, nil, true, fmt.Errorf("invalid output ID %q", fs[0])
+	}
+	ts, err := strconv.ParseInt(fs[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}, nil, true, fmt.Errorf("invalid timestamp: %w", err)
+	}
+	size, err := strconv.Atoi(fs[2])
+	if err != nil || size < 0 {
+		return "", time.Time{}, nil, true, fmt.Errorf("invalid size %q", fs[2])
+	} else if size != len(body) {
+		return "", time.Time{}, nil, true, fmt.Errorf("inline output has %d bytes, want %d", len(body), size)
+	}
+	return fs[0], time.Unix(ts/1e9, ts%1e9), body, true, nil
+}
+
+// parseAnyAction parses an action record in either the inline format or the
+// format written by formatAction, compressed or not. The body is nil unless
+// the record is inline, and the version is "" unless the record pins one.
+func parseAnyAction(data []byte) (outputID string, mtime time.Time, version string, body []byte, inline bool, _ error) {
+	data, err := decodeAction(data)
+	if err != nil {
+		return "", time.Time{}, "", nil, false, err
+	}
+	outputID, mtime, body, inline, err = parseInlineAction(data)
+	if inline {
+		return outputID, mtime, "", body, true, err
+	}
+	outputID, mtime, version, err = parseActionVersion(data)
+	return outputID, mtime, version, nil, false, err
+}
+
+// readInline reads the local copy of an output at diskPath, to be written
+// inline in its action record, and reports its modification time. It holds a
+// slot of sema, if set, while the file is open.
+func readInline(ctx context.Context, diskPath string, sema *semaphore.Weighted, wait *expvar.Int) ([]byte, time.Time, error) {
+	release, err := holdFiles(ctx, sema, 1, wait)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer release()
+	f, err := os.Open(diskPath)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return data, fi.ModTime(), nil
+}
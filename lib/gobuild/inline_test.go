@@ -0,0 +1,98 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"bytes"
+	"expvar"
+	"testing"
+	"time"
+)
+
+func TestParseInlineAction(t *testing.T) {
+	mtime := time.Unix(1700000000, 12345)
+	const content = "binary\ndata with\nnewlines\n"
+	out := testID("f")
+	rec := formatInlineAction(out, mtime, []byte(content))
+	t.Logf("Record: %q", rec)
+
+	id, got, body, ok, err := parseInlineAction(rec)
+	if !ok || err != nil {
+		t.Fatalf("Parse inline action: got (%v, %v), want (true, nil)", ok, err)
+	} else if id != out || !got.Equal(mtime) || string(body) != content {
+		t.Errorf("Parse inline action: got (%q, %v, %q), want (%q, %v, %q)", id, got, body, out, mtime, content)
+	}
+
+	// An inline record with no contents is valid.
+	if _, _, body, ok, err := parseInlineAction(formatInlineAction(out, mtime, nil)); !ok || err != nil || len(body) != 0 {
+		t.Errorf("Parse empty inline action: got (%q, %v, %v), want (\"\", true, nil)", body, ok, err)
+	}
+
+	// A record in the other format is not inline, and parses as usual.
+	if _, _, _, ok, err := parseInlineAction([]byte(formatAction(out, mtime, ""))); ok || err != nil {
+		t.Errorf("Parse plain action: got (%v, %v), want (false, nil)", ok, err)
+	}
+	if _, _, _, _, inline, err := parseAnyAction([]byte(formatAction(out, mtime, "1234"))); inline || err != nil {
+		t.Errorf("Parse any plain action: got (%v, %v), want (false, nil)", inline, err)
+	}
+
+	// Older readers treat an inline record as invalid.
+	if _, _, err := parseAction(rec); err == nil {
+		t.Error("Parse inline action as plain: got nil error, want error")
+	}
+
+	tests := []struct {
+		name, input string
+	}{
+		{"NoContents", "inline " + out + " 1700000000000012345 4"},
+		{"Truncated", "inline " + out + " 1700000000000012345 4\nab"},
+		{"TooLong", "inline " + out + " 1700000000000012345 1\nab"},
+		{"NoSize", "inline " + out + " 1700000000000012345\nab"},
+		{"BadSize", "inline " + out + " 1700000000000012345 -2\nab"},
+		{"BadTimestamp", "inline " + out + " 17000x 2\nab"},
+		{"NonHexOutput", "inline output-id 1700000000000012345 2\nab"},
+		{"ShortOutput", "inline ab 1700000000000012345 2\nab"},
+	}
+	for _, tc := range tests {
+		if id, _, _, ok, err := parseInlineAction([]byte(tc.input)); !ok {
+			t.Errorf("Parse %s (%q): not inline, want inline", tc.name, tc.input)
+		} else if err == nil {
+			t.Errorf("Parse %s (%q): got output %q, want error", tc.name, tc.input, id)
+		} else {
+			t.Logf("Parse %s: %v", tc.name, err)
+		}
+	}
+}
+
+func TestEncodeAction(t *testing.T) {
+	mtime := time.Unix(1700000000, 12345)
+	var gz, plain expvar.Int
+	check := func(rec []byte, compress bool, wantGzip bool) {
+		t.Helper()
+		enc := encodeAction(rec, compress, &gz, &plain)
+		if got := bytes.HasPrefix(enc, gzipMagic); got != wantGzip {
+			t.Errorf("Encode %q: compressed is %v, want %v", rec, got, wantGzip)
+		}
+		if dec, err := decodeAction(enc); err != nil {
+			t.Errorf("Decode %q: unexpected error: %v", rec, err)
+		} else if !bytes.Equal(dec, rec) {
+			t.Errorf("Decode: got %q, want %q", dec, rec)
+		}
+	}
+
+	long := formatInlineAction("ff01", mtime, bytes.Repeat([]byte("text "), 100))
+	short := []byte(formatAction("ff01", mtime, ""))
+	check(long, true, true)
+	check(long, false, false)
+	check(short, true, false) // compression would make it larger
+	if gz.Value() != 1 || plain.Value() != 2 {
+		t.Errorf("Counts: got %d compressed, %d plain; want 1, 2", gz.Value(), plain.Value())
+	}
+
+	// A damaged compressed record is reported.
+	enc := encodeAction(long, true, &gz, &plain)
+	if _, err := decodeAction(enc[:len(enc)/2]); err == nil {
+		t.Error("Decode truncated record: got nil error, want error")
+	}
+}
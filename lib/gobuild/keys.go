@@ -0,0 +1,130 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"path"
+	"time"
+)
+
+// DefaultPartitionDepth is the number of leading hex digits of an action or
+// output ID used to partition storage keys, if no other depth is specified.
+//
+// A deeper partition spreads keys over more prefixes (16 per digit), which
+// reduces hotspotting when IDs are not uniformly distributed, at the cost of
+// making each prefix listing cover fewer keys. A shallower partition has the
+// opposite effect.
+const DefaultPartitionDepth = 2
+
+// partitionDepth returns d if it is positive, or otherwise
+// DefaultPartitionDepth.
+func partitionDepth(d int) int {
+	if d <= 0 {
+		return DefaultPartitionDepth
+	}
+	return d
+}
+
+// readKeys returns the storage keys at which an entry of the given kind and
+// ID may be found, in order of preference. The first is the key at the
+// specified partition depth; if that differs from the default, the key at the
+// default depth is also included, so that entries written before a change of
+// depth remain readable.
+func readKeys(prefix, kind, id string, depth int) []string {
+	depth = partitionDepth(depth)
+	keys := []string{path.Join(prefix, kind, id[:depth], id)}
+	if depth != DefaultPartitionDepth {
+		keys = append(keys, path.Join(prefix, kind, id[:DefaultPartitionDepth], id))
+	}
+	return keys
+}
+
+// StorageKeys returns the storage keys at which the build cache looks for the
+// entry of the given kind ("action" or "output") and ID, for the given key
+// prefix and partition depth, in order of preference. The first is the key
+// at which the cache writes the entry. It reports an error if id is not a
+// valid action or output ID.
+//
+// With action batching (see [GCSCache.ActionBatch]), action records are also
+// looked up in batches, which are not included.
+func StorageKeys(prefix, kind, id string, depth int) ([]string, error) {
+	if kind != "action" && kind != "output" {
+		return nil, fmt.Errorf("unknown entry kind %q", kind)
+	} else if !validID(id) {
+		return nil, fmt.Errorf("invalid %s ID %q", kind, id)
+	}
+	return readKeys(prefix, kind, id, depth), nil
+}
+
+// validID reports whether id is a valid action or output ID, the hex encoding
+// of a SHA-256 digest.
+func validID(id string) bool {
+	_, err := hex.DecodeString(id)
+	return err == nil && len(id) == 2*sha256.Size
+}
+
+// getFirst calls get for each of the specified keys in order, and returns the
+// first result whose error does not satisfy [fs.ErrNotExist]. If no key is
+// found, it returns the error from the first key.
+func getFirst[T any](keys []string, get func(string) (T, error)) (T, error) {
+	var first error
+	for _, key := range keys {
+		v, err := get(key)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return v, err
+		} else if first == nil {
+			first = err
+		}
+	}
+	var zero T
+	return zero, first
+}
+
+// KindTag is the key of the tag attached to each object the build cache
+// writes to storage, whose value is "action" or "output" according to the
+// kind of the object. This is in addition to any tags set on the client.
+const KindTag = "gocache-kind"
+
+// PinTag is the key of a tag that protects an object from deletion by
+// maintenance tools such as [Fsck], if its value is "true". The cache does
+// not set this tag itself; an administrator can set it on valuable entries
+// with [PinEntry], which backs the /debug/pin endpoint of the server, or with
+// the tools for the bucket, e.g., "gcloud storage objects update
+// --update-custom-metadata" or "aws s3api put-object-tagging".
+const PinTag = "gocache-pinned"
+
+// ExpiresTag is the key of the tag attached to each action record written
+// with a remote TTL (see [GCSCache.RemoteTTL]). Its value is the time, in RFC
+// 3339 format, after which the cache treats the record as a miss. The cache
+// reads the time from the record itself, so the tag is for maintenance tools
+// and bucket rules, which can use it to delete stale records.
+const ExpiresTag = "gocache-expires"
+
+var (
+	actionTags = map[string]string{KindTag: "action"}
+	outputTags = map[string]string{KindTag: "output"}
+)
+
+// recordTags returns the tags for an action record with timestamp mtime. If
+// ttl is positive, they include ExpiresTag for the time ttl after mtime.
+func recordTags(mtime time.Time, ttl time.Duration) map[string]string {
+	if ttl <= 0 {
+		return actionTags
+	}
+	tags := maps.Clone(actionTags)
+	tags[ExpiresTag] = mtime.Add(ttl).UTC().Format(time.RFC3339)
+	return tags
+}
+
+// expired reports whether an action record with timestamp mtime is older
+// than ttl. If ttl is zero or negative, no record expires.
+func expired(mtime time.Time, ttl time.Duration) bool {
+	return ttl > 0 && time.Since(mtime) > ttl
+}
@@ -0,0 +1,118 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/creachadair/gocache"
+)
+
+// A Manifest is an append-only log of the build actions a cache has written
+// to storage, recording which output each action produced and when. It is
+// meant for operators auditing or debugging the cache, and is not used to
+// serve requests: the action records in storage remain authoritative.
+//
+// The log is a file of JSON objects, one [ManifestEntry] per line, which can
+// be read with [ScanManifest]. An action written more than once has an entry
+// for each write, in order.
+//
+// A nil *Manifest is valid, and records nothing.
+type Manifest struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// A ManifestEntry records one action written to storage.
+type ManifestEntry struct {
+	ActionID string    `json:"action"`
+	OutputID string    `json:"output"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mtime"` // as recorded in the action
+	Time     time.Time `json:"time"`  // when the action was written
+}
+
+// OpenManifest opens the manifest file at path for appending, creating it if
+// it does not exist.
+func OpenManifest(path string) (*Manifest, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Manifest{f: f}, nil
+}
+
+// Add appends e to the manifest. If e.Time is zero, the current time is used.
+// It is safe to call Add concurrently.
+func (m *Manifest) Add(e ManifestEntry) error {
+	if m == nil {
+		return nil
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+	return nil
+}
+
+// Close closes the manifest file. After Close, m must not be used.
+func (m *Manifest) Close() error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.f.Close()
+}
+
+// ScanManifest reads the entries of a manifest from r, in the order they were
+// written, and calls f for each. If f reports an error, scanning stops and
+// that error is returned. A final line left incomplete by an interrupted
+// write is ignored.
+func ScanManifest(r io.Reader, f func(ManifestEntry) error) error {
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			return nil // including a partial final line
+		} else if err != nil {
+			return err
+		}
+		var e ManifestEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+		if err := f(e); err != nil {
+			return err
+		}
+	}
+}
+
+// recordAction adds an entry to m for the action of obj, written to storage
+// with the given modification time. Failures are logged to logf.
+func recordAction(m *Manifest, obj gocache.Object, mtime time.Time, logf func(string, ...any)) {
+	err := m.Add(ManifestEntry{
+		ActionID: obj.ActionID,
+		OutputID: obj.OutputID,
+		Size:     obj.Size,
+		ModTime:  mtime,
+	})
+	if err != nil {
+		logf("record action %s: %v", obj.ActionID, err)
+	}
+}
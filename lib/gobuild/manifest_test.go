@@ -0,0 +1,99 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestManifest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "manifest.jsonl")
+	m, err := OpenManifest(path)
+	if err != nil {
+		t.Fatalf("OpenManifest: unexpected error: %v", err)
+	}
+
+	// Concurrent writes produce whole entries.
+	const numEntries = 20
+	mtime := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	var wg sync.WaitGroup
+	for i := range numEntries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := m.Add(ManifestEntry{
+				ActionID: fmt.Sprintf("action%d", i%2),
+				OutputID: fmt.Sprintf("output%d", i),
+				Size:     int64(i),
+				ModTime:  mtime,
+			}); err != nil {
+				t.Errorf("Add %d: unexpected error: %v", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+
+	// Reopening appends to the existing entries, and an interrupted write
+	// leaves a partial line that is ignored.
+	m, err = OpenManifest(path)
+	if err != nil {
+		t.Fatalf("OpenManifest: unexpected error: %v", err)
+	}
+	if err := m.Add(ManifestEntry{ActionID: "last", OutputID: "x"}); err != nil {
+		t.Fatalf("Add: unexpected error: %v", err)
+	}
+	m.Close()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"action":"partial","outp`)
+	f.Close()
+
+	f, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []ManifestEntry
+	if err := ScanManifest(f, func(e ManifestEntry) error {
+		got = append(got, e)
+		return nil
+	}); err != nil {
+		t.Fatalf("ScanManifest: unexpected error: %v", err)
+	}
+	if len(got) != numEntries+1 {
+		t.Fatalf("ScanManifest: got %d entries, want %d", len(got), numEntries+1)
+	}
+	for _, e := range got[:numEntries] {
+		if !strings.HasPrefix(e.ActionID, "action") || !e.ModTime.Equal(mtime) || e.Time.IsZero() {
+			t.Errorf("Entry: got %+v, want action with mtime %v", e, mtime)
+		}
+	}
+	if last := got[numEntries]; last.ActionID != "last" {
+		t.Errorf("Last entry: got %+v, want action %q", last, "last")
+	}
+
+	// A nil manifest records nothing.
+	var nm *Manifest
+	if err := nm.Add(ManifestEntry{ActionID: "x"}); err != nil {
+		t.Errorf("Add to nil: unexpected error: %v", err)
+	}
+}
+
+func TestScanManifestError(t *testing.T) {
+	err := ScanManifest(strings.NewReader("{\"action\":\"a\"}\nnot json\n"), func(ManifestEntry) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("ScanManifest: got %v, want error on line 2", err)
+	}
+}
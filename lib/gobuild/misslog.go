@@ -0,0 +1,24 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import "sync/atomic"
+
+// Reasons reported by the sampled miss log.
+const (
+	missLocal   = "local-miss" // not in the local cache, but found in storage
+	missFault   = "fault-miss" // not found in the local cache or storage
+	missTime    = "timeout"    // not read from storage within GetTimeout
+	missCorrupt = "corrupt"    // the action record in storage is malformed
+	missExpired = "expired"    // the action record in storage is older than RemoteTTL
+)
+
+// missSampler selects cache misses for logging.
+type missSampler struct{ count atomic.Int64 }
+
+// sample reports whether the current miss should be logged, which is true
+// for every nth miss. If n ≤ 0, sample reports false without counting.
+func (m *missSampler) sample(n int) bool {
+	return n > 0 && m.count.Add(1)%int64(n) == 0
+}
@@ -0,0 +1,115 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"container/list"
+	"fmt"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// DefaultNegCacheSize is the number of action IDs a negative cache holds if
+// its size is not set.
+const DefaultNegCacheSize = 10000
+
+// errNegCached is reported in place of a read from storage for an action
+// that recently missed there. It satisfies [fs.ErrNotExist], so it is handled
+// as a miss.
+var errNegCached = fmt.Errorf("action recently missed in storage: %w", fs.ErrNotExist)
+
+// A negCache remembers the action IDs recently found missing from storage, so
+// that a repeated lookup of the same action reports a miss without a round
+// trip to storage. Each entry expires after ttl, and the cache holds at most
+// size entries, evicting the oldest first.
+//
+// A nil *negCache is valid, and remembers nothing.
+type negCache struct {
+	ttl  time.Duration
+	size int
+
+	mu    sync.Mutex
+	order *list.List               // of *negEntry, oldest first
+	ids   map[string]*list.Element // action ID → element of order
+}
+
+type negEntry struct {
+	id      string
+	expires time.Time
+}
+
+// newNegCache returns a negative cache with the given TTL and size. If ttl is
+// zero or negative, it returns nil. If size is zero or negative, it uses
+// DefaultNegCacheSize.
+func newNegCache(ttl time.Duration, size int) *negCache {
+	if ttl <= 0 {
+		return nil
+	}
+	if size <= 0 {
+		size = DefaultNegCacheSize
+	}
+	return &negCache{
+		ttl:   ttl,
+		size:  size,
+		order: list.New(),
+		ids:   make(map[string]*list.Element),
+	}
+}
+
+// has reports whether id missed in storage within the TTL of n.
+func (n *negCache) has(id string) bool {
+	if n == nil {
+		return false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.expireLocked(time.Now())
+	_, ok := n.ids[id]
+	return ok
+}
+
+// add records that id missed in storage.
+func (n *negCache) add(id string) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := time.Now()
+	if elt, ok := n.ids[id]; ok {
+		elt.Value.(*negEntry).expires = now.Add(n.ttl)
+		n.order.MoveToBack(elt)
+	} else {
+		n.ids[id] = n.order.PushBack(&negEntry{id: id, expires: now.Add(n.ttl)})
+	}
+	n.expireLocked(now)
+}
+
+// remove discards the record of id, if any, for example because the action
+// has since been written.
+func (n *negCache) remove(id string) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if elt, ok := n.ids[id]; ok {
+		n.order.Remove(elt)
+		delete(n.ids, id)
+	}
+}
+
+// expireLocked discards entries that have expired as of now, and the oldest
+// entries beyond the size limit. The caller must hold n.mu.
+func (n *negCache) expireLocked(now time.Time) {
+	for elt := n.order.Front(); elt != nil; elt = n.order.Front() {
+		e := elt.Value.(*negEntry)
+		if n.order.Len() <= n.size && now.Before(e.expires) {
+			break
+		}
+		n.order.Remove(elt)
+		delete(n.ids, e.id)
+	}
+}
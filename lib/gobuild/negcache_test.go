@@ -0,0 +1,61 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNegCache(t *testing.T) {
+	t.Run("Nil", func(t *testing.T) {
+		n := newNegCache(0, 10)
+		if n != nil {
+			t.Fatalf("newNegCache(0, 10): got %v, want nil", n)
+		}
+		n.add("a")
+		if n.has("a") {
+			t.Error("Nil cache has a, want not")
+		}
+		n.remove("a")
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		n := newNegCache(time.Minute, 10)
+		n.add("a")
+		n.add("b")
+		n.remove("a")
+		if n.has("a") {
+			t.Error("Cache has a after remove, want not")
+		}
+		if !n.has("b") {
+			t.Error("Cache does not have b, want it")
+		}
+	})
+
+	t.Run("Expire", func(t *testing.T) {
+		n := newNegCache(10*time.Millisecond, 10)
+		n.add("a")
+		if !n.has("a") {
+			t.Error("Cache does not have a, want it")
+		}
+		time.Sleep(20 * time.Millisecond)
+		if n.has("a") {
+			t.Error("Cache has a after its TTL, want not")
+		}
+	})
+
+	t.Run("Size", func(t *testing.T) {
+		n := newNegCache(time.Minute, 2)
+		n.add("a")
+		n.add("b")
+		n.add("a") // refreshes a, so b is now the oldest
+		n.add("c")
+		for id, want := range map[string]bool{"a": true, "b": false, "c": true} {
+			if got := n.has(id); got != want {
+				t.Errorf("has(%q): got %v, want %v", id, got, want)
+			}
+		}
+	})
+}
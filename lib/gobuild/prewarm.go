@@ -0,0 +1,141 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"context"
+	"expvar"
+	"path"
+	"slices"
+	"sync/atomic"
+
+	"github.com/creachadair/taskgroup"
+	"github.com/tailscale/go-cache-plugin/lib/revproxy"
+)
+
+// Prewarm stages the outputs of the n most recently written actions in GCS
+// into the local cache, so that a new build finds them as local hits. It
+// reads at most DownloadConcurrency actions concurrently, and returns the
+// number of actions staged. Only actions in the per-action layout are
+// considered, not those in batches.
+func (s *GCSCache) Prewarm(ctx context.Context, n int) (int, error) {
+	s.init()
+	return prewarm(ctx, s.GCSClient.List, path.Join(s.KeyPrefix, "action")+"/", n,
+		concurrency(s.DownloadConcurrency), s.Get)
+}
+
+// Prewarm stages the outputs of the n most recently written actions in S3
+// into the local cache, so that a new build finds them as local hits. It
+// reads at most DownloadConcurrency actions concurrently, and returns the
+// number of actions staged.
+func (s *S3Cache) Prewarm(ctx context.Context, n int) (int, error) {
+	s.init()
+	return prewarm(ctx, s.S3Client.List, path.Join(s.KeyPrefix, "action")+"/", n,
+		concurrency(s.DownloadConcurrency), s.Get)
+}
+
+// Prefetch stages the outputs of the given actions from GCS into the local
+// cache, so that a build that needs them finds them as local hits. It reads
+// at most DownloadConcurrency actions concurrently, and stops early if ctx
+// ends. Actions already in the local cache count as hits.
+func (s *GCSCache) Prefetch(ctx context.Context, actionIDs []string) (PrefetchStats, error) {
+	s.init()
+	return prefetch(ctx, actionIDs, concurrency(s.DownloadConcurrency), s.get, &s.prefetchHit, &s.prefetchMiss)
+}
+
+// Prefetch stages the outputs of the given actions from S3 into the local
+// cache, so that a build that needs them finds them as local hits. It reads
+// at most DownloadConcurrency actions concurrently, and stops early if ctx
+// ends. Actions already in the local cache count as hits.
+func (s *S3Cache) Prefetch(ctx context.Context, actionIDs []string) (PrefetchStats, error) {
+	s.init()
+	return prefetch(ctx, actionIDs, concurrency(s.DownloadConcurrency), s.get, &s.prefetchHit, &s.prefetchMiss)
+}
+
+// PrefetchStats report the results of a prefetch.
+type PrefetchStats struct {
+	Hits   int `json:"hits"`   // actions whose outputs are now in the local cache
+	Misses int `json:"misses"` // actions not found, invalid, or that failed
+}
+
+// getFunc is the signature of the Get method of a cache.
+type getFunc func(context.Context, string) (string, string, error)
+
+// prefetch calls get for each of the action IDs, with at most conc calls
+// active concurrently, and counts the results in hit and miss as well as the
+// returned stats. Invalid IDs are counted as misses without calling get. If
+// ctx ends, no more calls are started, and the error of ctx is returned.
+func prefetch(ctx context.Context, actionIDs []string, conc int, get getFunc, hit, miss *expvar.Int) (PrefetchStats, error) {
+	valid := make([]string, 0, len(actionIDs))
+	for _, id := range actionIDs {
+		if validID(id) {
+			valid = append(valid, id)
+		}
+	}
+	hits := fetchActions(ctx, valid, conc, get)
+	st := PrefetchStats{Hits: hits, Misses: len(actionIDs) - hits}
+	hit.Add(int64(st.Hits))
+	miss.Add(int64(st.Misses))
+	return st, ctx.Err()
+}
+
+// fetchActions calls get for each of the action IDs, with at most conc calls
+// active concurrently, and returns the number of calls that found an output.
+// If ctx ends, no more calls are started.
+func fetchActions(ctx context.Context, actionIDs []string, conc int, get getFunc) int {
+	var found atomic.Int64
+	g, start := taskgroup.New(nil).Limit(conc)
+	for _, id := range actionIDs {
+		if ctx.Err() != nil {
+			break
+		}
+		start(func() error {
+			// Errors here are not fatal; the build will fault the entry in later.
+			if outputID, _, err := get(ctx, id); err == nil && outputID != "" {
+				found.Add(1)
+			}
+			return nil
+		})
+	}
+	g.Wait()
+	return int(found.Load())
+}
+
+// listFunc is the signature of the List method of a storage client.
+type listFunc func(context.Context, string, func(revproxy.ObjectInfo) error) error
+
+// prewarm lists the actions under prefix, and calls get for the IDs of the n
+// most recently written, with at most conc calls active concurrently. It
+// returns the number of calls to get that found an output.
+func prewarm(ctx context.Context, list listFunc, prefix string, n, conc int, get getFunc) (int, error) {
+	if n <= 0 {
+		return 0, nil
+	}
+
+	// Keep the n most recent actions. To avoid sorting on every insert, let
+	// the buffer grow to twice that size before trimming it.
+	newestFirst := func(a, b revproxy.ObjectInfo) int { return b.ModTime.Compare(a.ModTime) }
+	var recent []revproxy.ObjectInfo
+	if err := list(ctx, prefix, func(oi revproxy.ObjectInfo) error {
+		if !validID(path.Base(oi.Key)) {
+			return nil // not an action record
+		}
+		recent = append(recent, oi)
+		if len(recent) >= 2*n {
+			slices.SortFunc(recent, newestFirst)
+			recent = recent[:n]
+		}
+		return ctx.Err()
+	}); err != nil {
+		return 0, err
+	}
+	slices.SortFunc(recent, newestFirst)
+	recent = recent[:min(n, len(recent))]
+
+	ids := make([]string, len(recent))
+	for i, oi := range recent {
+		ids[i] = path.Base(oi.Key)
+	}
+	return fetchActions(ctx, ids, conc, get), ctx.Err()
+}
@@ -6,23 +6,33 @@
 package gobuild
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"expvar"
 	"fmt"
+	"io"
 	"io/fs"
+	"math/rand/v2"
 	"os"
 	"path"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/creachadair/gocache"
 	"github.com/creachadair/gocache/cachedir"
 	"github.com/creachadair/taskgroup"
+	"github.com/tailscale/go-cache-plugin/lib/eventlog"
+	"github.com/tailscale/go-cache-plugin/lib/keylock"
+	"github.com/tailscale/go-cache-plugin/lib/revproxy"
 	"github.com/tailscale/go-cache-plugin/lib/s3util"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/sync/singleflight"
 )
 
 // S3Cache implements callbacks for a gocache.Server using an S3 bucket for
@@ -41,13 +51,32 @@ import (
 //
 // The object and action IDs are encoded as lower-case hexadecimal strings,
 // with "<xx>" denoting the first two bytes of the ID to partition the space.
+// The length of the partition can be changed by setting PartitionDepth.
 //
 // The contents of each action file have the format:
 //
-//	<output-id> <timestamp>
+//	<output-id> <timestamp> [<version>]
 //
 // where the object ID is hex encoded and the timestamp is Unix nanoseconds.
+// The version, the version ID of the output object, is present only if
+// PinVersions is set.
 // The object file contains just the binary data of the object.
+//
+// If InlineThreshold is set, an action whose output is smaller than the
+// threshold is stored in a single action file, with no output file:
+//
+//	inline <output-id> <timestamp> <size>
+//	<contents>
+//
+// where the first line is terminated by a newline, and the size is the length
+// in bytes of the contents that follow it. Reads handle either format.
+// Each file is tagged with its kind (see KindTag), in addition to any tags
+// set on the storage client.
+//
+// If CompressActions is set, action files are compressed with gzip, unless
+// that would not make them smaller. Output files are not compressed. Reads
+// recognize a compressed action file by its gzip header, so they handle
+// either form, whether or not CompressActions is set.
 type S3Cache struct {
 	// Local is the local cache directory where actions and objects are staged.
 	// It must be non-nil. A local stage is required because the Go toolchain
@@ -55,94 +84,506 @@ type S3Cache struct {
 	// It is safe to use a tmpfs directory.
 	Local *cachedir.Dir
 
-	// S3Client is the S3 client used to read and write cache entries to the
-	// backing store. It must be non-nil.
-	S3Client *s3util.Client
+	// LocalLarge, if non-nil, is a second local directory where objects larger
+	// than LargeThreshold bytes are staged instead of Local. This allows Local
+	// to be a small, fast directory (such as a tmpfs) without the risk of
+	// filling it with large objects. Lookups check Local first, then
+	// LocalLarge.
+	LocalLarge *cachedir.Dir
+
+	// LargeThreshold is the size in bytes above which objects are staged in
+	// LocalLarge. It is ignored if LocalLarge is nil.
+	LargeThreshold int64
+
+	// S3Client is the client used to read and write cache entries to the
+	// backing store. It must be non-nil. It is normally an [*s3util.Client];
+	// other implementations do not support object tags or copying to Mirror.
+	S3Client Client
 
 	// KeyPrefix, if non-empty, is prepended to each key stored into S3, with an
 	// intervening slash.
 	KeyPrefix string
 
+	// PartitionDepth, if positive, is the number of leading hex digits of each
+	// action and output ID used to partition keys. If zero or negative, it
+	// uses DefaultPartitionDepth. When reading, entries stored at the default
+	// depth are also found, to allow migrating an existing bucket.
+	PartitionDepth int
+
 	// MinUploadSize, if positive, defines a minimum object size in bytes below
 	// which the cache will not write the object to S3.
 	MinUploadSize int64
 
+	// MaxUploadSize, if positive, defines a maximum object size in bytes above
+	// which the cache will not write the object to S3. Such objects are still
+	// staged locally, so the build can proceed.
+	MaxUploadSize int64
+
+	// StrictWrites, if positive, is the number of consecutive background
+	// writes to S3 that may fail before Put reports an error to the
+	// toolchain, so that a broken bucket fails the build rather than going
+	// unnoticed. Put still stores each object locally and tries to upload it,
+	// and reports success again once an upload succeeds. If zero or negative,
+	// failed uploads are logged but otherwise ignored.
+	StrictWrites int
+
+	// SyncUploads, if true, makes Put wait for its write to S3 to finish
+	// before it returns, rather than leaving the write in the background.
+	// Writes still wait for a slot among UploadConcurrency. This slows Put,
+	// but leaves nothing to lose on an abrupt exit, and lets StrictWrites
+	// report a failed write from the Put that made it.
+	SyncUploads bool
+
+	// InlineThreshold, if positive, is the size in bytes below which an output
+	// is written inside its action record rather than as a separate object,
+	// so that reading or writing the action takes one request instead of two.
+	// Larger outputs are stored as separate objects.
+	InlineThreshold int64
+
+	// CompressActions, if true, compresses action records with gzip before
+	// they are written to S3, if that makes them smaller. Outputs, which are
+	// often compressed already, are written as they are. Compressed records
+	// are read whether or not this is set.
+	CompressActions bool
+
+	// GetTimeout, if positive, bounds the time Get spends reading an entry
+	// from S3, including staging it locally. A read that takes longer is
+	// abandoned and reported as a miss, so that the toolchain rebuilds the
+	// action rather than waiting indefinitely for a stuck read. If zero or
+	// negative, reads are bounded only by the context of the request.
+	GetTimeout time.Duration
+
+	// MaxClockSkew, if positive, is the maximum difference from the current
+	// time allowed for the timestamp of an action. When writing, a timestamp
+	// further in the past or future is replaced by the current time; when
+	// reading, so is a timestamp further in the future. This keeps a host with
+	// a bad clock from confusing age-based cleanup on other hosts.
+	MaxClockSkew time.Duration
+
+	// Retention, if positive, is how long each output object written to S3
+	// is retained by the bucket, which refuses to delete or replace it until
+	// then (see the Retention field of the storage client). Action records,
+	// and outputs stored inline in them, are not retained, since the cache
+	// replaces them as it runs. If zero or negative, objects are not retained.
+	Retention time.Duration
+
+	// RemoteTTL, if positive, is how long an action record in S3 stays
+	// fresh. Get treats a record whose timestamp is older than this as a miss,
+	// even though it is present, so the toolchain rebuilds the action and its
+	// Put replaces the record. Records are also tagged with their expiry time
+	// (see ExpiresTag). A local copy is not affected; see Local for how local
+	// files are cleaned up. If zero or negative, records do not expire.
+	RemoteTTL time.Duration
+
+	// Logf, if non-nil, is used to write warnings about conditions an operator
+	// may want to investigate. If nil, these warnings are discarded.
+	Logf func(string, ...any)
+
+	// LogMissSample, if positive, enables a sampled log of cache misses: every
+	// LogMissSample-th miss is logged to Logf, with its action ID, the output
+	// ID if known, and whether it missed only locally (local-miss) or also in
+	// S3 (fault-miss). If zero or negative, misses are not logged.
+	LogMissSample int
+
 	// UploadConcurrency, if positive, defines the maximum number of concurrent
 	// tasks for writing cache entries to S3.  If zero or negative, it uses
 	// runtime.NumCPU.
 	UploadConcurrency int
 
+	// DownloadConcurrency, if positive, defines the maximum number of
+	// concurrent reads from S3 to fault in cache entries. If zero or negative,
+	// it uses runtime.NumCPU. Reads beyond the limit wait for a slot.
+	DownloadConcurrency int
+
+	// ResumeDir, if non-empty, is a directory where objects read from S3 are
+	// staged before they are added to Local. If a read is interrupted, the
+	// partial object is kept there, and a later read of the same object
+	// resumes where it stopped. The directory must exist.
+	ResumeDir string
+
+	// SharedLocal, if true, means that Local and LocalLarge are shared with
+	// processes on other hosts, as on a network filesystem such as NFS, whose
+	// weaker consistency may let this host see a file that another host has
+	// removed, or not yet see all of its contents. Get then checks each local
+	// file before it reports a hit, and treats a file that is missing or the
+	// wrong size as a miss; Put checks the file it staged, and reports an
+	// error if it does not match.
+	SharedLocal bool
+
+	// Mirror, if non-nil, is a client for a secondary bucket to which all
+	// objects and actions written to S3 are also replicated, asynchronously
+	// and on a best-effort basis. Failures writing to the mirror are logged
+	// but do not affect the primary operation. The mirror is never read.
+	Mirror *s3util.Client
+
+	// MirrorConcurrency, if positive, defines the maximum number of concurrent
+	// tasks for writing to the mirror. If zero or negative, it uses
+	// runtime.NumCPU.
+	MirrorConcurrency int
+
+	// RemoteFirst, if true, makes Get read the action record from S3 before
+	// checking Local, and fault in its output without checking for a local
+	// copy. Local is consulted only if the action is not found in S3, for
+	// example because its output was too small to upload.
+	//
+	// This helps when Local is usually cold, as in a fresh container, or is
+	// slower to check than S3, as on a network filesystem. It hurts when
+	// Local is warm and fast, as on a local SSD, since every hit then costs a
+	// round trip to S3 and a transfer of the output. Compare get_local_hit
+	// with get_fault_hit, and get_local_fallback, to decide.
+	RemoteFirst bool
+
+	// UploadPacing, if positive, spreads bursts of background writes to S3
+	// over time: when other writes are already pending, each write waits for
+	// a random delay of up to UploadPacing before it starts. This reduces the
+	// chance of tripping the request rate limits of the bucket, at the cost
+	// of some latency. Close still waits for all writes to finish.
+	UploadPacing time.Duration
+
+	// OpenFiles, if non-nil, limits the number of files the cache holds open
+	// at once in the local directory, including objects staged for upload.
+	// Operations beyond the limit wait for a slot. The same semaphore may be
+	// shared with other caches to apply a single limit across all of them.
+	OpenFiles *semaphore.Weighted
+
+	// Breaker, if non-nil, is a circuit breaker for requests to S3. While it
+	// is open, Get reports a miss for entries not found locally, and Put keeps
+	// new entries local only, without waiting for S3 to fail.
+	Breaker *Breaker
+
+	// NegCacheTTL, if positive, enables a negative cache of actions recently
+	// found missing from S3: for NegCacheTTL after a miss, Get reports a miss
+	// for the same action without a round trip to S3. This saves repeated
+	// lookups of the same missing action within a build, at the cost of
+	// missing an action written meanwhile by another client. A Put of the
+	// action clears its entry. If zero or negative, misses are not cached.
+	NegCacheTTL time.Duration
+
+	// NegCacheSize, if positive, is the maximum number of actions held in the
+	// negative cache, the oldest being discarded first. If zero or negative,
+	// it uses DefaultNegCacheSize. It is ignored unless NegCacheTTL > 0.
+	NegCacheSize int
+
+	// AdmissionWindow, if positive, enables an admission filter for uploads:
+	// an object is written to S3 only the second time it is Put within
+	// about AdmissionWindow Puts, so that objects produced once and never
+	// again, which are unlikely to be read, do not take space in the bucket.
+	// The counts are estimated in a sketch of about 4*AdmissionWindow bytes.
+	// Skipped objects are kept in Local. This trades hits on the first reuse
+	// of each object, by other clients, for less storage and upload traffic.
+	AdmissionWindow int
+
+	// PinVersions, if true, records in each action record written to S3 the
+	// version of its output object, and makes Get read that version of the
+	// output, so that a reader never sees an object that a concurrent writer
+	// is replacing. If the pinned version is no longer available, for example
+	// because the bucket does not keep old versions, Get reads the current
+	// object. It has no effect unless S3Client implements
+	// [revproxy.VersionedClient]. Records written in batches are not pinned.
+	PinVersions bool
+
+	// Manifest, if non-nil, records each action written to S3, with the
+	// output it produced (see [Manifest]).
+	Manifest *Manifest
+
+	// Events, if non-nil, records an event for each Get and Put, for analysis
+	// of cache effectiveness (see [eventlog.Log]).
+	Events *eventlog.Log
+
 	// Tracks tasks pushing cache writes to S3.
 	initOnce sync.Once
 	push     *taskgroup.Group
 	start    func(taskgroup.Task)
 
-	getLocalHit  expvar.Int // count of Get hits in the local cache
-	getFaultHit  expvar.Int // count of Get hits faulted in from S3
-	getFaultMiss expvar.Int // count of Get faults that were misses
-	putSkipSmall expvar.Int // count of "small" objects not written to S3
-	putS3Found   expvar.Int // count of objects not written to S3 because they were already present
-	putS3Action  expvar.Int // count of actions written to S3
-	putS3Object  expvar.Int // count of objects written to S3
-	putS3Error   expvar.Int // count of errors writing to S3
+	// Limits concurrent reads faulting in cache entries.
+	fetch *semaphore.Weighted
+
+	neg    *negCache        // actions recently missing from storage; nil if disabled
+	admit  *admissionFilter // objects seen recently; nil if disabled
+	stage  keylock.Set      // serializes staging of each action locally by Put
+	faults faultGroup       // shares concurrent faults of each action by Get
+
+	// Tracks tasks replicating cache writes to the mirror.
+	mirror      *taskgroup.Group
+	startMirror func(taskgroup.Task)
+
+	pending atomic.Int64 // count of background writes in progress
+	misses  missSampler  // counts misses for LogMissSample
+
+	getLocalHit   expvar.Int // count of Get hits in the local cache
+	getLocalStale expvar.Int // count of local files that failed the SharedLocal check
+	getFaultHit   expvar.Int // count of Get hits faulted in from S3
+	getFaultMiss  expvar.Int // count of Get faults that were misses
+	getFallback   expvar.Int // count of RemoteFirst misses that hit in the local cache
+	getThrottled  expvar.Int // count of Get faults that waited for a download slot
+	getTimeout    expvar.Int // count of Get faults abandoned after GetTimeout
+	getNegHit     expvar.Int // count of Get misses answered by the negative cache
+	getPinned     expvar.Int // count of Get faults that read the pinned version of the output
+	getInline     expvar.Int // count of Get faults whose output was inline in the action
+	getPinMissing expvar.Int // count of Get faults whose pinned version was not available
+	prefetchHit   expvar.Int // count of prefetched actions whose outputs are local
+	prefetchMiss  expvar.Int // count of prefetched actions not found or failed
+	fdWait        expvar.Int // count of file operations that waited for an open-file slot
+	actionBadTime expvar.Int // count of action timestamps outside MaxClockSkew
+	actionCorrupt expvar.Int // count of malformed action records treated as misses
+	getTTLExpired expvar.Int // count of action records older than RemoteTTL treated as misses
+	putSkipSmall  expvar.Int // count of "small" objects not written to S3
+	putSkipLarge  expvar.Int // count of "large" objects not written to S3
+	putAdmitSkip  expvar.Int // count of objects not written to S3 on their first sight
+	putS3Found    expvar.Int // count of objects not written to S3 because they were already present
+	putS3Action   expvar.Int // count of actions written to S3
+	putInline     expvar.Int // count of actions written to S3 with their output inline
+	putS3Object   expvar.Int // count of objects written to S3
+	putS3Error    expvar.Int // count of errors writing to S3
+	putActionGzip expvar.Int // count of action records written to S3 compressed
+	putActionRaw  expvar.Int // count of action records written to S3 uncompressed
+	putRateLimit  expvar.Int // count of writes to S3 rejected by rate limiting (429 or 503)
+	putIntegrity  expvar.Int // count of writes rejected by S3 for a checksum mismatch
+	putCondRace   expvar.Int // count of conditional writes that lost a race with another writer
+	putFailStreak failStreak // count of consecutive background writes that failed
+	opErr         ctxErrors  // count of operations that timed out or were canceled
+	mirrorObject  expvar.Int // count of objects written to the mirror
+	mirrorAction  expvar.Int // count of actions written to the mirror
+	mirrorError   expvar.Int // count of errors writing to the mirror
 }
 
 func (s *S3Cache) init() {
 	s.initOnce.Do(func() {
-		s.push, s.start = taskgroup.New(nil).Limit(s.uploadConcurrency())
+		var start func(taskgroup.Task)
+		s.push, start = taskgroup.New(nil).Limit(s.uploadConcurrency())
+		s.start = countTasks(start, &s.pending)
+		s.fetch = semaphore.NewWeighted(int64(concurrency(s.DownloadConcurrency)))
+		s.neg = newNegCache(s.NegCacheTTL, s.NegCacheSize)
+		s.admit = newAdmissionFilter(s.AdmissionWindow)
+		if s.Mirror != nil {
+			var start func(taskgroup.Task)
+			s.mirror, start = taskgroup.New(nil).Limit(concurrency(s.MirrorConcurrency))
+			s.startMirror = countTasks(start, &s.pending)
+		}
 	})
 }
 
 // Get implements the corresponding callback of the cache protocol.
-func (s *S3Cache) Get(ctx context.Context, actionID string) (outputID, diskPath string, _ error) {
+func (s *S3Cache) Get(ctx context.Context, actionID string) (outputID, diskPath string, err error) {
+	start := time.Now()
+	outputID, diskPath, err = s.get(ctx, actionID)
+	s.opErr.note(err)
+	recordGet(s.Events, actionID, diskPath, start, err)
+	return outputID, diskPath, err
+}
+
+func (s *S3Cache) get(ctx context.Context, actionID string) (outputID, diskPath string, _ error) {
 	s.init()
 
-	objID, diskPath, err := s.Local.Get(ctx, actionID)
-	if err == nil && objID != "" && diskPath != "" {
-		s.getLocalHit.Add(1)
-		return objID, diskPath, nil // cache hit, OK
+	if !s.RemoteFirst {
+		if objID, diskPath, err := s.getLocal(ctx, actionID); err != nil || objID != "" {
+			return objID, diskPath, err // cache hit, OK
+		}
 	}
 
-	// Reaching here, either we got a cache miss or an error reading from local.
-	// Try reading the action from S3.
-	action, err := s.S3Client.GetData(ctx, s.actionKey(actionID))
-	if err != nil {
+	// Concurrent requests for the same action share one fault, so that they
+	// do not each read it from S3.
+	return s.faults.do(ctx, actionID, func(ctx context.Context) (string, string, error) {
+		return s.fault(ctx, actionID)
+	})
+}
+
+// fault reads the action record for actionID from S3, and stages it and its
+// output in the local cache. Requests for the same action must not call fault
+// concurrently (see faultGroup).
+func (s *S3Cache) fault(ctx context.Context, actionID string) (outputID, diskPath string, _ error) {
+	// Check again for a local copy, which a fault that ended just before this
+	// one began may have staged.
+	if !s.RemoteFirst {
+		if objID, diskPath, err := s.getLocal(ctx, actionID); err != nil || objID != "" {
+			return objID, diskPath, err
+		}
+	}
+
+	// Reaching here, either we got a cache miss or an error reading from local,
+	// or we did not check local first. Unless the action recently missed in
+	// S3, wait for a slot to read from S3, and hold it until the result is
+	// staged.
+	negHit := s.neg.has(actionID)
+	if !negHit {
+		if err := acquire(ctx, s.fetch, &s.getThrottled); err != nil {
+			return "", "", err
+		}
+		defer s.fetch.Release(1)
+	}
+
+	// Bound the time spent reading from S3, if requested. The original
+	// context still governs the local cache.
+	gctx, cancel := getContext(ctx, s.GetTimeout)
+	defer cancel()
+
+	// Try reading the action from S3, unless it recently missed there or S3
+	// is known to be unhealthy.
+	var action []byte
+	err := errBreakerOpen
+	if negHit {
+		s.getNegHit.Add(1)
+		err = errNegCached
+	} else if s.Breaker.Allow() {
+		action, err = getFirst(s.actionReadKeys(actionID), func(key string) ([]byte, error) {
+			return s.S3Client.GetData(gctx, key)
+		})
+		s.Breaker.Done(err)
 		if errors.Is(err, fs.ErrNotExist) {
+			s.neg.add(actionID)
+		}
+	}
+	if isTimeout(ctx, gctx, err) {
+		s.getTimeout.Add(1)
+		s.opErr.timeout.Add(1)
+		s.logMiss(actionID, "", missTime)
+		return "", "", nil // treat as a miss, so the build proceeds
+	} else if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			if s.RemoteFirst {
+				objID, diskPath, err := s.getLocal(ctx, actionID)
+				if err != nil {
+					return "", "", err
+				} else if objID != "" {
+					s.getFallback.Add(1)
+					return objID, diskPath, nil
+				}
+			}
 			s.getFaultMiss.Add(1)
+			s.logMiss(actionID, "", missFault)
 			return "", "", nil // cache miss, OK
 		}
 		return "", "", fmt.Errorf("[s3] read action %s: %w", actionID, err)
 	}
 
-	// We got an action hit remotely, try to update the local copy.
-	outputID, mtime, err := parseAction(action)
+	// We got an action hit remotely, try to update the local copy. The record
+	// may hold the output inline, in which case it is staged from there.
+	outputID, mtime, version, body, inline, err := parseAnyAction(action)
 	if err != nil {
-		return "", "", err
+		// A record damaged by an interrupted write is a miss, so the toolchain
+		// rebuilds the action and its put replaces the record.
+		s.actionCorrupt.Add(1)
+		s.logMiss(actionID, "", missCorrupt)
+		s.logf("[s3] action %s: %v (treating as miss)", actionID, err)
+		return "", "", nil
 	}
+	mtime = s.checkTime(actionID, mtime, false)
+	if expired(mtime, s.RemoteTTL) {
+		s.getTTLExpired.Add(1)
+		s.logMiss(actionID, outputID, missExpired)
+		return "", "", nil
+	}
+	s.logMiss(actionID, outputID, missLocal)
 
-	object, size, err := s.S3Client.Get(ctx, s.outputKey(outputID))
+	// Hold a file slot for the local copy, and another for the staged copy
+	// if reads are resumable, until the object is added to Local.
+	nfiles := int64(1)
+	if s.ResumeDir != "" && !inline {
+		nfiles = 2
+	}
+	release, err := holdFiles(ctx, s.OpenFiles, nfiles, &s.fdWait)
 	if err != nil {
-		// At this point we know the action exists, so if we can't read the
-		// object report it as an error rather than a cache miss.
-		return "", "", fmt.Errorf("[s3] read object %s: %w", outputID, err)
+		return "", "", err
+	}
+	defer release()
+
+	var object io.ReadCloser
+	var size int64
+	if inline {
+		// The output is held in the record, so there is no object to read.
+		object, size = io.NopCloser(bytes.NewReader(body)), int64(len(body))
+		s.getInline.Add(1)
+	} else {
+		// If the action pins a version of its output, read that version, so
+		// that a write of the object in progress is not seen half done.
+		var pinned bool
+		object, size, pinned, err = getVersion(gctx, s.S3Client, s.outputKey(outputID), version, &s.getPinMissing)
+		if !pinned {
+			object, err = getFirst(s.outputReadKeys(outputID), func(key string) (io.ReadCloser, error) {
+				if s.ResumeDir != "" {
+					f, n, err := revproxy.GetResumable(gctx, s.S3Client, key, s.resumePath(outputID))
+					size = n
+					return f, err
+				}
+				rc, n, err := s.S3Client.Get(gctx, key)
+				size = n
+				return rc, err
+			})
+		} else if err == nil {
+			s.getPinned.Add(1)
+		}
+		s.Breaker.Done(err)
+		if isTimeout(ctx, gctx, err) {
+			s.getTimeout.Add(1)
+			s.opErr.timeout.Add(1)
+			s.logMiss(actionID, outputID, missTime)
+			return "", "", nil
+		} else if err != nil {
+			// At this point we know the action exists, so if we can't read the
+			// object report it as an error rather than a cache miss.
+			return "", "", fmt.Errorf("[s3] read object %s: %w", outputID, err)
+		}
+		if s.ResumeDir != "" {
+			defer os.Remove(s.resumePath(outputID))
+		}
 	}
 	defer object.Close()
 	s.getFaultHit.Add(1)
 
 	// Now we should have the body; poke it into the local cache.  Preserve the
 	// modification timestamp recorded with the original action.
-	diskPath, err = s.Local.Put(ctx, gocache.Object{
+	local := stageDir(s.Local, s.LocalLarge, s.LargeThreshold, size)
+	diskPath, err = local.Put(gctx, gocache.Object{
 		ActionID: actionID,
 		OutputID: outputID,
 		Size:     size,
 		Body:     object,
 		ModTime:  mtime,
 	})
+	if isTimeout(ctx, gctx, err) {
+		s.getTimeout.Add(1)
+		s.opErr.timeout.Add(1)
+		s.logMiss(actionID, outputID, missTime)
+		return "", "", nil
+	} else if err == nil && s.SharedLocal && !checkStaged(diskPath, size) {
+		s.getLocalStale.Add(1)
+		s.logf("[s3] staged output %s for action %s does not have size %d (treating as miss)", outputID, actionID, size)
+		return "", "", nil
+	}
 	return outputID, diskPath, err
 }
 
+// getLocal reads the action record for actionID from the local cache, and
+// reports the output ID and path if found, or empty strings if not. Errors
+// reading the local cache are treated as misses.
+func (s *S3Cache) getLocal(ctx context.Context, actionID string) (outputID, diskPath string, _ error) {
+	release, err := holdFiles(ctx, s.OpenFiles, 1, &s.fdWait)
+	if err != nil {
+		return "", "", err
+	}
+	defer release()
+	objID, diskPath, err := getTiered(ctx, s.Local, s.LocalLarge, actionID)
+	if err == nil && objID != "" && diskPath != "" {
+		if s.SharedLocal && !checkStaged(diskPath, -1) {
+			s.getLocalStale.Add(1)
+			return "", "", nil
+		}
+		s.getLocalHit.Add(1)
+		return objID, diskPath, nil
+	}
+	return "", "", nil
+}
+
 // Put implements the corresponding callback of the cache protocol.
-func (s *S3Cache) Put(ctx context.Context, obj gocache.Object) (diskPath string, _ error) {
+func (s *S3Cache) Put(ctx context.Context, obj gocache.Object) (diskPath string, err error) {
+	start := time.Now()
+	diskPath, err = s.put(ctx, obj)
+	s.opErr.note(err)
+	recordPut(s.Events, obj, start, err)
+	return diskPath, err
+}
+
+func (s *S3Cache) put(ctx context.Context, obj gocache.Object) (string, error) {
 	s.init()
 
 	// Compute an etag so we can do a conditional put on the object data.
@@ -151,38 +592,115 @@ func (s *S3Cache) Put(ctx context.Context, obj gocache.Object) (diskPath string,
 	etr := s3util.NewETagReader(obj.Body)
 	obj.Body = etr
 
-	diskPath, err := s.Local.Put(ctx, obj)
+	// Stage the output under the lock for its action, so that concurrent
+	// Puts of the action take turns. A fault of the action by Get may stage
+	// it meanwhile, but each file is replaced atomically, so either copy is
+	// complete.
+	unlock, err := s.stage.Lock(ctx, obj.ActionID)
+	if err != nil {
+		return "", err
+	}
+	release, err := holdFiles(ctx, s.OpenFiles, 1, &s.fdWait)
+	if err != nil {
+		unlock()
+		return "", err
+	}
+	diskPath, err := stageDir(s.Local, s.LocalLarge, s.LargeThreshold, obj.Size).Put(ctx, obj)
+	release()
+	unlock()
 	if err != nil {
 		return "", err // don't bother trying to forward it to the remote
+	} else if s.SharedLocal && !checkStaged(diskPath, obj.Size) {
+		s.getLocalStale.Add(1)
+		return "", fmt.Errorf("[s3] staged output %s does not have size %d", obj.OutputID, obj.Size)
 	}
+	s.neg.remove(obj.ActionID)
 	if obj.Size < s.MinUploadSize {
 		s.putSkipSmall.Add(1)
 		return diskPath, nil // don't bother uploading this, it's too small
 	}
+	if s.MaxUploadSize > 0 && obj.Size > s.MaxUploadSize {
+		s.putSkipLarge.Add(1)
+		s.logf("WARNING: [s3] not uploading object %s for action %s: size %d exceeds limit %d",
+			obj.OutputID, obj.ActionID, obj.Size, s.MaxUploadSize)
+		return diskPath, nil // too large, keep it local only
+	}
+	if !s.admit.admit(obj.OutputID) {
+		s.putAdmitSkip.Add(1)
+		return diskPath, nil // not seen before, keep it local only for now
+	}
+
+	// Try to push the record to S3 in the background, or wait for it if
+	// uploads are synchronous.
+	runTask(s.start, s.SyncUploads, func() (err error) {
+		if !s.Breaker.Allow() {
+			return nil // S3 is unhealthy, keep the entry local only
+		}
+		defer func() { s.putFailStreak.note(err) }()
+		pace(s.UploadPacing, &s.pending)
 
-	// Try to push the record to S3 in the background.
-	s.start(func() error {
 		// Override the context with a separate timeout in case S3 is farkakte.
 		sctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 1*time.Minute)
 		defer cancel()
 
 		// Stage 1: Maybe write the object. Do this before writing the action
-		// record so we are less likely to get a spurious miss later.
-		mtime, err := s.maybePutObject(sctx, obj.OutputID, diskPath, etr.ETag())
-		if err != nil {
-			return err
+		// record so we are less likely to get a spurious miss later. A small
+		// output is instead read to be written inline in the action record.
+		inline := obj.Size < s.InlineThreshold
+		var data []byte
+		var mtime time.Time
+		if inline {
+			data, mtime, err = readInline(sctx, diskPath, s.OpenFiles, &s.fdWait)
+			if err != nil {
+				gocache.Logf(ctx, "[s3] read local object %s: %v", obj.OutputID, err)
+				return err
+			}
+		} else {
+			mtime, err = s.maybePutObject(sctx, obj.OutputID, diskPath, etr.ETag())
+			s.Breaker.Done(err)
+			if err != nil {
+				return err
+			}
 		}
+		mtime = s.checkTime(obj.ActionID, mtime, true)
 
 		// Stage 2: Write the action record.
-		if err := s.S3Client.Put(ctx, s.actionKey(obj.ActionID),
-			strings.NewReader(fmt.Sprintf("%s %d", obj.OutputID, mtime.UnixNano()))); err != nil {
+		var record []byte
+		if inline {
+			record = formatInlineAction(obj.OutputID, mtime, data)
+		} else {
+			var version string
+			if s.PinVersions {
+				version = objectVersion(sctx, s.S3Client, s.outputKey(obj.OutputID), s.logf)
+			}
+			record = []byte(formatAction(obj.OutputID, mtime, version))
+		}
+		record = encodeAction(record, s.CompressActions, &s.putActionGzip, &s.putActionRaw)
+		err = withTags(s.S3Client, recordTags(mtime, s.RemoteTTL)).Put(sctx, s.actionKey(obj.ActionID), bytes.NewReader(record))
+		s.Breaker.Done(err)
+		if err != nil {
+			if errors.Is(err, revproxy.ErrChecksumMismatch) {
+				s.putIntegrity.Add(1)
+			} else if errors.Is(err, revproxy.ErrThrottled) {
+				s.putRateLimit.Add(1)
+			} else {
+				s.opErr.note(err)
+			}
 			gocache.Logf(ctx, "write action %s: %v", obj.ActionID, err)
 			return err
 		}
 		s.putS3Action.Add(1)
+		if inline {
+			s.putInline.Add(1)
+		}
+		recordAction(s.Manifest, obj, mtime, s.logf)
+		s.mirrorPut(ctx, obj.OutputID, obj.ActionID, diskPath, etr.ETag(), mtime)
 		return nil
 	})
 
+	if err := s.putFailStreak.check(s.StrictWrites); err != nil {
+		return "", fmt.Errorf("[s3] %w", err)
+	}
 	return diskPath, nil
 }
 
@@ -194,25 +712,68 @@ func (s *S3Cache) Close(ctx context.Context) error {
 		s.push.Wait()
 		gocache.Logf(ctx, "uploads complete (%v elapsed)", time.Since(wstart).Round(10*time.Microsecond))
 	}
-	return nil
+	var merr error
+	if s.mirror != nil {
+		gocache.Logf(ctx, "waiting for mirror writes...")
+		s.mirror.Wait()
+		merr = s.Mirror.Close()
+	}
+	return errors.Join(merr, s.S3Client.Close())
 }
 
+// Pending reports the number of writes to storage, including the mirror,
+// that have been started in the background and have not yet finished.
+func (s *S3Cache) Pending() int { return int(s.pending.Load()) }
+
 // SetMetrics implements the corresponding server callback.
 func (s *S3Cache) SetMetrics(_ context.Context, m *expvar.Map) {
 	m.Set("get_local_hit", &s.getLocalHit)
+	m.Set("get_local_stale", &s.getLocalStale)
 	m.Set("get_fault_hit", &s.getFaultHit)
 	m.Set("get_fault_miss", &s.getFaultMiss)
+	m.Set("get_local_fallback", &s.getFallback)
+	m.Set("get_throttled", &s.getThrottled)
+	m.Set("get_timeout", &s.getTimeout)
+	m.Set("get_neg_cache_hit", &s.getNegHit)
+	m.Set("get_pinned", &s.getPinned)
+	m.Set("get_inline", &s.getInline)
+	m.Set("get_pin_missing", &s.getPinMissing)
+	m.Set("prefetch_hit", &s.prefetchHit)
+	m.Set("prefetch_miss", &s.prefetchMiss)
+	m.Set("fd_wait", &s.fdWait)
+	m.Set("action_bad_timestamp", &s.actionBadTime)
+	m.Set("action_corrupt", &s.actionCorrupt)
+	m.Set("get_ttl_expired", &s.getTTLExpired)
 	m.Set("put_skip_small", &s.putSkipSmall)
+	m.Set("put_skip_large", &s.putSkipLarge)
+	m.Set("put_admission_skip", &s.putAdmitSkip)
 	m.Set("put_s3_found", &s.putS3Found)
 	m.Set("put_s3_action", &s.putS3Action)
+	m.Set("put_inline", &s.putInline)
 	m.Set("put_s3_object", &s.putS3Object)
 	m.Set("put_s3_error", &s.putS3Error)
+	m.Set("put_action_compressed", &s.putActionGzip)
+	m.Set("put_action_plain", &s.putActionRaw)
+	m.Set("put_rate_limited", &s.putRateLimit)
+	m.Set("put_integrity_fail", &s.putIntegrity)
+	m.Set("put_cond_race", &s.putCondRace)
+	m.Set("put_fail_streak", &s.putFailStreak)
+	s.opErr.setMetrics(m)
+	s.Breaker.setMetrics(m)
+	m.Set("mirror_object", &s.mirrorObject)
+	m.Set("mirror_action", &s.mirrorAction)
+	m.Set("mirror_error", &s.mirrorError)
 }
 
 // maybePutObject writes the specified object contents to S3 if there is not
 // already a matching key with the same etag. It returns the modified time of
 // the object file, whether or not it was sent to S3.
 func (s *S3Cache) maybePutObject(ctx context.Context, outputID, diskPath, etag string) (time.Time, error) {
+	release, err := holdFiles(ctx, s.OpenFiles, 1, &s.fdWait)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer release()
 	f, err := os.Open(diskPath)
 	if err != nil {
 		gocache.Logf(ctx, "[s3] open local object %s: %v", outputID, err)
@@ -224,44 +785,354 @@ func (s *S3Cache) maybePutObject(ctx context.Context, outputID, diskPath, etag s
 		return time.Time{}, err
 	}
 
-	written, err := s.S3Client.PutCond(ctx, s.outputKey(outputID), etag, f)
-	if err != nil {
-		s.putS3Error.Add(1)
+	written, err := withRetention(withTags(s.S3Client, outputTags), s.Retention).PutCond(ctx, s.outputKey(outputID), etag, f)
+	if errors.Is(err, revproxy.ErrPutRace) {
+		// Another writer stored the object while we were checking for it.
+		s.putCondRace.Add(1)
+		s.putS3Found.Add(1)
+		return fi.ModTime(), nil
+	} else if errors.Is(err, revproxy.ErrChecksumMismatch) {
+		s.putIntegrity.Add(1)
+		s.logf("WARNING: [s3] object %s corrupted in transit: %v", outputID, err)
+		return fi.ModTime(), err
+	} else if err != nil {
+		if errors.Is(err, revproxy.ErrThrottled) {
+			s.putRateLimit.Add(1)
+		}
+		if !s.opErr.note(err) {
+			s.putS3Error.Add(1)
+		}
 		gocache.Logf(ctx, "[s3] put object %s: %v", outputID, err)
 		return fi.ModTime(), err
 	}
 	if written {
-		s.putS3Found.Add(1)
-		return fi.ModTime(), nil // already present and matching
+		s.putS3Object.Add(1)
+	} else {
+		s.putS3Found.Add(1) // already present and matching
 	}
-	s.putS3Object.Add(1)
 	return fi.ModTime(), nil
 }
 
+// mirrorPut enqueues a task to replicate the specified object and its action
+// record to the mirror, if one is configured.
+func (s *S3Cache) mirrorPut(ctx context.Context, outputID, actionID, diskPath, etag string, mtime time.Time) {
+	if s.mirror == nil {
+		return
+	}
+	s.startMirror(func() error {
+		mctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 1*time.Minute)
+		defer cancel()
+
+		if written, err := s.mirrorOutput(mctx, outputID, diskPath, etag); err != nil {
+			s.mirrorError.Add(1)
+			gocache.Logf(ctx, "[s3] mirror: put object %s: %v", outputID, err)
+			return nil
+		} else if written {
+			s.mirrorObject.Add(1)
+		}
+		if err := s.Mirror.WithTags(actionTags).Put(mctx, s.actionKey(actionID), strings.NewReader(formatAction(outputID, mtime, ""))); err != nil {
+			s.mirrorError.Add(1)
+			gocache.Logf(ctx, "[s3] mirror: write action %s: %v", actionID, err)
+			return nil
+		}
+		s.mirrorAction.Add(1)
+		return nil
+	})
+}
+
+// mirrorOutput writes the specified output object to the mirror from its local
+// copy at diskPath. If the local copy is gone, for example because it expired
+// while the write was queued, the object is copied from the primary bucket by
+// the server instead. It reports whether the object was written.
+func (s *S3Cache) mirrorOutput(ctx context.Context, outputID, diskPath, etag string) (bool, error) {
+	key := s.outputKey(outputID)
+	release, err := holdFiles(ctx, s.OpenFiles, 1, &s.fdWait)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+	f, err := os.Open(diskPath)
+	if src, ok := s.S3Client.(*s3util.Client); ok && errors.Is(err, fs.ErrNotExist) {
+		return true, s.Mirror.WithTags(outputTags).CopyFrom(ctx, src, key, key)
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	written, err := s.Mirror.WithTags(outputTags).PutCond(ctx, key, etag, f)
+	if errors.Is(err, revproxy.ErrPutRace) {
+		s.putCondRace.Add(1)
+		return false, nil
+	}
+	return written, err
+}
+
+// checkTime returns the timestamp t of the action record for actionID, or the
+// current time if t is not within MaxClockSkew (see clampTime).
+func (s *S3Cache) checkTime(actionID string, t time.Time, past bool) time.Time {
+	ct, ok := clampTime(t, s.MaxClockSkew, past)
+	if !ok {
+		s.actionBadTime.Add(1)
+		s.logf("WARNING: [s3] action %s has timestamp %v, more than %v from now (using current time)",
+			actionID, t.Format(time.RFC3339), s.MaxClockSkew)
+	}
+	return ct
+}
+
+// logMiss logs a cache miss for actionID, if it is selected by the sampler.
+// If the output ID is not known, outputID == "".
+func (s *S3Cache) logMiss(actionID, outputID, reason string) {
+	if s.misses.sample(s.LogMissSample) {
+		if outputID == "" {
+			outputID = "-"
+		}
+		s.logf("[s3] sampled miss: action %s output %s (%s)", actionID, outputID, reason)
+	}
+}
+
+func (s *S3Cache) logf(msg string, args ...any) {
+	if s.Logf != nil {
+		s.Logf(msg, args...)
+	}
+}
+
 // makeKey assembles a complete key from the specified parts, including the key
 // prefix if one is defined.
 func (s *S3Cache) makeKey(parts ...string) string {
 	return path.Join(s.KeyPrefix, path.Join(parts...))
 }
 
-func (s *S3Cache) actionKey(id string) string { return s.makeKey("action", id[:2], id) }
-func (s *S3Cache) outputKey(id string) string { return s.makeKey("output", id[:2], id) }
+func (s *S3Cache) actionKey(id string) string {
+	return s.makeKey("action", id[:partitionDepth(s.PartitionDepth)], id)
+}
+
+func (s *S3Cache) outputKey(id string) string {
+	return s.makeKey("output", id[:partitionDepth(s.PartitionDepth)], id)
+}
 
-func (s *S3Cache) uploadConcurrency() int {
-	if s.UploadConcurrency <= 0 {
+func (s *S3Cache) actionReadKeys(id string) []string {
+	return readKeys(s.KeyPrefix, "action", id, s.PartitionDepth)
+}
+
+func (s *S3Cache) outputReadKeys(id string) []string {
+	return readKeys(s.KeyPrefix, "output", id, s.PartitionDepth)
+}
+
+// resumePath returns the path in ResumeDir where outputID is staged.
+func (s *S3Cache) resumePath(outputID string) string { return filepath.Join(s.ResumeDir, outputID) }
+
+func (s *S3Cache) uploadConcurrency() int { return concurrency(s.UploadConcurrency) }
+
+// concurrency returns n if it is positive, or otherwise runtime.NumCPU.
+func concurrency(n int) int {
+	if n <= 0 {
 		return runtime.NumCPU()
 	}
-	return s.UploadConcurrency
+	return n
+}
+
+// countTasks returns a function that starts tasks with start, and counts
+// in pending the number of those tasks that have not yet finished.
+func countTasks(start func(taskgroup.Task), pending *atomic.Int64) func(taskgroup.Task) {
+	return func(task taskgroup.Task) {
+		pending.Add(1)
+		start(func() error {
+			defer pending.Add(-1)
+			return task()
+		})
+	}
+}
+
+// runTask runs task with start, and if wait is true, waits for it to finish.
+func runTask(start func(taskgroup.Task), wait bool, task taskgroup.Task) {
+	if !wait {
+		start(task)
+		return
+	}
+	done := make(chan struct{})
+	start(func() error {
+		defer close(done)
+		return task()
+	})
+	<-done
 }
 
+// getContext returns a context governed by ctx for a read from storage, with
+// a timeout of d if d is positive, and a function to release it.
+func getContext(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// ctxErrors counts operations that failed because their context ended,
+// separating timeouts, which suggest that storage is slow, from
+// cancellations, which mean that the client went away.
+type ctxErrors struct {
+	timeout  expvar.Int
+	canceled expvar.Int
+}
+
+// note reports whether err is the result of a context ending, and if so,
+// counts it as a timeout or a cancellation.
+func (c *ctxErrors) note(err error) bool {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		c.timeout.Add(1)
+	case errors.Is(err, context.Canceled):
+		c.canceled.Add(1)
+	default:
+		return false
+	}
+	return true
+}
+
+func (c *ctxErrors) setMetrics(m *expvar.Map) {
+	m.Set("op_timeout", &c.timeout)
+	m.Set("op_canceled", &c.canceled)
+}
+
+// isTimeout reports whether err is the result of gctx, obtained from
+// getContext(ctx, ...), reaching its deadline while ctx is still active.
+func isTimeout(ctx, gctx context.Context, err error) bool {
+	return err != nil && ctx.Err() == nil && errors.Is(gctx.Err(), context.DeadlineExceeded)
+}
+
+// failStreak counts consecutive failures of background writes to storage, for
+// StrictWrites. A successful write resets the count.
+type failStreak struct{ expvar.Int }
+
+// note records the outcome of a background write.
+func (f *failStreak) note(err error) {
+	if err != nil {
+		f.Add(1)
+	} else {
+		f.Set(0)
+	}
+}
+
+// check reports an error if limit is positive and at least limit writes in a
+// row have failed.
+func (f *failStreak) check(limit int) error {
+	if n := f.Value(); limit > 0 && n >= int64(limit) {
+		return fmt.Errorf("the last %d writes to storage failed", n)
+	}
+	return nil
+}
+
+// acquire acquires a slot from sema, and counts in throttled whether it had
+// to wait for one.
+func acquire(ctx context.Context, sema *semaphore.Weighted, throttled *expvar.Int) error {
+	if sema.TryAcquire(1) {
+		return nil
+	}
+	throttled.Add(1)
+	return sema.Acquire(ctx, 1)
+}
+
+// pace waits for a random delay of up to d before a background write, if d is
+// positive and other writes are pending, to spread bursts of writes over time.
+func pace(d time.Duration, pending *atomic.Int64) {
+	if d > 0 && pending.Load() > 1 {
+		time.Sleep(rand.N(d))
+	}
+}
+
+// holdFiles acquires n slots from sema, if it is non-nil, and counts in wait
+// whether it had to wait for them. It returns a function that releases the
+// slots, which is a no-op if sema is nil.
+func holdFiles(ctx context.Context, sema *semaphore.Weighted, n int64, wait *expvar.Int) (func(), error) {
+	if sema == nil {
+		return func() {}, nil
+	}
+	if !sema.TryAcquire(n) {
+		wait.Add(1)
+		if err := sema.Acquire(ctx, n); err != nil {
+			return nil, err
+		}
+	}
+	return func() { sema.Release(n) }, nil
+}
+
+// faultGroup shares the fault of a build action from storage among concurrent
+// requests for it, so that they do not each read it. Unlike a lock, it does
+// not make requests for other actions wait while one is read.
+type faultGroup struct{ g singleflight.Group }
+
+type faultResult struct{ outputID, diskPath string }
+
+// do calls fault for actionID, or waits for a call already in progress and
+// reports its result. The call runs with the context of the request that
+// started it. If that request ends first, a waiter whose own context is still
+// active calls fault again, rather than report the other request's error.
+func (f *faultGroup) do(ctx context.Context, actionID string, fault func(context.Context) (string, string, error)) (outputID, diskPath string, _ error) {
+	for retried := false; ; retried = true {
+		ch := f.g.DoChan(actionID, func() (any, error) {
+			outputID, diskPath, err := fault(ctx)
+			return faultResult{outputID, diskPath}, err
+		})
+		select {
+		case <-ctx.Done():
+			return "", "", ctx.Err()
+		case r := <-ch:
+			if r.Shared && !retried && ctx.Err() == nil && isContextErr(r.Err) {
+				continue // the request that started the call went away
+			}
+			res, _ := r.Val.(faultResult)
+			return res.outputID, res.diskPath, r.Err
+		}
+	}
+}
+
+// isContextErr reports whether err is the result of a context ending.
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// clampTime reports whether t is within skew of the current time, and if not,
+// returns the current time in place of t. If past is false, only timestamps in
+// the future are checked. If skew ≤ 0, t is always accepted.
+func clampTime(t time.Time, skew time.Duration, past bool) (time.Time, bool) {
+	if skew <= 0 {
+		return t, true
+	}
+	now := time.Now()
+	if d := t.Sub(now); d > skew || (past && d < -skew) {
+		return now, false
+	}
+	return t, true
+}
+
+// parseAction parses an action record written by formatAction. It reports an
+// error if the record is malformed, for example one left empty or truncated
+// by an interrupted write.
 func parseAction(data []byte) (outputID string, mtime time.Time, _ error) {
+	outputID, mtime, _, err := parseActionVersion(data)
+	return outputID, mtime, err
+}
+
+// parseActionVersion is as parseAction, but also reports the version of the
+// output object pinned by the record, or "" if it does not pin one.
+func parseActionVersion(data []byte) (outputID string, mtime time.Time, version string, _ error) {
 	fs := strings.Fields(string(data))
-	if len(fs) != 2 {
-		return "", time.Time{}, errors.New("invalid action record")
+	switch len(fs) {
+	case 0:
+		return "", time.Time{}, "", errors.New("empty action record")
+	case 1:
+		return "", time.Time{}, "", errors.New("action record has no timestamp")
+	case 2, 3:
+		if !validID(fs[0]) {
+			return "", time.Time{}, "", fmt.Errorf("invalid output ID %q", fs[0])
+		}
+	default:
+		return "", time.Time{}, "", errors.New("invalid action record")
 	}
 	ts, err := strconv.ParseInt(fs[1], 10, 64)
 	if err != nil {
-		return "", time.Time{}, fmt.Errorf("invalid timestamp: %w", err)
+		return "", time.Time{}, "", fmt.Errorf("invalid timestamp: %w", err)
+	}
+	if len(fs) == 3 {
+		version = fs[2]
 	}
-	return fs[0], time.Unix(ts/1e9, ts%1e9), nil
+	return fs[0], time.Unix(ts/1e9, ts%1e9), version, nil
 }
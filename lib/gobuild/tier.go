@@ -0,0 +1,42 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"context"
+	"os"
+
+	"github.com/creachadair/gocache/cachedir"
+)
+
+// stageDir returns the local directory in which to stage an object of the
+// given size: large, if it is non-nil and size exceeds threshold; otherwise
+// small.
+func stageDir(small, large *cachedir.Dir, threshold, size int64) *cachedir.Dir {
+	if large != nil && size > threshold {
+		return large
+	}
+	return small
+}
+
+// getTiered reads the action record for actionID from small, or from large if
+// it is non-nil and the action is not found in small. It reports the output ID
+// and path of the first hit, or empty strings if neither has the action.
+func getTiered(ctx context.Context, small, large *cachedir.Dir, actionID string) (outputID, diskPath string, _ error) {
+	objID, diskPath, err := small.Get(ctx, actionID)
+	if (err != nil || objID == "" || diskPath == "") && large != nil {
+		objID, diskPath, err = large.Get(ctx, actionID)
+	}
+	return objID, diskPath, err
+}
+
+// checkStaged reports whether the file at diskPath exists and, unless size is
+// negative, has the given size. It is used to check files in a local directory
+// shared with other hosts, where the directory may report a file that another
+// host has since removed, or whose contents this host does not yet see in
+// full.
+func checkStaged(diskPath string, size int64) bool {
+	fi, err := os.Stat(diskPath)
+	return err == nil && (size < 0 || fi.Size() == size)
+}
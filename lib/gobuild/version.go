@@ -0,0 +1,50 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"io/fs"
+
+	"github.com/tailscale/go-cache-plugin/lib/revproxy"
+)
+
+// objectVersion reports the current version of the object at key, for an
+// action record to pin. It reports "" if c does not support versioned reads,
+// or the version cannot be found, in which case the record pins nothing.
+func objectVersion(ctx context.Context, c Client, key string, logf func(string, ...any)) string {
+	vc, ok := c.(revproxy.VersionedClient)
+	if !ok {
+		return ""
+	}
+	info, err := vc.Stat(ctx, key)
+	if err != nil {
+		logf("stat object %s: %v (not pinning its version)", key, err)
+		return ""
+	}
+	return info.Version
+}
+
+// getVersion reads the given version of the object at key, as pinned by an
+// action record. It reports ok == false, and no error, if version is empty,
+// c does not support versioned reads, or the version is no longer available;
+// in that case the caller should read the current object instead. Outputs
+// are addressed by their contents, so the current object has the same
+// contents, unless a write of it is in progress. Versions no longer available
+// are counted in missing.
+func getVersion(ctx context.Context, c Client, key, version string, missing *expvar.Int) (_ io.ReadCloser, size int64, ok bool, _ error) {
+	vc, isVersioned := c.(revproxy.VersionedClient)
+	if version == "" || !isVersioned {
+		return nil, -1, false, nil
+	}
+	rc, size, err := vc.GetVersion(ctx, key, version)
+	if errors.Is(err, fs.ErrNotExist) {
+		missing.Add(1)
+		return nil, -1, false, nil
+	}
+	return rc, size, true, err
+}
@@ -0,0 +1,64 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package keylock provides mutual exclusion keyed by strings, such as the
+// paths of files being staged, with memory bounded by a fixed number of locks.
+//
+// A [Set] maps each key to one of a fixed number of shards by hashing, and
+// holds one lock per shard. Requests for the same key are always serialized;
+// requests for different keys usually proceed in parallel, but may wait for
+// each other if their keys share a shard.
+package keylock
+
+import (
+	"context"
+	"hash/maphash"
+	"sync"
+)
+
+// DefaultShards is the number of locks in a [Set] if its size is not set.
+const DefaultShards = 1024
+
+// A Set is a collection of locks keyed by strings. It is safe for concurrent
+// use. The zero value is ready for use, with DefaultShards locks.
+type Set struct {
+	// Shards, if positive, is the number of locks in the set. It must not
+	// be changed after the set is first used.
+	Shards int
+
+	once  sync.Once
+	seed  maphash.Seed
+	locks []chan struct{} // each a lock held while it has a value
+}
+
+func (s *Set) init() {
+	s.once.Do(func() {
+		n := s.Shards
+		if n <= 0 {
+			n = DefaultShards
+		}
+		s.seed = maphash.MakeSeed()
+		s.locks = make([]chan struct{}, n)
+		for i := range s.locks {
+			s.locks[i] = make(chan struct{}, 1)
+		}
+	})
+}
+
+// Lock acquires the lock for key, waiting until it is free or ctx ends. On
+// success, it returns a function that releases the lock, which must be called
+// exactly once.
+//
+// A caller that checks for a result before it takes the lock, such as a file
+// staged at the path named by key, should check again once it holds the lock,
+// since another holder may have produced the result meanwhile.
+func (s *Set) Lock(ctx context.Context, key string) (unlock func(), _ error) {
+	s.init()
+	lk := s.locks[maphash.String(s.seed, key)%uint64(len(s.locks))]
+	select {
+	case lk <- struct{}{}:
+		return func() { <-lk }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package keylock_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tailscale/go-cache-plugin/lib/keylock"
+)
+
+func TestSet(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Hammer", func(t *testing.T) {
+		// Many goroutines update the same unsynchronized counters under the
+		// lock for their key. With -race, any overlap is reported.
+		var s keylock.Set
+		keys := []string{"a", "b", "c"}
+		counts := make(map[string]*int)
+		for _, k := range keys {
+			counts[k] = new(int)
+		}
+		const n = 100
+		var wg sync.WaitGroup
+		for i := range n * len(keys) {
+			key := keys[i%len(keys)]
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				unlock, err := s.Lock(ctx, key)
+				if err != nil {
+					t.Errorf("Lock %q: unexpected error: %v", key, err)
+					return
+				}
+				defer unlock()
+				*counts[key]++
+			}()
+		}
+		wg.Wait()
+		for _, k := range keys {
+			if got := *counts[k]; got != n {
+				t.Errorf("Count %q: got %d, want %d", k, got, n)
+			}
+		}
+	})
+
+	t.Run("Wait", func(t *testing.T) {
+		s := keylock.Set{Shards: 1}
+		unlock, err := s.Lock(ctx, "x")
+		if err != nil {
+			t.Fatalf("Lock: unexpected error: %v", err)
+		}
+
+		// While the lock is held, another request waits until its context
+		// ends.
+		tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		if _, err := s.Lock(tctx, "x"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Lock while held: got %v, want %v", err, context.DeadlineExceeded)
+		}
+
+		// A request for another key in the same shard waits too, and gets
+		// the lock once it is released.
+		done := make(chan error)
+		go func() {
+			unlock2, err := s.Lock(ctx, "y")
+			if err == nil {
+				unlock2()
+			}
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			t.Fatalf("Lock of y while x is held: got %v, want to wait", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+		unlock()
+		if err := <-done; err != nil {
+			t.Errorf("Lock of y: %v", err)
+		}
+	})
+}
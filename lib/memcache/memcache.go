@@ -0,0 +1,328 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package memcache implements an in-memory storage client, for testing
+// components that use cloud storage without a real bucket.
+package memcache
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tailscale/go-cache-plugin/lib/revproxy"
+)
+
+var (
+	_ revproxy.ConditionalClient = (*Client)(nil)
+	_ revproxy.ChecksumClient    = (*Client)(nil)
+	_ revproxy.ListClient        = (*Client)(nil)
+	_ revproxy.StatClient        = (*Client)(nil)
+	_ revproxy.VersionedClient   = (*Client)(nil)
+	_ revproxy.SwapClient        = (*Client)(nil)
+)
+
+// Client is an in-memory implementation of the storage client interfaces of
+// [revproxy], backed by a map from keys to objects. The etag of each object
+// is the hex-encoded MD5 digest of its contents, as computed by an S3 etag
+// reader. Each write of an object gives it a new version, and only the latest
+// version of each object is kept, as in a bucket without versioning. The zero
+// value is ready for use, and is empty. A Client is safe for concurrent use.
+type Client struct {
+	// Fault, if non-nil, is called before each operation with the name of the
+	// method and the key it concerns (for List, the prefix). If it reports an
+	// error, the operation fails with that error without effect. This can be
+	// used to simulate storage failures. Operations also fail without effect
+	// if their context has ended by the time Fault returns.
+	Fault func(op, key string) error
+
+	mu   sync.Mutex
+	objs map[string]object
+	gen  int64 // the version of the most recent write
+}
+
+type object struct {
+	data    []byte
+	etag    string
+	modTime time.Time
+	version string
+	tags    map[string]string
+}
+
+// Keys returns the keys of all the objects in c, in lexicographic order.
+func (c *Client) Keys() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Sorted(maps.Keys(c.objs))
+}
+
+// Get retrieves the object with the given key.
+func (c *Client) Get(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	obj, err := c.get(ctx, "Get", key)
+	if err != nil {
+		return nil, -1, err
+	}
+	return io.NopCloser(bytes.NewReader(obj.data)), int64(len(obj.data)), nil
+}
+
+// GetCond retrieves the object with the given key, unless etag is non-empty
+// and matches its etag, in which case it reports [revproxy.ErrNotModified].
+func (c *Client) GetCond(ctx context.Context, key, etag string) (io.ReadCloser, int64, string, error) {
+	obj, err := c.get(ctx, "GetCond", key)
+	if err != nil {
+		return nil, -1, "", err
+	} else if etag != "" && etag == obj.etag {
+		return nil, -1, "", fmt.Errorf("key %q: %w", key, revproxy.ErrNotModified)
+	}
+	return io.NopCloser(bytes.NewReader(obj.data)), int64(len(obj.data)), obj.etag, nil
+}
+
+// GetChecksum retrieves the object with the given key, and its CRC32C.
+func (c *Client) GetChecksum(ctx context.Context, key string) (io.ReadCloser, int64, uint32, error) {
+	obj, err := c.get(ctx, "GetChecksum", key)
+	if err != nil {
+		return nil, -1, 0, err
+	}
+	crc := crc32.Checksum(obj.data, crc32.MakeTable(crc32.Castagnoli))
+	return io.NopCloser(bytes.NewReader(obj.data)), int64(len(obj.data)), crc, nil
+}
+
+// GetRange retrieves length bytes of the object with the given key starting
+// at offset, or the rest of the object if length < 0.
+func (c *Client) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	obj, err := c.get(ctx, "GetRange", key)
+	if err != nil {
+		return nil, err
+	}
+	data := obj.data[min(offset, int64(len(obj.data))):]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// GetData returns the contents of the object with the given key.
+func (c *Client) GetData(ctx context.Context, key string) ([]byte, error) {
+	obj, err := c.get(ctx, "GetData", key)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Clone(obj.data), nil
+}
+
+// Put writes the contents of data to the object with the given key.
+func (c *Client) Put(ctx context.Context, key string, data io.Reader) error {
+	if err := c.fault(ctx, "Put", key); err != nil {
+		return err
+	}
+	bits, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	c.put(key, bits)
+	return nil
+}
+
+// PutCond writes the contents of data to the object with the given key,
+// unless an object with that key and etag is already present. It reports
+// whether the object was written.
+func (c *Client) PutCond(ctx context.Context, key, etag string, data io.Reader) (bool, error) {
+	if err := c.fault(ctx, "PutCond", key); err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	obj, ok := c.objs[key]
+	c.mu.Unlock()
+	if ok && obj.etag == etag {
+		return false, nil
+	}
+	bits, err := io.ReadAll(data)
+	if err != nil {
+		return false, err
+	}
+	c.put(key, bits)
+	return true, nil
+}
+
+// PutVersion writes the contents of data to the object with the given key,
+// only if its current version is version, or if version is empty, only if it
+// does not exist. Otherwise it reports an error wrapping
+// [revproxy.ErrPutRace].
+func (c *Client) PutVersion(ctx context.Context, key, version string, data io.Reader) error {
+	if err := c.fault(ctx, "PutVersion", key); err != nil {
+		return err
+	}
+	bits, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	obj, ok := c.objs[key]
+	if ok != (version != "") || ok && obj.version != version {
+		return fmt.Errorf("key %q version %q: %w", key, version, revproxy.ErrPutRace)
+	}
+	c.putLocked(key, bits)
+	return nil
+}
+
+// Stat reports the metadata of the object with the given key.
+func (c *Client) Stat(ctx context.Context, key string) (revproxy.ObjectInfo, error) {
+	obj, err := c.get(ctx, "Stat", key)
+	if err != nil {
+		return revproxy.ObjectInfo{}, err
+	}
+	return revproxy.ObjectInfo{Key: key, Size: int64(len(obj.data)), ModTime: obj.modTime, Version: obj.version}, nil
+}
+
+// GetVersion retrieves the given version of the object with the given key.
+// Only the latest version of each object is kept, so if version is not the
+// latest, the error satisfies [fs.ErrNotExist].
+func (c *Client) GetVersion(ctx context.Context, key, version string) (io.ReadCloser, int64, error) {
+	obj, err := c.get(ctx, "GetVersion", key)
+	if err != nil {
+		return nil, -1, err
+	} else if obj.version != version {
+		return nil, -1, fmt.Errorf("key %q version %q: %w", key, version, fs.ErrNotExist)
+	}
+	return io.NopCloser(bytes.NewReader(obj.data)), int64(len(obj.data)), nil
+}
+
+// List calls f for each object whose key has the given prefix, in
+// lexicographic order by key.
+func (c *Client) List(ctx context.Context, prefix string, f func(revproxy.ObjectInfo) error) error {
+	if err := c.fault(ctx, "List", prefix); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	var infos []revproxy.ObjectInfo
+	for key, obj := range c.objs {
+		if strings.HasPrefix(key, prefix) {
+			infos = append(infos, revproxy.ObjectInfo{Key: key, Size: int64(len(obj.data)), ModTime: obj.modTime})
+		}
+	}
+	c.mu.Unlock()
+	slices.SortFunc(infos, func(a, b revproxy.ObjectInfo) int { return strings.Compare(a.Key, b.Key) })
+	for _, info := range infos {
+		if err := f(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes the object with the given key, if it exists.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	if err := c.fault(ctx, "Delete", key); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.objs, key)
+	return nil
+}
+
+// Copy copies the object with key srcKey to dstKey.
+func (c *Client) Copy(ctx context.Context, srcKey, dstKey string) error {
+	obj, err := c.get(ctx, "Copy", srcKey)
+	if err != nil {
+		return err
+	}
+	c.put(dstKey, obj.data)
+	return nil
+}
+
+// ObjectTags returns the tags of the object with the given key. An object has
+// no tags until they are set by SetObjectTag; writing an object clears them.
+func (c *Client) ObjectTags(ctx context.Context, key string) (map[string]string, error) {
+	obj, err := c.get(ctx, "ObjectTags", key)
+	if err != nil {
+		return nil, err
+	}
+	tags := maps.Clone(obj.tags)
+	if tags == nil {
+		tags = make(map[string]string)
+	}
+	return tags, nil
+}
+
+// SetObjectTag sets the tag with the given name to value on the object with
+// the given key, keeping its other tags.
+func (c *Client) SetObjectTag(ctx context.Context, key, name, value string) error {
+	if err := c.fault(ctx, "SetObjectTag", key); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	obj, ok := c.objs[key]
+	if !ok {
+		return fmt.Errorf("key %q: %w", key, fs.ErrNotExist)
+	}
+	obj.tags = maps.Clone(obj.tags)
+	if obj.tags == nil {
+		obj.tags = make(map[string]string)
+	}
+	obj.tags[name] = value
+	c.objs[key] = obj
+	return nil
+}
+
+// Close implements a method of [revproxy.CacheClient]. It does nothing.
+func (c *Client) Close() error { return nil }
+
+// get returns the object with the given key for operation op. If the key is
+// not found, the error satisfies [fs.ErrNotExist].
+func (c *Client) get(ctx context.Context, op, key string) (object, error) {
+	if err := c.fault(ctx, op, key); err != nil {
+		return object{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	obj, ok := c.objs[key]
+	if !ok {
+		return object{}, fmt.Errorf("key %q: %w", key, fs.ErrNotExist)
+	}
+	return obj, nil
+}
+
+func (c *Client) put(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.putLocked(key, data)
+}
+
+// putLocked stores data as a new version of the object with the given key.
+// The caller must hold c.mu.
+func (c *Client) putLocked(key string, data []byte) {
+	if c.objs == nil {
+		c.objs = make(map[string]object)
+	}
+	c.gen++
+	c.objs[key] = object{
+		data:    data,
+		etag:    fmt.Sprintf("%x", md5.Sum(data)),
+		modTime: time.Now(),
+		version: strconv.FormatInt(c.gen, 10),
+	}
+}
+
+// fault reports the error, if any, that operation op on key should fail with:
+// that reported by Fault, or otherwise that of ctx, if it has ended.
+func (c *Client) fault(ctx context.Context, op, key string) error {
+	if c.Fault != nil {
+		if err := c.Fault(op, key); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,211 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package modproxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A GzipHandler is an [http.Handler] that compresses the successful responses
+// of a module proxy handler with gzip, for clients that accept it. Only the
+// transfer is affected: the wrapped handler, and its cache, see and store the
+// uncompressed files.
+//
+// Module zip files are already compressed, and sum database tiles are hashes,
+// which do not compress, so responses for these are sent as they are, as are
+// responses to range requests.
+type GzipHandler struct {
+	// Handler is the module proxy handler whose responses are compressed. It
+	// must be non-nil.
+	Handler http.Handler
+
+	served   expvar.Int // responses sent compressed
+	rawBytes expvar.Int // total bytes of compressed responses before compression
+	gzBytes  expvar.Int // total bytes of compressed responses after compression
+}
+
+// gzipWriters holds reusable gzip writers for GzipHandler.
+var gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(io.Discard) }}
+
+// ServeHTTP implements the [http.Handler] interface.
+func (g *GzipHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !canGzip(r) {
+		g.Handler.ServeHTTP(w, r)
+		return
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(r.Header.Values("Accept-Encoding")) {
+		g.Handler.ServeHTTP(w, r)
+		return
+	}
+	gw := &gzipWriter{ResponseWriter: w}
+	defer func() {
+		if gw.gz == nil {
+			return
+		}
+		gw.gz.Close()
+		gw.gz.Reset(io.Discard) // drop the reference to w
+		gzipWriters.Put(gw.gz)
+		g.served.Add(1)
+		g.rawBytes.Add(gw.raw)
+		g.gzBytes.Add(gw.sent)
+	}()
+	g.Handler.ServeHTTP(gw, r)
+}
+
+// Metrics returns a map of compression metrics. The caller is responsible for
+// publishing these metrics.
+func (g *GzipHandler) Metrics() *expvar.Map {
+	m := new(expvar.Map)
+	m.Set("served", &g.served)
+	m.Set("raw_bytes", &g.rawBytes)
+	m.Set("gzip_bytes", &g.gzBytes)
+	return m
+}
+
+// canGzip reports whether the response to r may be compressed, if the client
+// accepts it.
+func canGzip(r *http.Request) bool {
+	if r.Method != http.MethodGet || r.Header.Get("Range") != "" {
+		return false
+	}
+	return path.Ext(r.URL.Path) != ".zip" && !strings.Contains(r.URL.Path, "/tile/")
+}
+
+// acceptsGzip reports whether the Accept-Encoding header values vals allow a
+// gzip response.
+func acceptsGzip(vals []string) bool {
+	for _, v := range vals {
+		for enc := range strings.SplitSeq(v, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				continue
+			}
+			q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+			if !ok {
+				return true
+			}
+			f, err := strconv.ParseFloat(q, 64)
+			return err == nil && f > 0
+		}
+	}
+	return false
+}
+
+// gzipWriter is a [http.ResponseWriter] that compresses the body of a
+// successful response, unless the handler already encoded it.
+type gzipWriter struct {
+	http.ResponseWriter
+	gz    *gzip.Writer // nil unless the response is compressed
+	wrote bool
+
+	raw, sent int64 // bytes written before and after compression
+}
+
+func (w *gzipWriter) WriteHeader(code int) {
+	if !w.wrote {
+		w.wrote = true
+		h := w.Header()
+		if code == http.StatusOK && h.Get("Content-Encoding") == "" {
+			if h.Get("Content-Type") == "" {
+				// Otherwise it would be sniffed from the compressed bytes.
+				h.Set("Content-Type", "application/octet-stream")
+			}
+			h.Del("Content-Length")
+			h.Set("Content-Encoding", "gzip")
+			if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				h.Set("ETag", "W/"+etag) // the bytes differ from the original
+			}
+			w.gz = gzipWriters.Get().(*gzip.Writer)
+			w.gz.Reset(countWriter{w.ResponseWriter, &w.sent})
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipWriter) Write(data []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz == nil {
+		return w.ResponseWriter.Write(data)
+	}
+	w.raw += int64(len(data))
+	return w.gz.Write(data)
+}
+
+// Unwrap supports [http.ResponseController].
+func (w *gzipWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// countWriter is an [io.Writer] that counts the bytes written through it.
+type countWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c countWriter) Write(data []byte) (int, error) {
+	nw, err := c.w.Write(data)
+	*c.n += int64(nw)
+	return nw, err
+}
+
+// storedCompressible reports whether the file with the given cache name is
+// compressed in storage when StorageCacher.CompressText is set. Only the small
+// text files of a module version qualify: zip files are already compressed,
+// and the sum database is not worth the trouble.
+func storedCompressible(name string) bool {
+	if strings.HasPrefix(name, "sumdb/") {
+		return false
+	}
+	switch path.Ext(name) {
+	case ".info", ".mod":
+		return true
+	}
+	return false
+}
+
+// gzipIfSmaller returns data compressed with gzip, and true, if that makes it
+// smaller. Otherwise it returns data unchanged, and false.
+func gzipIfSmaller(data []byte) ([]byte, bool) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	if err := w.Close(); err != nil || buf.Len() >= len(data) {
+		return data, false
+	}
+	return buf.Bytes(), true
+}
+
+// maybeGunzip returns a reader for the contents of rc, decompressing them if
+// they begin with a gzip header. Neither a .info file (JSON) nor a .mod file
+// (text) can begin that way, so plain and compressed objects are read alike.
+// Closing the result closes rc.
+func maybeGunzip(rc io.ReadCloser) (io.ReadCloser, error) {
+	br := bufio.NewReader(rc)
+	if magic, _ := br.Peek(2); !bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return struct {
+			io.Reader
+			io.Closer
+		}{br, rc}, nil
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("compressed object: %w", err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{zr, rc}, nil
+}
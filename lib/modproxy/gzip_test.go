@@ -0,0 +1,73 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package modproxy
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGzipHandler(t *testing.T) {
+	const body = "module example.com/foo\n\ngo 1.24\n"
+	g := &GzipHandler{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if strings.HasSuffix(r.URL.Path, "/missing.mod") {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		io.WriteString(w, body)
+	})}
+
+	tests := []struct {
+		desc, path, accept string
+		want               bool // whether the response should be compressed
+	}{
+		{"Mod", "/example.com/foo/@v/v1.0.0.mod", "gzip", true},
+		{"Info", "/example.com/foo/@v/v1.0.0.info", "br, gzip;q=0.5", true},
+		{"NoAccept", "/example.com/foo/@v/v1.0.0.mod", "", false},
+		{"Refused", "/example.com/foo/@v/v1.0.0.mod", "gzip;q=0", false},
+		{"Zip", "/example.com/foo/@v/v1.0.0.zip", "gzip", false},
+		{"Tile", "/sumdb/sum.golang.org/tile/8/0/001", "gzip", false},
+		{"Error", "/example.com/foo/@v/missing.mod", "gzip", false},
+	}
+	var nserved int64
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.accept != "" {
+				req.Header.Set("Accept-Encoding", tc.accept)
+			}
+			rec := httptest.NewRecorder()
+			g.ServeHTTP(rec, req)
+
+			got := rec.Header().Get("Content-Encoding") == "gzip"
+			if got != tc.want {
+				t.Fatalf("Compressed: got %v, want %v", got, tc.want)
+			} else if !got {
+				return
+			}
+			nserved++
+			zr, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatalf("Open gzip: %v", err)
+			}
+			data, err := io.ReadAll(zr)
+			if err != nil {
+				t.Fatalf("Read gzip: %v", err)
+			} else if string(data) != body {
+				t.Errorf("Body: got %q, want %q", data, body)
+			}
+			if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+				t.Errorf("Content-Type: got %q, want text/plain", ct)
+			}
+		})
+	}
+	if got := g.served.Value(); got != nserved {
+		t.Errorf("served: got %d, want %d", got, nserved)
+	}
+}
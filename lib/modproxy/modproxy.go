@@ -14,17 +14,24 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/creachadair/atomicfile"
 	"github.com/creachadair/taskgroup"
 	"github.com/goproxy/goproxy"
+	"github.com/tailscale/go-cache-plugin/lib/eventlog"
+	"github.com/tailscale/go-cache-plugin/lib/keylock"
 	"github.com/tailscale/go-cache-plugin/lib/revproxy"
+	"golang.org/x/mod/semver"
 	"golang.org/x/sync/semaphore"
 )
 
@@ -48,6 +55,23 @@ var _ goproxy.Cacher = (*StorageCacher)(nil)
 // the specified key prefix instead:
 //
 //	<key-prefix>/module/16/0db4d719252162c87a9169e26deda33d2340770d0d540fd4c580c55008b2d6
+//
+// The length of the storage key partition can be changed by setting
+// PartitionDepth. The local cache layout is not affected.
+//
+// If ReadableKeys is true, files are instead stored under a key formed from
+// the filename itself, with each path element URL-escaped, so that the
+// objects for a module can be found by name:
+//
+//	<key-prefix>/module/cloud.google.com/go/@v/v0.1.0.zip
+//
+// Again, the local cache layout is not affected.
+//
+// If the storage client supports it (see [revproxy.TypedClient]), version
+// files are written with a content type inferred from their names:
+// "application/json" for .info files, "text/plain" for .mod files, and
+// "application/zip" for .zip files. Other objects get the default content
+// type of the backend.
 type StorageCacher struct {
 	// Local is the path of a local cache directory where modules are cached.
 	// It must be non-empty.
@@ -61,11 +85,83 @@ type StorageCacher struct {
 	// intervening slash.
 	KeyPrefix string
 
+	// PartitionDepth, if positive, is the number of leading hex digits of the
+	// digest used to partition storage keys. If zero or negative, it uses
+	// DefaultPartitionDepth. When reading, objects stored at the default depth
+	// are also found, to allow migrating an existing bucket.
+	PartitionDepth int
+
+	// ReadableKeys, if true, stores objects under keys formed from the names
+	// of the files rather than their digests (see "Cache Layout" above). When
+	// reading, objects stored under digest keys are also found, so that an
+	// existing bucket can be used without migration. The converse is not true:
+	// a cacher without ReadableKeys does not find objects under readable keys.
+	ReadableKeys bool
+
+	// RevalidateAfter, if positive, is the age after which a locally cached
+	// file is revalidated against cloud storage before it is served. If the
+	// storage client supports conditional reads (see
+	// [revproxy.ConditionalClient]) and the stored object has not changed, the
+	// local copy is kept and its age is reset without transferring the
+	// contents again. If zero or negative, local files are served without
+	// revalidation.
+	//
+	// To support this, the etag of each object faulted in from storage is
+	// recorded in a sidecar file next to the local copy.
+	RevalidateAfter time.Duration
+
+	// ResumeDownloads, if true, stages files read from storage next to their
+	// local path before they are added to the cache. If a read is interrupted,
+	// the partial file is kept, and a later read resumes where it stopped.
+	// Files read this way do not record an etag for RevalidateAfter, so the
+	// first revalidation of such a file reads it again in full.
+	ResumeDownloads bool
+
+	// PartialScope, if non-empty, is included in the names of the partial
+	// files staged by ResumeDownloads, so that processes on different hosts
+	// sharing Local, as on a network filesystem, do not write to the same
+	// partial file. It should name the host.
+	PartialScope string
+
+	// MutableTTL, if positive, is the maximum age of a cached answer to a
+	// mutable query, one whose answer changes as new versions are published,
+	// such as "@latest" or "@v/list". Such answers are kept only in the local
+	// directory, not in storage, and a local copy older than MutableTTL is
+	// reported as a miss so that the proxy fetches a fresh answer. The files of
+	// specific module versions never change, and are cached indefinitely. If
+	// zero or negative, all files are cached indefinitely.
+	MutableTTL time.Duration
+
+	// GetTimeout, if positive, bounds the time Get spends reading a file from
+	// cloud storage, including staging it locally. A read that takes longer
+	// is abandoned and reported as a miss, so that the proxy fetches the file
+	// from upstream instead. If zero or negative, reads are bounded only by
+	// the context of the request.
+	GetTimeout time.Duration
+
 	// MaxTasks, if positive, limits the number of concurrent tasks that may be
 	// interacting with cloud storage. If zero or negative, the default is
 	// [runtime.NumCPU].
 	MaxTasks int
 
+	// SyncUploads, if true, makes Put wait for its write to cloud storage to
+	// finish, and report its error, rather than leaving the write in the
+	// background. Writes still count toward MaxTasks.
+	SyncUploads bool
+
+	// CompressText, if true, compresses the .info and .mod files of module
+	// versions with gzip before they are written to storage, if that makes
+	// them smaller. Zip files and sum database files are written as they are.
+	// Compressed objects are recognized by their contents, and read whether or
+	// not this is set; the local copies are never compressed.
+	CompressText bool
+
+	// OpenFiles, if non-nil, limits the number of files the cacher holds open
+	// at once in the local directory. Operations beyond the limit wait for a
+	// slot. The same semaphore may be shared with other caches to apply a
+	// single limit across all of them.
+	OpenFiles *semaphore.Weighted
+
 	// Logf, if non-nil, is used to write log messages. If nil, logs are
 	// discarded.
 	Logf func(string, ...any)
@@ -90,28 +186,63 @@ type StorageCacher struct {
 	//
 	LogRequests bool
 
+	// LogMissSample, if positive, enables a sampled log of cache misses: every
+	// LogMissSample-th miss is logged to Logf, with the name of the file
+	// requested and whether it missed only locally (local-miss) or also in
+	// cloud storage (fault-miss). Unlike LogRequests, this is cheap enough to
+	// leave enabled. If zero or negative, misses are not logged.
+	LogMissSample int
+
+	// ExposeKeys, if true, the handler returned by [StorageCacher.Handler]
+	// reports the storage key of each file in an X-Cache-Key header. This is
+	// meant for debugging.
+	ExposeKeys bool
+
+	// Events, if non-nil, records an event for each Get and Put, for analysis
+	// of cache effectiveness (see [eventlog.Log]). Unlike LogRequests, this
+	// does not slow requests.
+	Events *eventlog.Log
+
 	// Tracks tasks interacting with cloud storage in the background.
 	initOnce sync.Once
 	tasks    *taskgroup.Group
 	start    func(taskgroup.Task)
 	sema     *semaphore.Weighted
+	pending  atomic.Int64 // counts background writes in progress
+	misses   atomic.Int64 // counts misses for LogMissSample
+
+	// Serializes staging files at the same local path.
+	paths keylock.Set
 
 	pathError       expvar.Int // errors constructing file paths
+	fdWait          expvar.Int // file operations that waited for an open-file slot
 	getRequest      expvar.Int // total number of Get requests
 	getLocalHit     expvar.Int // get: hit in local directory
+	getMutableHit   expvar.Int // get: hit for a mutable query within MutableTTL
+	getMutableStale expvar.Int // get: miss for a mutable query older than MutableTTL
+	getImmutableHit expvar.Int // get: hit for a specific module version, local or remote
 	getLocalMiss    expvar.Int // get: miss in local directory
 	getFaultHit     expvar.Int // get: hit in remote storage
+	getSharedHit    expvar.Int // get: hit staged meanwhile by a concurrent request
 	getFaultMiss    expvar.Int // get: miss in remote storage
 	getLocalError   expvar.Int // get: error reading the local directory
 	getFaultError   expvar.Int // get: error reading from storage
+	getTimeout      expvar.Int // get: read from storage abandoned after GetTimeout
+	getNotModified  expvar.Int // get: local copy revalidated without transfer
 	getLocalBytes   expvar.Int // get: total bytes fetched from the local directory
 	getStorageBytes expvar.Int // get: total bytes fetched from storage
+	getStagedBytes  expvar.Int // get: total bytes served as staged, without reading the local copy back
 	putRequest      expvar.Int // total number of Put requests
 	putLocalHit     expvar.Int // put: put of object already stored locally
 	putLocalError   expvar.Int // put: error writing the local directory
 	putStorageError expvar.Int // put: error writing to storage
+	putStorageDedup expvar.Int // put: upload skipped, object already in storage
 	putLocalBytes   expvar.Int // put: total bytes written to the local directory
 	putStorageBytes expvar.Int // put: total bytes written to storage
+	putStorageGzip  expvar.Int // put: objects written to storage compressed
+	putStorageRaw   expvar.Int // put: objects written to storage uncompressed
+	opTimeout       expvar.Int // get or put: failed because a deadline passed
+	opCanceled      expvar.Int // get or put: failed because the client went away
 }
 
 func (c *StorageCacher) init() {
@@ -120,7 +251,15 @@ func (c *StorageCacher) init() {
 		if nt <= 0 {
 			nt = runtime.NumCPU()
 		}
-		c.tasks, c.start = taskgroup.New(nil).Limit(nt)
+		var start func(taskgroup.Task)
+		c.tasks, start = taskgroup.New(nil).Limit(nt)
+		c.start = func(task taskgroup.Task) {
+			c.pending.Add(1)
+			start(func() error {
+				defer c.pending.Add(-1)
+				return task()
+			})
+		}
 		c.sema = semaphore.NewWeighted(int64(nt))
 	})
 }
@@ -134,16 +273,29 @@ func (c *StorageCacher) Get(ctx context.Context, name string) (_ io.ReadCloser,
 	hash, path, err := c.makePath(name)
 
 	c.vlogf("mc B GET %q (%s)", name, hash)
-	defer func() { c.vlogf("mc E GET %q, err=%v, %v elapsed", name, oerr, time.Since(start)) }()
+	defer func() {
+		c.vlogf("mc E GET %q, err=%v, %v elapsed", name, oerr, time.Since(start))
+		c.recordEvent("get", name, path, start, oerr)
+		c.countContextErr(oerr)
+	}()
 
 	if err != nil {
 		return nil, err
 	}
+	if c.MutableTTL > 0 && isMutable(name) {
+		return c.getMutable(ctx, name, hash, path)
+	}
 
 	// Check whether the file already exists locally.
-	if rc, size, err := openReader(path); err == nil {
+	result := "hit, local"
+	if c.RevalidateAfter > 0 && c.maybeRevalidate(ctx, name, hash, path) {
+		result = "hit, local, revalidated"
+	}
+	if rc, size, err := c.openLocal(ctx, path); err == nil {
 		c.getLocalHit.Add(1)
+		c.getImmutableHit.Add(1)
 		c.getLocalBytes.Add(size)
+		setResult(ctx, result, c.makeKey(name, hash))
 		return rc, nil
 	} else if errors.Is(err, os.ErrNotExist) {
 		c.getLocalMiss.Add(1)
@@ -152,43 +304,297 @@ func (c *StorageCacher) Get(ctx context.Context, name string) (_ io.ReadCloser,
 		c.logf("get %q local: %v (treating as miss)", name, err)
 	}
 
+	// Only one request at a time stages a given path, so that concurrent
+	// requests for a file do not each fault it in. Holding the lock, check
+	// again for a local copy, which another request may have staged.
+	unlock, err := c.paths.Lock(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if rc, size, err := c.openLocal(ctx, path); err == nil {
+		c.getSharedHit.Add(1)
+		c.getImmutableHit.Add(1)
+		c.getLocalBytes.Add(size)
+		setResult(ctx, "hit, local, shared", c.makeKey(name, hash))
+		return rc, nil
+	}
+
 	// Local cache miss, fault in from cloud storage.
 	if err := c.sema.Acquire(ctx, 1); err != nil {
 		return nil, err
 	}
 	defer c.sema.Release(1)
 
-	obj, _, err := c.Client.Get(ctx, c.makeKey(hash))
-	if errors.Is(err, fs.ErrNotExist) {
+	// Hold a file slot for the local copy, and another for the partial copy
+	// if reads are resumable, until the object is added to the cache.
+	nfiles := int64(1)
+	if c.ResumeDownloads {
+		nfiles = 2
+	}
+	release, err := c.holdFiles(ctx, nfiles)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// Bound the time spent reading from storage, if requested.
+	gctx, cancel := ctx, func() {}
+	if c.GetTimeout > 0 {
+		gctx, cancel = context.WithTimeout(ctx, c.GetTimeout)
+	}
+	defer cancel()
+
+	key := c.makeKey(name, hash)
+	obj, etag, err := c.fetchRemote(gctx, key, path)
+	for _, alt := range c.altKeys(name, hash) {
+		if !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		key = alt
+		obj, etag, err = c.fetchRemote(gctx, key, path)
+	}
+	if c.isTimeout(ctx, gctx, err) {
+		c.logMiss(name, "timeout")
+		setResult(ctx, "miss", c.makeKey(name, hash))
+		return nil, fs.ErrNotExist
+	} else if errors.Is(err, fs.ErrNotExist) {
 		c.getFaultMiss.Add(1)
+		c.logMiss(name, "fault-miss")
+		setResult(ctx, "miss", c.makeKey(name, hash))
 		return nil, err
 	} else if err != nil {
-		c.getFaultError.Add(1)
+		if !isContextErr(err) {
+			c.getFaultError.Add(1)
+		}
 		return nil, err
 	}
+	if storedCompressible(name) {
+		if obj, err = maybeGunzip(obj); err != nil {
+			c.getFaultError.Add(1)
+			return nil, err
+		}
+	}
 	defer obj.Close()
 	c.getFaultHit.Add(1)
+	c.getImmutableHit.Add(1)
+	c.logMiss(name, "local-miss")
+	setResult(ctx, "hit, remote", key)
 	c.vlogf("mc F GET %q hit (%s)", name, hash)
 
-	if _, err := c.putLocal(ctx, name, path, obj); err != nil {
+	ok, staged, err := c.putLocal(ctx, name, path, obj, true)
+	if c.isTimeout(ctx, gctx, err) {
+		c.logMiss(name, "timeout")
+		return nil, fs.ErrNotExist
+	} else if err != nil {
 		return nil, err
 	}
-	rc, _, err := openReader(path)
+	if c.ResumeDownloads {
+		os.Remove(c.partialPath(path))
+	}
+	c.writeETag(path, etag)
+	if !ok {
+		// Serve the contents as staged, rather than reading the file we just
+		// wrote back from disk.
+		c.getStagedBytes.Add(int64(len(staged)))
+		return io.NopCloser(bytes.NewReader(staged)), nil
+	}
+	rc, _, err := openReader(path) // still holding the file slots
 	return rc, err
 }
 
+// getMutable reports the local copy of the mutable query name at path, if
+// there is one and it is younger than MutableTTL. Otherwise it reports a miss
+// without consulting storage, so the proxy will fetch a fresh answer.
+func (c *StorageCacher) getMutable(ctx context.Context, name, hash, path string) (io.ReadCloser, error) {
+	fi, err := os.Stat(path)
+	if err == nil && time.Since(fi.ModTime()) >= c.MutableTTL {
+		c.getMutableStale.Add(1)
+		err = fs.ErrNotExist
+	} else if errors.Is(err, fs.ErrNotExist) {
+		c.getLocalMiss.Add(1)
+	}
+	if err == nil {
+		var rc io.ReadCloser
+		var size int64
+		if rc, size, err = c.openLocal(ctx, path); err == nil {
+			c.getLocalHit.Add(1)
+			c.getMutableHit.Add(1)
+			c.getLocalBytes.Add(size)
+			setResult(ctx, "hit, local", c.makeKey(name, hash))
+			return rc, nil
+		}
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		c.getLocalError.Add(1)
+		c.logf("get %q local: %v (treating as miss)", name, err)
+	}
+	c.logMiss(name, "mutable-miss")
+	setResult(ctx, "miss", c.makeKey(name, hash))
+	return nil, fs.ErrNotExist
+}
+
+// isMutable reports whether name is the cache name of a query whose answer may
+// change over time, as opposed to a file of a specific module version. Names
+// follow the module proxy protocol, for example "<module>/@v/list",
+// "<module>/@latest", or "<module>/@v/<version>.info". A version info query
+// for a non-canonical version, such as a branch name, is mutable.
+func isMutable(name string) bool {
+	if rest, ok := strings.CutPrefix(name, "sumdb/"); ok {
+		return path.Base(rest) == "latest" // the signed tree head
+	}
+	if strings.HasSuffix(name, "/@latest") || strings.HasSuffix(name, "/@v/list") {
+		return true
+	}
+	i := strings.LastIndex(name, "/@v/")
+	if i < 0 {
+		return false
+	}
+	file := name[i+len("/@v/"):]
+	switch ext := path.Ext(file); ext {
+	case ".info", ".mod", ".zip":
+		v := strings.TrimSuffix(strings.TrimSuffix(file, ext), "+incompatible")
+		return semver.Canonical(v) != v
+	}
+	return false
+}
+
+// contentType returns the content type of the module proxy file with the given
+// cache name, or "" if it is not known.
+func contentType(name string) string {
+	if strings.HasPrefix(name, "sumdb/") {
+		return ""
+	}
+	switch path.Ext(name) {
+	case ".info":
+		return "application/json"
+	case ".mod":
+		return "text/plain"
+	case ".zip":
+		return "application/zip"
+	}
+	return ""
+}
+
+// getRemote reads the object for key from storage. If the storage client
+// supports conditional reads, it reports the etag of the object, and if etag
+// is non-empty and matches, it reports [revproxy.ErrNotModified].
+func (c *StorageCacher) getRemote(ctx context.Context, key, etag string) (io.ReadCloser, string, error) {
+	if cc, ok := c.Client.(revproxy.ConditionalClient); ok {
+		rc, _, tag, err := cc.GetCond(ctx, key, etag)
+		return rc, tag, err
+	}
+	rc, _, err := c.Client.Get(ctx, key)
+	return rc, "", err
+}
+
+// fetchRemote reads the object for key from storage to be stored at the local
+// path. If ResumeDownloads is true, the object is read via a partial file that
+// allows an interrupted read to resume, and no etag is reported. Otherwise it
+// behaves as getRemote with no etag.
+func (c *StorageCacher) fetchRemote(ctx context.Context, key, path string) (io.ReadCloser, string, error) {
+	if !c.ResumeDownloads {
+		return c.getRemote(ctx, key, "")
+	}
+	f, _, err := revproxy.GetResumable(ctx, c.Client, key, c.partialPath(path))
+	if err != nil {
+		return nil, "", err
+	}
+	return f, "", nil
+}
+
+// maybeRevalidate checks whether the local copy of name at path is older than
+// RevalidateAfter, and if so, refreshes it from storage. Errors are logged and
+// otherwise ignored, leaving the local copy in place. It reports whether the
+// local copy was successfully revalidated.
+func (c *StorageCacher) maybeRevalidate(ctx context.Context, name, hash, path string) bool {
+	fi, err := os.Stat(path)
+	if err != nil || time.Since(fi.ModTime()) < c.RevalidateAfter {
+		return false // not present, or not yet due
+	}
+	if err := c.sema.Acquire(ctx, 1); err != nil {
+		return false
+	}
+	defer c.sema.Release(1)
+	release, err := c.holdFiles(ctx, 1)
+	if err != nil {
+		return false
+	}
+	defer release()
+
+	etag, _ := os.ReadFile(etagPath(path)) // if missing, fetch unconditionally
+	obj, tag, err := c.getRemote(ctx, c.makeKey(name, hash), string(etag))
+	if errors.Is(err, revproxy.ErrNotModified) {
+		c.getNotModified.Add(1)
+		now := time.Now()
+		os.Chtimes(path, now, now)
+		return true
+	} else if err != nil {
+		c.logf("revalidate %q: %v (using local copy)", name, err)
+		return false
+	}
+	if storedCompressible(name) {
+		if obj, err = maybeGunzip(obj); err != nil {
+			c.logf("revalidate %q: %v (using local copy)", name, err)
+			return false
+		}
+	}
+	defer obj.Close()
+	c.getFaultHit.Add(1)
+	nw, err := atomicfile.WriteAll(path, obj, 0644)
+	c.getStorageBytes.Add(nw)
+	if err != nil {
+		c.putLocalError.Add(1)
+		c.logf("revalidate %q: update local: %v", name, err)
+		return false
+	}
+	c.writeETag(path, tag)
+	return true
+}
+
+// writeETag records etag in the sidecar file for path, if etag is non-empty.
+func (c *StorageCacher) writeETag(path, etag string) {
+	if etag == "" {
+		return
+	}
+	if err := atomicfile.WriteData(etagPath(path), []byte(etag), 0644); err != nil {
+		c.logf("write etag for %q: %v", path, err)
+	}
+}
+
+// etagPath returns the path of the etag sidecar file for the local cache path.
+func etagPath(path string) string { return path + ".etag" }
+
+// partialPath returns the path of the partial file used to resume reads of
+// the object for the local cache path.
+func (c *StorageCacher) partialPath(path string) string {
+	if c.PartialScope != "" {
+		return path + "." + c.PartialScope + ".partial"
+	}
+	return path + ".partial"
+}
+
 // putLocal reports whether the specified path already exists in the local
-// cache, and if not, writes data atomically into the path.
-func (c *StorageCacher) putLocal(ctx context.Context, name, path string, data io.Reader) (bool, error) {
+// cache, and if not, writes data atomically into the path. If keep is true and
+// data are written, putLocal also returns a copy of the contents written, so
+// the caller can serve them without reading the file back.
+func (c *StorageCacher) putLocal(ctx context.Context, name, path string, data io.Reader, keep bool) (bool, []byte, error) {
 	if _, err := os.Stat(path); err == nil {
-		return true, nil
+		return true, nil, nil
+	}
+	var buf bytes.Buffer
+	if keep {
+		data = io.TeeReader(data, &buf)
 	}
 	nw, err := atomicfile.WriteAll(path, data, 0644)
 	c.putLocalBytes.Add(nw)
 	if err != nil {
-		c.putLocalError.Add(1)
+		if !isContextErr(err) {
+			c.putLocalError.Add(1)
+		}
+		return false, nil, err
 	}
-	return false, err
+	return false, buf.Bytes(), nil
 }
 
 // Put implements a method of the goproxy.Cacher interface. It stores data into
@@ -200,26 +606,59 @@ func (c *StorageCacher) Put(ctx context.Context, name string, data io.ReadSeeker
 	hash, path, err := c.makePath(name)
 
 	c.vlogf("mc B PUT %q (%s)", name, hash)
-	defer func() { c.vlogf("mc E PUT %q, err=%v, %v elapsed", name, oerr, time.Since(start)) }()
+	defer func() {
+		c.vlogf("mc E PUT %q, err=%v, %v elapsed", name, oerr, time.Since(start))
+		c.recordEvent("put", name, path, start, oerr)
+		c.countContextErr(oerr)
+	}()
 
 	if err != nil {
 		return err
 	}
 
-	if ok, err := c.putLocal(ctx, name, path, data); err != nil {
+	// Stage the file under the lock for its path, as Get does. The lock is
+	// taken before the file slot, in the same order as Get.
+	unlock, err := c.paths.Lock(ctx, path)
+	if err != nil {
+		return err
+	}
+	release, err := c.holdFiles(ctx, 1)
+	if err != nil {
+		unlock()
+		return err
+	}
+	if c.MutableTTL > 0 && isMutable(name) {
+		// Replace any stale answer, and do not share it via storage.
+		defer unlock()
+		defer release()
+		nw, err := atomicfile.WriteAll(path, data, 0644)
+		c.putLocalBytes.Add(nw)
+		if err != nil && !isContextErr(err) {
+			c.putLocalError.Add(1)
+		}
+		return err
+	}
+	ok, _, err := c.putLocal(ctx, name, path, data, false)
+	unlock()
+	if err != nil || ok {
+		release()
+		if ok {
+			c.putLocalHit.Add(1)
+		}
 		return err
-	} else if ok {
-		c.putLocalHit.Add(1)
-		return nil
 	}
 
-	// Try to push the object to cloud storage in the background.
+	// Try to push the object to cloud storage in the background, or wait for
+	// it if uploads are synchronous. The file slot is held until the upload
+	// is finished.
 	f, size, err := openFileSize(path)
 	if err != nil {
+		release()
 		c.putLocalError.Add(1)
 		return err
 	}
-	c.start(func() error {
+	upload := func() error {
+		defer release()
 		defer f.Close()
 		start := time.Now()
 
@@ -227,14 +666,64 @@ func (c *StorageCacher) Put(ctx context.Context, name string, data io.ReadSeeker
 		sctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 1*time.Minute)
 		defer cancel()
 
-		if err := c.Client.Put(sctx, c.makeKey(hash), f); err != nil {
-			c.putStorageError.Add(1)
+		// A specific module version never changes, so if storage already has
+		// the object (e.g., the local copy was cleaned up), it is identical to
+		// this one and need not be sent again. Mutable answers such as @latest
+		// are always sent. If the check fails, upload anyway.
+		key := c.makeKey(name, hash)
+		if sc, ok := c.Client.(revproxy.StatClient); ok && !isMutable(name) {
+			if _, err := sc.Stat(sctx, key); err == nil {
+				c.putStorageDedup.Add(1)
+				c.vlogf("mc W PUT %q, already in storage, %v elapsed", name, time.Since(start))
+				return nil
+			}
+		}
+		var body io.Reader = f
+		compressed := false
+		if c.CompressText && storedCompressible(name) {
+			data, err := io.ReadAll(f)
+			if err != nil {
+				c.putLocalError.Add(1)
+				return err
+			}
+			data, compressed = gzipIfSmaller(data)
+			body, size = bytes.NewReader(data), int64(len(data))
+		}
+		var err error
+		if tc, ok := c.Client.(revproxy.TypedClient); ok {
+			err = tc.PutType(sctx, key, contentType(name), body)
+		} else {
+			err = c.Client.Put(sctx, key, body)
+		}
+		if err != nil {
+			if !isContextErr(err) {
+				c.putStorageError.Add(1)
+			}
 			c.logf("[storage] put %q failed: %v", name, err)
 		} else {
 			c.putStorageBytes.Add(size)
+			if compressed {
+				c.putStorageGzip.Add(1)
+			} else {
+				c.putStorageRaw.Add(1)
+			}
 		}
 		c.vlogf("mc W PUT %q, err=%v %v elapsed", name, err, time.Since(start))
 		return err
+	}
+	if c.SyncUploads {
+		errc := make(chan error, 1)
+		c.start(func() error {
+			err := upload()
+			errc <- err
+			return err
+		})
+		return <-errc
+	}
+	c.start(func() error {
+		err := upload()
+		c.countContextErr(err) // a synchronous upload is counted by Put
+		return err
 	})
 	return nil
 }
@@ -245,25 +734,42 @@ func (c *StorageCacher) Close() error {
 	return c.tasks.Wait()
 }
 
+// Pending reports the number of background updates to storage that have been
+// started and have not yet finished.
+func (c *StorageCacher) Pending() int { return int(c.pending.Load()) }
+
 // Metrics returns a map of cacher metrics. The caller is responsible for
 // publishing these metrics.
 func (c *StorageCacher) Metrics() *expvar.Map {
 	m := new(expvar.Map)
 	m.Set("path_error", &c.pathError)
+	m.Set("fd_wait", &c.fdWait)
 	m.Set("get_request", &c.getRequest)
 	m.Set("get_local_hit", &c.getLocalHit)
 	m.Set("get_local_miss", &c.getLocalMiss)
+	m.Set("get_mutable_hit", &c.getMutableHit)
+	m.Set("get_mutable_stale", &c.getMutableStale)
+	m.Set("get_immutable_hit", &c.getImmutableHit)
 	m.Set("get_fault_hit", &c.getFaultHit)
+	m.Set("get_shared_hit", &c.getSharedHit)
 	m.Set("get_fault_miss", &c.getFaultMiss)
 	m.Set("get_local_error", &c.getLocalError)
+	m.Set("get_timeout", &c.getTimeout)
+	m.Set("get_notmodified", &c.getNotModified)
 	m.Set("get_local_bytes", &c.getLocalBytes)
 	m.Set("get_storage_bytes", &c.getStorageBytes)
+	m.Set("get_staged_bytes", &c.getStagedBytes)
 	m.Set("put_request", &c.putRequest)
 	m.Set("put_local_hit", &c.putLocalHit)
 	m.Set("put_local_error", &c.putLocalError)
 	m.Set("put_storage_error", &c.putStorageError)
+	m.Set("put_storage_dedup", &c.putStorageDedup)
 	m.Set("put_local_bytes", &c.putLocalBytes)
 	m.Set("put_storage_bytes", &c.putStorageBytes)
+	m.Set("put_storage_compressed", &c.putStorageGzip)
+	m.Set("put_storage_plain", &c.putStorageRaw)
+	m.Set("op_timeout", &c.opTimeout)
+	m.Set("op_canceled", &c.opCanceled)
 	return m
 }
 
@@ -271,10 +777,73 @@ func hashName(name string) string {
 	return fmt.Sprintf("%x", sha256.Sum256([]byte(name)))
 }
 
-// makeKey assembles a complete storage key from the specified parts, including the
-// key prefix if one is defined.
-func (c *StorageCacher) makeKey(hash string) string {
-	return path.Join(c.KeyPrefix, hash[:2], hash)
+// makeKey assembles a complete storage key for the file with the given name
+// and digest, including the key prefix if one is defined.
+func (c *StorageCacher) makeKey(name, hash string) string {
+	if c.ReadableKeys {
+		if key := c.readableKey(name); key != "" {
+			return key
+		}
+	}
+	return c.hashKey(hash)
+}
+
+// StorageKeys returns the storage keys at which c looks for the file with the
+// given cache name, in order of preference. The first is the key at which c
+// writes the file. Names of mutable queries are included, although c stores
+// them only locally if MutableTTL is set.
+func (c *StorageCacher) StorageKeys(name string) []string {
+	hash := hashName(name)
+	return append([]string{c.makeKey(name, hash)}, c.altKeys(name, hash)...)
+}
+
+// hashKey returns the storage key for hash at the configured partition depth.
+func (c *StorageCacher) hashKey(hash string) string {
+	return path.Join(c.KeyPrefix, hash[:c.partitionDepth()], hash)
+}
+
+// readableKey returns the storage key for name in the readable layout, or ""
+// if name cannot be represented there because it has an empty, "." or ".."
+// path element, which would not survive cleaning of the key.
+func (c *StorageCacher) readableKey(name string) string {
+	elts := strings.Split(name, "/")
+	for i, elt := range elts {
+		if elt == "" || elt == "." || elt == ".." {
+			return ""
+		}
+		elts[i] = url.PathEscape(elt)
+	}
+	return path.Join(c.KeyPrefix, strings.Join(elts, "/"))
+}
+
+// altKeys returns the other storage keys, besides makeKey(name, hash), where
+// the object for name may have been written by a cacher with different
+// settings, in the order they should be tried.
+func (c *StorageCacher) altKeys(name, hash string) []string {
+	primary := c.makeKey(name, hash)
+	var keys []string
+	for _, key := range []string{c.hashKey(hash), c.defaultKey(hash)} {
+		if key != primary && !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// defaultKey returns the storage key for hash at the default partition depth.
+func (c *StorageCacher) defaultKey(hash string) string {
+	return path.Join(c.KeyPrefix, hash[:DefaultPartitionDepth], hash)
+}
+
+// DefaultPartitionDepth is the number of leading hex digits of the digest used
+// to partition storage keys, if no other depth is specified.
+const DefaultPartitionDepth = 2
+
+func (c *StorageCacher) partitionDepth() int {
+	if c.PartitionDepth <= 0 {
+		return DefaultPartitionDepth
+	}
+	return c.PartitionDepth
 }
 
 // makePath assembles a complete local cache path for the given name, creating
@@ -289,6 +858,64 @@ func (c *StorageCacher) makePath(name string) (hash, path string, err error) {
 	return hash, path, err
 }
 
+// isTimeout reports whether err is the result of gctx, derived from ctx,
+// reaching the deadline set by GetTimeout while ctx is still active. If so, it
+// counts the timeout.
+func (c *StorageCacher) isTimeout(ctx, gctx context.Context, err error) bool {
+	if err != nil && ctx.Err() == nil && errors.Is(gctx.Err(), context.DeadlineExceeded) {
+		c.getTimeout.Add(1)
+		c.opTimeout.Add(1)
+		return true
+	}
+	return false
+}
+
+// isContextErr reports whether err is the result of a context ending, either
+// at a deadline or because it was canceled. Such errors are not counted as
+// errors of the local directory or storage.
+func isContextErr(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)
+}
+
+// countContextErr counts err as a timeout or a cancellation, if it is one.
+func (c *StorageCacher) countContextErr(err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		c.opTimeout.Add(1)
+	} else if errors.Is(err, context.Canceled) {
+		c.opCanceled.Add(1)
+	}
+}
+
+// recordEvent adds an event to c.Events for an operation op on name, whose
+// local copy is at path, that began at start and reported err. A get that
+// reports [fs.ErrNotExist] is a miss.
+func (c *StorageCacher) recordEvent(op, name, path string, start time.Time, err error) {
+	if c.Events == nil {
+		return
+	}
+	result := "ok"
+	if op == "get" {
+		result = "hit"
+		if errors.Is(err, fs.ErrNotExist) {
+			result, err = "miss", nil
+		}
+	}
+	var size int64
+	if result != "miss" && err == nil {
+		if fi, err := os.Stat(path); err == nil {
+			size = fi.Size()
+		}
+	}
+	c.Events.Record(eventlog.ClassModule, op, name, result, size, start, err)
+}
+
+// logMiss logs a cache miss for name, if it is selected by LogMissSample.
+func (c *StorageCacher) logMiss(name, reason string) {
+	if n := int64(c.LogMissSample); n > 0 && c.misses.Add(1)%n == 0 {
+		c.logf("sampled miss: %q (%s)", name, reason)
+	}
+}
+
 func (c *StorageCacher) logf(msg string, args ...any) {
 	if c.Logf != nil {
 		c.Logf(msg, args...)
@@ -301,6 +928,32 @@ func (c *StorageCacher) vlogf(msg string, args ...any) {
 	}
 }
 
+// openLocal opens the local cache file at path, holding a file slot while it
+// is read.
+func (c *StorageCacher) openLocal(ctx context.Context, path string) (io.ReadCloser, int64, error) {
+	release, err := c.holdFiles(ctx, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer release()
+	return openReader(path)
+}
+
+// holdFiles acquires n slots from c.OpenFiles, if it is set, and returns a
+// function that releases them.
+func (c *StorageCacher) holdFiles(ctx context.Context, n int64) (func(), error) {
+	if c.OpenFiles == nil {
+		return func() {}, nil
+	}
+	if !c.OpenFiles.TryAcquire(n) {
+		c.fdWait.Add(1)
+		if err := c.OpenFiles.Acquire(ctx, n); err != nil {
+			return nil, err
+		}
+	}
+	return func() { c.OpenFiles.Release(n) }, nil
+}
+
 func openReader(path string) (_ io.ReadCloser, size int64, _ error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -0,0 +1,292 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package modproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tailscale/go-cache-plugin/lib/memcache"
+)
+
+func TestStorageKeys(t *testing.T) {
+	const name = "cloud.google.com/go/@v/v0.1.0.zip"
+	hash := hashName(name)
+	hashed := "pfx/" + hash[:2] + "/" + hash
+
+	tests := []struct {
+		desc     string
+		c        *StorageCacher
+		name     string
+		wantKey  string
+		wantAlts []string
+	}{
+		{"Hashed", &StorageCacher{KeyPrefix: "pfx"}, name, hashed, nil},
+		{"HashedDeep", &StorageCacher{KeyPrefix: "pfx", PartitionDepth: 4}, name,
+			"pfx/" + hash[:4] + "/" + hash, []string{hashed}},
+		{"Readable", &StorageCacher{KeyPrefix: "pfx", ReadableKeys: true}, name,
+			"pfx/" + name, []string{hashed}},
+		{"ReadableEscaped", &StorageCacher{KeyPrefix: "pfx", ReadableKeys: true}, "example.com/a b/@v/list",
+			"pfx/example.com/a%20b/@v/list", nil},
+		{"ReadableDotDot", &StorageCacher{KeyPrefix: "pfx", ReadableKeys: true}, "example.com/../x",
+			"", nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			hash := hashName(tc.name)
+			want := tc.wantKey
+			if want == "" {
+				want = tc.c.hashKey(hash) // not representable, fall back
+			}
+			if got := tc.c.makeKey(tc.name, hash); got != want {
+				t.Errorf("makeKey: got %q, want %q", got, want)
+			}
+			if tc.name == name {
+				if got := tc.c.altKeys(tc.name, hash); !slices.Equal(got, tc.wantAlts) {
+					t.Errorf("altKeys: got %q, want %q", got, tc.wantAlts)
+				}
+			}
+		})
+	}
+}
+
+func TestContentType(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"cloud.google.com/go/@v/v0.1.0.info", "application/json"},
+		{"cloud.google.com/go/@v/v0.1.0.mod", "text/plain"},
+		{"cloud.google.com/go/@v/v0.1.0.zip", "application/zip"},
+		{"cloud.google.com/go/@v/list", ""},
+		{"sumdb/sum.golang.org/lookup/golang.org/x/mod@v0.1.0", ""},
+	}
+	for _, tc := range tests {
+		if got := contentType(tc.name); got != tc.want {
+			t.Errorf("contentType(%q): got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestEmptyFile(t *testing.T) {
+	const name = "example.com/empty/@v/v1.0.0.mod"
+	ctx := context.Background()
+	mc := new(memcache.Client)
+
+	c := &StorageCacher{Local: t.TempDir(), Client: mc, KeyPrefix: "pfx"}
+	if err := c.Put(ctx, name, strings.NewReader("")); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+	if keys := mc.Keys(); len(keys) != 1 {
+		t.Fatalf("Storage keys: got %q, want 1", keys)
+	}
+
+	// A cacher with an empty local directory faults in the empty file, rather
+	// than reporting a miss.
+	c2 := &StorageCacher{Local: t.TempDir(), Client: mc, KeyPrefix: "pfx"}
+	rc, err := c2.Get(ctx, name)
+	if err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("Read: unexpected error: %v", err)
+	} else if len(data) != 0 {
+		t.Errorf("Get: got %q, want empty", data)
+	}
+	if got := c2.getFaultHit.Value(); got != 1 {
+		t.Errorf("get_fault_hit: got %d, want 1", got)
+	}
+
+	// Having staged it, it is a local hit.
+	rc, err = c2.Get(ctx, name)
+	if err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	rc.Close()
+	if got := c2.getLocalHit.Value(); got != 1 {
+		t.Errorf("get_local_hit: got %d, want 1", got)
+	}
+}
+
+func TestCompressText(t *testing.T) {
+	ctx := context.Background()
+	mc := new(memcache.Client)
+	mod := "module example.com/text\n\n" + strings.Repeat("require example.com/dep v1.0.0\n", 50)
+	files := map[string]string{
+		"example.com/text/@v/v1.0.0.mod": mod,
+		"example.com/text/@v/v1.0.0.zip": mod, // compressible, but never compressed
+	}
+
+	c := &StorageCacher{Local: t.TempDir(), Client: mc, CompressText: true}
+	for name, text := range files {
+		if err := c.Put(ctx, name, strings.NewReader(text)); err != nil {
+			t.Fatalf("Put %q: unexpected error: %v", name, err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+	if got := c.putStorageGzip.Value(); got != 1 {
+		t.Errorf("put_storage_compressed: got %d, want 1", got)
+	}
+	if got := c.putStorageRaw.Value(); got != 1 {
+		t.Errorf("put_storage_plain: got %d, want 1", got)
+	}
+	for name, text := range files {
+		data, err := mc.GetData(ctx, c.makeKey(name, hashName(name)))
+		if err != nil {
+			t.Fatalf("GetData %q: %v", name, err)
+		}
+		if stored := string(data) != text; stored != strings.HasSuffix(name, ".mod") {
+			t.Errorf("Stored %q: compressed is %v", name, stored)
+		}
+	}
+
+	// A cacher that does not compress reads both as they were written.
+	c2 := &StorageCacher{Local: t.TempDir(), Client: mc}
+	for name, text := range files {
+		rc, err := c2.Get(ctx, name)
+		if err != nil {
+			t.Fatalf("Get %q: unexpected error: %v", name, err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("Read %q: unexpected error: %v", name, err)
+		} else if string(data) != text {
+			t.Errorf("Get %q: got %q, want %q", name, data, text)
+		}
+	}
+}
+
+func TestStagedFaultIn(t *testing.T) {
+	const name = "example.com/big/@v/v1.0.0.zip"
+	const text = "the quick brown fox jumps over the lazy dog"
+	ctx := context.Background()
+	mc := new(memcache.Client)
+
+	c := &StorageCacher{Local: t.TempDir(), Client: mc}
+	if err := c.Put(ctx, name, strings.NewReader(text)); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+
+	// Faulting in from storage serves the contents as they were staged, and
+	// leaves a local copy for later requests.
+	c2 := &StorageCacher{Local: t.TempDir(), Client: mc}
+	for i := range 2 {
+		rc, err := c2.Get(ctx, name)
+		if err != nil {
+			t.Fatalf("Get %d: unexpected error: %v", i+1, err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("Read %d: unexpected error: %v", i+1, err)
+		} else if string(data) != text {
+			t.Errorf("Get %d: got %q, want %q", i+1, data, text)
+		}
+		if got := c2.getStagedBytes.Value(); got != int64(len(text)) {
+			t.Errorf("Get %d: get_staged_bytes: got %d, want %d", i+1, got, len(text))
+		}
+	}
+	if got := c2.getLocalHit.Value(); got != 1 {
+		t.Errorf("get_local_hit: got %d, want 1", got)
+	}
+}
+
+func TestConcurrentFaultIn(t *testing.T) {
+	const name = "example.com/busy/@v/v1.0.0.zip"
+	const text = "many hands make light work"
+	ctx := context.Background()
+	var reads atomic.Int64
+	mc := &memcache.Client{Fault: func(op, key string) error {
+		if strings.HasPrefix(op, "Get") {
+			reads.Add(1)
+		}
+		return nil
+	}}
+
+	c := &StorageCacher{Local: t.TempDir(), Client: mc}
+	if err := c.Put(ctx, name, strings.NewReader(text)); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+	reads.Store(0) // ignore the dedup check of the upload
+
+	// Many requests for the same file on an empty local cache fault it in
+	// once, and the rest are served the staged copy.
+	c2 := &StorageCacher{Local: t.TempDir(), Client: mc}
+	const n = 32
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rc, err := c2.Get(ctx, name)
+			if err != nil {
+				t.Errorf("Get: unexpected error: %v", err)
+				return
+			}
+			data, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil || string(data) != text {
+				t.Errorf("Get: got (%q, %v), want %q", data, err, text)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := reads.Load(); got != 1 {
+		t.Errorf("Storage reads: got %d, want 1", got)
+	}
+	if got := c2.getFaultHit.Value(); got != 1 {
+		t.Errorf("get_fault_hit: got %d, want 1", got)
+	}
+}
+
+func TestContextErrors(t *testing.T) {
+	const name = "example.com/slow/@v/v1.0.0.zip"
+	ctx := context.Background()
+
+	// An upload that times out is not counted as a storage error.
+	mc := &memcache.Client{Fault: func(string, string) error { return context.DeadlineExceeded }}
+	c := &StorageCacher{Local: t.TempDir(), Client: mc}
+	if err := c.Put(ctx, name, strings.NewReader("data")); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	c.Close() // reports the failed upload
+	if got := c.putStorageError.Value(); got != 0 {
+		t.Errorf("put_storage_error: got %d, want 0", got)
+	}
+	if got := c.opTimeout.Value(); got != 1 {
+		t.Errorf("op_timeout: got %d, want 1", got)
+	}
+
+	// A read abandoned by the client is counted as canceled.
+	mc.Fault = func(string, string) error { return context.Canceled }
+	c2 := &StorageCacher{Local: t.TempDir(), Client: mc}
+	if _, err := c2.Get(ctx, name); !errors.Is(err, context.Canceled) {
+		t.Errorf("Get: got error %v, want %v", err, context.Canceled)
+	}
+	if got := c2.getFaultError.Value(); got != 0 {
+		t.Errorf("get_fault_error: got %d, want 0", got)
+	}
+	if got := c2.opCanceled.Value(); got != 1 {
+		t.Errorf("op_canceled: got %d, want 1", got)
+	}
+}
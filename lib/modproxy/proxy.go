@@ -0,0 +1,54 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package modproxy
+
+import (
+	"net/http"
+
+	"github.com/goproxy/goproxy"
+)
+
+// DefaultSumDBs are the sum databases proxied by [NewHandler] if none are
+// specified.
+var DefaultSumDBs = []string{"sum.golang.org"}
+
+// NewHandler returns an HTTP handler for a Go module proxy that serves the
+// public module proxy (proxy.golang.org) and the specified sum databases,
+// caching files with cacher. If sumDBs is empty, [DefaultSumDBs] are used.
+// Requests to the upstream proxy and sum databases are sent with upstream, or
+// [http.DefaultTransport] if it is nil. Paths are relative to the root of the
+// handler.
+//
+// The cacher may be a [StorageCacher] or any other implementation of
+// [goproxy.Cacher], for example one that wraps a StorageCacher with
+// additional behavior. If cacher has a method
+//
+//	Handler(http.Handler) http.Handler
+//
+// as [StorageCacher.Handler] does, the proxy is wrapped by it.
+func NewHandler(cacher goproxy.Cacher, sumDBs []string, upstream http.RoundTripper) http.Handler {
+	if len(sumDBs) == 0 {
+		sumDBs = DefaultSumDBs
+	}
+	proxy := &goproxy.Goproxy{
+		Fetcher: &goproxy.GoFetcher{
+			// As configured, the fetcher should never shell out to the go
+			// tool. Specifically, because we set GOPROXY and do not set any
+			// bypass via GONOPROXY, GOPRIVATE, etc., we will only attempt to
+			// proxy for the specific server(s) listed in Env.
+			GoBin:     "/bin/false",
+			Env:       []string{"GOPROXY=https://proxy.golang.org"},
+			Transport: upstream,
+		},
+		Cacher:        cacher,
+		ProxiedSumDBs: sumDBs,
+		Transport:     upstream,
+	}
+	if w, ok := cacher.(interface {
+		Handler(http.Handler) http.Handler
+	}); ok {
+		return w.Handler(proxy)
+	}
+	return proxy
+}
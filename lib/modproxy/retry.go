@@ -0,0 +1,106 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package modproxy
+
+import (
+	"expvar"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/tailscale/go-cache-plugin/lib/retrybudget"
+)
+
+// A RetryTransport is an [http.RoundTripper] that retries requests to the
+// upstream proxy that fail with a transient error: a network error, or a
+// response with status 429 (Too Many Requests) or 5xx. Other responses,
+// including 404 and 410 (not found), are returned as they are.
+//
+// Only GET and HEAD requests without a body are retried.
+type RetryTransport struct {
+	// Base is the transport used to send requests. If nil, it uses
+	// [http.DefaultTransport].
+	Base http.RoundTripper
+
+	// MaxRetries is the number of times a failed request is retried after the
+	// first attempt. If zero or negative, requests are not retried.
+	MaxRetries int
+
+	// Backoff is the delay before the first retry, doubled for each retry
+	// after that. If zero or negative, it uses DefaultRetryBackoff.
+	Backoff time.Duration
+
+	// Budget, if non-nil, is drawn on by each retry. If it is spent, the
+	// failed response is returned instead of retrying.
+	Budget *retrybudget.Budget
+
+	retries   expvar.Int // requests sent again after a transient failure
+	recovered expvar.Int // requests that succeeded after at least one retry
+	exhausted expvar.Int // requests that failed after all retries
+}
+
+// DefaultRetryBackoff is the initial delay between retries used by a
+// [RetryTransport] if none is specified.
+const DefaultRetryBackoff = 250 * time.Millisecond
+
+// RoundTrip implements the [http.RoundTripper] interface.
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	canRetry := (req.Method == http.MethodGet || req.Method == http.MethodHead) &&
+		(req.Body == nil || req.Body == http.NoBody)
+	if !canRetry || t.MaxRetries <= 0 {
+		return base.RoundTrip(req)
+	}
+
+	delay := t.Backoff
+	if delay <= 0 {
+		delay = DefaultRetryBackoff
+	}
+	for i := 0; ; i++ {
+		rsp, err := base.RoundTrip(req)
+		if !isTransient(rsp, err) {
+			if i > 0 {
+				t.recovered.Add(1)
+			}
+			return rsp, err
+		} else if i == t.MaxRetries || req.Context().Err() != nil || !t.Budget.Allow() {
+			t.exhausted.Add(1)
+			return rsp, err
+		}
+		if rsp != nil {
+			// Drain a little of the body so the connection can be reused.
+			io.CopyN(io.Discard, rsp.Body, 4<<10)
+			rsp.Body.Close()
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+		t.retries.Add(1)
+	}
+}
+
+// isTransient reports whether a response or error from a round trip reports
+// a failure that may succeed if retried.
+func isTransient(rsp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return rsp.StatusCode == http.StatusTooManyRequests || rsp.StatusCode >= 500
+}
+
+// Metrics returns a map of retry metrics. The caller is responsible for
+// publishing these metrics.
+func (t *RetryTransport) Metrics() *expvar.Map {
+	m := new(expvar.Map)
+	m.Set("retries", &t.retries)
+	m.Set("recovered", &t.recovered)
+	m.Set("exhausted", &t.exhausted)
+	return m
+}
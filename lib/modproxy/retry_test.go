@@ -0,0 +1,90 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package modproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tailscale/go-cache-plugin/lib/retrybudget"
+)
+
+func TestRetryTransport(t *testing.T) {
+	tests := []struct {
+		name       string
+		codes      []int // status codes replied in order
+		retries    int
+		wantCode   int
+		wantTries  int
+		wantMetric string
+	}{
+		{"OK", []int{200}, 2, 200, 1, ""},
+		{"Recovered", []int{502, 503, 200}, 2, 200, 3, "recovered"},
+		{"Exhausted", []int{500, 500, 500, 500}, 2, 500, 3, "exhausted"},
+		{"NotFound", []int{404, 200}, 2, 404, 1, ""},
+		{"Gone", []int{410, 200}, 2, 410, 1, ""},
+		{"Disabled", []int{503, 200}, 0, 503, 1, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var tries int
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.codes[tries])
+				tries++
+			}))
+			defer srv.Close()
+
+			rt := &RetryTransport{MaxRetries: tc.retries, Backoff: time.Millisecond}
+			cli := &http.Client{Transport: rt}
+			rsp, err := cli.Get(srv.URL + "/example.com/m/@v/list")
+			if err != nil {
+				t.Fatalf("Get: unexpected error: %v", err)
+			}
+			rsp.Body.Close()
+			if rsp.StatusCode != tc.wantCode {
+				t.Errorf("Status: got %d, want %d", rsp.StatusCode, tc.wantCode)
+			}
+			if tries != tc.wantTries {
+				t.Errorf("Attempts: got %d, want %d", tries, tc.wantTries)
+			}
+			if got, want := rt.retries.Value(), int64(tc.wantTries-1); got != want {
+				t.Errorf("Retries: got %d, want %d", got, want)
+			}
+			for name, v := range map[string]int64{"recovered": rt.recovered.Value(), "exhausted": rt.exhausted.Value()} {
+				if want := name == tc.wantMetric; (v == 1) != want {
+					t.Errorf("Metric %s: got %d, want set=%v", name, v, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	var tries int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		tries++
+	}))
+	defer srv.Close()
+
+	// The budget allows a single retry, shared by both requests.
+	b := retrybudget.New(0.001)
+	rt := &RetryTransport{MaxRetries: 3, Backoff: time.Millisecond, Budget: b}
+	cli := &http.Client{Transport: rt}
+	for range 2 {
+		rsp, err := cli.Get(srv.URL + "/example.com/m/@v/list")
+		if err != nil {
+			t.Fatalf("Get: unexpected error: %v", err)
+		}
+		rsp.Body.Close()
+	}
+	if tries != 3 {
+		t.Errorf("Attempts: got %d, want 3", tries)
+	}
+	if got := b.Metrics().Get("retries_dropped").String(); got != "2" {
+		t.Errorf("retries_dropped: got %s, want 2", got)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package modproxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// Handler wraps h, which is expected to be a module proxy using c as its
+// cacher, so that responses report how c handled the request:
+//
+//   - "hit, local": The file was served out of the local cache.
+//   - "hit, local, revalidated": The file was served out of the local cache,
+//     after revalidating it against storage (see RevalidateAfter).
+//   - "hit, remote": The file was faulted in from storage.
+//   - "miss": The file was not cached, and was fetched from upstream.
+//
+// This is reported in an X-Cache header, as with [revproxy.Server]. If
+// ExposeKeys is true, the storage key of the file is also reported in an
+// X-Cache-Key header. Responses that did not consult the cache (for example,
+// sum database requests) are not annotated.
+func (c *StorageCacher) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := new(cacheResult)
+		ctx := context.WithValue(r.Context(), cacheResultKey{}, res)
+		h.ServeHTTP(&xcacheWriter{ResponseWriter: w, res: res, keys: c.ExposeKeys}, r.WithContext(ctx))
+	})
+}
+
+// cacheResultKey is the context key for a *cacheResult.
+type cacheResultKey struct{}
+
+// cacheResult records the outcome of a cache lookup on behalf of an HTTP
+// request, for reporting in the response headers.
+type cacheResult struct {
+	mu     sync.Mutex
+	result string
+	key    string
+}
+
+// setResult records the result of a lookup of key in the cacheResult attached
+// to ctx, if there is one. If there are multiple lookups, the last one wins.
+func setResult(ctx context.Context, result, key string) {
+	if res, ok := ctx.Value(cacheResultKey{}).(*cacheResult); ok {
+		res.mu.Lock()
+		defer res.mu.Unlock()
+		res.result, res.key = result, key
+	}
+}
+
+// xcacheWriter is a [http.ResponseWriter] that adds X-Cache headers from res
+// before the response header is written.
+type xcacheWriter struct {
+	http.ResponseWriter
+	res   *cacheResult
+	keys  bool
+	wrote bool
+}
+
+func (w *xcacheWriter) WriteHeader(code int) {
+	if !w.wrote {
+		w.wrote = true
+		w.res.mu.Lock()
+		result, key := w.res.result, w.res.key
+		w.res.mu.Unlock()
+		if result != "" {
+			h := w.Header()
+			h.Set("X-Cache", result)
+			if w.keys {
+				h.Set("X-Cache-Key", key)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *xcacheWriter) Write(data []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Unwrap supports [http.ResponseController].
+func (w *xcacheWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
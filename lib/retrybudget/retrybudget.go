@@ -0,0 +1,66 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package retrybudget provides a limit on the rate of retries shared by all
+// the operations of a process.
+//
+// When a backend fails for everyone at once, each operation retrying on its
+// own multiplies the load on the backend just when it can least handle it. A
+// [Budget] caps the aggregate rate of retries instead: an operation that fails
+// while the budget is spent fails at once rather than retrying.
+package retrybudget
+
+import (
+	"expvar"
+	"math"
+
+	"golang.org/x/time/rate"
+)
+
+// A Budget is a token bucket for retries. Each retry takes a token, and
+// tokens are replenished at a fixed rate, up to a burst of one second's
+// worth. It is safe for concurrent use.
+//
+// A nil *Budget is valid, and allows every retry.
+type Budget struct {
+	lim *rate.Limiter
+
+	allowed expvar.Int // retries that got a token
+	dropped expvar.Int // retries refused for lack of a token
+}
+
+// New returns a budget that allows perSecond retries per second, on average.
+// If perSecond is zero or negative, New returns nil.
+func New(perSecond float64) *Budget {
+	if perSecond <= 0 {
+		return nil
+	}
+	burst := max(1, int(math.Ceil(perSecond)))
+	return &Budget{lim: rate.NewLimiter(rate.Limit(perSecond), burst)}
+}
+
+// Allow reports whether a retry may be made now, and takes a token for it if
+// so. It does not wait: if the budget is spent, it reports false, and the
+// caller should fail rather than retry.
+func (b *Budget) Allow() bool {
+	if b == nil {
+		return true
+	}
+	if !b.lim.Allow() {
+		b.dropped.Add(1)
+		return false
+	}
+	b.allowed.Add(1)
+	return true
+}
+
+// Metrics returns a map of budget metrics. The caller is responsible for
+// publishing these metrics.
+func (b *Budget) Metrics() *expvar.Map {
+	m := new(expvar.Map)
+	if b != nil {
+		m.Set("retries_allowed", &b.allowed)
+		m.Set("retries_dropped", &b.dropped)
+	}
+	return m
+}
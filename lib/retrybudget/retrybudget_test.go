@@ -0,0 +1,45 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package retrybudget_test
+
+import (
+	"testing"
+
+	"github.com/tailscale/go-cache-plugin/lib/retrybudget"
+)
+
+func TestBudget(t *testing.T) {
+	t.Run("Nil", func(t *testing.T) {
+		b := retrybudget.New(0)
+		if b != nil {
+			t.Fatalf("New(0): got %v, want nil", b)
+		}
+		for range 100 {
+			if !b.Allow() {
+				t.Fatal("Allow: got false, want true")
+			}
+		}
+	})
+
+	t.Run("Limit", func(t *testing.T) {
+		// With a rate this low, no token is replenished during the test, so
+		// only the burst is allowed.
+		b := retrybudget.New(0.001)
+		if !b.Allow() {
+			t.Error("Allow 1: got false, want true")
+		}
+		for i := range 3 {
+			if b.Allow() {
+				t.Errorf("Allow %d: got true, want false", i+2)
+			}
+		}
+		m := b.Metrics()
+		if got := m.Get("retries_allowed").String(); got != "1" {
+			t.Errorf("retries_allowed: got %s, want 1", got)
+		}
+		if got := m.Get("retries_dropped").String(); got != "3" {
+			t.Errorf("retries_dropped: got %s, want 3", got)
+		}
+	})
+}
@@ -10,13 +10,16 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"maps"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/creachadair/atomicfile"
+	"github.com/creachadair/mds/mapset"
 	"github.com/creachadair/scheddle"
 	"github.com/creachadair/taskgroup"
 )
@@ -32,8 +35,9 @@ func (s *Server) cacheLoadLocal(hash string) ([]byte, http.Header, error) {
 
 // cacheStoreLocal writes the contents of body to the local cache.
 //
-// The file format is a plain-text section at the top recording a subset of the
-// response headers, followed by "\n\n", followed by the response body.
+// The file format is a plain-text section at the top recording the response
+// headers that describe the object (see cacheHeader), one "Name: value" line
+// per value, followed by "\n\n", followed by the response body.
 func (s *Server) cacheStoreLocal(hash string, hdr http.Header, body []byte) error {
 	path := s.makePath(hash)
 	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
@@ -44,36 +48,178 @@ func (s *Server) cacheStoreLocal(hash string, hdr http.Header, body []byte) erro
 	})
 }
 
+// A cacheSpool is a local cache entry whose body is written as a response is
+// delivered to the client. The entry is not visible in the cache until it is
+// committed, so an entry abandoned partway through is never served. A failure
+// to write is recorded rather than reported, so that a problem with the cache
+// does not interrupt delivery of the response.
+type cacheSpool struct {
+	f   *atomicfile.File
+	n   int64 // body bytes written
+	err error // the first write error, if any
+}
+
+// cacheBeginLocal begins a local cache entry for hash with the headers of hdr
+// (see cacheStoreLocal). The caller must either commit or cancel the spool.
+func (s *Server) cacheBeginLocal(hash string, hdr http.Header) (*cacheSpool, error) {
+	path := s.makePath(hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := atomicfile.New(path, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeCacheHeader(f, hdr); err != nil {
+		f.Cancel()
+		return nil, err
+	}
+	return &cacheSpool{f: f}, nil
+}
+
+// Write implements [io.Writer]. It always reports success.
+func (c *cacheSpool) Write(data []byte) (int, error) {
+	if c.err == nil {
+		nw, err := c.f.Write(data)
+		c.n += int64(nw)
+		c.err = err
+	}
+	return len(data), nil
+}
+
+// commit makes the entry visible in the cache, unless a write failed.
+func (c *cacheSpool) commit() error {
+	if c.err != nil {
+		c.f.Cancel()
+		return c.err
+	}
+	return c.f.Close()
+}
+
+// cancel discards the entry.
+func (c *cacheSpool) cancel() { c.f.Cancel() }
+
 // cacheLoadS3 reads cached headers and body from the remote storage cache.
-func (s *Server) cacheLoadS3(ctx context.Context, hash string) ([]byte, http.Header, error) {
-	data, err := s.Storage.GetData(ctx, s.makeKey(hash))
+// If the storage supports conditional reads, it also reports the etag of the
+// remote object.
+func (s *Server) cacheLoadS3(ctx context.Context, hash string) ([]byte, http.Header, string, error) {
+	data, etag, err := s.getRemote(ctx, hash, "")
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, "", err
+	}
+	body, hdr, err := parseCacheObject(data)
+	return body, hdr, etag, err
+}
+
+// getRemote reads the contents of the remote storage object for hash. If the
+// storage supports conditional reads, it reports the etag of the object, and
+// if etag is non-empty and matches, it reports [ErrNotModified].
+func (s *Server) getRemote(ctx context.Context, hash, etag string) ([]byte, string, error) {
+	cc, ok := s.Storage.(ConditionalClient)
+	if !ok {
+		data, err := s.Storage.GetData(ctx, s.makeKey(hash))
+		return data, "", err
+	}
+	rc, _, tag, err := cc.GetCond(ctx, s.makeKey(hash), etag)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	return data, tag, err
+}
+
+// cacheRevalidate checks whether the local cache entry for hash is older than
+// the revalidation period, and if so, refreshes it from the remote storage
+// cache. If the remote object has not changed since it was stored locally,
+// the local entry is kept and its age is reset. Errors are logged and
+// otherwise ignored, leaving the local entry in place. It reports whether the
+// local entry was successfully revalidated.
+func (s *Server) cacheRevalidate(ctx context.Context, hash string) bool {
+	path := s.makePath(hash)
+	fi, err := os.Stat(path)
+	if err != nil || time.Since(fi.ModTime()) < s.RevalidateAfter {
+		return false // not present, or not yet due
+	}
+	etag, _ := os.ReadFile(etagPath(path)) // if missing, fetch unconditionally
+	data, tag, err := s.getRemote(ctx, hash, string(etag))
+	if errors.Is(err, ErrNotModified) {
+		s.reqNotModified.Add(1)
+		now := time.Now()
+		os.Chtimes(path, now, now)
+		return true
+	} else if err != nil {
+		s.logf("revalidate %q: %v (using local copy)", hash, err)
+		return false
+	}
+	body, hdr, err := parseCacheObject(data)
+	if err == nil {
+		err = s.cacheStoreLocal(hash, hdr, body)
+	}
+	if err != nil {
+		s.logf("revalidate %q: update local: %v", hash, err)
+		return false
+	}
+	s.writeETag(hash, tag)
+	return true
+}
+
+// writeETag records etag in the sidecar file for the local cache entry for
+// hash, if etag is non-empty.
+func (s *Server) writeETag(hash, etag string) {
+	if etag == "" {
+		return
+	}
+	if err := atomicfile.WriteData(etagPath(s.makePath(hash)), []byte(etag), 0644); err != nil {
+		s.logf("write etag for %q: %v", hash, err)
 	}
-	return parseCacheObject(data)
 }
 
-// cacheStoreS3 returns a task that writes the contents of body to the remote
-// storage cache.
-func (s *Server) cacheStoreS3(hash string, hdr http.Header, body []byte) taskgroup.Task {
-	var buf bytes.Buffer
-	writeCacheObject(&buf, hdr, body)
-	nb := buf.Len()
+// etagPath returns the path of the etag sidecar file for the local cache path.
+func etagPath(path string) string { return path + ".etag" }
+
+// cacheStoreS3 returns a task that writes the local cache entry for hash to
+// the remote storage cache. The entry is opened before the task is returned,
+// so that the task writes it as it is now, even if it is later replaced.
+func (s *Server) cacheStoreS3(hash string) taskgroup.Task {
+	f, err := os.Open(s.makePath(hash))
+	var fi fs.FileInfo
+	if err == nil {
+		fi, err = f.Stat()
+		if err != nil {
+			f.Close()
+		}
+	}
 	return func() error {
+		if err != nil {
+			s.logf("[storage] put %q failed: %v", hash, err)
+			s.rspPushError.Add(1)
+			return nil
+		}
+		defer f.Close()
 		sctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
 		defer cancel()
 
-		if err := s.Storage.Put(sctx, s.makeKey(hash), &buf); err != nil {
+		if err := s.Storage.Put(sctx, s.makeKey(hash), f); err != nil {
 			s.logf("[storage] put %q failed: %v", hash, err)
 			s.rspPushError.Add(1)
 		} else {
 			s.rspPush.Add(1)
-			s.rspPushBytes.Add(int64(nb))
+			s.rspPushBytes.Add(fi.Size())
 		}
 		return nil
 	}
 }
 
+// cacheLoadFetched reads cached headers and body from the memory cache, or if
+// not found there, from the local cache, as stored by a fetch from a target.
+func (s *Server) cacheLoadFetched(hash string) ([]byte, http.Header, error) {
+	if data, hdr, err := s.cacheLoadMemory(hash); err == nil {
+		return data, hdr, nil
+	}
+	return s.cacheLoadLocal(hash)
+}
+
 // cacheLoadMemory reads cached headers and body from the memory cache.
 func (s *Server) cacheLoadMemory(hash string) ([]byte, http.Header, error) {
 	e, ok := s.mcache.Get(hash)
@@ -86,7 +232,7 @@ func (s *Server) cacheLoadMemory(hash string) ([]byte, http.Header, error) {
 // cacheStoreMemory writes the contents of body to the memory cache.
 func (s *Server) cacheStoreMemory(hash string, maxAge time.Duration, hdr http.Header, body []byte) {
 	s.mcache.Put(hash, memCacheEntry{
-		header: trimCacheHeader(hdr),
+		header: cacheHeader(hdr),
 		body:   body,
 	})
 	s.expire.After(maxAge, scheddle.Run(func() {
@@ -94,16 +240,43 @@ func (s *Server) cacheStoreMemory(hash string, maxAge time.Duration, hdr http.He
 	}))
 }
 
-var keepHeader = []string{
-	"Cache-Control", "Content-Type", "Date", "Etag",
-}
+// hopHeaders are headers that apply only to a single connection, and must not
+// be stored or replayed (RFC 9110, Section 7.6.1).
+var hopHeaders = mapset.New(
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+)
+
+// skipHeaders are end-to-end headers that describe a particular response
+// rather than the object, and are not stored. The Content-Length of a cached
+// response is computed from the stored body.
+var skipHeaders = mapset.New(
+	"Age", "Content-Length", "X-Cache", "X-Cache-Id", "X-Cache-Key",
+)
+
+// sensitiveHeaders are headers that may carry credentials or per-user state,
+// and are never stored with a cached response.
+var sensitiveHeaders = mapset.New(
+	"Authorization", "Cookie", "Set-Cookie", "WWW-Authenticate",
+)
 
-func trimCacheHeader(h http.Header) http.Header {
+// cacheHeader returns a copy of the headers of h to be stored with a cached
+// response and replayed when it is served, including Content-Type,
+// Content-Encoding, and Content-Disposition. Hop-by-hop headers, including any
+// named by the Connection header, and sensitive headers are omitted.
+func cacheHeader(h http.Header) http.Header {
+	conn := mapset.New[string]()
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			conn.Add(http.CanonicalHeaderKey(strings.TrimSpace(name)))
+		}
+	}
 	out := make(http.Header)
-	for _, name := range keepHeader {
-		if v := h.Get(name); v != "" {
-			out.Set(name, v)
+	for name, vals := range h {
+		if hopHeaders.Has(name) || skipHeaders.Has(name) || sensitiveHeaders.Has(name) || conn.Has(name) {
+			continue
 		}
+		out[name] = slices.Clone(vals)
 	}
 	return out
 }
@@ -125,28 +298,40 @@ func parseCacheObject(data []byte) ([]byte, http.Header, error) {
 }
 
 // writeCacheObject writes the specified response data into a cache object at w.
+// Headers are written in order by name, so that identical responses produce
+// identical objects.
 func writeCacheObject(w io.Writer, h http.Header, body []byte) error {
-	hprintf(w, h, "Content-Type", "application/octet-stream")
-	hprintf(w, h, "Date", "")
-	hprintf(w, h, "Etag", "")
-	fmt.Fprint(w, "\n")
+	if err := writeCacheHeader(w, h); err != nil {
+		return err
+	}
 	_, err := w.Write(body)
 	return err
 }
 
-func hprintf(w io.Writer, h http.Header, name, fallback string) {
-	if v := h.Get(name); v != "" {
-		fmt.Fprintf(w, "%s: %s\n", name, v)
-	} else if fallback != "" {
-		fmt.Fprintf(w, "%s: %s\n", name, fallback)
+// writeCacheHeader writes the header section of a cache object for a
+// response with headers h to w, including the blank line that ends it.
+func writeCacheHeader(w io.Writer, h http.Header) error {
+	h = cacheHeader(h)
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", "application/octet-stream")
 	}
+	for _, name := range slices.Sorted(maps.Keys(h)) {
+		for _, v := range h[name] {
+			fmt.Fprintf(w, "%s: %s\n", name, v)
+		}
+	}
+	_, err := fmt.Fprint(w, "\n")
+	return err
 }
 
 // setXCacheInfo adds cache-specific headers to h.
-func setXCacheInfo(h http.Header, result, hash string) {
+func (s *Server) setXCacheInfo(h http.Header, result, hash string) {
 	h.Set("X-Cache", result)
 	if hash != "" {
 		h.Set("X-Cache-Id", hash[:12])
+		if s.ExposeKeys {
+			h.Set("X-Cache-Key", s.makeKey(hash))
+		}
 	}
 }
 
@@ -7,7 +7,9 @@ package revproxy
 
 import (
 	"context"
+	"errors"
 	"io"
+	"time"
 )
 
 // CacheClient defines the interface for storage backends used by the reverse proxy
@@ -18,6 +20,12 @@ type CacheClient interface {
 	// The caller must close the returned ReadCloser when done.
 	Get(ctx context.Context, key string) (io.ReadCloser, int64, error)
 
+	// GetRange retrieves length bytes of the object with the given key,
+	// starting at offset, or the rest of the object if length < 0.
+	// If the backend does not support range reads, it reports
+	// ErrRangeNotSupported. The caller must close the returned ReadCloser.
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+
 	// GetData is a convenience method that returns the complete content of the object
 	// with the given key as a byte slice.
 	GetData(ctx context.Context, key string) ([]byte, error)
@@ -29,8 +37,164 @@ type CacheClient interface {
 	// PutCond performs a conditional put operation for the object with the given key.
 	// It only writes the data if the object doesn't exist or has a different content hash.
 	// Returns a boolean indicating whether the object was written, and any error.
+	// If another writer stores the object concurrently, the backend may refuse
+	// the write and report an error wrapping ErrPutRace.
 	PutCond(ctx context.Context, key, contentHash string, data io.Reader) (bool, error)
 
 	// Close releases any resources used by the client.
 	Close() error
 }
+
+// ErrRangeNotSupported is reported by a range read when the backend does not
+// support reading part of an object.
+var ErrRangeNotSupported = errors.New("range reads not supported")
+
+// ErrChecksumMismatch is reported by a write when the backend rejects the
+// upload because its contents do not match the checksum sent with it, meaning
+// the data were corrupted in transit.
+var ErrChecksumMismatch = errors.New("upload checksum mismatch")
+
+// Classes of storage errors. Storage clients wrap the errors they report from
+// the backend so that errors.Is reports whether an error belongs to one of
+// these classes, while preserving the original error.
+var (
+	// ErrAccessDenied means the credentials of the client do not permit the
+	// operation. Retrying will not help.
+	ErrAccessDenied = errors.New("access denied")
+
+	// ErrThrottled means the backend rejected the request because of its rate
+	// limits. The request may succeed if retried later.
+	ErrThrottled = errors.New("request throttled")
+
+	// ErrTimeout means the request did not complete in time, either because
+	// the deadline of its context expired or the backend timed out.
+	ErrTimeout = errors.New("request timed out")
+
+	// ErrRetained means the backend refused to delete or replace the object
+	// because it is under a retention period or hold. Retrying will not help
+	// until the retention ends or the hold is released.
+	ErrRetained = errors.New("object is retained")
+)
+
+// ErrPutRace is reported by a conditional put that did not write the object
+// because another writer stored it after the client checked for it. The
+// object is present, so callers may treat this as if a matching object had
+// been found.
+var ErrPutRace = errors.New("conditional put lost a race")
+
+// ErrNotModified is reported by a conditional read when the object in storage
+// matches the etag given by the caller.
+var ErrNotModified = errors.New("object not modified")
+
+// A ConditionalClient is a [CacheClient] that also supports conditional reads.
+// Storage backends that support it can use conditional reads to avoid
+// re-transferring an object whose contents have not changed.
+type ConditionalClient interface {
+	CacheClient
+
+	// GetCond is as Get, but if etag is non-empty and matches the current etag
+	// of the object, it reports ErrNotModified without reading the contents.
+	// On success, it also returns the current etag of the object.
+	GetCond(ctx context.Context, key, etag string) (io.ReadCloser, int64, string, error)
+}
+
+// A StatClient is a [CacheClient] that can also report whether an object is
+// present without reading its contents. Callers can use it to avoid uploading
+// an object that storage already has.
+type StatClient interface {
+	CacheClient
+
+	// Stat reports the metadata of the object with the given key. If the key
+	// is not found, the error satisfies [fs.ErrNotExist].
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+}
+
+// A VersionedClient is a [StatClient] that can also read a specific version
+// of an object, as reported by Stat. Callers can use it to read exactly the
+// object they recorded, even if it has since been replaced.
+type VersionedClient interface {
+	StatClient
+
+	// GetVersion is as Get, but reads the given version of the object with
+	// the given key. If that version is not found, for example because the
+	// object has been replaced in a bucket that does not keep old versions,
+	// the error satisfies [fs.ErrNotExist].
+	GetVersion(ctx context.Context, key, version string) (io.ReadCloser, int64, error)
+}
+
+// A SwapClient is a [VersionedClient] that can also write an object only if
+// it is still at the version the caller read, so that a read-modify-write of
+// the object does not overwrite a concurrent update.
+type SwapClient interface {
+	VersionedClient
+
+	// PutVersion is as Put, but writes the object only if its current version
+	// is version, as reported by Stat, or if version is empty, only if the
+	// object does not exist. Otherwise it reports an error wrapping
+	// ErrPutRace, without effect.
+	PutVersion(ctx context.Context, key, version string, data io.Reader) error
+}
+
+// A ChecksumClient is a [CacheClient] that can also report the CRC32C
+// checksum (Castagnoli) stored with an object, so that the caller can verify
+// the contents it reads against the checksum computed when they were written.
+type ChecksumClient interface {
+	CacheClient
+
+	// GetChecksum is as Get, but also reports the CRC32C of the object. The
+	// checksum describes the same version of the object as the contents.
+	GetChecksum(ctx context.Context, key string) (io.ReadCloser, int64, uint32, error)
+}
+
+// A TypedClient is a [CacheClient] that can also record the content type of
+// the objects it writes, so that they can be served directly from storage.
+type TypedClient interface {
+	CacheClient
+
+	// PutType is as Put, but records contentType as the content type of the
+	// object. If contentType is empty, the default of the backend is used.
+	PutType(ctx context.Context, key, contentType string, data io.Reader) error
+}
+
+// ObjectInfo describes an object in storage, as reported by [ListClient] and
+// [StatClient].
+type ObjectInfo struct {
+	Key     string    // the storage key of the object
+	Size    int64     // the size of the object in bytes
+	ModTime time.Time // when the object was last written
+
+	// Version identifies the version of the object, if the backend reports
+	// one: the generation in GCS, or the version ID in S3. It is reported by
+	// Stat, and may be empty.
+	Version string
+}
+
+// A ListClient is a [CacheClient] that also supports enumerating and deleting
+// objects, for maintenance tools that operate on a whole bucket.
+type ListClient interface {
+	CacheClient
+
+	// List calls f for each object whose key has the given prefix, in
+	// lexicographic order by key. If f reports an error, List stops and
+	// returns that error.
+	List(ctx context.Context, prefix string, f func(ObjectInfo) error) error
+
+	// Delete removes the object with the given key. It is not an error if
+	// the object does not exist.
+	Delete(ctx context.Context, key string) error
+
+	// Copy copies the object with key srcKey to dstKey in the same bucket,
+	// without transferring its contents through the client. If srcKey is not
+	// found, the error satisfies [fs.ErrNotExist].
+	Copy(ctx context.Context, srcKey, dstKey string) error
+
+	// ObjectTags returns the tags attached to the object with the given key, as
+	// object metadata in GCS or object tags in S3. If the key is not found,
+	// the error satisfies [fs.ErrNotExist].
+	ObjectTags(ctx context.Context, key string) (map[string]string, error)
+
+	// SetObjectTag sets the tag with the given name to value on the object
+	// with the given key, keeping its other tags. If the key is not found,
+	// the error satisfies [fs.ErrNotExist].
+	SetObjectTag(ctx context.Context, key, name, value string) error
+}
@@ -0,0 +1,73 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// GetResumable reads the contents of the object for key from c into the file
+// at path, and returns the file open for reading from the beginning, along
+// with its size. The caller is responsible for closing and removing the file.
+//
+// If the file already exists, its contents are assumed to be a prefix of the
+// object left by an earlier call that was interrupted, and only the rest of
+// the object is read, using a range read. If the range read fails, for example
+// because the backend does not support it, the whole object is read instead.
+// If reading fails partway through, the file is kept so that a later call can
+// resume from where this one stopped.
+//
+// Because the prefix is not checked against the object, this should only be
+// used for objects whose contents do not change once written.
+func GetResumable(ctx context.Context, c CacheClient, key, path string) (*os.File, int64, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	var rc io.ReadCloser
+	if offset > 0 {
+		rc, err = c.GetRange(ctx, key, offset, -1)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			offset = 0 // fall back to reading the whole object
+		}
+	}
+	if offset == 0 {
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return nil, 0, err
+		} else if _, err := f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		rc, _, err = c.Get(ctx, key)
+	}
+	if err != nil {
+		f.Close()
+		if offset == 0 {
+			os.Remove(path) // nothing worth keeping
+		}
+		return nil, 0, err
+	}
+	defer rc.Close()
+
+	nw, err := io.Copy(f, rc)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, offset + nw, nil
+}
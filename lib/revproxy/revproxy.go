@@ -15,7 +15,10 @@ package revproxy
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"crypto/tls"
+	"errors"
 	"expvar"
 	"fmt"
 	"io"
@@ -53,6 +56,12 @@ import (
 // A cached response is a file with a header section and the body, separated by
 // a blank line. Only a subset of response headers are saved.
 //
+// A response fetched from a target is written to the local cache as it is
+// copied to the client, and becomes visible in the cache only once the whole
+// body has been read. If the client disconnects first, the partial entry is
+// discarded. Once the entry is complete, it is written to S3 in the
+// background.
+//
 // # Cache Responses
 //
 // For requests handled by the proxy, the response includes an "X-Cache" header
@@ -60,12 +69,68 @@ import (
 //
 //   - "hit, memory": The response was served out of the memory cache.
 //   - "hit, local": The response was served out of the local cache.
+//   - "hit, local, revalidated": The response was served out of the local
+//     cache, after revalidating it against S3 (see RevalidateAfter).
 //   - "hit, remote": The response was faulted in from S3.
+//   - "hit, coalesced": The response was fetched from the target by another
+//     concurrent request for the same object (see "Request Coalescing").
 //   - "fetch, cached": The response was forwarded to the target and cached.
 //   - "fetch, uncached": The response was forwarded to the target and not cached.
 //
 // For results intersecting with the cache, it also reports a X-Cache-Id giving
-// the storage key of the cache object.
+// a prefix of the digest of the cache object. If ExposeKeys is true, it also
+// reports an X-Cache-Key giving the full storage key of the cache object.
+//
+// # Request Coalescing
+//
+// If a cacheable request misses in all the caches while another request for
+// the same object is already being forwarded to the target, the proxy waits
+// for that request to finish instead of forwarding another, and then serves
+// the response it cached. If the response could not be cached, the waiting
+// requests are forwarded as usual. If the client of the forwarded request
+// disconnects before the response is complete, one of the waiting requests is
+// forwarded in its place.
+//
+// # HEAD Requests
+//
+// A HEAD request for an object held in the memory or local cache is answered
+// from the cache, with the stored headers and a Content-Length giving the size
+// of the cached body, without contacting the target. Otherwise the request is
+// forwarded to the target; HEAD responses carry no body, so they are never
+// cached, and a HEAD request does not fault objects in from S3.
+//
+// # Cache Bypass
+//
+// If AllowBypass is true, a client can force a cacheable request to be
+// fetched from the target by setting either "X-Cache-Bypass: 1" or
+// "Cache-Control: no-cache" on the request. The response is cached as usual,
+// replacing any previously cached copy, so that subsequent requests see it.
+//
+// # Cache Rules
+//
+// Some targets do not advertise a caching policy that suits a proxy, such as
+// a download server that does not mark its versioned files immutable. Rules
+// override the policy of the target for the requests they match: the first
+// rule in Rules matching the host and path of a request decides how a
+// successful response is cached, regardless of its Cache-Control header (see
+// [CacheRule]). Requests that no rule matches are cached as described above.
+//
+// # Authenticated Targets
+//
+// If AuthHeaders has an entry for a target, the proxy adds that header to
+// each request it forwards to the target, so that clients can fetch from a
+// target that requires credentials without holding them. Cache keys depend
+// only on the request URL, so they do not include the credentials. The
+// injected header is removed from responses before they are cached or
+// returned to the client, and is never logged. Regardless of target,
+// credentials and cookies in responses (see sensitiveHeaders) are not cached.
+//
+// If Signers has an entry for a target, the proxy signs each request it
+// forwards to the target, for example with AWS credentials for a private
+// bucket. A request is signed just before it is sent, so each one carries a
+// fresh signature, and a request forwarded again, for example after a
+// coalesced fetch was abandoned, is not sent with a stale one. As with
+// injected headers, the signature is not part of the cache key.
 type Server struct {
 	// Targets is the list of hosts for which the proxy should forward requests.
 	// Host names should be fully-qualified ("host.example.com").
@@ -83,6 +148,50 @@ type Server struct {
 	// intervening slash.
 	KeyPrefix string
 
+	// RevalidateAfter, if positive, is the age after which a response cached
+	// on local disk is revalidated against the remote storage before it is
+	// served. If Storage supports conditional reads (see [ConditionalClient])
+	// and the stored object has not changed, the local copy is kept and its
+	// age is reset without transferring the contents again. If zero or
+	// negative, local entries are served without revalidation.
+	RevalidateAfter time.Duration
+
+	// AllowBypass, if true, allows clients to request a fetch from the target
+	// that skips cached copies (see "Cache Bypass" above). This is off by
+	// default so that untrusted clients cannot stampede the target.
+	AllowBypass bool
+
+	// ExposeKeys, if true, adds an X-Cache-Key header giving the storage key
+	// of the cache object to responses. This is meant for debugging.
+	ExposeKeys bool
+
+	// Settings for connections to the targets. Requests are forwarded with a
+	// copy of [http.DefaultTransport], modified by any of these that are set.
+	// HTTP/2 is used for targets that support it, unless DisableHTTP2 is true.
+	MaxConnsPerHost       int           // maximum connections per target (0 for no limit)
+	IdleConnTimeout       time.Duration // how long to keep idle connections
+	ResponseHeaderTimeout time.Duration // maximum wait for response headers
+	DisableHTTP2          bool          // use only HTTP/1.1 to the targets
+
+	// Rules, if non-empty, override the caching policy of the targets for the
+	// requests they match (see "Cache Rules" above).
+	Rules []CacheRule
+
+	// AuthHeaders, if non-nil, maps target hosts to a header that the proxy
+	// adds to requests forwarded to that target, replacing any value sent by
+	// the client (see "Authenticated Targets" above).
+	AuthHeaders map[string]AuthHeader
+
+	// Signers, if non-nil, maps target hosts to a signer for requests that
+	// the proxy forwards to that target (see "Authenticated Targets" above).
+	Signers map[string]RequestSigner
+
+	// OriginTimeout, if positive, is the maximum time allowed for a request
+	// forwarded to a target, including reading the response body. A request
+	// that exceeds it fails with HTTP 504 (Gateway Timeout). If zero or
+	// negative, forwarded requests are bounded only by the client.
+	OriginTimeout time.Duration
+
 	// Logf, if non-nil, is used to write log messages. If nil, logs are
 	// discarded.
 	Logf func(string, ...any)
@@ -95,8 +204,10 @@ type Server struct {
 	//     B U:"<url>" H:<digest> C:<bool>
 	//     E H:<digest> <disposition> B:<bytes> (<time> elapsed)
 	//     - H:<digest> miss
+	//     - H:<digest> bypass
 	//
 	// The "B" line is when the request began, and "E" when it was finished.
+	// A "-" line reports a cache miss, or a client request to bypass the cache.
 	// The abbreviated fields are:
 	//
 	//     U:       -- request URL
@@ -106,10 +217,13 @@ type Server struct {
 	//
 	// The dispositions of a request are:
 	//
-	//     hit mem  -- cache hit in memory (volatile)
-	//     hit disk -- cache hit in local disk
-	//     hit S3   -- cache hit in S3 (faulted to disk)
-	//     fetch    -- fetched from the origin server
+	//     hit mem       -- cache hit in memory (volatile)
+	//     hit disk      -- cache hit in local disk
+	//     hit S3        -- cache hit in S3 (faulted to disk)
+	//     hit coalesced -- fetched by a concurrent request for the same object
+	//     head mem      -- HEAD request answered from memory
+	//     head disk     -- HEAD request answered from local disk
+	//     fetch         -- fetched from the origin server
 	//
 	// On fetches, the "RC" tag indicates whether the response is cacheable,
 	// with "no" meaning it was not cached at all, "mem" meaning it was cached
@@ -117,37 +231,56 @@ type Server struct {
 	// cached on disk (and S3).
 	LogRequests bool
 
-	initOnce sync.Once
-	tasks    *taskgroup.Group
-	start    func(taskgroup.Task)
-	mcache   *cache.Cache[string, memCacheEntry] // short-lived mutable objects
-	expire   *scheddle.Queue                     // cache expirations
-
-	reqReceived  expvar.Int // total requests received
-	reqMemoryHit expvar.Int // hit in memory cache (volatile)
-	reqLocalHit  expvar.Int // hit in local cache
-	reqLocalMiss expvar.Int // miss in local cache
-	reqFaultHit  expvar.Int // hit in remote (S3) cache
-	reqFaultMiss expvar.Int // miss in remote (S3) cache
-	reqForward   expvar.Int // request forwarded directly to upstream
-	rspSave      expvar.Int // successful response saved in local cache
-	rspSaveMem   expvar.Int // response saved in memory cache
-	rspSaveError expvar.Int // error saving to local cache
-	rspSaveBytes expvar.Int // bytes written to local cache
-	rspPush      expvar.Int // successful response saved in S3
-	rspPushError expvar.Int // error saving to S3
-	rspPushBytes expvar.Int // bytes written to S3
-	rspNotCached expvar.Int // response not cached anywhere
+	initOnce  sync.Once
+	tasks     *taskgroup.Group
+	start     func(taskgroup.Task)
+	transport http.RoundTripper                   // for requests to the targets
+	mcache    *cache.Cache[string, memCacheEntry] // short-lived mutable objects
+	expire    *scheddle.Queue                     // cache expirations
+
+	fmu     sync.Mutex
+	flights map[string]*flight // fetches from the targets in progress, by hash
+
+	reqReceived    expvar.Int // total requests received
+	reqBypass      expvar.Int // cacheable request bypassed the cache by client request
+	reqMemoryHit   expvar.Int // hit in memory cache (volatile)
+	reqLocalHit    expvar.Int // hit in local cache
+	reqLocalMiss   expvar.Int // miss in local cache
+	reqFaultHit    expvar.Int // hit in remote (S3) cache
+	reqFaultMiss   expvar.Int // miss in remote (S3) cache
+	reqHeadHit     expvar.Int // HEAD request answered from cache
+	reqHeadMiss    expvar.Int // HEAD request not in cache, forwarded
+	reqCoalesced   expvar.Int // request served from the fetch of a concurrent request
+	reqNotModified expvar.Int // local entry revalidated without transfer
+	reqForward     expvar.Int // request forwarded directly to upstream
+	reqTimeout     expvar.Int // forwarded request exceeded OriginTimeout
+	rspSave        expvar.Int // successful response saved in local cache
+	rspSaveMem     expvar.Int // response saved in memory cache
+	rspSaveError   expvar.Int // error saving to local cache
+	rspSaveBytes   expvar.Int // bytes written to local cache
+	rspPush        expvar.Int // successful response saved in S3
+	rspPushError   expvar.Int // error saving to S3
+	rspPushBytes   expvar.Int // bytes written to S3
+	rspNotCached   expvar.Int // response not cached anywhere
+	rspAbort       expvar.Int // partial response discarded from local cache
+
+	bytesFromCache  expvar.Int // body bytes served to clients from a cache
+	bytesFromOrigin expvar.Int // body bytes read from targets
 }
 
 func (s *Server) init() {
 	s.initOnce.Do(func() {
 		nt := runtime.NumCPU()
 		s.tasks, s.start = taskgroup.New(nil).Limit(nt)
+		s.transport = s.newTransport()
+		if len(s.Signers) != 0 {
+			s.transport = signTransport{base: s.transport, signers: s.Signers}
+		}
 		s.mcache = cache.New(cache.LRU[string, memCacheEntry](10 << 20).
 			WithSize(entrySize),
 		)
 		s.expire = scheddle.NewQueue(nil)
+		s.flights = make(map[string]*flight)
 	})
 }
 
@@ -156,12 +289,18 @@ func (s *Server) init() {
 func (s *Server) Metrics() *expvar.Map {
 	m := new(expvar.Map)
 	m.Set("req_received", &s.reqReceived)
+	m.Set("req_client_bypass", &s.reqBypass)
 	m.Set("req_memory_hit", &s.reqMemoryHit)
 	m.Set("req_local_hit", &s.reqLocalHit)
 	m.Set("req_local_miss", &s.reqLocalMiss)
 	m.Set("req_fault_hit", &s.reqFaultHit)
 	m.Set("req_fault_miss", &s.reqFaultMiss)
+	m.Set("req_head_hit", &s.reqHeadHit)
+	m.Set("req_head_miss", &s.reqHeadMiss)
+	m.Set("req_coalesced", &s.reqCoalesced)
+	m.Set("req_notmodified", &s.reqNotModified)
 	m.Set("req_forward", &s.reqForward)
+	m.Set("req_origin_timeout", &s.reqTimeout)
 	m.Set("rsp_save", &s.rspSave)
 	m.Set("rsp_save_memory", &s.rspSaveMem)
 	m.Set("rsp_save_error", &s.rspSaveError)
@@ -170,9 +309,23 @@ func (s *Server) Metrics() *expvar.Map {
 	m.Set("rsp_push_error", &s.rspPushError)
 	m.Set("rsp_push_bytes", &s.rspPushBytes)
 	m.Set("rsp_not_cached", &s.rspNotCached)
+	m.Set("rsp_partial_abort", &s.rspAbort)
+	m.Set("bytes_served_from_cache", &s.bytesFromCache)
+	m.Set("bytes_fetched_from_origin", &s.bytesFromOrigin)
+	m.Set("bytes_saved_ratio", expvar.Func(s.savedRatio))
 	return m
 }
 
+// savedRatio reports the fraction of body bytes served to clients that came
+// from a cache rather than a target, or 0 if none have been served.
+func (s *Server) savedRatio() any {
+	cached, fetched := s.bytesFromCache.Value(), s.bytesFromOrigin.Value()
+	if cached+fetched == 0 {
+		return 0.0
+	}
+	return float64(cached) / float64(cached+fetched)
+}
+
 // ServeHTTP implements the [http.Handler] interface for the proxy.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.init()
@@ -187,41 +340,87 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	hash := hashRequestURL(r.URL)
 	canCache := s.canCacheRequest(r)
+	canHead := s.canAnswerHead(r)
+	bypass := (canCache || canHead) && s.AllowBypass && wantsBypass(r)
 	s.vlogf("rp B U:%q H:%s C:%v", r.URL, hash, canCache)
 	start := time.Now()
-	if canCache {
+	if bypass {
+		s.reqBypass.Add(1)
+		s.vlogf("rp - H:%s bypass", hash)
+	} else if canHead {
+		// Answer from a cached copy if we have one, but do not fault in from
+		// S3 only to report the headers.
+		if s.serveHead(w, hash, start) {
+			s.reqHeadHit.Add(1)
+			return
+		}
+		s.reqHeadMiss.Add(1)
+		s.vlogf("rp - H:%s miss", hash)
+	} else if canCache {
 		// Check for a hit on this object in the memory cache.
 		if data, hdr, err := s.cacheLoadMemory(hash); err == nil {
 			s.reqMemoryHit.Add(1)
-			setXCacheInfo(hdr, "hit, memory", hash)
-			writeCachedResponse(w, hdr, data)
+			s.setXCacheInfo(hdr, "hit, memory", hash)
+			s.bytesFromCache.Add(writeCachedResponse(w, hdr, data))
 			s.vlogf("rp E H:%s hit mem B:%d (%v elapsed)", hash, len(data), time.Since(start))
 			return
 		}
 
 		// Check for a hit on this object in the local cache.
+		result := "hit, local"
+		if s.RevalidateAfter > 0 && s.cacheRevalidate(r.Context(), hash) {
+			result = "hit, local, revalidated"
+		}
 		if data, hdr, err := s.cacheLoadLocal(hash); err == nil {
 			s.reqLocalHit.Add(1)
-			setXCacheInfo(hdr, "hit, local", hash)
-			writeCachedResponse(w, hdr, data)
+			s.setXCacheInfo(hdr, result, hash)
+			s.bytesFromCache.Add(writeCachedResponse(w, hdr, data))
 			s.vlogf("rp E H:%s hit disk B:%d (%v elapsed)", hash, len(data), time.Since(start))
 			return
 		}
 		s.reqLocalMiss.Add(1)
 
 		// Fault in from S3.
-		if data, hdr, err := s.cacheLoadS3(r.Context(), hash); err == nil {
+		if data, hdr, etag, err := s.cacheLoadS3(r.Context(), hash); err == nil {
 			s.reqFaultHit.Add(1)
 			if err := s.cacheStoreLocal(hash, hdr, data); err != nil {
 				s.logf("update %q local: %v", hash, err)
+			} else {
+				s.writeETag(hash, etag)
 			}
-			setXCacheInfo(hdr, "hit, remote", hash)
-			writeCachedResponse(w, hdr, data)
+			s.setXCacheInfo(hdr, "hit, remote", hash)
+			s.bytesFromCache.Add(writeCachedResponse(w, hdr, data))
 			s.vlogf("rp E H:%s hit S3 B:%d (%v elapsed)", hash, len(data), time.Since(start))
 			return
 		}
 		s.reqFaultMiss.Add(1)
 		s.vlogf("rp - H:%s miss", hash)
+
+		// If another request is already fetching this object, wait for it
+		// and serve its result, rather than fetching it again.
+		for {
+			f, leader := s.joinFlight(hash)
+			if leader {
+				cctx := r.Context() // N.B. before OriginTimeout is applied
+				defer func() { s.leaveFlight(hash, f, cctx.Err() != nil) }()
+				break
+			}
+			select {
+			case <-r.Context().Done():
+				return // the client went away while waiting
+			case <-f.done:
+			}
+			if data, hdr, err := s.cacheLoadFetched(hash); err == nil {
+				s.reqCoalesced.Add(1)
+				s.setXCacheInfo(hdr, "hit, coalesced", hash)
+				s.bytesFromCache.Add(writeCachedResponse(w, hdr, data))
+				s.vlogf("rp E H:%s hit coalesced B:%d (%v elapsed)", hash, len(data), time.Since(start))
+				return
+			} else if !f.retry {
+				break // not cached, forward the request ourselves
+			}
+			// The other fetch was abandoned by its client; try again.
+		}
 	}
 
 	// Reaching here, the object is not already cached locally so we have to
@@ -229,30 +428,42 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// cacheable. Note we handle each request with its own proxy instance, so
 	// that we can handle each response in context of this request.
 	s.reqForward.Add(1)
-	proxy := &httputil.ReverseProxy{Rewrite: s.rewriteRequest}
-	updateCache := func() {}
+	proxy := &httputil.ReverseProxy{
+		Rewrite:        s.rewriteRequest,
+		Transport:      s.transport,
+		ErrorHandler:   s.forwardError,
+		ModifyResponse: s.prepareResponse,
+	}
+	if s.OriginTimeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), s.OriginTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	updateCache, abortCache := func() {}, func() {}
+	var complete bool // whether the whole body of a cacheable response was read
 	if canCache {
 		proxy.ModifyResponse = func(rsp *http.Response) error {
+			s.prepareResponse(rsp)
 			maxAge, isVolatile := s.canMemoryCache(rsp)
 			canCacheResponse := s.canCacheResponse(rsp)
 			if !canCacheResponse && !isVolatile {
 				// A response we cannot cache at all.
-				setXCacheInfo(rsp.Header, "fetch, uncached", "")
+				s.setXCacheInfo(rsp.Header, "fetch, uncached", "")
 				s.rspNotCached.Add(1)
 				s.vlogf("rp E H:%s fetch RC:no (%v elapsed)", hash, time.Since(start))
 				return nil
 			}
 
-			// Read out the whole response body so we can update the cache, and
-			// replace the response reader so we can copy it back to the caller.
-			var buf bytes.Buffer
-			rsp.Body = copyReader{
-				Reader: io.TeeReader(rsp.Body, &buf),
-				Closer: rsp.Body,
-			}
 			if !canCacheResponse && isVolatile {
-				// A volatile response we can cache temporarily.
-				setXCacheInfo(rsp.Header, "fetch, cached, volatile", hash)
+				// A volatile response we can cache temporarily. Read out the
+				// whole response body so we can update the cache, and replace
+				// the response reader so we can copy it back to the caller.
+				var buf bytes.Buffer
+				rsp.Body = copyReader{
+					Reader: eofReader{r: io.TeeReader(rsp.Body, &buf), eof: &complete},
+					Closer: rsp.Body,
+				}
+				s.setXCacheInfo(rsp.Header, "fetch, cached, volatile", hash)
 				updateCache = func() {
 					body := buf.Bytes()
 					s.cacheStoreMemory(hash, maxAge, rsp.Header, body)
@@ -261,28 +472,59 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 					// N.B. Don't persist on disk or in S3.
 					s.vlogf("rp E H:%s fetch RC:mem B:%d (%v elapsed)", hash, len(body), time.Since(start))
 				}
-			} else {
-				setXCacheInfo(rsp.Header, "fetch, cached", hash)
-				updateCache = func() {
-					body := buf.Bytes()
-					if err := s.cacheStoreLocal(hash, rsp.Header, body); err != nil {
-						s.rspSaveError.Add(1)
-						s.logf("save %q to cache: %v", hash, err)
-
-						// N.B.: Don't bother trying to forward to S3 in this case.
-					} else {
-						s.rspSave.Add(1)
-						s.rspSaveBytes.Add(int64(len(body)))
-						s.start(s.cacheStoreS3(hash, rsp.Header, body))
-					}
-					s.vlogf("rp E H:%s fetch RC:yes B:%d (%v elapsed)", hash, len(body), time.Since(start))
+				return nil
+			}
+
+			// Write the response body to the local cache as it is copied back
+			// to the caller, so that the caller does not wait for the cache,
+			// and large bodies are not held in memory.
+			spool, err := s.cacheBeginLocal(hash, rsp.Header)
+			if err != nil {
+				s.rspSaveError.Add(1)
+				s.logf("save %q to cache: %v", hash, err)
+				s.setXCacheInfo(rsp.Header, "fetch, uncached", "")
+				return nil
+			}
+			rsp.Body = copyReader{
+				Reader: eofReader{r: io.TeeReader(rsp.Body, spool), eof: &complete},
+				Closer: rsp.Body,
+			}
+			s.setXCacheInfo(rsp.Header, "fetch, cached", hash)
+			updateCache = func() {
+				if err := spool.commit(); err != nil {
+					s.rspSaveError.Add(1)
+					s.logf("save %q to cache: %v", hash, err)
+
+					// N.B.: Don't bother trying to forward to S3 in this case.
+				} else {
+					s.rspSave.Add(1)
+					s.rspSaveBytes.Add(spool.n)
+					s.start(s.cacheStoreS3(hash))
 				}
+				s.vlogf("rp E H:%s fetch RC:yes B:%d (%v elapsed)", hash, spool.n, time.Since(start))
+			}
+			abortCache = func() {
+				spool.cancel()
+				s.rspAbort.Add(1)
 			}
 			return nil
 		}
 	}
+	// N.B. This is deferred because the proxy panics with http.ErrAbortHandler
+	// if the client goes away after the response headers are sent, and the
+	// spool must be discarded in that case too.
+	defer func() {
+		if complete {
+			updateCache()
+		} else if canCache {
+			// The body was not read in full, for example because the client
+			// went away. Discard what was written, so as not to cache a
+			// truncated response.
+			abortCache()
+			s.vlogf("rp E H:%s fetch incomplete (%v elapsed)", hash, time.Since(start))
+		}
+	}()
 	proxy.ServeHTTP(w, r)
-	updateCache()
 }
 
 // rewriteRequest rewrites the inbound request for routing to a target.
@@ -294,6 +536,171 @@ func (s *Server) rewriteRequest(pr *httputil.ProxyRequest) {
 	}
 	pr.Out.URL = u
 	pr.Out.Host = u.Host
+	pr.Out.Header.Del(bypassHeader)
+	if auth, ok := s.AuthHeaders[u.Host]; ok {
+		pr.Out.Header.Set(auth.Name, auth.Value)
+	}
+}
+
+// stripAuth removes the header injected for the target of rsp, if any, so
+// that it is neither cached nor returned to the client.
+func (s *Server) stripAuth(rsp *http.Response) error {
+	if auth, ok := s.AuthHeaders[rsp.Request.Host]; ok {
+		rsp.Header.Del(auth.Name)
+	}
+	return nil
+}
+
+// prepareResponse makes the changes needed for every response from a target,
+// before it is cached or returned to the client.
+func (s *Server) prepareResponse(rsp *http.Response) error {
+	s.countOrigin(rsp)
+	return s.stripAuth(rsp)
+}
+
+// countOrigin replaces the body of rsp with one that counts the bytes read
+// from the target. This counts what is actually transferred, since the
+// response may not have a Content-Length, or may end early.
+func (s *Server) countOrigin(rsp *http.Response) {
+	rsp.Body = copyReader{
+		Reader: countReader{r: rsp.Body, n: &s.bytesFromOrigin},
+		Closer: rsp.Body,
+	}
+}
+
+// A countReader is an [io.Reader] that adds the number of bytes read from r
+// to n.
+type countReader struct {
+	r io.Reader
+	n *expvar.Int
+}
+
+func (c countReader) Read(data []byte) (int, error) {
+	nr, err := c.r.Read(data)
+	c.n.Add(int64(nr))
+	return nr, err
+}
+
+// An eofReader is an [io.Reader] that sets *eof when r reports [io.EOF].
+type eofReader struct {
+	r   io.Reader
+	eof *bool
+}
+
+func (e eofReader) Read(data []byte) (int, error) {
+	nr, err := e.r.Read(data)
+	if err == io.EOF {
+		*e.eof = true
+	}
+	return nr, err
+}
+
+// A flight is a request forwarded to a target for a cacheable object, which
+// other requests for the same object can wait for.
+type flight struct {
+	done  chan struct{} // closed when the request is finished
+	retry bool          // the request was abandoned; valid after done is closed
+}
+
+// joinFlight reports the flight for hash, and whether the caller leads it.
+// If no request for hash is in flight, the caller leads a new flight, and
+// must call leaveFlight when its request is finished. Otherwise, the caller
+// may wait for the existing flight to finish.
+func (s *Server) joinFlight(hash string) (_ *flight, leader bool) {
+	s.fmu.Lock()
+	defer s.fmu.Unlock()
+	if f, ok := s.flights[hash]; ok {
+		return f, false
+	}
+	f := &flight{done: make(chan struct{})}
+	s.flights[hash] = f
+	return f, true
+}
+
+// leaveFlight ends the flight f for hash, and releases the requests waiting
+// for it. If retry is true, the request was abandoned before it finished, and
+// a waiting request should be forwarded in its place.
+func (s *Server) leaveFlight(hash string, f *flight, retry bool) {
+	s.fmu.Lock()
+	defer s.fmu.Unlock()
+	delete(s.flights, hash)
+	f.retry = retry
+	close(f.done)
+}
+
+// An AuthHeader is a header added to requests forwarded to a target, for
+// example to supply an API key. Its String method does not reveal the value,
+// so that it is not accidentally logged.
+type AuthHeader struct {
+	Name  string // the header name, e.g., "Authorization"
+	Value string // the header value, e.g., "Bearer <token>"
+}
+
+func (a AuthHeader) String() string { return a.Name + ": [redacted]" }
+
+func (a AuthHeader) GoString() string {
+	return fmt.Sprintf("revproxy.AuthHeader{Name:%q, Value:[redacted]}", a.Name)
+}
+
+// A RequestSigner signs requests forwarded to a target.
+type RequestSigner interface {
+	// SignRequest adds a signature to the headers of req. The body of req,
+	// if any, must not be consumed.
+	SignRequest(req *http.Request) error
+}
+
+// signTransport is an [http.RoundTripper] that signs each request to a host
+// with a signer before sending it with base.
+type signTransport struct {
+	base    http.RoundTripper
+	signers map[string]RequestSigner
+}
+
+func (t signTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	sg, ok := t.signers[req.Host]
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+
+	// A RoundTripper must not modify the request, so sign a copy.
+	cp := req.Clone(req.Context())
+	if err := sg.SignRequest(cp); err != nil {
+		return nil, fmt.Errorf("sign request for %s: %w", req.Host, err)
+	}
+	return t.base.RoundTrip(cp)
+}
+
+// newTransport returns a transport for requests to the targets, configured
+// according to the connection settings of s.
+func (s *Server) newTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if s.MaxConnsPerHost > 0 {
+		t.MaxConnsPerHost = s.MaxConnsPerHost
+	}
+	if s.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = s.IdleConnTimeout
+	}
+	if s.ResponseHeaderTimeout > 0 {
+		t.ResponseHeaderTimeout = s.ResponseHeaderTimeout
+	}
+	if s.DisableHTTP2 {
+		// A non-nil empty map disables the automatic HTTP/2 upgrade.
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return t
+}
+
+// forwardError reports an error forwarding a request to its target. A request
+// that exceeded OriginTimeout is reported as a timeout.
+func (s *Server) forwardError(w http.ResponseWriter, r *http.Request, err error) {
+	code := http.StatusBadGateway
+	if errors.Is(err, context.DeadlineExceeded) {
+		s.reqTimeout.Add(1)
+		code = http.StatusGatewayTimeout
+	}
+	s.logf("forward %q: %v", r.URL, err)
+	w.WriteHeader(code)
 }
 
 type copyReader struct {
@@ -328,11 +735,92 @@ func (s *Server) canCacheRequest(r *http.Request) bool {
 	return r.Method == "GET" && !parseCacheControl(r.Header.Get("Cache-Control")).Keys.Has("no-store")
 }
 
+// canAnswerHead reports whether r is a HEAD request that can be answered from
+// the cache.
+func (s *Server) canAnswerHead(r *http.Request) bool {
+	return r.Method == "HEAD" && !parseCacheControl(r.Header.Get("Cache-Control")).Keys.Has("no-store")
+}
+
+// serveHead answers a HEAD request for hash from the memory or local cache,
+// and reports whether the object was found there.
+func (s *Server) serveHead(w http.ResponseWriter, hash string, start time.Time) bool {
+	result, disp := "hit, memory", "mem"
+	body, hdr, err := s.cacheLoadMemory(hash)
+	if err != nil {
+		result, disp = "hit, local", "disk"
+		body, hdr, err = s.cacheLoadLocal(hash)
+		if err != nil {
+			return false
+		}
+	}
+	s.setXCacheInfo(hdr, result, hash)
+	wh := w.Header()
+	for name, vals := range hdr {
+		wh[name] = slices.Clone(vals)
+	}
+	wh.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	s.vlogf("rp E H:%s head %s B:%d (%v elapsed)", hash, disp, len(body), time.Since(start))
+	return true
+}
+
+// bypassHeader is a request header that, if AllowBypass is set, requests that
+// the proxy skip cached copies and fetch from the target.
+const bypassHeader = "X-Cache-Bypass"
+
+// wantsBypass reports whether r requests that cached copies be skipped.
+func wantsBypass(r *http.Request) bool {
+	if v, err := strconv.ParseBool(r.Header.Get(bypassHeader)); err == nil && v {
+		return true
+	}
+	return parseCacheControl(r.Header.Get("Cache-Control")).Keys.Has("no-cache")
+}
+
+// A CacheRule sets how successful responses to the requests it matches are
+// cached, in place of the Cache-Control header of the response.
+type CacheRule struct {
+	// Host is the target host whose requests the rule matches.
+	Host string
+
+	// Path is a pattern for the paths of the requests the rule matches, in
+	// the syntax of [path.Match]. The query is not considered. A malformed
+	// pattern matches nothing.
+	Path string
+
+	// Immutable, if true, caches matching responses as if they were marked
+	// immutable, on local disk and in storage.
+	Immutable bool
+
+	// MaxAge, if positive and Immutable is false, caches matching responses
+	// in memory for this long, as if they were volatile. If neither is set,
+	// matching responses are not cached.
+	MaxAge time.Duration
+}
+
+// matches reports whether r matches the host and path of u.
+func (r CacheRule) matches(u *url.URL) bool {
+	ok, err := path.Match(r.Path, u.Path)
+	return u.Host == r.Host && ok && err == nil
+}
+
+// ruleFor returns the first of the cache rules of s matching u, if any.
+func (s *Server) ruleFor(u *url.URL) (CacheRule, bool) {
+	for _, r := range s.Rules {
+		if r.matches(u) {
+			return r, true
+		}
+	}
+	return CacheRule{}, false
+}
+
 // canCacheResponse reports whether r is a response whose body can be cached.
 func (s *Server) canCacheResponse(rsp *http.Response) bool {
 	if rsp.StatusCode != http.StatusOK {
 		return false
 	}
+	if rule, ok := s.ruleFor(rsp.Request.URL); ok {
+		return rule.Immutable
+	}
 	cc := parseCacheControl(rsp.Header.Get("Cache-Control"))
 	if cc.Keys.Has("no-store") {
 		return false
@@ -372,6 +860,9 @@ func (s *Server) canMemoryCache(rsp *http.Response) (time.Duration, bool) {
 	if rsp.StatusCode != http.StatusOK {
 		return 0, false
 	}
+	if rule, ok := s.ruleFor(rsp.Request.URL); ok {
+		return rule.MaxAge, !rule.Immutable && rule.MaxAge > 0
+	}
 	cc := parseCacheControl(rsp.Header.Get("Cache-Control"))
 	if cc.Keys.Has("no-store") || cc.Keys.Has("no-cache") {
 		// While no-cache doesn't mean we can't cache it, it requires
@@ -393,13 +884,15 @@ func hashRequestURL(u *url.URL) string {
 }
 
 // writeCachedResponse generates an HTTP response for a cached result using the
-// provided headers and body from the cache object.
-func writeCachedResponse(w http.ResponseWriter, hdr http.Header, body []byte) {
+// provided headers and body from the cache object. It returns the number of
+// bytes of the body written to the client.
+func writeCachedResponse(w http.ResponseWriter, hdr http.Header, body []byte) int64 {
 	wh := w.Header()
 	for name, vals := range hdr {
 		for _, val := range vals {
 			wh.Add(name, val)
 		}
 	}
-	w.Write(body)
+	n, _ := w.Write(body)
+	return int64(n)
 }
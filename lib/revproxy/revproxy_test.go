@@ -0,0 +1,717 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tailscale/go-cache-plugin/lib/revproxy"
+)
+
+// memStorage is an in-memory implementation of [revproxy.CacheClient].
+type memStorage struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func (m *memStorage) Get(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	data, err := m.GetData(ctx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+func (m *memStorage) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	return nil, revproxy.ErrRangeNotSupported
+}
+
+func (m *memStorage) GetData(_ context.Context, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.data[key]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return data, nil
+}
+
+func (m *memStorage) Put(_ context.Context, key string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.data == nil {
+		m.data = make(map[string][]byte)
+	}
+	m.data[key] = data
+	return nil
+}
+
+func (m *memStorage) PutCond(ctx context.Context, key, _ string, r io.Reader) (bool, error) {
+	return true, m.Put(ctx, key, r)
+}
+
+func (m *memStorage) Close() error { return nil }
+
+func TestCachedHeaders(t *testing.T) {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	gz.Write([]byte("the quick brown fox jumps over the lazy dog"))
+	gz.Close()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Cache-Control", "public, max-age=31536000, immutable")
+		h.Set("Content-Type", "application/x-debian-package")
+		h.Set("Content-Encoding", "gzip")
+		h.Set("Content-Disposition", `attachment; filename="fox.deb"`)
+		h.Set("Connection", "X-Hop")
+		h.Set("X-Hop", "not replayed")
+		w.Write(body.Bytes())
+	}))
+	defer origin.Close()
+	u, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &revproxy.Server{
+		Targets: []string{u.Host},
+		Local:   t.TempDir(),
+		Storage: new(memStorage),
+		Logf:    t.Logf,
+	}
+	fetch := func(wantCache string) *http.Response {
+		t.Helper()
+		req := httptest.NewRequest("GET", origin.URL+"/pool/fox.deb", nil)
+		req.Header.Set("Accept-Encoding", "gzip") // keep the body encoded
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		rsp := rec.Result()
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatalf("Status: got %d, want %d", rsp.StatusCode, http.StatusOK)
+		}
+		if got := rsp.Header.Get("X-Cache"); got != wantCache {
+			t.Errorf("X-Cache: got %q, want %q", got, wantCache)
+		}
+		return rsp
+	}
+
+	fetch("fetch, cached")
+	rsp := fetch("hit, local")
+
+	for name, want := range map[string]string{
+		"Content-Type":        "application/x-debian-package",
+		"Content-Encoding":    "gzip",
+		"Content-Disposition": `attachment; filename="fox.deb"`,
+		"X-Hop":               "",
+		"Connection":          "",
+		"Transfer-Encoding":   "",
+	} {
+		if got := rsp.Header.Get(name); got != want {
+			t.Errorf("Cached header %s: got %q, want %q", name, got, want)
+		}
+	}
+	got, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, body.Bytes()) {
+		t.Errorf("Cached body: got %q, want %q", got, body.Bytes())
+	}
+}
+
+func TestAuthHeaders(t *testing.T) {
+	const secret = "s3kr1t-api-key"
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != secret {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h := w.Header()
+		h.Set("Cache-Control", "public, max-age=31536000, immutable")
+		h.Set("X-Api-Key", secret) // a careless origin echoes the key
+		h.Set("Set-Cookie", "session=12345")
+		w.Write([]byte("package contents"))
+	}))
+	defer origin.Close()
+	u, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs strings.Builder
+	var mu sync.Mutex
+	srv := &revproxy.Server{
+		Targets:     []string{u.Host},
+		Local:       t.TempDir(),
+		Storage:     new(memStorage),
+		AuthHeaders: map[string]revproxy.AuthHeader{u.Host: {Name: "X-Api-Key", Value: secret}},
+		Logf: func(msg string, args ...any) {
+			mu.Lock()
+			defer mu.Unlock()
+			fmt.Fprintf(&logs, msg+"\n", args...)
+		},
+		LogRequests: true,
+	}
+	fetch := func(wantCache string) *http.Response {
+		t.Helper()
+		req := httptest.NewRequest("GET", origin.URL+"/pkg/file.tgz", nil)
+		req.Header.Set("X-Api-Key", "client-supplied") // replaced by the proxy
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		rsp := rec.Result()
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatalf("Status: got %d, want %d", rsp.StatusCode, http.StatusOK)
+		}
+		if got := rsp.Header.Get("X-Cache"); got != wantCache {
+			t.Errorf("X-Cache: got %q, want %q", got, wantCache)
+		}
+		if got := rsp.Header.Get("X-Api-Key"); got != "" {
+			t.Errorf("Response X-Api-Key: got %q, want it removed", got)
+		}
+		return rsp
+	}
+
+	fetch("fetch, cached")
+	if got := fetch("hit, local").Header.Get("Set-Cookie"); got != "" {
+		t.Errorf("Cached Set-Cookie: got %q, want it removed", got)
+	}
+
+	// The secret must not appear in the cache or the logs.
+	filepath.WalkDir(srv.Local, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if data, err := os.ReadFile(path); err != nil {
+			t.Errorf("Read cache file: %v", err)
+		} else if bytes.Contains(data, []byte(secret)) {
+			t.Errorf("Cache file %s contains the secret:\n%s", path, data)
+		}
+		return nil
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Contains(logs.String(), secret) {
+		t.Errorf("Logs contain the secret:\n%s", logs.String())
+	}
+	if s := fmt.Sprintf("%v %#v", srv.AuthHeaders, srv.AuthHeaders); strings.Contains(s, secret) {
+		t.Errorf("Formatted auth headers contain the secret: %s", s)
+	}
+}
+
+func TestByteCounts(t *testing.T) {
+	const body = "the quick brown fox jumps over the lazy dog"
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		// Flush before writing the body, so the response is chunked and has no
+		// Content-Length.
+		w.(http.Flusher).Flush()
+		io.WriteString(w, body)
+	}))
+	defer origin.Close()
+	u, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &revproxy.Server{
+		Targets: []string{u.Host},
+		Local:   t.TempDir(),
+		Storage: new(memStorage),
+		Logf:    t.Logf,
+	}
+	for _, want := range []string{"fetch, cached", "hit, local", "hit, local"} {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest("GET", origin.URL+"/file.txt", nil))
+		if got := rec.Result().Header.Get("X-Cache"); got != want {
+			t.Errorf("X-Cache: got %q, want %q", got, want)
+		}
+		if got := rec.Body.String(); got != body {
+			t.Errorf("Body: got %q, want %q", got, body)
+		}
+	}
+
+	m := srv.Metrics()
+	for name, want := range map[string]string{
+		"bytes_fetched_from_origin": fmt.Sprint(len(body)),
+		"bytes_served_from_cache":   fmt.Sprint(2 * len(body)),
+		"bytes_saved_ratio":         fmt.Sprint(2.0 / 3.0),
+	} {
+		if got := m.Get(name).String(); got != want {
+			t.Errorf("Metric %s: got %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestHeadRequests(t *testing.T) {
+	const body = "the quick brown fox jumps over the lazy dog"
+	var originReqs atomic.Int64
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originReqs.Add(1)
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, body)
+	}))
+	defer origin.Close()
+	u, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &revproxy.Server{
+		Targets: []string{u.Host},
+		Local:   t.TempDir(),
+		Storage: new(memStorage),
+		Logf:    t.Logf,
+	}
+	tests := []struct {
+		method, wantCache string
+		wantOrigin        int64
+	}{
+		{"HEAD", "", 1},             // not cached, forwarded
+		{"GET", "fetch, cached", 2}, // HEAD did not populate the cache
+		{"HEAD", "hit, local", 2},   // answered from the cache
+		{"GET", "hit, local", 2},
+	}
+	for i, tc := range tests {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(tc.method, origin.URL+"/file.txt", nil))
+		rsp := rec.Result()
+		if got := rsp.Header.Get("X-Cache"); got != tc.wantCache {
+			t.Errorf("%d: %s X-Cache: got %q, want %q", i, tc.method, got, tc.wantCache)
+		}
+		if got := originReqs.Load(); got != tc.wantOrigin {
+			t.Errorf("%d: %s origin requests: got %d, want %d", i, tc.method, got, tc.wantOrigin)
+		}
+		if tc.method != "HEAD" || tc.wantCache == "" {
+			continue
+		}
+		if got, want := rsp.Header.Get("Content-Length"), fmt.Sprint(len(body)); got != want {
+			t.Errorf("%d: HEAD Content-Length: got %q, want %q", i, got, want)
+		}
+		if got := rsp.Header.Get("Content-Type"); got != "text/plain" {
+			t.Errorf("%d: HEAD Content-Type: got %q, want text/plain", i, got)
+		}
+		if rec.Body.Len() != 0 {
+			t.Errorf("%d: HEAD body: got %q, want empty", i, rec.Body)
+		}
+	}
+
+	m := srv.Metrics()
+	for name, want := range map[string]string{
+		"req_head_hit":  "1",
+		"req_head_miss": "1",
+	} {
+		if got := m.Get(name).String(); got != want {
+			t.Errorf("Metric %s: got %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestCoalescing(t *testing.T) {
+	const body = "the quick brown fox jumps over the lazy dog"
+	var originReqs atomic.Int64
+	arrived := make(chan struct{}, 10)
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := originReqs.Add(1)
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		if r.URL.Path == "/abandon.txt" && n == 1 {
+			// Send part of the body, then stall until the client gives up.
+			io.WriteString(w, body[:10])
+			w.(http.Flusher).Flush()
+			arrived <- struct{}{}
+			<-r.Context().Done()
+			return
+		}
+		arrived <- struct{}{}
+		<-release
+		io.WriteString(w, body)
+	}))
+	defer origin.Close()
+	u, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &revproxy.Server{
+		Targets: []string{u.Host},
+		Local:   t.TempDir(),
+		Storage: new(memStorage),
+		Logf:    t.Logf,
+	}
+	m := srv.Metrics()
+	metric := func(name string) string { return m.Get(name).String() }
+
+	// waitMisses waits until n requests have missed in all the caches, after
+	// which they are waiting for the request in flight.
+	waitMisses := func(n int) {
+		t.Helper()
+		for metric("req_fault_miss") != fmt.Sprint(n) {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(10 * time.Millisecond) // let them reach the wait
+	}
+	get := func(ctx context.Context, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest("GET", origin.URL+path, nil).WithContext(ctx))
+		return rec
+	}
+
+	t.Run("Shared", func(t *testing.T) {
+		const numWaiters = 5
+		var wg sync.WaitGroup
+		recs := make([]*httptest.ResponseRecorder, numWaiters+1)
+		wg.Add(1)
+		go func() { defer wg.Done(); recs[0] = get(context.Background(), "/shared.txt") }()
+		<-arrived // the leader is in flight
+		for i := range numWaiters {
+			wg.Add(1)
+			go func() { defer wg.Done(); recs[i+1] = get(context.Background(), "/shared.txt") }()
+		}
+		waitMisses(numWaiters + 1)
+		close(release)
+		wg.Wait()
+
+		if n := originReqs.Load(); n != 1 {
+			t.Errorf("Origin requests: got %d, want 1", n)
+		}
+		for i, rec := range recs {
+			want := "hit, coalesced"
+			if i == 0 {
+				want = "fetch, cached"
+			}
+			if got := rec.Result().Header.Get("X-Cache"); got != want {
+				t.Errorf("Request %d X-Cache: got %q, want %q", i, got, want)
+			}
+			if got := rec.Body.String(); got != body {
+				t.Errorf("Request %d body: got %q, want %q", i, got, body)
+			}
+		}
+		if got := metric("req_coalesced"); got != fmt.Sprint(numWaiters) {
+			t.Errorf("req_coalesced: got %s, want %d", got, numWaiters)
+		}
+	})
+
+	t.Run("Abandoned", func(t *testing.T) {
+		originReqs.Store(0)
+		misses, _ := strconv.Atoi(metric("req_fault_miss"))
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() { defer close(done); get(ctx, "/abandon.txt") }()
+		<-arrived // the leader has part of the body
+
+		var rec *httptest.ResponseRecorder
+		wdone := make(chan struct{})
+		go func() { defer close(wdone); rec = get(context.Background(), "/abandon.txt") }()
+		waitMisses(misses + 2)
+		cancel() // the leader's client goes away
+		<-done
+		<-arrived // the waiter takes over the fetch
+		<-wdone
+
+		if n := originReqs.Load(); n != 2 {
+			t.Errorf("Origin requests: got %d, want 2", n)
+		}
+		if got := rec.Result().Header.Get("X-Cache"); got != "fetch, cached" {
+			t.Errorf("X-Cache: got %q, want %q", got, "fetch, cached")
+		}
+		if got := rec.Body.String(); got != body {
+			t.Errorf("Body: got %q, want %q", got, body)
+		}
+	})
+}
+
+func TestStreaming(t *testing.T) {
+	const head, tail = "the quick brown fox ", "jumps over the lazy dog"
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		// Send the first part of the body, then stall until released. With no
+		// Content-Length, the proxy flushes each part to its client.
+		io.WriteString(w, head)
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		io.WriteString(w, tail)
+	}))
+	defer origin.Close()
+	u, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local := t.TempDir()
+	srv := &revproxy.Server{
+		Targets: []string{u.Host},
+		Local:   local,
+		Storage: new(memStorage),
+		Logf:    t.Logf,
+	}
+	m := srv.Metrics()
+	metric := func(name string) string { return m.Get(name).String() }
+
+	proxy := httptest.NewServer(srv)
+	defer proxy.Close()
+	pu, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pu)}}
+	defer cli.CloseIdleConnections()
+
+	// readHead fetches the object through the proxy, and checks that the first
+	// part of the body arrives while the origin is still stalled.
+	readHead := func(ctx context.Context) *http.Response {
+		t.Helper()
+		req, err := http.NewRequestWithContext(ctx, "GET", origin.URL+"/stream.txt", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp, err := cli.Do(req)
+		if err != nil {
+			t.Fatalf("Get: unexpected error: %v", err)
+		}
+		buf := make([]byte, len(head))
+		if _, err := io.ReadFull(rsp.Body, buf); err != nil {
+			t.Fatalf("Read head: unexpected error: %v", err)
+		} else if string(buf) != head {
+			t.Errorf("Read head: got %q, want %q", buf, head)
+		}
+		return rsp
+	}
+
+	// localFiles reports the names of the files in the local cache directory.
+	localFiles := func() []string {
+		var names []string
+		filepath.WalkDir(local, func(path string, e fs.DirEntry, err error) error {
+			if err == nil && e.Type().IsRegular() {
+				names = append(names, filepath.Base(path))
+			}
+			return err
+		})
+		return names
+	}
+
+	t.Run("Abort", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		rsp := readHead(ctx)
+		cancel() // the client goes away partway through
+		rsp.Body.Close()
+
+		for metric("rsp_partial_abort") != "1" {
+			time.Sleep(time.Millisecond)
+		}
+		if names := localFiles(); len(names) != 0 {
+			t.Errorf("Local cache after abort: got %q, want empty", names)
+		}
+		if got := metric("rsp_save"); got != "0" {
+			t.Errorf("rsp_save: got %s, want 0", got)
+		}
+	})
+
+	t.Run("Complete", func(t *testing.T) {
+		rsp := readHead(context.Background())
+		defer rsp.Body.Close()
+		if got := rsp.Header.Get("X-Cache"); got != "fetch, cached" {
+			t.Errorf("X-Cache: got %q, want %q", got, "fetch, cached")
+		}
+		close(release)
+		rest, err := io.ReadAll(rsp.Body)
+		if err != nil {
+			t.Fatalf("Read tail: unexpected error: %v", err)
+		} else if string(rest) != tail {
+			t.Errorf("Read tail: got %q, want %q", rest, tail)
+		}
+
+		// The proxy commits the entry after the body is delivered.
+		for metric("rsp_save") != "1" {
+			time.Sleep(time.Millisecond)
+		}
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest("GET", origin.URL+"/stream.txt", nil))
+		if got := rec.Result().Header.Get("X-Cache"); got != "hit, local" {
+			t.Errorf("X-Cache: got %q, want %q", got, "hit, local")
+		}
+		if got, want := rec.Body.String(), head+tail; got != want {
+			t.Errorf("Body: got %q, want %q", got, want)
+		}
+		if got := metric("rsp_partial_abort"); got != "1" {
+			t.Errorf("rsp_partial_abort: got %s, want 1", got)
+		}
+	})
+}
+
+func TestCacheRules(t *testing.T) {
+	// An archive the origin does not mark immutable, with bytes that would
+	// not survive being decoded or re-encoded on the way through.
+	archive := make([]byte, 64<<10)
+	for i := range archive {
+		archive[i] = byte(i * 7919 >> 3)
+	}
+	const index = `[{"version":"go1.99.0","stable":true}]`
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/go/go1.99.0.linux-amd64.tar.gz":
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+			w.Header().Set("Content-Type", "application/x-gzip")
+			w.Write(archive)
+		case "/dl/":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, index)
+		default:
+			io.WriteString(w, "not covered by a rule")
+		}
+	}))
+	defer origin.Close()
+	u, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &revproxy.Server{
+		Targets: []string{u.Host},
+		Local:   t.TempDir(),
+		Storage: new(memStorage),
+		Logf:    t.Logf,
+		Rules: []revproxy.CacheRule{
+			{Host: u.Host, Path: "/go/*", Immutable: true},
+			{Host: u.Host, Path: "/dl/", MaxAge: time.Minute},
+		},
+	}
+	fetch := func(path string) *http.Response {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest("GET", origin.URL+path, nil))
+		return rec.Result()
+	}
+	check := func(path, wantCache, wantType string, want []byte) {
+		t.Helper()
+		rsp := fetch(path)
+		if got := rsp.Header.Get("X-Cache"); got != wantCache {
+			t.Errorf("Get %s X-Cache: got %q, want %q", path, got, wantCache)
+		}
+		if wantType != "" {
+			if got := rsp.Header.Get("Content-Type"); got != wantType {
+				t.Errorf("Get %s Content-Type: got %q, want %q", path, got, wantType)
+			}
+		}
+		got, err := io.ReadAll(rsp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Get %s body: got %d bytes, want %d bytes matching the origin", path, len(got), len(want))
+		}
+	}
+
+	const tarball = "/go/go1.99.0.linux-amd64.tar.gz"
+	check(tarball, "fetch, cached", "application/x-gzip", archive)
+	check(tarball, "hit, local", "application/x-gzip", archive)
+
+	check("/dl/?mode=json", "fetch, cached, volatile", "application/json", []byte(index))
+	check("/dl/?mode=json", "hit, memory", "application/json", []byte(index))
+
+	check("/other", "fetch, uncached", "", []byte("not covered by a rule"))
+}
+
+// signerFunc implements [revproxy.RequestSigner] with a function.
+type signerFunc func(*http.Request) error
+
+func (f signerFunc) SignRequest(req *http.Request) error { return f(req) }
+
+func TestSigners(t *testing.T) {
+	var signed []string // signatures received by the origin
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signed = append(signed, r.Header.Get("Authorization"))
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		io.WriteString(w, "signed content")
+	}))
+	defer origin.Close()
+	u, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	srv := &revproxy.Server{
+		Targets: []string{u.Host},
+		Local:   t.TempDir(),
+		Storage: new(memStorage),
+		Logf:    t.Logf,
+		Signers: map[string]revproxy.RequestSigner{
+			u.Host: signerFunc(func(req *http.Request) error {
+				n++
+				req.Header.Set("Authorization", fmt.Sprintf("sig-%d", n))
+				return nil
+			}),
+		},
+		AllowBypass: true,
+	}
+	fetch := func(bypass bool) string {
+		t.Helper()
+		req := httptest.NewRequest("GET", origin.URL+"/repo/Release", nil)
+		req.Header.Set("Authorization", "from the client")
+		if bypass {
+			req.Header.Set("X-Cache-Bypass", "1")
+		}
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Status: got %d, want %d", rec.Code, http.StatusOK)
+		}
+		return rec.Result().Header.Get("X-Cache")
+	}
+
+	// Each forwarded request is signed afresh, and the signature does not
+	// affect the cache key.
+	if got := fetch(false); got != "fetch, cached" {
+		t.Errorf("First X-Cache: got %q, want fetch", got)
+	}
+	if got := fetch(false); got != "hit, local" {
+		t.Errorf("Second X-Cache: got %q, want hit", got)
+	}
+	if got := fetch(true); got != "fetch, cached" {
+		t.Errorf("Bypass X-Cache: got %q, want fetch", got)
+	}
+	if want := []string{"sig-1", "sig-2"}; !slices.Equal(signed, want) {
+		t.Errorf("Signatures at origin: got %q, want %q", signed, want)
+	}
+
+	// A failure to sign is reported as a bad gateway.
+	srv.Signers[u.Host] = signerFunc(func(*http.Request) error { return errors.New("no credentials") })
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest("GET", origin.URL+"/repo/other", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("Sign failure: got %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+}
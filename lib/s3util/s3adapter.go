@@ -12,7 +12,12 @@ type S3Adapter struct {
 	Client *Client
 }
 
-var _ revproxy.CacheClient = (*S3Adapter)(nil)
+var (
+	_ revproxy.ConditionalClient = (*S3Adapter)(nil)
+	_ revproxy.ListClient        = (*S3Adapter)(nil)
+	_ revproxy.StatClient        = (*S3Adapter)(nil)
+	_ revproxy.TypedClient       = (*S3Adapter)(nil)
+)
 
 // NewS3Adapter creates a new S3Adapter that implements CacheClient.
 func NewS3Adapter(client *Client) *S3Adapter {
@@ -24,6 +29,16 @@ func (a *S3Adapter) Get(ctx context.Context, key string) (io.ReadCloser, int64,
 	return a.Client.Get(ctx, key)
 }
 
+// GetCond retrieves the object with the given key from S3, unless it matches etag.
+func (a *S3Adapter) GetCond(ctx context.Context, key, etag string) (io.ReadCloser, int64, string, error) {
+	return a.Client.GetCond(ctx, key, etag)
+}
+
+// GetRange retrieves part of the object with the given key from S3.
+func (a *S3Adapter) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	return a.Client.GetRange(ctx, key, offset, length)
+}
+
 // GetData returns the complete content of the object with the given key from S3.
 func (a *S3Adapter) GetData(ctx context.Context, key string) ([]byte, error) {
 	return a.Client.GetData(ctx, key)
@@ -34,11 +49,47 @@ func (a *S3Adapter) Put(ctx context.Context, key string, data io.Reader) error {
 	return a.Client.Put(ctx, key, data)
 }
 
+// PutType writes the data from the provided reader to the object with the
+// given key in S3, with the specified content type.
+func (a *S3Adapter) PutType(ctx context.Context, key, contentType string, data io.Reader) error {
+	return a.Client.PutType(ctx, key, contentType, data)
+}
+
 // PutCond performs a conditional put operation for the object with the given key in S3.
 func (a *S3Adapter) PutCond(ctx context.Context, key, contentHash string, data io.Reader) (bool, error) {
 	return a.Client.PutCond(ctx, key, contentHash, data)
 }
 
+// List calls f for each object in S3 whose key has the given prefix.
+func (a *S3Adapter) List(ctx context.Context, prefix string, f func(revproxy.ObjectInfo) error) error {
+	return a.Client.List(ctx, prefix, f)
+}
+
+// Delete removes the object with the given key from S3.
+func (a *S3Adapter) Delete(ctx context.Context, key string) error {
+	return a.Client.Delete(ctx, key)
+}
+
+// Copy copies the object with key srcKey to dstKey within the S3 bucket.
+func (a *S3Adapter) Copy(ctx context.Context, srcKey, dstKey string) error {
+	return a.Client.Copy(ctx, srcKey, dstKey)
+}
+
+// ObjectTags returns the tags of the object with the given key from S3.
+func (a *S3Adapter) ObjectTags(ctx context.Context, key string) (map[string]string, error) {
+	return a.Client.ObjectTags(ctx, key)
+}
+
+// SetObjectTag sets one tag of the object with the given key in S3.
+func (a *S3Adapter) SetObjectTag(ctx context.Context, key, name, value string) error {
+	return a.Client.SetObjectTag(ctx, key, name, value)
+}
+
+// Stat reports the metadata of the object with the given key in S3.
+func (a *S3Adapter) Stat(ctx context.Context, key string) (revproxy.ObjectInfo, error) {
+	return a.Client.Stat(ctx, key)
+}
+
 // Close is a no-op for S3 since there's no need to close the client.
 func (a *S3Adapter) Close() error {
 	return nil
@@ -5,20 +5,32 @@
 package s3util
 
 import (
+	"bytes"
 	"cmp"
 	"context"
 	"crypto/md5"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"hash"
 	"io"
 	"io/fs"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/creachadair/mds/value"
+	"github.com/tailscale/go-cache-plugin/lib/retrybudget"
+	"github.com/tailscale/go-cache-plugin/lib/revproxy"
 )
 
 // IsNotExist reports whether err is an error indicating the requested resource
@@ -32,15 +44,86 @@ func IsNotExist(err error) bool {
 	return errors.Is(err, os.ErrNotExist)
 }
 
+// IsRateLimited reports whether err indicates that S3 throttled the request,
+// with a 429 (Too Many Requests) or 503 (Slow Down) status.
+func IsRateLimited(err error) bool {
+	var rerr *awshttp.ResponseError
+	if errors.As(err, &rerr) {
+		code := rerr.HTTPStatusCode()
+		return code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable
+	}
+	return false
+}
+
+// Errors reported by the client for failed requests wrap one of these classes,
+// if applicable, so that they can be checked with errors.Is. They are the same
+// as the corresponding errors of [revproxy].
+var (
+	ErrAccessDenied = revproxy.ErrAccessDenied
+	ErrThrottled    = revproxy.ErrThrottled
+	ErrTimeout      = revproxy.ErrTimeout
+)
+
+// classify returns err wrapped with its class of storage error, if it belongs
+// to one, or otherwise err unchanged.
+func classify(err error) error {
+	var rerr *awshttp.ResponseError
+	var nerr net.Error
+	code := 0
+	if errors.As(err, &rerr) {
+		code = rerr.HTTPStatusCode()
+	}
+	switch {
+	case err == nil:
+		return nil
+	case IsRateLimited(err):
+		return fmt.Errorf("%w: %w", ErrThrottled, err)
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return fmt.Errorf("%w: %w", ErrAccessDenied, err)
+	case code == http.StatusRequestTimeout || code == http.StatusGatewayTimeout,
+		errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &nerr) && nerr.Timeout():
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	return err
+}
+
+// WithRetryBudget returns an option for an S3 client that draws its retries
+// from b, so that a retry is abandoned, and the request fails, if b is spent.
+// The client otherwise retries as it would by default.
+func WithRetryBudget(b *retrybudget.Budget) func(*s3.Options) {
+	return func(o *s3.Options) {
+		o.Retryer = retry.NewStandard(func(so *retry.StandardOptions) {
+			so.RateLimiter = budgetLimiter{b}
+		})
+	}
+}
+
+// budgetLimiter adapts a [retrybudget.Budget] to the rate limiter of the
+// standard AWS retryer, which asks it for a token before each retry.
+type budgetLimiter struct{ b *retrybudget.Budget }
+
+func (l budgetLimiter) GetToken(context.Context, uint) (func() error, error) {
+	if !l.b.Allow() {
+		return nil, errors.New("retry budget exhausted")
+	}
+	return func() error { return nil }, nil
+}
+
+// AddTokens implements part of the rate limiter interface. Tokens of a budget
+// are replenished over time, not by successful requests, so it does nothing.
+func (budgetLimiter) AddTokens(uint) error { return nil }
+
 // BucketRegion reports the specified region for the given bucket using the
-// GetBucketLocation API.
-func BucketRegion(ctx context.Context, bucket string) (string, error) {
+// GetBucketLocation API. Additional options are passed to the AWS config
+// loader, e.g., to select a shared config profile.
+func BucketRegion(ctx context.Context, bucket string, opts ...func(*config.LoadOptions) error) (string, error) {
 	// The default AWS region, which we use for resolving the bucket location
 	// and also serves as the fallback if the API reports an empty region name.
 	// The API returns "" for buckets in this region for historical reasons.
 	const defaultRegion = "us-east-1"
 
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(defaultRegion))
+	cfg, err := config.LoadDefaultConfig(ctx, append(opts, config.WithRegion(defaultRegion))...)
 	if err != nil {
 		return "", err
 	}
@@ -80,10 +163,102 @@ func (e ETagReader) ETag() string { return fmt.Sprintf("%x", e.hash.Sum(nil)) }
 type Client struct {
 	Client *s3.Client
 	Bucket string
+
+	// ReadClient, if non-nil, is used instead of Client to read the contents
+	// of objects, for example to read through a replica or an accelerated
+	// endpoint. All other requests, including writes and metadata queries,
+	// use Client, so that conditional writes see the state they update.
+	ReadClient *s3.Client
+
+	// Tags, if non-empty, are attached as object tags to each object written
+	// by the client, e.g., for cost allocation or lifecycle rules. Writing
+	// tags requires the s3:PutObjectTagging permission.
+	Tags map[string]string
+
+	// RequesterPays, if true, accepts the charges for requests to a bucket
+	// configured as requester-pays. Without this, such a bucket denies access
+	// to requests from accounts other than its owner.
+	RequesterPays bool
+
+	// ACL, if non-empty, is the canned ACL applied to each object written by
+	// the client, for example "public-read". If empty, objects get the
+	// default ACL of the bucket. Buckets that enforce bucket owner ownership
+	// reject writes with an ACL other than "bucket-owner-full-control".
+	ACL types.ObjectCannedACL
+
+	// Retention, if positive, is how long each object written by the client
+	// is locked by S3 Object Lock, in governance mode: until then, S3 refuses
+	// to delete or replace that version of the object, unless the caller has
+	// the s3:BypassGovernanceRetention permission. The bucket must have Object
+	// Lock enabled, which also enables versioning, so deleting the object
+	// without naming a version only adds a delete marker, and the locked
+	// version remains in the bucket.
+	Retention time.Duration
+}
+
+// reader returns the S3 client used to read the contents of objects.
+func (c *Client) reader() *s3.Client {
+	if c.ReadClient != nil {
+		return c.ReadClient
+	}
+	return c.Client
 }
 
+// requestPayer returns the request-payer setting for object requests by c.
+func (c *Client) requestPayer() types.RequestPayer {
+	if c.RequesterPays {
+		return types.RequestPayerRequester
+	}
+	return ""
+}
+
+// WithTags returns a copy of c that attaches the specified tags to each
+// object it writes, in addition to the tags of c. Where keys overlap, tags
+// takes precedence. The copy shares the underlying S3 clients with c.
+func (c *Client) WithTags(tags map[string]string) *Client {
+	cp := *c
+	cp.Tags = maps.Clone(c.Tags)
+	if cp.Tags == nil {
+		cp.Tags = make(map[string]string, len(tags))
+	}
+	maps.Copy(cp.Tags, tags)
+	return &cp
+}
+
+// WithRetention returns a copy of c that locks each object it writes for d
+// (see Client.Retention). The copy shares the underlying S3 clients with c.
+func (c *Client) WithRetention(d time.Duration) *Client {
+	cp := *c
+	cp.Retention = d
+	return &cp
+}
+
+// Close implements a method of [revproxy.CacheClient]. The S3 client holds
+// no resources that need to be released, so it does nothing.
+func (c *Client) Close() error { return nil }
+
 // Put writes the specified data to S3 under the given key.
+// The upload is checked by S3 against the MD5 of data; if they do not match,
+// Put reports an error wrapping [revproxy.ErrChecksumMismatch].
 func (c *Client) Put(ctx context.Context, key string, data io.Reader) error {
+	return c.put(ctx, key, "", data, nil)
+}
+
+// PutType is as Put, but sets the content type of the object to contentType.
+// If contentType is empty, S3 uses binary/octet-stream.
+func (c *Client) PutType(ctx context.Context, key, contentType string, data io.Reader) error {
+	return c.put(ctx, key, contentType, data, nil)
+}
+
+// put implements Put. If contentType is non-empty, it is sent as the content
+// type of the object. If ifNoneMatch is non-nil, it is sent as the
+// If-None-Match precondition of the request.
+func (c *Client) put(ctx context.Context, key, contentType string, data io.Reader, ifNoneMatch *string) error {
+	data, sum, err := contentMD5(data)
+	if err != nil {
+		return err
+	}
+
 	// Attempt to find the size of the input to send as a content length.
 	// If we can't do this, let the SDK figure it out.
 	var sizePtr *int64
@@ -108,13 +283,71 @@ func (c *Client) Put(ctx context.Context, key string, data io.Reader) error {
 			}
 		}
 	}
-	_, err := c.Client.PutObject(ctx, &s3.PutObjectInput{
+	var ctype *string
+	if contentType != "" {
+		ctype = &contentType
+	}
+	in := &s3.PutObjectInput{
 		Bucket:        &c.Bucket,
 		Key:           &key,
 		Body:          data,
 		ContentLength: sizePtr,
-	})
-	return err
+		ContentMD5:    &sum,
+		ContentType:   ctype,
+		IfNoneMatch:   ifNoneMatch,
+		ACL:           c.ACL,
+		Tagging:       c.tagging(),
+		RequestPayer:  c.requestPayer(),
+	}
+	if c.Retention > 0 {
+		// Object Lock requires a checksum of the contents, which we always send.
+		in.ObjectLockMode = types.ObjectLockModeGovernance
+		in.ObjectLockRetainUntilDate = value.Ptr(time.Now().Add(c.Retention))
+	}
+	_, err = c.Client.PutObject(ctx, in)
+	var aerr interface{ ErrorCode() string }
+	if errors.As(err, &aerr) && aerr.ErrorCode() == "BadDigest" {
+		return fmt.Errorf("key %q: %w: %w", key, revproxy.ErrChecksumMismatch, err)
+	}
+	return classify(err)
+}
+
+// contentMD5 returns the base64-encoded MD5 of the contents of data, as
+// required for the Content-MD5 header, along with a reader for those contents.
+// If data is seekable, it is rewound after reading and returned; otherwise
+// its contents are buffered in memory.
+func contentMD5(data io.Reader) (io.Reader, string, error) {
+	h := md5.New()
+	if s, ok := data.(io.ReadSeeker); ok {
+		pos, err := s.Seek(0, io.SeekCurrent)
+		if err == nil {
+			if _, err := io.Copy(h, s); err != nil {
+				return nil, "", err
+			} else if _, err := s.Seek(pos, io.SeekStart); err != nil {
+				return nil, "", fmt.Errorf("[unexpected] seek failed: %w", err)
+			}
+			return s, base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+		}
+	}
+	buf, err := io.ReadAll(data)
+	if err != nil {
+		return nil, "", err
+	}
+	h.Write(buf)
+	return bytes.NewReader(buf), base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// tagging returns the tags of c encoded as URL query parameters, as required
+// by the S3 API, or nil if c has no tags.
+func (c *Client) tagging() *string {
+	if len(c.Tags) == 0 {
+		return nil
+	}
+	q := make(url.Values, len(c.Tags))
+	for k, v := range c.Tags {
+		q.Set(k, v)
+	}
+	return value.Ptr(q.Encode())
 }
 
 // Get returns the contents of the specified key from S3. On success, the
@@ -123,17 +356,100 @@ func (c *Client) Put(ctx context.Context, key string, data io.Reader) error {
 //
 // If the key is not found, the resulting error satisfies [fs.ErrNotExist].
 func (c *Client) Get(ctx context.Context, key string) (io.ReadCloser, int64, error) {
-	rsp, err := c.Client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: &c.Bucket,
-		Key:    &key,
+	rsp, err := c.reader().GetObject(ctx, &s3.GetObjectInput{
+		Bucket:       &c.Bucket,
+		Key:          &key,
+		RequestPayer: c.requestPayer(),
 	})
 	if err != nil {
 		if IsNotExist(err) {
 			return nil, -1, fmt.Errorf("key %q: %w", key, fs.ErrNotExist)
 		}
-		return nil, -1, err
+		return nil, -1, classify(err)
 	}
-	return rsp.Body, *rsp.ContentLength, nil
+	return rsp.Body, value.At(rsp.ContentLength), nil
+}
+
+// GetCond returns the contents of the specified key from S3, unless etag is
+// non-empty and matches the current etag of the object, in which case it
+// reports [revproxy.ErrNotModified] without reading the contents. On success,
+// it also returns the current etag of the object, and the caller must close
+// the returned reader when finished.
+//
+// If the key is not found, the resulting error satisfies [fs.ErrNotExist].
+func (c *Client) GetCond(ctx context.Context, key, etag string) (io.ReadCloser, int64, string, error) {
+	in := &s3.GetObjectInput{
+		Bucket:       &c.Bucket,
+		Key:          &key,
+		RequestPayer: c.requestPayer(),
+	}
+	if etag != "" {
+		in.IfNoneMatch = &etag
+	}
+	rsp, err := c.reader().GetObject(ctx, in)
+	if err != nil {
+		var rerr *awshttp.ResponseError
+		if errors.As(err, &rerr) && rerr.HTTPStatusCode() == http.StatusNotModified {
+			return nil, -1, "", revproxy.ErrNotModified
+		} else if IsNotExist(err) {
+			return nil, -1, "", fmt.Errorf("key %q: %w", key, fs.ErrNotExist)
+		}
+		return nil, -1, "", classify(err)
+	}
+	return rsp.Body, value.At(rsp.ContentLength), value.At(rsp.ETag), nil
+}
+
+// GetVersion returns the contents of the given version of the specified key
+// from S3, where version is a version ID as reported by Stat. Version IDs are
+// reported only for buckets with versioning enabled. On success, the caller
+// must close the returned reader when finished.
+//
+// If the version is not found, the resulting error satisfies [fs.ErrNotExist].
+func (c *Client) GetVersion(ctx context.Context, key, version string) (io.ReadCloser, int64, error) {
+	rsp, err := c.reader().GetObject(ctx, &s3.GetObjectInput{
+		Bucket:       &c.Bucket,
+		Key:          &key,
+		VersionId:    &version,
+		RequestPayer: c.requestPayer(),
+	})
+	if err != nil {
+		if IsNotExist(err) {
+			return nil, -1, fmt.Errorf("key %q version %q: %w", key, version, fs.ErrNotExist)
+		}
+		return nil, -1, classify(err)
+	}
+	return rsp.Body, value.At(rsp.ContentLength), nil
+}
+
+// GetRange returns length bytes of the contents of the specified key from S3,
+// starting at offset, or the rest of the contents if length < 0. The caller
+// must close the returned reader when finished. If the server does not honor
+// the range, it reports [revproxy.ErrRangeNotSupported].
+//
+// If the key is not found, the resulting error satisfies [fs.ErrNotExist].
+func (c *Client) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	rng := fmt.Sprintf("bytes=%d-", offset)
+	if length >= 0 {
+		rng += strconv.FormatInt(offset+length-1, 10)
+	}
+	rsp, err := c.reader().GetObject(ctx, &s3.GetObjectInput{
+		Bucket:       &c.Bucket,
+		Key:          &key,
+		Range:        &rng,
+		RequestPayer: c.requestPayer(),
+	})
+	if err != nil {
+		if IsNotExist(err) {
+			return nil, fmt.Errorf("key %q: %w", key, fs.ErrNotExist)
+		}
+		return nil, classify(err)
+	}
+	if rsp.ContentRange == nil {
+		// Some S3-compatible servers ignore the range and return everything.
+		rsp.Body.Close()
+		return nil, revproxy.ErrRangeNotSupported
+	}
+	return rsp.Body, nil
 }
 
 // GetData returns the contents of the specified key from S3. It is a shorthand
@@ -151,15 +467,219 @@ func (c *Client) GetData(ctx context.Context, key string) ([]byte, error) {
 // not already exist, or if its content differs from the given etag.
 // The etag is an MD5 of the expected contents, encoded as lowercase hex digits.
 // On success, written reports whether the object was written.
+//
+// Tags do not affect the etag, so an existing object with the same content is
+// not rewritten to update its tags.
+//
+// If the key does not exist, it is written with the precondition
+// "If-None-Match: *", so that if another writer stores it first, only one
+// upload succeeds. The loser reports an error wrapping [revproxy.ErrPutRace].
+// If the server does not support the precondition, the key is written
+// without it.
 func (c *Client) PutCond(ctx context.Context, key, etag string, data io.Reader) (written bool, _ error) {
-	if _, err := c.Client.HeadObject(ctx, &s3.HeadObjectInput{
-		Bucket:  &c.Bucket,
-		Key:     &key,
-		IfMatch: &etag,
-	}); err == nil {
+	_, err := c.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       &c.Bucket,
+		Key:          &key,
+		IfMatch:      &etag,
+		RequestPayer: c.requestPayer(),
+	})
+	if err == nil {
 		return false, nil
+	} else if !IsNotExist(err) {
+		return true, c.Put(ctx, key, data) // present with different contents
+	}
+
+	err = c.put(ctx, key, "", data, value.Ptr("*"))
+	switch statusCode(err) {
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		// The key was created since we checked (412), or a concurrent
+		// conditional write of it is in progress (409).
+		return false, fmt.Errorf("key %q: %w", key, revproxy.ErrPutRace)
+	case http.StatusNotImplemented:
+		if s, ok := data.(io.Seeker); ok {
+			if _, err := s.Seek(0, io.SeekStart); err != nil {
+				return false, fmt.Errorf("[unexpected] seek failed: %w", err)
+			}
+			return true, c.Put(ctx, key, data)
+		}
+	}
+	return err == nil, err
+}
+
+// statusCode returns the HTTP status code of the S3 response that err
+// reports, or 0 if err does not report a response.
+func statusCode(err error) int {
+	var rerr *awshttp.ResponseError
+	if errors.As(err, &rerr) {
+		return rerr.HTTPStatusCode()
+	}
+	return 0
+}
+
+// List calls f for each object in the bucket whose key has the given prefix,
+// in lexicographic order by key. If f reports an error, List stops and returns
+// that error.
+func (c *Client) List(ctx context.Context, prefix string, f func(revproxy.ObjectInfo) error) error {
+	pages := s3.NewListObjectsV2Paginator(c.Client, &s3.ListObjectsV2Input{
+		Bucket:       &c.Bucket,
+		Prefix:       &prefix,
+		RequestPayer: c.requestPayer(),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			if err := f(revproxy.ObjectInfo{
+				Key:     value.At(obj.Key),
+				Size:    value.At(obj.Size),
+				ModTime: value.At(obj.LastModified),
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Delete removes the object with the given key. It is not an error if the
+// object does not exist.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	_, err := c.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:       &c.Bucket,
+		Key:          &key,
+		RequestPayer: c.requestPayer(),
+	})
+	return err
+}
+
+// Copy copies the object with key srcKey to dstKey, without transferring its
+// contents through the client. If c has tags, they replace the tags of the
+// copy; otherwise the tags of the source are kept.
+//
+// If srcKey is not found, the resulting error satisfies [fs.ErrNotExist].
+func (c *Client) Copy(ctx context.Context, srcKey, dstKey string) error {
+	return c.CopyFrom(ctx, c, srcKey, dstKey)
+}
+
+// CopyFrom is as Copy, but copies the object with key srcKey from the bucket
+// of src, which may differ from the bucket of c. The credentials of c must
+// allow reading from the source bucket.
+func (c *Client) CopyFrom(ctx context.Context, src *Client, srcKey, dstKey string) error {
+	in := &s3.CopyObjectInput{
+		Bucket:       &c.Bucket,
+		Key:          &dstKey,
+		CopySource:   value.Ptr(src.Bucket + "/" + url.PathEscape(srcKey)),
+		ACL:          c.ACL,
+		RequestPayer: c.requestPayer(),
+	}
+	if tags := c.tagging(); tags != nil {
+		in.Tagging = tags
+		in.TaggingDirective = types.TaggingDirectiveReplace
+	}
+	if _, err := c.Client.CopyObject(ctx, in); err != nil {
+		if IsNotExist(err) {
+			return fmt.Errorf("key %q: %w", srcKey, fs.ErrNotExist)
+		}
+		return err
+	}
+	return nil
+}
+
+// ObjectTags returns the object tags of the object with the given key.
+// Reading tags requires the s3:GetObjectTagging permission.
+//
+// If the key is not found, the resulting error satisfies [fs.ErrNotExist].
+func (c *Client) ObjectTags(ctx context.Context, key string) (map[string]string, error) {
+	rsp, err := c.Client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket:       &c.Bucket,
+		Key:          &key,
+		RequestPayer: c.requestPayer(),
+	})
+	if err != nil {
+		if IsNotExist(err) {
+			return nil, fmt.Errorf("key %q: %w", key, fs.ErrNotExist)
+		}
+		return nil, err
+	}
+	tags := make(map[string]string, len(rsp.TagSet))
+	for _, tag := range rsp.TagSet {
+		tags[value.At(tag.Key)] = value.At(tag.Value)
+	}
+	return tags, nil
+}
+
+// SetObjectTag sets the object tag with the given name to val on the object
+// with the given key, keeping its other tags. S3 replaces the tag set as a
+// whole, so this reads the tags and writes them back, which requires the
+// s3:GetObjectTagging and s3:PutObjectTagging permissions.
+//
+// If the key is not found, the resulting error satisfies [fs.ErrNotExist].
+func (c *Client) SetObjectTag(ctx context.Context, key, name, val string) error {
+	tags, err := c.ObjectTags(ctx, key)
+	if err != nil {
+		return err
+	}
+	tags[name] = val
+	set := make([]types.Tag, 0, len(tags))
+	for k, v := range tags {
+		set = append(set, types.Tag{Key: value.Ptr(k), Value: value.Ptr(v)})
+	}
+	if _, err := c.Client.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+		Bucket:       &c.Bucket,
+		Key:          &key,
+		Tagging:      &types.Tagging{TagSet: set},
+		RequestPayer: c.requestPayer(),
+	}); err != nil {
+		if IsNotExist(err) {
+			return fmt.Errorf("key %q: %w", key, fs.ErrNotExist)
+		}
+		return err
+	}
+	return nil
+}
+
+// Stat reports the metadata of the object with the given key, without reading
+// its contents. If the key is not found, the error satisfies [fs.ErrNotExist].
+func (c *Client) Stat(ctx context.Context, key string) (revproxy.ObjectInfo, error) {
+	rsp, err := c.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       &c.Bucket,
+		Key:          &key,
+		RequestPayer: c.requestPayer(),
+	})
+	if err != nil {
+		if IsNotExist(err) {
+			return revproxy.ObjectInfo{}, fmt.Errorf("key %q: %w", key, fs.ErrNotExist)
+		}
+		return revproxy.ObjectInfo{}, classify(err)
+	}
+	return revproxy.ObjectInfo{
+		Key:     key,
+		Size:    value.At(rsp.ContentLength),
+		ModTime: value.At(rsp.LastModified),
+		Version: value.At(rsp.VersionId),
+	}, nil
+}
+
+// Verify checks that the bucket exists and is accessible with the credentials
+// of the client. If not, the error reports whether the bucket was not found,
+// access was denied, or the service could not be reached.
+func (c *Client) Verify(ctx context.Context) error {
+	_, err := c.Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: &c.Bucket})
+	if err == nil {
+		return nil
+	}
+	var rerr *awshttp.ResponseError
+	if errors.As(err, &rerr) {
+		switch rerr.HTTPStatusCode() {
+		case http.StatusNotFound:
+			return fmt.Errorf("bucket %q not found", c.Bucket)
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return fmt.Errorf("access denied to bucket %q: %w", c.Bucket, err)
+		}
 	}
-	return true, c.Put(ctx, key, data)
+	return fmt.Errorf("unable to reach bucket %q (network error?): %w", c.Bucket, err)
 }
 
 // A sizer exports a Size method, e.g., [bytes.Reader] and similar.
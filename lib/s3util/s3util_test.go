@@ -5,12 +5,20 @@ package s3util_test
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"errors"
 	"io"
+	"net/http"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tailscale/go-cache-plugin/lib/revproxy"
 	"github.com/tailscale/go-cache-plugin/lib/s3util"
 )
 
@@ -40,3 +48,335 @@ func TestETagReader(t *testing.T) {
 		t.Errorf("Wrong result: got %x, want %x", got, want)
 	}
 }
+
+// captureClient is a fake S3 HTTP client that records the request-payer
+// header of each request, and replies with an empty success.
+type captureClient struct {
+	payer map[string]string // operation → request payer header
+}
+
+func (c *captureClient) Do(req *http.Request) (*http.Response, error) {
+	op := req.Method
+	if req.URL.Query().Has("list-type") {
+		op = "LIST"
+	}
+	c.payer[op] = req.Header.Get("X-Amz-Request-Payer")
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Length": {"0"}},
+		Body:          http.NoBody,
+		ContentLength: 0,
+		Request:       req,
+	}, nil
+}
+
+// newCaptureS3 returns an S3 client that sends its requests to cc.
+func newCaptureS3(cc *captureClient) *s3.Client {
+	return s3.New(s3.Options{
+		Region:           "us-east-1",
+		BaseEndpoint:     aws.String("http://s3.test"),
+		UsePathStyle:     true,
+		Credentials:      aws.AnonymousCredentials{},
+		HTTPClient:       cc,
+		RetryMaxAttempts: 1,
+	})
+}
+
+func TestRequesterPays(t *testing.T) {
+	for _, pays := range []bool{false, true} {
+		cc := &captureClient{payer: make(map[string]string)}
+		c := &s3util.Client{
+			Client:        newCaptureS3(cc),
+			Bucket:        "test-bucket",
+			RequesterPays: pays,
+		}
+
+		// The replies are not meaningful, so ignore errors and check only the
+		// requests that were sent.
+		ctx := context.Background()
+		c.Put(ctx, "key", strings.NewReader("data"))
+		c.GetData(ctx, "key")
+		c.PutCond(ctx, "key", "etag", strings.NewReader("data"))
+		c.List(ctx, "prefix/", func(revproxy.ObjectInfo) error { return nil })
+		c.Delete(ctx, "key")
+
+		want := ""
+		if pays {
+			want = "requester"
+		}
+		for _, op := range []string{"PUT", "GET", "HEAD", "LIST", "DELETE"} {
+			got, ok := cc.payer[op]
+			if !ok {
+				t.Errorf("RequesterPays=%v: no %s request was sent", pays, op)
+			} else if got != want {
+				t.Errorf("RequesterPays=%v: %s request payer is %q, want %q", pays, op, got, want)
+			}
+		}
+	}
+}
+
+func TestReadClient(t *testing.T) {
+	wc := &captureClient{payer: make(map[string]string)}
+	rc := &captureClient{payer: make(map[string]string)}
+	c := &s3util.Client{
+		Client:     newCaptureS3(wc),
+		ReadClient: newCaptureS3(rc),
+		Bucket:     "test-bucket",
+	}
+
+	// The replies are not meaningful, so ignore errors and check only which
+	// client each request was sent to.
+	ctx := context.Background()
+	c.Get(ctx, "key")
+	c.GetCond(ctx, "key", "etag")
+	c.GetRange(ctx, "key", 0, 10)
+	c.Put(ctx, "key", strings.NewReader("data"))
+	c.PutCond(ctx, "key", "etag", strings.NewReader("data"))
+	c.Stat(ctx, "key")
+	c.List(ctx, "prefix/", func(revproxy.ObjectInfo) error { return nil })
+	c.Delete(ctx, "key")
+
+	checkOps := func(name string, cc *captureClient, want ...string) {
+		t.Helper()
+		var got []string
+		for op := range cc.payer {
+			got = append(got, op)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, want) {
+			t.Errorf("%s client got %q requests, want %q", name, got, want)
+		}
+	}
+	checkOps("read", rc, "GET")
+	checkOps("write", wc, "DELETE", "HEAD", "LIST", "PUT")
+
+	// Without a read client, reads use the main client.
+	c.ReadClient = nil
+	clear(wc.payer)
+	c.Get(ctx, "key")
+	checkOps("write", wc, "GET")
+}
+
+// statusClient is an HTTP client that replies to every request with an empty
+// response having the given status code.
+type statusClient int
+
+func (c statusClient) Do(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: int(c),
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+func TestErrorClasses(t *testing.T) {
+	for _, tc := range []struct {
+		code      int
+		throttled bool
+		class     error
+	}{
+		{http.StatusForbidden, false, s3util.ErrAccessDenied},
+		{http.StatusInternalServerError, false, nil},
+		{http.StatusGatewayTimeout, false, s3util.ErrTimeout},
+		{http.StatusTooManyRequests, true, s3util.ErrThrottled},
+		{http.StatusServiceUnavailable, true, s3util.ErrThrottled},
+	} {
+		c := &s3util.Client{
+			Client: s3.New(s3.Options{
+				Region:           "us-east-1",
+				BaseEndpoint:     aws.String("http://s3.test"),
+				UsePathStyle:     true,
+				Credentials:      aws.AnonymousCredentials{},
+				HTTPClient:       statusClient(tc.code),
+				RetryMaxAttempts: 1,
+			}),
+			Bucket: "test-bucket",
+		}
+		ctx := context.Background()
+		perr := c.Put(ctx, "key", strings.NewReader("data"))
+		_, _, gerr := c.Get(ctx, "key")
+		for _, err := range []error{perr, gerr} {
+			if err == nil {
+				t.Fatalf("Status %d: got nil error", tc.code)
+			}
+			if got := s3util.IsRateLimited(err); got != tc.throttled {
+				t.Errorf("IsRateLimited(%v): got %v, want %v", err, got, tc.throttled)
+			}
+			for _, class := range []error{s3util.ErrAccessDenied, s3util.ErrThrottled, s3util.ErrTimeout} {
+				if got, want := errors.Is(err, class), class == tc.class; got != want {
+					t.Errorf("errors.Is(%v, %v): got %v, want %v", err, class, got, want)
+				}
+			}
+		}
+	}
+}
+
+// condClient is an HTTP client that simulates conditional writes. HEAD
+// requests report whether the object exists, and each PUT request replies
+// with the next status code from puts. The If-None-Match header of each PUT
+// is recorded.
+type condClient struct {
+	exists      bool
+	puts        []int
+	ifNoneMatch []string
+}
+
+func (c *condClient) Do(req *http.Request) (*http.Response, error) {
+	code, body := http.StatusOK, ""
+	switch req.Method {
+	case "HEAD":
+		if !c.exists {
+			code, body = http.StatusNotFound, "<Error><Code>NotFound</Code></Error>"
+		}
+	case "PUT":
+		c.ifNoneMatch = append(c.ifNoneMatch, req.Header.Get("If-None-Match"))
+		code, c.puts = c.puts[0], c.puts[1:]
+	}
+	return &http.Response{
+		StatusCode: code,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+func TestPutCondRace(t *testing.T) {
+	tests := []struct {
+		name        string
+		exists      bool
+		puts        []int
+		wantWritten bool
+		wantRace    bool
+		wantHeaders []string
+	}{
+		{"Present", true, nil, false, false, nil},
+		{"Written", false, []int{http.StatusOK}, true, false, []string{"*"}},
+		{"LostRace", false, []int{http.StatusPreconditionFailed}, false, true, []string{"*"}},
+		{"Conflict", false, []int{http.StatusConflict}, false, true, []string{"*"}},
+		{"Unsupported", false, []int{http.StatusNotImplemented, http.StatusOK}, true, false, []string{"*", ""}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cc := &condClient{exists: tc.exists, puts: tc.puts}
+			c := &s3util.Client{
+				Client: s3.New(s3.Options{
+					Region:           "us-east-1",
+					BaseEndpoint:     aws.String("http://s3.test"),
+					UsePathStyle:     true,
+					Credentials:      aws.AnonymousCredentials{},
+					HTTPClient:       cc,
+					RetryMaxAttempts: 1,
+				}),
+				Bucket: "test-bucket",
+			}
+			written, err := c.PutCond(context.Background(), "key", "etag", strings.NewReader("data"))
+			if got := errors.Is(err, revproxy.ErrPutRace); got != tc.wantRace {
+				t.Errorf("PutCond: got err=%v, want race=%v", err, tc.wantRace)
+			} else if !tc.wantRace && err != nil {
+				t.Errorf("PutCond: unexpected error: %v", err)
+			}
+			if written != tc.wantWritten {
+				t.Errorf("PutCond: got written=%v, want %v", written, tc.wantWritten)
+			}
+			if got := strings.Join(cc.ifNoneMatch, ","); got != strings.Join(tc.wantHeaders, ",") {
+				t.Errorf("If-None-Match: got %q, want %q", cc.ifNoneMatch, tc.wantHeaders)
+			}
+		})
+	}
+}
+
+// lockClient is an HTTP client that records the Object Lock headers of each
+// PUT request, and replies with an empty success.
+type lockClient struct {
+	mode, until []string
+}
+
+func (c *lockClient) Do(req *http.Request) (*http.Response, error) {
+	if req.Method == "PUT" {
+		c.mode = append(c.mode, req.Header.Get("X-Amz-Object-Lock-Mode"))
+		c.until = append(c.until, req.Header.Get("X-Amz-Object-Lock-Retain-Until-Date"))
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+		Request:    req,
+	}, nil
+}
+
+func TestRetention(t *testing.T) {
+	lc := new(lockClient)
+	c := &s3util.Client{
+		Client: s3.New(s3.Options{
+			Region:           "us-east-1",
+			BaseEndpoint:     aws.String("http://s3.test"),
+			UsePathStyle:     true,
+			Credentials:      aws.AnonymousCredentials{},
+			HTTPClient:       lc,
+			RetryMaxAttempts: 1,
+		}),
+		Bucket: "test-bucket",
+	}
+	ctx := context.Background()
+	if err := c.Put(ctx, "plain", strings.NewReader("data")); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	start := time.Now()
+	if err := c.WithRetention(time.Hour).Put(ctx, "locked", strings.NewReader("data")); err != nil {
+		t.Fatalf("Put with retention: unexpected error: %v", err)
+	}
+	if want := []string{"", "GOVERNANCE"}; !slices.Equal(lc.mode, want) {
+		t.Errorf("Lock mode: got %q, want %q", lc.mode, want)
+	}
+	if lc.until[0] != "" {
+		t.Errorf("Retain until without retention: got %q, want empty", lc.until[0])
+	}
+	if until, err := time.Parse(time.RFC3339, lc.until[1]); err != nil {
+		t.Errorf("Retain until: %v", err)
+	} else if d := until.Sub(start); d < time.Hour-time.Second || d > time.Hour+time.Minute {
+		t.Errorf("Retain until: got %v, want about an hour after %v", until, start)
+	}
+}
+
+func TestSigner(t *testing.T) {
+	var calls int
+	cfg := aws.Config{
+		Region: "us-west-2",
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			calls++
+			return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret", SessionToken: "token"}, nil
+		}),
+	}
+	var _ revproxy.RequestSigner = s3util.NewSigner(cfg, "")
+
+	for _, tc := range []struct {
+		region, want string
+	}{
+		{"", "us-west-2"},
+		{"eu-central-1", "eu-central-1"},
+	} {
+		sg := s3util.NewSigner(cfg, tc.region)
+		req, err := http.NewRequest("GET", "https://apt.example.com/dists/stable/Release", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer from-the-client")
+		if err := sg.SignRequest(req); err != nil {
+			t.Fatalf("SignRequest: unexpected error: %v", err)
+		}
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") ||
+			!strings.Contains(auth, "/"+tc.want+"/s3/aws4_request") {
+			t.Errorf("Authorization: got %q, want a signature for %s", auth, tc.want)
+		}
+		for _, name := range []string{"X-Amz-Date", "X-Amz-Content-Sha256", "X-Amz-Security-Token"} {
+			if req.Header.Get(name) == "" {
+				t.Errorf("Header %s is not set", name)
+			}
+		}
+	}
+	if calls != 2 {
+		t.Errorf("Credential lookups: got %d, want 2 (one per request)", calls)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package s3util
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// emptyPayloadHash is the SHA-256 digest of an empty request body, in hex.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// A Signer signs plain HTTP requests to S3 with AWS Signature Version 4, for
+// example so that a reverse proxy can fetch from a bucket served as a private
+// static website. It implements [revproxy.RequestSigner].
+type Signer struct {
+	creds  aws.CredentialsProvider
+	region string
+	signer *v4.Signer
+}
+
+// NewSigner returns a signer for requests to S3 in the given region, using
+// the credentials of cfg. If region is empty, the region of cfg is used.
+func NewSigner(cfg aws.Config, region string) *Signer {
+	if region == "" {
+		region = cfg.Region
+	}
+	return &Signer{creds: cfg.Credentials, region: region, signer: v4.NewSigner()}
+}
+
+// SignRequest signs req in place, replacing any Authorization header. The
+// body of a request that has one is not read, and is sent unsigned.
+func (s *Signer) SignRequest(req *http.Request) error {
+	if s.creds == nil {
+		return fmt.Errorf("no AWS credentials to sign requests for %s", req.Host)
+	}
+	creds, err := s.creds.Retrieve(req.Context())
+	if err != nil {
+		return fmt.Errorf("retrieve AWS credentials: %w", err)
+	}
+	hash := emptyPayloadHash
+	if req.Body != nil && req.Body != http.NoBody {
+		hash = "UNSIGNED-PAYLOAD"
+	}
+	req.Header.Del("Authorization")
+	req.Header.Set("X-Amz-Content-Sha256", hash)
+	return s.signer.SignHTTP(req.Context(), creds, req, hash, "s3", s.region, time.Now())
+}
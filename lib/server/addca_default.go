@@ -3,20 +3,18 @@
 
 //go:build !linux
 
-package main
+package server
 
 import (
 	"errors"
 	"log"
 
 	"github.com/creachadair/atomicfile"
-	"github.com/creachadair/command"
-	"github.com/creachadair/tlsutil"
 )
 
-func installSigningCert(env *command.Env, cert tlsutil.Certificate) error {
+func installSigningCert(certPEM []byte) error {
 	const certFile = "revproxy-ca.crt"
-	if err := atomicfile.WriteData(certFile, cert.CertPEM(), 0644); err != nil {
+	if err := atomicfile.WriteData(certFile, certPEM, 0644); err != nil {
 		log.Printf("WARNING: Unable to write cert file: %v", err)
 	} else {
 		log.Printf("Wrote signing cert to %s", certFile)
@@ -1,27 +1,28 @@
 // Copyright (c) Tailscale Inc & AUTHORS
 // SPDX-License-Identifier: BSD-3-Clause
 
-package main
+package server
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 
-	"github.com/creachadair/command"
-	"github.com/creachadair/tlsutil"
 	"golang.org/x/sys/unix"
 )
 
-func installSigningCert(env *command.Env, cert tlsutil.Certificate) error {
+func installSigningCert(certPEM []byte) error {
 	const ubuntuCertFile = "/etc/ssl/certs/ca-certificates.crt"
-	return lockAndAppend(ubuntuCertFile, cert.CertPEM())
+	return lockAndAppend(ubuntuCertFile, certPEM)
 }
 
 // lockAndAppend acquires an exclusive advisory lock on path, if possible, and
-// appends data to the end of it. It reports an error if path does not exist,
-// or if the lock could not be acquired. The lock is automatically released
-// before returning.
+// appends data to the end of it, unless the file already contains data, as
+// it does for a persistent signing cert installed by an earlier run. It
+// reports an error if path does not exist, or if the lock could not be
+// acquired. The lock is automatically released before returning.
 func lockAndAppend(path string, data []byte) error {
 	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0)
 	if err != nil {
@@ -33,6 +34,9 @@ func lockAndAppend(path string, data []byte) error {
 		return fmt.Errorf("lock: %w", err)
 	}
 	defer unix.Flock(fd, unix.LOCK_UN)
+	if old, err := io.ReadAll(f); err == nil && bytes.Contains(old, data) {
+		return f.Close()
+	}
 	_, werr := f.Write(data)
 	cerr := f.Close()
 	return errors.Join(werr, cerr)
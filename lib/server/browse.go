@@ -0,0 +1,120 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// cacheBrowser is an HTTP handler that serves the files of a local cache
+// directory read-only, for inspection. Request paths are relative to the
+// directory. Listings of directories include the size and modification time
+// of each entry.
+type cacheBrowser struct {
+	fsys  fs.FS
+	files http.Handler
+}
+
+func newCacheBrowser(dir string) cacheBrowser {
+	fsys := os.DirFS(dir)
+	return cacheBrowser{fsys: fsys, files: http.FileServerFS(fsys)}
+}
+
+func (b cacheBrowser) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.Trim(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = "."
+	}
+	fi, err := fs.Stat(b.fsys, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !fi.IsDir() {
+		b.files.ServeHTTP(w, r)
+		return
+	}
+	if name != "." && !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, path.Base(name)+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	des, err := fs.ReadDir(b.fsys, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	type entry struct {
+		Name, Href string
+		Size       int64
+		ModTime    string
+	}
+	var entries []entry
+	for _, de := range des {
+		info, err := de.Info()
+		if err != nil {
+			continue // removed since it was listed
+		}
+		e := entry{
+			Name:    de.Name(),
+			Href:    url.PathEscape(de.Name()),
+			Size:    info.Size(),
+			ModTime: info.ModTime().UTC().Format(time.RFC3339),
+		}
+		if de.IsDir() {
+			e.Name += "/"
+			e.Href += "/"
+		}
+		entries = append(entries, e)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	listingTemplate.Execute(w, struct {
+		Path    string
+		Entries []entry
+	}{Path: "/" + strings.TrimPrefix(name, "."), Entries: entries})
+}
+
+var listingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html><head><title>Cache: {{.Path}}</title></head>
+<body>
+<h1>Cache: {{.Path}}</h1>
+<table>
+<tr><th align="left">Name</th><th align="right">Size</th><th align="left">Modified</th></tr>
+{{range .Entries}}<tr><td><a href="{{.Href}}">{{.Name}}</a></td><td align="right">{{.Size}}</td><td>{{.ModTime}}</td></tr>
+{{end}}</table>
+</body></html>
+`))
+
+// requireToken returns a handler that serves requests with h only if they
+// carry the header "Authorization: Bearer <token>", and otherwise reports an
+// error. The token must be non-empty.
+func requireToken(token string, h http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,107 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCacheBrowser(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "ab"), 0755); err != nil {
+		t.Fatalf("Create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "ab", "abc-d"), []byte("hello, world"), 0644); err != nil {
+		t.Fatalf("Write file: %v", err)
+	}
+
+	const token = "s3kr1t"
+	browse := requireToken(token, http.StripPrefix("/cache/", newCacheBrowser(dir)))
+	srv := httptest.NewServer(makeHandler(nil, nil, browse, nil, nil, nil, nil, ""))
+	defer srv.Close()
+
+	do := func(method, path, auth string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		rsp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer rsp.Body.Close()
+		body, _ := io.ReadAll(rsp.Body)
+		return rsp.StatusCode, string(body)
+	}
+
+	t.Run("NoToken", func(t *testing.T) {
+		if code, _ := do("GET", "/cache/ab/abc-d", ""); code != http.StatusUnauthorized {
+			t.Errorf("Get: got %d, want %d", code, http.StatusUnauthorized)
+		}
+		if code, _ := do("GET", "/cache/ab/abc-d", "wrong"); code != http.StatusUnauthorized {
+			t.Errorf("Get: got %d, want %d", code, http.StatusUnauthorized)
+		}
+	})
+
+	t.Run("File", func(t *testing.T) {
+		code, body := do("GET", "/cache/ab/abc-d", token)
+		if code != http.StatusOK || body != "hello, world" {
+			t.Errorf("Get: got %d %q, want %d %q", code, body, http.StatusOK, "hello, world")
+		}
+		if code, _ := do("GET", "/cache/ab/nonesuch", token); code != http.StatusNotFound {
+			t.Errorf("Get missing: got %d, want %d", code, http.StatusNotFound)
+		}
+	})
+
+	t.Run("Listing", func(t *testing.T) {
+		code, body := do("GET", "/cache/ab/", token)
+		if code != http.StatusOK {
+			t.Fatalf("Get: got %d, want %d", code, http.StatusOK)
+		}
+		for _, want := range []string{`href="abc-d"`, ">12<"} {
+			if !strings.Contains(body, want) {
+				t.Errorf("Listing does not contain %q:\n%s", want, body)
+			}
+		}
+		if code, body := do("GET", "/cache/", token); code != http.StatusOK || !strings.Contains(body, `href="ab/"`) {
+			t.Errorf("Get root: got %d, want %d with ab/:\n%s", code, http.StatusOK, body)
+		}
+	})
+
+	t.Run("ReadOnly", func(t *testing.T) {
+		for _, method := range []string{"PUT", "POST", "DELETE"} {
+			if code, _ := do(method, "/cache/ab/abc-d", token); code != http.StatusMethodNotAllowed {
+				t.Errorf("%s: got %d, want %d", method, code, http.StatusMethodNotAllowed)
+			}
+		}
+		if data, err := os.ReadFile(filepath.Join(dir, "ab", "abc-d")); err != nil || string(data) != "hello, world" {
+			t.Errorf("File was modified: %q, %v", data, err)
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		srv := httptest.NewServer(makeHandler(nil, nil, nil, nil, nil, nil, nil, ""))
+		defer srv.Close()
+		req, _ := http.NewRequest("GET", srv.URL+"/cache/ab/abc-d", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rsp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		rsp.Body.Close()
+		if rsp.StatusCode != http.StatusNotFound {
+			t.Errorf("Get: got %d, want %d", rsp.StatusCode, http.StatusNotFound)
+		}
+	})
+}
@@ -0,0 +1,90 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+func TestGCSEmulated(t *testing.T) {
+	env := func(m map[string]string) func(string) string {
+		return func(key string) string { return m[key] }
+	}
+	tests := []struct {
+		name     string
+		endpoint string
+		env      map[string]string
+		want     bool
+	}{
+		{"Default", "", nil, false},
+		{"Private", "https://storage-private.googleapis.com/storage/v1/", nil, false},
+		{"HTTP", "http://localhost:4443/storage/v1/", nil, true},
+		{"EmulatorHost", "", map[string]string{"STORAGE_EMULATOR_HOST": "localhost:4443"}, true},
+	}
+	for _, tc := range tests {
+		c := Config{GCSEndpoint: tc.endpoint}
+		if got := c.gcsEmulated(env(tc.env)); got != tc.want {
+			t.Errorf("%s: gcsEmulated: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// TestGCSEmulator exercises the GCS client against an emulator such as
+// fake-gcs-server, if STORAGE_EMULATOR_HOST is set. For example:
+//
+//	docker run -d -p 4443:4443 fsouza/fake-gcs-server -scheme http
+//	STORAGE_EMULATOR_HOST=localhost:4443 go test -run GCSEmulator ./lib/server
+func TestGCSEmulator(t *testing.T) {
+	if os.Getenv("STORAGE_EMULATOR_HOST") == "" {
+		t.Skip("Skipping test: STORAGE_EMULATOR_HOST is not set")
+	}
+	ctx := context.Background()
+	const bucket = "go-cache-plugin-test"
+
+	// Create the bucket, if the emulator does not already have it.
+	sc, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatalf("Create storage client: %v", err)
+	}
+	defer sc.Close()
+	if err := sc.Bucket(bucket).Create(ctx, "test-project", nil); err != nil {
+		var gerr *googleapi.Error
+		if !errors.As(err, &gerr) || gerr.Code != http.StatusConflict {
+			t.Fatalf("Create bucket: %v", err)
+		}
+	}
+
+	// A key file that does not exist shows that no credentials are loaded.
+	s := &Server{config: Config{GCSBucket: bucket, GCSKeyFile: "/nonexistent/key.json", Logf: t.Logf}}
+	client, err := s.initGCSClient(ctx, bucket)
+	if err != nil {
+		t.Fatalf("initGCSClient: unexpected error: %v", err)
+	}
+	if err := client.Verify(ctx); err != nil {
+		t.Fatalf("Verify: unexpected error: %v", err)
+	}
+
+	const key, want = "emulator/test-object", "hello, emulator"
+	if err := client.PutType(ctx, key, "text/plain", strings.NewReader(want)); err != nil {
+		t.Fatalf("Put %q: unexpected error: %v", key, err)
+	}
+	got, err := client.GetData(ctx, key)
+	if err != nil {
+		t.Fatalf("Get %q: unexpected error: %v", key, err)
+	}
+	if string(got) != want {
+		t.Errorf("Get %q: got %q, want %q", key, got, want)
+	}
+	if err := client.Delete(ctx, key); err != nil {
+		t.Errorf("Delete %q: unexpected error: %v", key, err)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/tailscale/go-cache-plugin/lib/gobuild"
+	"github.com/tailscale/go-cache-plugin/lib/modproxy"
+)
+
+// keyReport describes the storage keys computed for one input by the keys
+// debug handler.
+type keyReport struct {
+	Kind  string   `json:"kind"`            // "action", "output", or "module"
+	Input string   `json:"input"`           // the ID or module cache name
+	Keys  []string `json:"keys,omitempty"`  // in order of preference, first is written
+	Error string   `json:"error,omitempty"` // why keys could not be computed
+}
+
+// newKeysHandler returns an HTTP handler that reports the storage keys the
+// server uses for the build cache entries and module proxy files named by the
+// query parameters of a request:
+//
+//	action=<id>    the action record for a build action ID
+//	output=<id>    the object for a build output ID
+//	module=<name>  the module proxy file with the given cache name,
+//	               e.g., "golang.org/x/mod/@v/v0.1.0.zip"
+//
+// Each parameter may be repeated. The response is a JSON array with one
+// report for each, in the order of the query. Storage is not consulted, so
+// the keys are reported whether or not the objects exist. If mod is nil,
+// module keys are not reported.
+func newKeysHandler(cfg *Config, mod *modproxy.StorageCacher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var out []keyReport
+		for _, p := range queryParams(r.URL.RawQuery) {
+			switch p.name {
+			case "action", "output":
+				keys, err := gobuild.StorageKeys(cfg.BuildKeyPrefix(), p.name, p.value, cfg.PartitionDepth)
+				out = append(out, newKeyReport(p.name, p.value, keys, err))
+			case "module":
+				rep := keyReport{Kind: "module", Input: p.value}
+				if mod == nil {
+					rep.Error = "module proxy storage is not enabled"
+				} else {
+					rep.Keys = mod.StorageKeys(p.value)
+				}
+				out = append(out, rep)
+			}
+		}
+		if len(out) == 0 {
+			http.Error(w, "usage: ?action=<id>, ?output=<id>, or ?module=<name>", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(out)
+	})
+}
+
+func newKeyReport(kind, input string, keys []string, err error) keyReport {
+	rep := keyReport{Kind: kind, Input: input, Keys: keys}
+	if err != nil {
+		rep.Error = err.Error()
+	}
+	return rep
+}
+
+// A queryParam is one name=value pair from a URL query.
+type queryParam struct{ name, value string }
+
+// queryParams parses the pairs of a raw URL query in the order they appear,
+// which url.ParseQuery does not preserve. Pairs that cannot be unescaped are
+// skipped, as url.ParseQuery does.
+func queryParams(raw string) []queryParam {
+	var out []queryParam
+	for pair := range strings.SplitSeq(raw, "&") {
+		if pair == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(pair, "=")
+		name, err1 := url.QueryUnescape(name)
+		value, err2 := url.QueryUnescape(value)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		out = append(out, queryParam{name, value})
+	}
+	return out
+}
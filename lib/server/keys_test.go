@@ -0,0 +1,74 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tailscale/go-cache-plugin/lib/modproxy"
+)
+
+func TestKeysHandler(t *testing.T) {
+	const id = "a1b2c3d4e5f6a1b2c3d4e5f6a1b2c3d4e5f6a1b2c3d4e5f6a1b2c3d4e5f6a1b2"
+	cfg := &Config{KeyPrefix: "pfx", PartitionDepth: 4}
+	mod := &modproxy.StorageCacher{KeyPrefix: "pfx/module", ReadableKeys: true}
+
+	get := func(t *testing.T, h http.Handler, query string) (int, []keyReport) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/keys?"+query, nil))
+		if rec.Code != http.StatusOK {
+			return rec.Code, nil
+		}
+		var out []keyReport
+		if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+			t.Fatalf("Decode response: %v", err)
+		}
+		return rec.Code, out
+	}
+
+	t.Run("Build", func(t *testing.T) {
+		_, out := get(t, newKeysHandler(cfg, nil), "action="+id+"&output="+id+"&action=bogus")
+		if len(out) != 3 {
+			t.Fatalf("Got %d reports, want 3", len(out))
+		}
+		want := []string{"pfx/action/a1b2/" + id, "pfx/action/a1/" + id}
+		if got := out[0].Keys; !slices.Equal(got, want) {
+			t.Errorf("Action keys: got %q, want %q", got, want)
+		}
+		if got := out[2]; got.Kind != "action" || got.Error == "" {
+			t.Errorf("Invalid action: got %+v, want an error", got)
+		}
+		if got := out[1].Keys; len(got) == 0 || got[0] != "pfx/output/a1b2/"+id {
+			t.Errorf("Output keys: got %q, want pfx/output/a1b2/%s first", got, id)
+		}
+	})
+
+	t.Run("Module", func(t *testing.T) {
+		const name = "golang.org/x/mod/@v/v0.1.0.zip"
+		_, out := get(t, newKeysHandler(cfg, mod), "module="+name)
+		if len(out) != 1 || len(out[0].Keys) < 2 {
+			t.Fatalf("Got %+v, want one report with alternate keys", out)
+		}
+		if got := out[0].Keys[0]; got != "pfx/module/"+name {
+			t.Errorf("Module key: got %q, want %q", got, "pfx/module/"+name)
+		}
+
+		_, out = get(t, newKeysHandler(cfg, nil), "module="+name)
+		if len(out) != 1 || !strings.Contains(out[0].Error, "not enabled") {
+			t.Errorf("Without module proxy: got %+v, want an error", out)
+		}
+	})
+
+	t.Run("NoQuery", func(t *testing.T) {
+		if code, _ := get(t, newKeysHandler(cfg, nil), ""); code != http.StatusBadRequest {
+			t.Errorf("Status: got %d, want %d", code, http.StatusBadRequest)
+		}
+	})
+}
@@ -0,0 +1,143 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/creachadair/atomicfile"
+)
+
+// LayoutVersion is the version of the layout of the local cache directory
+// used by this package. It is recorded in a marker file at the top of
+// CacheDir, so that a server whose layout differs can recognize the
+// directory. Whenever the layout of the local directories changes, increment
+// it and add a migration from the previous version to layoutMigrations.
+const LayoutVersion = 1
+
+// layoutFile is the name of the layout version marker in CacheDir.
+const layoutFile = "layout-version"
+
+// layoutMigrations[v] updates the local cache directories of c from layout
+// version v to version v+1 in place. Version 0 is a directory written before
+// the marker was introduced, whose layout is the same as version 1.
+var layoutMigrations = map[int]func(c *Config) error{
+	0: func(*Config) error { return nil },
+}
+
+// keepOnReset are the names of files in CacheDir that are not part of the
+// cache, and are kept when it is reset.
+var keepOnReset = []string{"revproxy-ca.crt", ActionManifestFile}
+
+// checkLayout checks the layout version of the local cache directories of c
+// against LayoutVersion. If CacheDir is new or empty, it is marked with the
+// current version. If it has an older version, it is migrated in place. If
+// it has a newer version, or cannot be migrated, checkLayout reports an
+// error unless c.ResetCache is true, in which case the directories are
+// emptied and marked with the current version.
+func (c *Config) checkLayout(logf func(string, ...any)) error {
+	if err := os.MkdirAll(c.CacheDir, 0755); err != nil {
+		return err
+	}
+	v, err := readLayout(c.CacheDir)
+	if err != nil {
+		return err
+	}
+	if v == LayoutVersion {
+		return writeLayout(c.CacheDir) // in case it was not marked yet
+	}
+
+	var merr error
+	if v > LayoutVersion {
+		merr = errors.New("it was written by a newer version of this program")
+	} else {
+		for ; v < LayoutVersion; v++ {
+			m, ok := layoutMigrations[v]
+			if !ok {
+				merr = fmt.Errorf("no migration from version %d", v)
+				break
+			} else if err := m(c); err != nil {
+				merr = fmt.Errorf("migrate from version %d: %w", v, err)
+				break
+			}
+			if err := writeVersion(c.CacheDir, v+1); err != nil {
+				return err
+			}
+		}
+		if merr == nil {
+			logf("migrated local cache directory %s to layout version %d", c.CacheDir, LayoutVersion)
+			return nil
+		}
+	}
+	if !c.ResetCache {
+		return fmt.Errorf("local cache directory %s has layout version %d, not %d: %w (reset the cache to discard its contents)",
+			c.CacheDir, v, LayoutVersion, merr)
+	}
+	logf("resetting local cache directory %s with layout version %d: %v", c.CacheDir, v, merr)
+	if err := resetDir(c.CacheDir, keepOnReset); err != nil {
+		return fmt.Errorf("reset local cache: %w", err)
+	}
+	if c.CacheDirLarge != "" {
+		if err := resetDir(c.CacheDirLarge, nil); err != nil {
+			return fmt.Errorf("reset large object cache: %w", err)
+		}
+	}
+	return writeLayout(c.CacheDir)
+}
+
+// readLayout reports the layout version recorded in dir. If dir has no
+// marker, the version is LayoutVersion if dir is empty, or 0 otherwise.
+func readLayout(dir string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(dir, layoutFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		des, err := os.ReadDir(dir)
+		if err != nil {
+			return 0, err
+		} else if len(des) == 0 {
+			return LayoutVersion, nil
+		}
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid layout version in %s: %q", filepath.Join(dir, layoutFile), data)
+	}
+	return v, nil
+}
+
+// writeLayout records LayoutVersion in dir.
+func writeLayout(dir string) error { return writeVersion(dir, LayoutVersion) }
+
+// writeVersion records layout version v in dir.
+func writeVersion(dir string, v int) error {
+	return atomicfile.WriteData(filepath.Join(dir, layoutFile), []byte(strconv.Itoa(v)+"\n"), 0644)
+}
+
+// resetDir removes the contents of dir, except for top-level files whose
+// names are listed in keep.
+func resetDir(dir string, keep []string) error {
+	des, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var errs []error
+	for _, de := range des {
+		if !de.IsDir() && slices.Contains(keep, de.Name()) {
+			continue
+		}
+		errs = append(errs, os.RemoveAll(filepath.Join(dir, de.Name())))
+	}
+	return errors.Join(errs...)
+}
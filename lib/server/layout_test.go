@@ -0,0 +1,100 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckLayout(t *testing.T) {
+	// setup returns a config for a new cache directory, whose layout marker
+	// and other files are populated from files, mapping paths to contents.
+	setup := func(t *testing.T, files map[string]string) *Config {
+		t.Helper()
+		dir := t.TempDir()
+		for name, data := range files {
+			path := filepath.Join(dir, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return &Config{CacheDir: dir}
+	}
+	checkVersion := func(t *testing.T, cfg *Config) {
+		t.Helper()
+		if v, err := readLayout(cfg.CacheDir); err != nil || v != LayoutVersion {
+			t.Errorf("Layout version: got (%d, %v), want %d", v, err, LayoutVersion)
+		}
+	}
+	exists := func(cfg *Config, name string) bool {
+		_, err := os.Stat(filepath.Join(cfg.CacheDir, name))
+		return err == nil
+	}
+	const newer = "999\n" // a version from the future
+
+	t.Run("New", func(t *testing.T) {
+		cfg := &Config{CacheDir: filepath.Join(t.TempDir(), "cache")}
+		if err := cfg.checkLayout(t.Logf); err != nil {
+			t.Fatalf("checkLayout: unexpected error: %v", err)
+		}
+		checkVersion(t, cfg)
+	})
+
+	t.Run("Unmarked", func(t *testing.T) {
+		cfg := setup(t, map[string]string{"module/x": "data"})
+		if err := cfg.checkLayout(t.Logf); err != nil {
+			t.Fatalf("checkLayout: unexpected error: %v", err)
+		}
+		checkVersion(t, cfg)
+		if !exists(cfg, "module/x") {
+			t.Error("Migration removed cached data")
+		}
+	})
+
+	t.Run("Newer", func(t *testing.T) {
+		cfg := setup(t, map[string]string{layoutFile: newer, "module/x": "data"})
+		if err := cfg.checkLayout(t.Logf); err == nil {
+			t.Fatal("checkLayout: got nil error, want a version mismatch")
+		}
+		if !exists(cfg, "module/x") {
+			t.Error("Failed check removed cached data")
+		}
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		cfg := setup(t, map[string]string{
+			layoutFile:        newer,
+			"module/x":        "data",
+			"revproxy-ca.crt": "cert",
+		})
+		cfg.CacheDirLarge = setup(t, map[string]string{"ab/y": "data"}).CacheDir
+		cfg.ResetCache = true
+		if err := cfg.checkLayout(t.Logf); err != nil {
+			t.Fatalf("checkLayout: unexpected error: %v", err)
+		}
+		checkVersion(t, cfg)
+		if exists(cfg, "module") {
+			t.Error("Reset kept cached data")
+		}
+		if !exists(cfg, "revproxy-ca.crt") {
+			t.Error("Reset removed the CA certificate")
+		}
+		if des, err := os.ReadDir(cfg.CacheDirLarge); err != nil || len(des) != 0 {
+			t.Errorf("Large directory: got %d entries (%v), want empty", len(des), err)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		cfg := setup(t, map[string]string{layoutFile: "bogus\n"})
+		cfg.ResetCache = true
+		if err := cfg.checkLayout(t.Logf); err == nil {
+			t.Fatal("checkLayout: got nil error, want invalid version")
+		}
+	})
+}
@@ -0,0 +1,72 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Kinds of filesystem accepted by Config.LocalFS.
+const (
+	// LocalFSLocal is a filesystem used only by this host, such as a local
+	// disk or tmpfs. This is the default.
+	LocalFSLocal = "local"
+
+	// LocalFSNFS is a filesystem shared by processes on several hosts over
+	// NFS, in place of a storage bucket or in front of one.
+	//
+	// Files are added to the local cache directories by writing a temporary
+	// file with a unique name and renaming it into place, which NFS does
+	// atomically on the server. What is not safe to share are the files that
+	// are staged under fixed names, namely the partial files kept to resume
+	// interrupted reads: with LocalFSNFS, these are kept in a subdirectory, or
+	// under a name, scoped to the host, so that two hosts never write the
+	// same one.
+	//
+	// NFS clients cache file attributes and directory entries, so a host may
+	// find an action in the local cache whose output another host has since
+	// removed, for example by cleanup, or whose contents it does not yet see
+	// in full. With LocalFSNFS, the build cache checks that each output it
+	// reports exists with the expected size, and treats one that does not as
+	// a miss (counted in the get_local_stale metric), fetching it again from
+	// storage if it can. A mismatch in an output just written is reported to
+	// the toolchain as a failed write.
+	//
+	// These checks do not detect an output that has the right size but the
+	// wrong contents. Outputs are named by the hash of their contents, so a
+	// file replaced by another host has the same contents as before; wrong
+	// contents mean the file itself was damaged. Nor does the toolchain catch
+	// that in general: it checks the hash only of the outputs it reads into
+	// memory, and uses the rest, such as compiled packages, from their files
+	// as they are.
+	LocalFSNFS = "nfs"
+)
+
+// checkLocalFS reports an error if c.LocalFS is not a known filesystem.
+func (c *Config) checkLocalFS() error {
+	switch c.LocalFS {
+	case "", LocalFSLocal, LocalFSNFS:
+		return nil
+	default:
+		return fmt.Errorf("unknown local filesystem %q (want %s or %s)", c.LocalFS, LocalFSLocal, LocalFSNFS)
+	}
+}
+
+// sharedLocal reports whether the local cache directories of c are shared
+// with other hosts.
+func (c *Config) sharedLocal() bool { return c.LocalFS == LocalFSNFS }
+
+// hostScope returns a name for this host, to scope the temporary files it
+// keeps in local cache directories shared with other hosts. If the host name
+// is not available, the process ID is used instead, which is unique on this
+// host but not across restarts.
+func hostScope() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return fmt.Sprintf("pid%d", os.Getpid())
+	}
+	return strings.NewReplacer("/", "_", `\`, "_").Replace(host)
+}
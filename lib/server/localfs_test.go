@@ -0,0 +1,31 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import "testing"
+
+func TestLocalFS(t *testing.T) {
+	tests := []struct {
+		fs     string
+		ok     bool
+		shared bool
+	}{
+		{"", true, false},
+		{LocalFSLocal, true, false},
+		{LocalFSNFS, true, true},
+		{"smb", false, false},
+	}
+	for _, tc := range tests {
+		c := Config{LocalFS: tc.fs}
+		if err := c.checkLocalFS(); (err == nil) != tc.ok {
+			t.Errorf("checkLocalFS(%q): got error %v, want ok=%v", tc.fs, err, tc.ok)
+		}
+		if got := c.sharedLocal(); got != tc.shared {
+			t.Errorf("sharedLocal(%q): got %v, want %v", tc.fs, got, tc.shared)
+		}
+	}
+	if s := hostScope(); s == "" {
+		t.Error("hostScope: got empty name")
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/tailscale/go-cache-plugin/lib/gobuild"
+	"github.com/tailscale/go-cache-plugin/lib/revproxy"
+)
+
+// newPinHandler returns an HTTP handler that pins the build cache entries
+// named by the query parameters of a request, so that maintenance tools such
+// as "fsck --repair" do not delete them (see [gobuild.PinTag]):
+//
+//	action=<id>    the action record for a build action ID
+//	output=<id>    the object for a build output ID
+//
+// Each parameter may be repeated. A POST request pins the entries, and a
+// DELETE request unpins them. The response is a JSON array with one report
+// for each entry, in the order of the query, giving the key of the object
+// tagged, or why it was not.
+func newPinHandler(cfg *Config, client revproxy.ListClient) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			http.Error(w, "usage: POST or DELETE ?action=<id> or ?output=<id>", http.StatusMethodNotAllowed)
+			return
+		}
+		pinned := r.Method == http.MethodPost
+		var out []keyReport
+		for _, p := range queryParams(r.URL.RawQuery) {
+			if p.name != "action" && p.name != "output" {
+				continue
+			}
+			key, err := gobuild.PinEntry(r.Context(), client, cfg.BuildKeyPrefix(), p.name, p.value, cfg.PartitionDepth, pinned)
+			var keys []string
+			if err == nil {
+				keys = []string{key}
+			}
+			out = append(out, newKeyReport(p.name, p.value, keys, err))
+		}
+		if len(out) == 0 {
+			http.Error(w, "usage: POST or DELETE ?action=<id> or ?output=<id>", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(out)
+	})
+}
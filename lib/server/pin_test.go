@@ -0,0 +1,72 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tailscale/go-cache-plugin/lib/gobuild"
+	"github.com/tailscale/go-cache-plugin/lib/memcache"
+)
+
+func TestPinHandler(t *testing.T) {
+	const id = "a1b2c3d4e5f6a1b2c3d4e5f6a1b2c3d4e5f6a1b2c3d4e5f6a1b2c3d4e5f6a1b2"
+	const key = "pfx/output/a1/" + id
+	cfg := &Config{KeyPrefix: "pfx"}
+	mc := new(memcache.Client)
+	if err := mc.Put(context.Background(), key, strings.NewReader("data")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	h := newPinHandler(cfg, mc)
+
+	send := func(t *testing.T, method, query string) (int, []keyReport) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, "/debug/pin?"+query, nil))
+		if rec.Code != http.StatusOK {
+			return rec.Code, nil
+		}
+		var out []keyReport
+		if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+			t.Fatalf("Decode response: %v", err)
+		}
+		return rec.Code, out
+	}
+	checkTag := func(t *testing.T, want string) {
+		t.Helper()
+		tags, err := mc.ObjectTags(context.Background(), key)
+		if err != nil {
+			t.Fatalf("ObjectTags: %v", err)
+		} else if got := tags[gobuild.PinTag]; got != want {
+			t.Errorf("Pin tag: got %q, want %q", got, want)
+		}
+	}
+
+	_, out := send(t, http.MethodPost, "action="+id+"&output="+id)
+	if len(out) != 2 {
+		t.Fatalf("Got %d reports, want 2", len(out))
+	}
+	if got := out[1]; got.Kind != "output" || len(got.Keys) != 1 || got.Keys[0] != key {
+		t.Errorf("Pin output: got %+v, want key %q", got, key)
+	}
+	if got := out[0]; got.Kind != "action" || got.Error == "" {
+		t.Errorf("Pin missing action: got %+v, want an error", got)
+	}
+	checkTag(t, "true")
+
+	send(t, http.MethodDelete, "output="+id)
+	checkTag(t, "false")
+
+	if code, _ := send(t, http.MethodGet, "output="+id); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: got status %d, want %d", code, http.StatusMethodNotAllowed)
+	}
+	if code, _ := send(t, http.MethodPost, ""); code != http.StatusBadRequest {
+		t.Errorf("No query: got status %d, want %d", code, http.StatusBadRequest)
+	}
+}
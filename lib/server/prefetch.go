@@ -0,0 +1,56 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/tailscale/go-cache-plugin/lib/gobuild"
+)
+
+// maxPrefetchBody is the largest request body accepted by the prefetch
+// handler, enough for about 100,000 action IDs.
+const maxPrefetchBody = 8 << 20
+
+// A prefetcher stages the outputs of build actions into the local cache.
+// It is implemented by [gobuild.GCSCache] and [gobuild.S3Cache].
+type prefetcher interface {
+	Prefetch(context.Context, []string) (gobuild.PrefetchStats, error)
+}
+
+// newPrefetchHandler returns an HTTP handler that stages the outputs of the
+// build actions listed in the body of a POST request into the local cache,
+// so that a build that needs them finds them as local hits. The body lists
+// action IDs, one per line; blank lines are ignored. The response is a JSON
+// object giving the number of hits and misses. If the client disconnects,
+// prefetching stops.
+func newPrefetchHandler(p prefetcher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "usage: POST a list of action IDs, one per line", http.StatusMethodNotAllowed)
+			return
+		}
+		var ids []string
+		sc := bufio.NewScanner(http.MaxBytesReader(w, r.Body, maxPrefetchBody))
+		for sc.Scan() {
+			if id := strings.TrimSpace(sc.Text()); id != "" {
+				ids = append(ids, id)
+			}
+		}
+		if err := sc.Err(); err != nil {
+			http.Error(w, "read action IDs: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		st, err := p.Prefetch(r.Context(), ids)
+		if err != nil {
+			return // the client went away, so there is no one to report to
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st)
+	})
+}
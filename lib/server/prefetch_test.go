@@ -0,0 +1,53 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tailscale/go-cache-plugin/lib/gobuild"
+)
+
+// prefetchFunc implements the prefetcher interface with a function.
+type prefetchFunc func(context.Context, []string) (gobuild.PrefetchStats, error)
+
+func (f prefetchFunc) Prefetch(ctx context.Context, ids []string) (gobuild.PrefetchStats, error) {
+	return f(ctx, ids)
+}
+
+func TestPrefetchHandler(t *testing.T) {
+	var got []string
+	h := newPrefetchHandler(prefetchFunc(func(_ context.Context, ids []string) (gobuild.PrefetchStats, error) {
+		got = ids
+		return gobuild.PrefetchStats{Hits: 2, Misses: 1}, nil
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/debug/prefetch", strings.NewReader("a1\n\n  b2 \nc3")))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Status: got %d, want %d", rec.Code, http.StatusOK)
+	}
+	if want := []string{"a1", "b2", "c3"}; !slices.Equal(got, want) {
+		t.Errorf("Action IDs: got %q, want %q", got, want)
+	}
+	var st gobuild.PrefetchStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil {
+		t.Fatalf("Decode response: %v", err)
+	}
+	if want := (gobuild.PrefetchStats{Hits: 2, Misses: 1}); st != want {
+		t.Errorf("Response: got %+v, want %+v", st, want)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/prefetch", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET status: got %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// Versions of the build cache protocol spoken by the toolchain, as reported
+// in the logs and accepted by Config.RequireProtocol.
+//
+// The toolchain does not announce a version, so it is inferred from the
+// requests it sends: v1 toolchains identify the output of a put by ObjectID
+// only, while v2 toolchains (Go 1.24 and later) also set OutputID. The version
+// is not known until the first put request.
+const (
+	ProtocolV1 = "v1"
+	ProtocolV2 = "v2"
+)
+
+// knownCommands are the protocol commands handled by the cache server.
+var knownCommands = []string{"get", "put", "close"}
+
+// maxRequestSize is the largest request object inspected by a protocolReader.
+// Requests are small; anything larger is passed through without inspection.
+const maxRequestSize = 64 << 10
+
+// protocolMetrics counts protocol problems observed across all connections.
+type protocolMetrics struct {
+	unknownCommand expvar.Int // requests with a command the server does not support
+	mismatch       expvar.Int // connections closed for a protocol mismatch
+}
+
+func (m *protocolMetrics) setMetrics(em *expvar.Map) {
+	em.Set("unknown_command", &m.unknownCommand)
+	em.Set("mismatch", &m.mismatch)
+}
+
+// A protocolReader passes through the request stream from a toolchain to the
+// cache server, and inspects the requests to log the protocol version in use
+// and report commands the server does not support.
+//
+// The stream is a sequence of JSON values: each request is an object, and the
+// body of a put, if any, follows as a separate string. Only the objects are
+// buffered for inspection; bodies are scanned and discarded.
+type protocolReader struct {
+	r       io.Reader
+	require string // if non-empty, the required protocol version
+	logf    func(string, ...any)
+	metrics *protocolMetrics
+
+	version string // detected protocol version, or "" if not yet known
+	err     error  // sticky error after a mismatch
+
+	// Scanner state.
+	depth    int    // nesting depth of the current value (0 at top level)
+	inString bool   // inside a string
+	escape   bool   // after a backslash in a string
+	buf      []byte // the current top-level object
+	overflow bool   // the current object exceeded maxRequestSize
+}
+
+func (p *protocolReader) Read(data []byte) (int, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+	n, err := p.r.Read(data)
+	for _, c := range data[:n] {
+		p.scan(c)
+		if p.err != nil {
+			// Do not pass on any part of the offending request.
+			return 0, p.err
+		}
+	}
+	return n, err
+}
+
+// scan advances the scanner by one byte of the stream.
+func (p *protocolReader) scan(c byte) {
+	if p.depth > 0 {
+		if len(p.buf) < maxRequestSize {
+			p.buf = append(p.buf, c)
+		} else {
+			p.overflow = true
+		}
+	}
+	if p.inString {
+		switch {
+		case p.escape:
+			p.escape = false
+		case c == '\\':
+			p.escape = true
+		case c == '"':
+			p.inString = false
+		}
+		return
+	}
+	switch c {
+	case '"':
+		p.inString = true
+	case '{', '[':
+		if p.depth == 0 {
+			p.buf = append(p.buf[:0], c)
+			p.overflow = false
+		}
+		p.depth++
+	case '}', ']':
+		p.depth--
+		if p.depth == 0 && !p.overflow {
+			p.check(p.buf)
+		}
+	}
+}
+
+// check inspects a single request object.
+func (p *protocolReader) check(obj []byte) {
+	var req struct {
+		ID       int64
+		Command  string
+		ObjectID json.RawMessage
+		OutputID json.RawMessage
+	}
+	if json.Unmarshal(obj, &req) != nil {
+		return // let the cache server report it
+	}
+	if !slices.Contains(knownCommands, req.Command) {
+		p.metrics.unknownCommand.Add(1)
+		p.logf("WARNING: request %d has unsupported command %q (the toolchain may use a newer protocol)", req.ID, req.Command)
+		if p.require != "" {
+			p.fail(fmt.Errorf("unsupported command %q", req.Command))
+		}
+		return
+	}
+	if req.Command != "put" || p.version != "" {
+		return
+	}
+	p.version = ProtocolV1
+	if len(req.OutputID) != 0 {
+		p.version = ProtocolV2
+	}
+	p.logf("client protocol: %s", p.version)
+	if p.require != "" && p.version != p.require {
+		p.fail(fmt.Errorf("client protocol %s does not match required %s", p.version, p.require))
+	}
+}
+
+// fail records a protocol mismatch, which ends the session.
+func (p *protocolReader) fail(err error) {
+	p.metrics.mismatch.Add(1)
+	p.err = fmt.Errorf("protocol mismatch: %w", err)
+	p.logf("closing client connection: %v", p.err)
+}
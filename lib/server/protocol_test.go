@@ -0,0 +1,68 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestProtocolReader(t *testing.T) {
+	const (
+		getReq    = `{"ID":1,"Command":"get","ActionID":"YWJj"}` + "\n"
+		putV1     = `{"ID":2,"Command":"put","ActionID":"YWJj","ObjectID":"ZGVm","BodySize":3}` + "\n" + `"e30i"` + "\n"
+		putV2     = `{"ID":2,"Command":"put","ActionID":"YWJj","OutputID":"ZGVm","ObjectID":"ZGVm","BodySize":3}` + "\n" + `"e30i"` + "\n"
+		oddBody   = `{"ID":3,"Command":"put","ActionID":"YWJj","OutputID":"ZGVm","BodySize":3}` + "\n" + `"{\"Command\":\"frob\"}"` + "\n"
+		unknown   = `{"ID":4,"Command":"frob"}` + "\n"
+		closeReq  = `{"ID":5,"Command":"close"}` + "\n"
+		bigPrefix = `{"ID":6,"Command":"put","Extra":"`
+	)
+	tests := []struct {
+		name, input, require string
+		wantVersion          string
+		wantErr              bool
+		wantUnknown          int64
+	}{
+		{"Empty", "", "", "", false, 0},
+		{"GetOnly", getReq + closeReq, "", "", false, 0},
+		{"V1", getReq + putV1 + closeReq, "", ProtocolV1, false, 0},
+		{"V2", getReq + putV2 + closeReq, "", ProtocolV2, false, 0},
+		{"BodyNotInspected", oddBody + closeReq, "", ProtocolV2, false, 0},
+		{"Unknown", getReq + unknown + putV2 + closeReq, "", ProtocolV2, false, 1},
+		{"RequireMatch", putV2 + closeReq, ProtocolV2, ProtocolV2, false, 0},
+		{"RequireMismatch", putV1 + closeReq, ProtocolV2, ProtocolV1, true, 0},
+		{"RequireUnknown", unknown + closeReq, ProtocolV1, "", true, 1},
+		{"Oversize", bigPrefix + strings.Repeat("x", 2*maxRequestSize) + `"}` + "\n" + putV1, "", ProtocolV1, false, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var m protocolMetrics
+			pr := &protocolReader{
+				r:       strings.NewReader(tc.input),
+				require: tc.require,
+				logf:    t.Logf,
+				metrics: &m,
+			}
+			got, err := io.ReadAll(pr)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("Read: got nil error, want mismatch")
+				} else if n := m.mismatch.Value(); n != 1 {
+					t.Errorf("Mismatch count: got %d, want 1", n)
+				}
+			} else if err != nil {
+				t.Errorf("Read: unexpected error: %v", err)
+			} else if string(got) != tc.input {
+				t.Errorf("Read: got %d bytes, want the input unchanged (%d bytes)", len(got), len(tc.input))
+			}
+			if pr.version != tc.wantVersion {
+				t.Errorf("Version: got %q, want %q", pr.version, tc.wantVersion)
+			}
+			if n := m.unknownCommand.Value(); n != tc.wantUnknown {
+				t.Errorf("Unknown commands: got %d, want %d", n, tc.wantUnknown)
+			}
+		})
+	}
+}
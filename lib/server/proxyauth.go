@@ -0,0 +1,165 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// A proxyAuth checks the credentials of requests to the module and reverse
+// proxies against the users and tokens listed in a file.
+//
+// Each line of the file is blank, a comment beginning with "#", or one of:
+//
+//	<user>:<hash>      a user for basic auth, as written by "htpasswd -B"
+//	Bearer <token>     a bearer token
+//
+// Only bcrypt password hashes are accepted. Since checking a bcrypt hash is
+// deliberately slow, and a client sends its credentials with every request,
+// a digest of each user and password that has been checked successfully is
+// remembered, and later requests with the same credentials skip the hash.
+//
+// A nil *proxyAuth is valid, and allows every request.
+type proxyAuth struct {
+	users  map[string][]byte // user name → bcrypt hash of password
+	tokens [][32]byte        // SHA-256 digests of bearer tokens
+
+	verified sync.Map // SHA-256 digests of checked user:password pairs
+
+	allowed expvar.Int // requests with valid credentials
+	denied  expvar.Int // requests rejected for missing or invalid credentials
+}
+
+// loadProxyAuth reads the users and tokens of a proxyAuth from the file at
+// path, in the format described by [proxyAuth].
+func loadProxyAuth(path string) (*proxyAuth, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("proxy auth: %w", err)
+	}
+	a, err := parseProxyAuth(data)
+	if err != nil {
+		return nil, fmt.Errorf("proxy auth %s: %w", path, err)
+	}
+	return a, nil
+}
+
+// parseProxyAuth parses the users and tokens of a proxyAuth from data.
+func parseProxyAuth(data []byte) (*proxyAuth, error) {
+	a := &proxyAuth{users: make(map[string][]byte)}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for ln := 1; sc.Scan(); ln++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if f := strings.Fields(line); f[0] == "Bearer" {
+			if len(f) != 2 {
+				return nil, fmt.Errorf("line %d: want Bearer <token>", ln)
+			}
+			a.tokens = append(a.tokens, sha256.Sum256([]byte(f[1])))
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d: want <user>:<hash> or Bearer <token>", ln)
+		} else if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("line %d: user %q: unsupported password hash (use htpasswd -B)", ln, user)
+		} else if _, dup := a.users[user]; dup {
+			return nil, fmt.Errorf("line %d: duplicate user %q", ln, user)
+		}
+		a.users[user] = []byte(hash)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(a.users) == 0 && len(a.tokens) == 0 {
+		return nil, errors.New("no users or tokens")
+	}
+	return a, nil
+}
+
+// authorize reports whether r carries valid credentials. If not, it writes an
+// error response to w, and the caller should not serve r further.
+//
+// A request the server is asked to proxy for the caller, including a CONNECT
+// request, carries its credentials in a Proxy-Authorization header, and is
+// rejected with status 407. Other requests carry them in an Authorization
+// header, and are rejected with status 401.
+func (a *proxyAuth) authorize(w http.ResponseWriter, r *http.Request) bool {
+	if a == nil {
+		return true
+	}
+	header, challenge, code := "Authorization", "WWW-Authenticate", http.StatusUnauthorized
+	if isProxyRequest(r) {
+		header, challenge, code = "Proxy-Authorization", "Proxy-Authenticate", http.StatusProxyAuthRequired
+	}
+	if a.valid(r.Header.Get(header)) {
+		a.allowed.Add(1)
+		return true
+	}
+	a.denied.Add(1)
+	w.Header().Add(challenge, `Basic realm="go-cache-plugin"`)
+	w.Header().Add(challenge, "Bearer")
+	http.Error(w, http.StatusText(code), code)
+	return false
+}
+
+// valid reports whether the credentials in the authorization header value
+// cred are those of a user or token of a.
+func (a *proxyAuth) valid(cred string) bool {
+	scheme, value, _ := strings.Cut(cred, " ")
+	value = strings.TrimSpace(value)
+	switch {
+	case strings.EqualFold(scheme, "Bearer"):
+		sum := sha256.Sum256([]byte(value))
+		ok := 0
+		for _, t := range a.tokens {
+			ok |= subtle.ConstantTimeCompare(sum[:], t[:])
+		}
+		return ok == 1
+
+	case strings.EqualFold(scheme, "Basic"):
+		dec, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return false
+		}
+		user, pass, ok := strings.Cut(string(dec), ":")
+		hash, known := a.users[user]
+		if !ok || !known {
+			return false
+		}
+		sum := sha256.Sum256(dec)
+		if _, ok := a.verified.Load(sum); ok {
+			return true
+		}
+		if bcrypt.CompareHashAndPassword(hash, []byte(pass)) != nil {
+			return false
+		}
+		a.verified.Store(sum, true)
+		return true
+	}
+	return false
+}
+
+// metrics returns a map of authentication metrics for a.
+func (a *proxyAuth) metrics() *expvar.Map {
+	m := new(expvar.Map)
+	m.Set("allowed", &a.allowed)
+	m.Set("denied", &a.denied)
+	return m
+}
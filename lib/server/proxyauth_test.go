@@ -0,0 +1,108 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestProxyAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Hash password: %v", err)
+	}
+	auth, err := parseProxyAuth(fmt.Appendf(nil, "# CI fleet\nalice:%s\n\nBearer s3kr1t\n", hash))
+	if err != nil {
+		t.Fatalf("parseProxyAuth: unexpected error: %v", err)
+	}
+	basic := func(user, pass string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+	h := makeHandler(ok, ok, nil, nil, nil, nil, auth, "")
+	tests := []struct {
+		name, url, header, cred string
+		want                    int
+	}{
+		{"ModNone", "/mod/x", "", "", http.StatusUnauthorized},
+		{"ModBasic", "/mod/x", "Authorization", basic("alice", "hunter2"), http.StatusOK},
+		{"ModBasicAgain", "/mod/x", "Authorization", basic("alice", "hunter2"), http.StatusOK},
+		{"ModWrongPassword", "/mod/x", "Authorization", basic("alice", "hunter3"), http.StatusUnauthorized},
+		{"ModUnknownUser", "/mod/x", "Authorization", basic("bob", "hunter2"), http.StatusUnauthorized},
+		{"ModBearer", "/mod/x", "Authorization", "Bearer s3kr1t", http.StatusOK},
+		{"ModWrongToken", "/mod/x", "Authorization", "Bearer s3kr1", http.StatusUnauthorized},
+		{"ProxyNone", "http://example.com/x", "", "", http.StatusProxyAuthRequired},
+		{"ProxyWrongHeader", "http://example.com/x", "Authorization", "Bearer s3kr1t", http.StatusProxyAuthRequired},
+		{"ProxyBasic", "http://example.com/x", "Proxy-Authorization", basic("alice", "hunter2"), http.StatusOK},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest("GET", tc.url, nil)
+		if tc.header != "" {
+			r.Header.Set(tc.header, tc.cred)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s: got status %d, want %d", tc.name, w.Code, tc.want)
+		}
+	}
+	if got := auth.denied.Value(); got != 6 {
+		t.Errorf("Denied: got %d, want 6", got)
+	}
+	if got := auth.allowed.Value(); got != 4 {
+		t.Errorf("Allowed: got %d, want 4", got)
+	}
+
+	// The debug handlers may refuse a test client for other reasons, so check
+	// only whether the request was rejected for its credentials.
+	t.Run("DebugToken", func(t *testing.T) {
+		tests := []struct {
+			token, cred string
+			denied      bool
+		}{
+			{"", "", false},
+			{"admin", "", true},
+			{"admin", "Bearer s3kr1t", true},
+			{"admin", "Bearer admin", false},
+		}
+		for _, tc := range tests {
+			h := makeHandler(nil, nil, nil, nil, nil, nil, auth, tc.token)
+			r := httptest.NewRequest("GET", "/debug/", nil)
+			if tc.cred != "" {
+				r.Header.Set("Authorization", tc.cred)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if got := w.Code == http.StatusUnauthorized; got != tc.denied {
+				t.Errorf("Debug token %q with %q: got status %d, want denied=%v", tc.token, tc.cred, w.Code, tc.denied)
+			}
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		tests := []struct {
+			name, input, want string
+		}{
+			{"Empty", "# nothing\n", "no users or tokens"},
+			{"NoHash", "alice\n", "want <user>:<hash>"},
+			{"PlainPassword", "alice:hunter2\n", "unsupported password hash"},
+			{"NoToken", "Bearer  \n", "want Bearer <token>"},
+			{"TwoTokens", "Bearer a b\n", "want Bearer <token>"},
+			{"Duplicate", fmt.Sprintf("alice:%s\nalice:%[1]s\n", hash), "duplicate user"},
+		}
+		for _, tc := range tests {
+			if _, err := parseProxyAuth([]byte(tc.input)); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("%s: got error %v, want %q", tc.name, err, tc.want)
+			}
+		}
+	})
+}
@@ -0,0 +1,152 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// meterWindow is the number of seconds over which a byteLimiter averages its
+// reported throughput.
+const meterWindow = 10
+
+// A byteLimiter limits and measures the rate of bytes read through the readers
+// it wraps. All the readers share a single budget, so the limit applies to the
+// total across concurrent transfers.
+type byteLimiter struct {
+	lim *rate.Limiter // nil if unlimited
+
+	total expvar.Int // total bytes read
+
+	mu      sync.Mutex
+	buckets [meterWindow]struct{ sec, n int64 }
+}
+
+// newByteLimiter returns a limiter that allows bps bytes per second, or an
+// unlimited one that only measures if bps <= 0.
+func newByteLimiter(bps int64) *byteLimiter {
+	b := new(byteLimiter)
+	if bps > 0 {
+		// Reads are split into chunks no larger than the burst, so keep it
+		// small enough that a single read does not exceed the budget by much.
+		b.lim = rate.NewLimiter(rate.Limit(bps), int(min(bps, 256<<10)))
+	}
+	return b
+}
+
+// wrap returns a reader for rc that is limited by b. A read waiting for the
+// limit fails when ctx ends.
+func (b *byteLimiter) wrap(ctx context.Context, rc io.ReadCloser) io.ReadCloser {
+	return limitedReader{ctx: ctx, rc: rc, b: b}
+}
+
+// record adds n bytes to the measurements of b.
+func (b *byteLimiter) record(n int) {
+	b.total.Add(int64(n))
+
+	sec := time.Now().Unix()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bk := &b.buckets[sec%meterWindow]
+	if bk.sec != sec {
+		bk.sec, bk.n = sec, 0
+	}
+	bk.n += int64(n)
+}
+
+// throughput returns the average throughput of b over the last meterWindow
+// seconds, in bytes per second.
+func (b *byteLimiter) throughput() int64 {
+	now := time.Now().Unix()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var sum int64
+	for _, bk := range b.buckets {
+		if now-bk.sec < meterWindow {
+			sum += bk.n
+		}
+	}
+	return sum / meterWindow
+}
+
+// setMetrics adds the metrics for b to m, with the given name prefix.
+func (b *byteLimiter) setMetrics(m *expvar.Map, prefix string) {
+	m.Set(prefix+"_bytes", &b.total)
+	m.Set(prefix+"_bps", expvar.Func(func() any { return b.throughput() }))
+}
+
+type limitedReader struct {
+	ctx context.Context
+	rc  io.ReadCloser
+	b   *byteLimiter
+}
+
+func (r limitedReader) Read(data []byte) (int, error) {
+	if r.b.lim != nil {
+		data = data[:min(len(data), r.b.lim.Burst())]
+	}
+	n, err := r.rc.Read(data)
+	if n > 0 {
+		r.b.record(n)
+		if r.b.lim != nil {
+			if werr := r.b.lim.WaitN(r.ctx, n); werr != nil && err == nil {
+				err = werr
+			}
+		}
+	}
+	return n, err
+}
+
+func (r limitedReader) Close() error { return r.rc.Close() }
+
+// limitTransport is an [http.RoundTripper] that limits request bodies by up
+// and response bodies by down.
+type limitTransport struct {
+	base     http.RoundTripper
+	up, down *byteLimiter
+}
+
+func (t limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.Body != http.NoBody {
+		// A RoundTripper must not modify the request, so send a copy. The base
+		// transport may resend the body from GetBody, so limit that as well.
+		ctx := req.Context()
+		cp := *req
+		cp.Body = t.up.wrap(ctx, req.Body)
+		if getBody := req.GetBody; getBody != nil {
+			cp.GetBody = func() (io.ReadCloser, error) {
+				rc, err := getBody()
+				if err != nil {
+					return nil, err
+				}
+				return t.up.wrap(ctx, rc), nil
+			}
+		}
+		req = &cp
+	}
+	rsp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	rsp.Body = t.down.wrap(req.Context(), rsp.Body)
+	return rsp, nil
+}
+
+// storageTransport returns an HTTP transport for storage clients, with the
+// settings of httpTransport, whose transfers are limited and measured by the
+// bandwidth limiters of s, if any.
+func (s *Server) storageTransport() http.RoundTripper {
+	t := s.config.httpTransport()
+	if s.upload == nil || s.download == nil {
+		return t
+	}
+	return limitTransport{base: t, up: s.upload, down: s.download}
+}
@@ -0,0 +1,93 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestByteLimiter(t *testing.T) {
+	const bps = 32 << 10
+	b := newByteLimiter(bps)
+
+	// The first burst is free, so reading two bursts' worth should take about
+	// one second.
+	data := make([]byte, 2*bps)
+	start := time.Now()
+	n, err := io.Copy(io.Discard, b.wrap(context.Background(), io.NopCloser(bytes.NewReader(data))))
+	if err != nil {
+		t.Fatalf("Copy: unexpected error: %v", err)
+	} else if n != int64(len(data)) {
+		t.Errorf("Copy: got %d bytes, want %d", n, len(data))
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("Copy took %v, want at least 1s", elapsed)
+	}
+
+	if got := b.total.Value(); got != int64(len(data)) {
+		t.Errorf("Total: got %d, want %d", got, len(data))
+	}
+	if got, want := b.throughput(), int64(len(data)/meterWindow); got != want {
+		t.Errorf("Throughput: got %d, want %d", got, want)
+	}
+
+	// An unlimited reader only measures.
+	u := newByteLimiter(0)
+	if _, err := io.Copy(io.Discard, u.wrap(context.Background(), io.NopCloser(bytes.NewReader(data)))); err != nil {
+		t.Fatalf("Copy: unexpected error: %v", err)
+	}
+	if got := u.total.Value(); got != int64(len(data)) {
+		t.Errorf("Total: got %d, want %d", got, len(data))
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestLimitTransport(t *testing.T) {
+	const body = "request body"
+	up, down := newByteLimiter(0), newByteLimiter(0)
+
+	// The base transport sends the body, then resends it from GetBody, as it
+	// may when it retries the request on a new connection.
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if _, err := io.Copy(io.Discard, req.Body); err != nil {
+			return nil, err
+		}
+		rc, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(io.Discard, rc); err != nil {
+			return nil, err
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("ok"))}, nil
+	})
+	lt := limitTransport{base: base, up: up, down: down}
+
+	req, err := http.NewRequest("PUT", "http://example.com/key", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	rsp, err := lt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip: unexpected error: %v", err)
+	}
+	io.Copy(io.Discard, rsp.Body)
+	rsp.Body.Close()
+
+	if got, want := up.total.Value(), int64(2*len(body)); got != want {
+		t.Errorf("Upload total: got %d, want %d", got, want)
+	}
+	if got := down.total.Value(); got != 2 {
+		t.Errorf("Download total: got %d, want 2", got)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/creachadair/atomicfile"
+)
+
+// persistentCALifetime is the validity period of a persistent signing
+// certificate generated for the reverse proxy. It is long, since the point of
+// keeping the certificate is that clients need not trust a new one.
+const persistentCALifetime = 5 * 365 * 24 * time.Hour
+
+// A signingCA is a certificate authority loaded from, or saved to, files, for
+// issuing the server certificates of the reverse proxy.
+type signingCA struct {
+	cert    *x509.Certificate
+	certPEM []byte
+	key     crypto.Signer
+}
+
+// loadOrCreateCA loads a signing certificate and its private key from the
+// PEM files at certPath and keyPath. If neither file exists, it generates a
+// new certificate and writes it to them, and reports created == true. The key
+// file is written with mode 0600. It reports an error if only one of the
+// files exists, if they do not match, or if the certificate has expired.
+func loadOrCreateCA(certPath, keyPath string) (_ *signingCA, created bool, _ error) {
+	certPEM, cerr := os.ReadFile(certPath)
+	keyPEM, kerr := os.ReadFile(keyPath)
+	switch {
+	case errors.Is(cerr, fs.ErrNotExist) && errors.Is(kerr, fs.ErrNotExist):
+		ca, err := newSigningCA(persistentCALifetime)
+		if err != nil {
+			return nil, false, err
+		}
+		if err := ca.save(certPath, keyPath); err != nil {
+			return nil, false, err
+		}
+		return ca, true, nil
+	case cerr != nil:
+		return nil, false, fmt.Errorf("read signing cert: %w", cerr)
+	case kerr != nil:
+		return nil, false, fmt.Errorf("read signing key: %w", kerr)
+	}
+	ca, err := parseSigningCA(certPEM, keyPEM)
+	if err != nil {
+		return nil, false, err
+	}
+	if now := time.Now(); now.After(ca.cert.NotAfter) {
+		return nil, false, fmt.Errorf("signing cert in %s expired at %v (remove it and %s to generate a new one)",
+			certPath, ca.cert.NotAfter.Format(time.RFC3339), keyPath)
+	}
+	return ca, false, nil
+}
+
+// newSigningCA generates a self-signed certificate authority valid for ttl.
+func newSigningCA(ttl time.Duration) (*signingCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate signing key: %w", err)
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Tailscale build automation"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(ttl),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("generate signing cert: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &signingCA{
+		cert:    cert,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		key:     key,
+	}, nil
+}
+
+// parseSigningCA parses a signing certificate and its PKCS #8 private key
+// from PEM, and checks that they belong together.
+func parseSigningCA(certPEM, keyPEM []byte) (*signingCA, error) {
+	cb, _ := pem.Decode(certPEM)
+	if cb == nil || cb.Type != "CERTIFICATE" {
+		return nil, errors.New("signing cert: no PEM certificate found")
+	}
+	cert, err := x509.ParseCertificate(cb.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("signing cert: %w", err)
+	} else if !cert.IsCA {
+		return nil, errors.New("signing cert is not a certificate authority")
+	}
+	kb, _ := pem.Decode(keyPEM)
+	if kb == nil || kb.Type != "PRIVATE KEY" {
+		return nil, errors.New("signing key: no PEM private key found")
+	}
+	pk, err := x509.ParsePKCS8PrivateKey(kb.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("signing key: %w", err)
+	}
+	key, ok := pk.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("signing key: unsupported key type %T", pk)
+	}
+	type publicKey interface{ Equal(crypto.PublicKey) bool }
+	if pub, ok := key.Public().(publicKey); !ok || !pub.Equal(cert.PublicKey) {
+		return nil, errors.New("signing key does not match the signing cert")
+	}
+	return &signingCA{cert: cert, certPEM: certPEM, key: key}, nil
+}
+
+// save writes the certificate of ca to certPath and its private key to
+// keyPath, in PEM format. The key file is readable only by its owner.
+func (ca *signingCA) save(certPath, keyPath string) error {
+	der, err := x509.MarshalPKCS8PrivateKey(ca.key)
+	if err != nil {
+		return fmt.Errorf("encode signing key: %w", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := atomicfile.WriteData(keyPath, keyPEM, 0600); err != nil {
+		return fmt.Errorf("write signing key: %w", err)
+	}
+	if err := atomicfile.WriteData(certPath, ca.certPEM, 0644); err != nil {
+		return fmt.Errorf("write signing cert: %w", err)
+	}
+	return nil
+}
+
+// serverCert issues a server certificate for the given host names, signed
+// by ca and valid for ttl.
+func (ca *signingCA) serverCert(hosts []string, ttl time.Duration) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generate server key: %w", err)
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"Go cache plugin reverse proxy"}},
+		DNSNames:     hosts,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(ttl),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generate server cert: %w", err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  key,
+	}, nil
+}
+
+// randomSerial returns a random certificate serial number.
+func randomSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("generate serial number: %w", err)
+	}
+	return serial, nil
+}
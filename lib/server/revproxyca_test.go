@@ -0,0 +1,79 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"bytes"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadOrCreateCA(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "ca.crt")
+	keyPath := filepath.Join(dir, "ca.key")
+
+	ca, created, err := loadOrCreateCA(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("loadOrCreateCA: unexpected error: %v", err)
+	} else if !created {
+		t.Error("loadOrCreateCA: created is false, want true")
+	}
+	if fi, err := os.Stat(keyPath); err != nil {
+		t.Fatalf("Stat key file: %v", err)
+	} else if mode := fi.Mode().Perm(); mode != 0600 {
+		t.Errorf("Key file mode: got %v, want 0600", mode)
+	}
+
+	// A second load finds the same certificate.
+	ca2, created, err := loadOrCreateCA(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("loadOrCreateCA: unexpected error: %v", err)
+	} else if created {
+		t.Error("loadOrCreateCA: created is true, want false")
+	}
+	if !bytes.Equal(ca2.certPEM, ca.certPEM) {
+		t.Error("Reloaded cert differs from the one created")
+	}
+
+	// Server certs issued from it verify against it.
+	sc, err := ca2.serverCert([]string{"example.com"}, time.Hour)
+	if err != nil {
+		t.Fatalf("serverCert: unexpected error: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(sc.Certificate[0])
+	if err != nil {
+		t.Fatalf("Parse server cert: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: roots}); err != nil {
+		t.Errorf("Verify server cert: %v", err)
+	}
+
+	t.Run("Mismatch", func(t *testing.T) {
+		other, err := newSigningCA(time.Hour)
+		if err != nil {
+			t.Fatalf("newSigningCA: %v", err)
+		}
+		otherCert := filepath.Join(t.TempDir(), "other.crt")
+		if err := os.WriteFile(otherCert, other.certPEM, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := loadOrCreateCA(otherCert, keyPath); err == nil || !strings.Contains(err.Error(), "does not match") {
+			t.Errorf("loadOrCreateCA: got %v, want mismatch error", err)
+		}
+	})
+
+	t.Run("Partial", func(t *testing.T) {
+		missing := filepath.Join(t.TempDir(), "missing.key")
+		if _, _, err := loadOrCreateCA(certPath, missing); err == nil {
+			t.Error("loadOrCreateCA with no key file: got nil error, want error")
+		}
+	})
+}
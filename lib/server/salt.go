@@ -0,0 +1,60 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/creachadair/atomicfile"
+)
+
+// saltFile is the name of the marker in CacheDir recording the digest of the
+// cache salt its entries were stored under.
+const saltFile = "cache-salt"
+
+// saltDigest returns the digest of c.CacheSalt that identifies its generation
+// in storage keys, or "" if no salt is set. The salt is hashed so that it may
+// be any string, and so that keys have a fixed shape.
+func (c *Config) saltDigest() string {
+	if c.CacheSalt == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte("go-cache-plugin salt\x00" + c.CacheSalt))
+	return hex.EncodeToString(sum[:8])
+}
+
+// checkSalt checks the salt recorded in the local cache directories of c
+// against c.CacheSalt. If they differ, the local entries belong to another
+// generation, so the directories are emptied and marked with the current
+// salt. A directory with no marker is taken to have no salt.
+func (c *Config) checkSalt(logf func(string, ...any)) error {
+	path := filepath.Join(c.CacheDir, saltFile)
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	old, cur := strings.TrimSpace(string(data)), c.saltDigest()
+	if old == cur {
+		return nil
+	}
+	logf("resetting local cache directory %s for a new cache salt", c.CacheDir)
+	if err := resetDir(c.CacheDir, append([]string{layoutFile}, keepOnReset...)); err != nil {
+		return err
+	}
+	if c.CacheDirLarge != "" {
+		if err := resetDir(c.CacheDirLarge, nil); err != nil {
+			return err
+		}
+	}
+	if cur == "" {
+		return nil // the reset removed the marker
+	}
+	return atomicfile.WriteData(path, []byte(cur+"\n"), 0644)
+}
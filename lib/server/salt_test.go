@@ -0,0 +1,59 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckSalt(t *testing.T) {
+	dir := t.TempDir()
+	entry := filepath.Join(dir, "ab", "entry")
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	// check runs checkSalt with salt after populating the cache, and reports
+	// whether the cached entry survived.
+	check := func(t *testing.T, salt string) bool {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(entry), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(entry, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg := &Config{CacheDir: dir, CacheSalt: salt}
+		if err := cfg.checkSalt(t.Logf); err != nil {
+			t.Fatalf("checkSalt(%q): unexpected error: %v", salt, err)
+		}
+		return exists(entry)
+	}
+	if err := writeLayout(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if !check(t, "") {
+		t.Error("No salt: entries were discarded")
+	}
+	if check(t, "v1") {
+		t.Error("New salt: entries were kept")
+	}
+	if !check(t, "v1") {
+		t.Error("Same salt: entries were discarded")
+	}
+	if check(t, "v2") {
+		t.Error("Changed salt: entries were kept")
+	}
+	if check(t, "") {
+		t.Error("Removed salt: entries were kept")
+	} else if exists(filepath.Join(dir, saltFile)) {
+		t.Error("Removed salt: marker was kept")
+	}
+	if !exists(filepath.Join(dir, layoutFile)) {
+		t.Error("Layout marker was discarded")
+	}
+}
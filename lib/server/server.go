@@ -0,0 +1,961 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package server implements a Go build cache server backed by a cloud storage
+// bucket (S3 or GCS), with an optional caching module proxy and reverse proxy.
+//
+// The server can be run in-process, for example in a test harness, or
+// wrapped by a command-line tool.
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/taskgroup"
+	"github.com/goproxy/goproxy"
+	"github.com/tailscale/go-cache-plugin/lib/eventlog"
+	"github.com/tailscale/go-cache-plugin/lib/gcsutil"
+	"github.com/tailscale/go-cache-plugin/lib/modproxy"
+	"github.com/tailscale/go-cache-plugin/lib/retrybudget"
+	"github.com/tailscale/go-cache-plugin/lib/revproxy"
+	"github.com/tailscale/go-cache-plugin/lib/s3util"
+	"golang.org/x/sync/semaphore"
+)
+
+// Config is the configuration of a cache server.
+type Config struct {
+	// CacheDir is the path of the local cache directory. It must be non-empty.
+	CacheDir string
+
+	// CacheDirLarge, if non-empty, is the path of a second local directory in
+	// which build cache objects larger than LargeThreshold bytes are staged
+	// instead of CacheDir, so that CacheDir can be a small tmpfs. It requires
+	// a positive LargeThreshold. The module and reverse proxy caches always
+	// use CacheDir.
+	CacheDirLarge  string
+	LargeThreshold int64
+
+	// ResetCache, if true, empties the local cache directories at startup if
+	// their layout version differs from LayoutVersion and they cannot be
+	// migrated. Otherwise, New reports an error in that case.
+	ResetCache bool
+
+	// LocalFS is the kind of filesystem holding the local cache directories:
+	// LocalFSLocal (the default, if empty) for a filesystem used only by this
+	// host, or LocalFSNFS for one shared with other hosts over NFS. See
+	// [LocalFSNFS] for what changes, and which guarantees hold, in that case.
+	LocalFS string
+
+	// S3 configuration. Exactly one of S3Bucket or GCSBucket must be set.
+	S3Bucket      string // S3 bucket name
+	S3Region      string // S3 region; if empty, it is resolved from the bucket
+	S3Endpoint    string // S3 custom endpoint URL; if empty, use the AWS default
+	S3PathStyle   bool   // use S3 path-style URLs
+	S3Profile     string // AWS shared config profile; if empty, use the default
+	S3Concurrency int    // maximum concurrency for upload to S3
+
+	// S3ReadEndpoint and S3WriteEndpoint, if set, override S3Endpoint for
+	// requests to S3Bucket that read the contents of objects, and for all
+	// other requests, respectively. This allows reads to be served from a
+	// replica or an accelerated endpoint while writes go to the origin. The
+	// mirror bucket is only written, so it uses the write endpoint.
+	S3ReadEndpoint  string
+	S3WriteEndpoint string
+
+	// S3RequesterPays, if true, accepts the request charges for S3 buckets
+	// configured as requester-pays, including the mirror.
+	S3RequesterPays bool
+
+	// GCS configuration. Exactly one of S3Bucket or GCSBucket must be set.
+	GCSBucket      string        // GCS bucket name
+	GCSKeyFile     string        // path to a GCS service account key file (optional)
+	GCSEndpoint    string        // custom GCS API endpoint URL (optional)
+	GCSConcurrency int           // maximum concurrency for upload to GCS
+	GCSActionBatch time.Duration // if positive, batch action records at this interval
+
+	// Common storage configuration.
+	KeyPrefix           string        // key prefix for storage objects (optional)
+	PartitionDepth      int           // hex digits used to partition storage keys (0 for default)
+	MirrorBucket        string        // secondary bucket to replicate writes to (optional)
+	MirrorConcurrency   int           // maximum concurrency for writes to the mirror
+	MinUploadSize       int64         // minimum object size to upload to storage
+	MaxUploadSize       int64         // maximum object size to upload to storage (0 for no limit)
+	RevalidateOutputs   bool          // revalidate local copies of build outputs read from storage (GCS only)
+	DownloadConcurrency int           // maximum concurrency for fault-in reads from storage
+	GetTimeout          time.Duration // if positive, report reads from storage taking longer as misses
+	UploadPacing        time.Duration // if positive, spread bursts of uploads over this window
+	RemoteFirst         bool          // check storage before the local cache (see gobuild.GCSCache)
+	MaxClockSkew        time.Duration // maximum skew allowed for action timestamps (0 for no limit)
+	RemoteTTL           time.Duration // if positive, treat action records older than this as misses
+	ObjectRetention     time.Duration // if positive, retain build outputs in storage this long (see gobuild.GCSCache)
+	Concurrency         int           // maximum number of concurrent build cache requests
+	Expiration          time.Duration // local cache expiration period (optional)
+	CleanupInterval     time.Duration // interval between periodic local cleanups (requires Expiration)
+
+	// BreakerThreshold, if positive, enables a circuit breaker for the build
+	// cache: after this many consecutive storage failures within
+	// BreakerWindow, the cache serves from the local directory only for
+	// BreakerCooldown before it tries storage again (see gobuild.Breaker).
+	BreakerThreshold int
+	BreakerWindow    time.Duration
+	BreakerCooldown  time.Duration
+
+	// StrictWrites, if positive, is the number of consecutive background
+	// uploads of build cache entries that may fail before the build cache
+	// reports errors to the toolchain (see gobuild.GCSCache). If zero, failed
+	// uploads are logged but do not affect the build.
+	StrictWrites int
+
+	// SyncUploads, if true, makes writes to the build cache and the module
+	// proxy wait for their uploads to storage to finish, instead of uploading
+	// in the background (see gobuild.GCSCache and modproxy.StorageCacher).
+	SyncUploads bool
+
+	// InlineThreshold, if positive, is the size in bytes below which a build
+	// output is stored inside its action record in storage, rather than
+	// as a separate object, so that reading or writing it takes one request
+	// instead of two (see gobuild.GCSCache).
+	InlineThreshold int64
+
+	// CompressActions, if true, compresses action records, and the .info and
+	// .mod files of the module proxy, with gzip before they are written to
+	// storage, leaving outputs and module zips as they are (see
+	// gobuild.GCSCache and modproxy.StorageCacher).
+	CompressActions bool
+
+	// VerifyUploads, if true, makes the build cache read back the metadata of
+	// each output it uploads to GCS of at least VerifyMinSize bytes, and
+	// upload it again if the stored size does not match (see
+	// gobuild.GCSCache). It has no effect with S3.
+	VerifyUploads bool
+	VerifyMinSize int64
+
+	// VerifyDownloads, if true, makes the build cache check each output it
+	// reads from GCS against the CRC32C recorded by GCS, and treat a mismatch
+	// as a miss (see gobuild.GCSCache). It has no effect with S3.
+	VerifyDownloads bool
+
+	// NegCacheTTL, if positive, enables an in-memory cache of build actions
+	// recently found missing from storage, so that a repeated lookup within
+	// NegCacheTTL reports a miss without a request to storage. It holds at
+	// most NegCacheSize actions, or gobuild.DefaultNegCacheSize if that is
+	// zero (see gobuild.GCSCache).
+	NegCacheTTL  time.Duration
+	NegCacheSize int
+
+	// AdmissionPolicy selects which build outputs are uploaded to storage:
+	// AdmitAll (the default, if empty) uploads all of them, and AdmitTinyLFU
+	// uploads an output only the second time it is written within about the
+	// last AdmissionWindow writes, or gobuild.DefaultAdmissionWindow if that
+	// is zero (see gobuild.GCSCache). Outputs not uploaded are kept locally.
+	AdmissionPolicy string
+	AdmissionWindow int
+
+	// PinVersions, if true, records the version of each build output in the
+	// action records written to storage, and reads outputs at the recorded
+	// version, so that readers do not see outputs being replaced by other
+	// writers (see gobuild.GCSCache).
+	PinVersions bool
+
+	// MonotonicActions, if true, makes the build cache replace an action
+	// record in GCS only with a record of a later timestamp, so that racing
+	// writers of a nondeterministic action do not regress it to an older
+	// output (see gobuild.GCSCache). It has no effect with S3.
+	MonotonicActions bool
+
+	// SkipSameActions, if true, makes the build cache skip writing an
+	// action record to GCS when the record already there refers to the same
+	// output, unless it is old enough to need refreshing (see
+	// gobuild.GCSCache). It has no effect with S3.
+	SkipSameActions bool
+
+	// ActionManifest, if true, records each build action written to storage,
+	// with the output it produced, in an append-only log named by
+	// ActionManifestFile in CacheDir (see gobuild.Manifest). The log is not
+	// pruned, and is kept if the cache is reset.
+	ActionManifest bool
+
+	// EventLog, if non-empty, is the path of a file to which a structured
+	// event is appended for each lookup and write of the build cache and the
+	// module proxy, as a line of JSON (see eventlog.Event). Events are
+	// written in the background, and dropped rather than slowing requests if
+	// the writer falls behind.
+	EventLog string
+
+	// Bandwidth limits for transfers to and from storage, in bytes per second,
+	// shared by all components of the server. If zero, transfers are not
+	// limited. In either case, throughput is reported in the server metrics.
+	MaxUploadBPS   int64
+	MaxDownloadBPS int64
+
+	// MaxRetryRate, if positive, caps the rate of retries of failed requests
+	// to storage and the upstream module proxy, in retries per second, shared
+	// by all components of the server. A request that fails while the budget
+	// is spent fails at once instead of retrying. If zero, retries are not
+	// limited. See [retrybudget.Budget].
+	MaxRetryRate float64
+
+	// UploadBufferSize is the size in bytes of the buffer allocated for each
+	// upload to GCS in flight, which bounds the memory uploads use to this
+	// times the upload concurrency. Smaller buffers mean more requests per
+	// large object, and so lower throughput. If zero, DefaultUploadBufferSize
+	// is used. S3 uploads stream from the staged file and are not buffered.
+	UploadBufferSize int
+
+	// MaxOpenFiles, if positive, limits the number of files in CacheDir that
+	// the build cache and module proxy hold open at once, in total. Operations
+	// beyond the limit wait for others to finish. If zero, there is no limit.
+	MaxOpenFiles int
+
+	// PrewarmRecent, if positive, is the number of recently written actions
+	// whose outputs New stages into the local cache before returning. This
+	// makes startup slower, but the first build faster.
+	PrewarmRecent int
+
+	// ResumeDownloads, if true, keeps the partial contents of interrupted reads
+	// from storage, and resumes them with range reads on the next request for
+	// the same object. Partial files for the build cache are kept in the
+	// "partial" subdirectory of CacheDir, and are removed by the periodic
+	// cleanup when they expire.
+	ResumeDownloads bool
+
+	// ObjectTags, if non-empty, are attached to each object written to
+	// storage, as object metadata in GCS or object tags in S3. Build cache
+	// objects are also tagged with their kind (see
+	// [github.com/tailscale/go-cache-plugin/lib/gobuild.KindTag]).
+	ObjectTags map[string]string
+
+	// ObjectACL, if non-empty, is the predefined ACL applied to each object
+	// written to storage, for example "public-read" for a bucket that serves
+	// as a public mirror. Names may be given in either the S3 form
+	// ("public-read") or the GCS form ("publicRead"). Only objects written
+	// after it is set are affected. If empty, objects get the default ACL of
+	// the bucket.
+	ObjectACL string
+
+	// HTTP connection pool settings for storage clients. If zero, the limits
+	// are scaled with the configured concurrency, and the timeout is the
+	// standard library default.
+	MaxIdleConns        int           // maximum idle connections overall
+	MaxIdleConnsPerHost int           // maximum idle connections per host
+	IdleConnTimeout     time.Duration // how long to keep idle connections
+
+	// Namespace, if non-empty, isolates the build cache and module proxy
+	// entries of one user of a shared bucket (typically a repository) from
+	// the others. It is appended to KeyPrefix, under "ns/", for build cache
+	// and module proxy keys, and reported in the metrics. Maintenance tools
+	// given the same namespace operate only on its entries.
+	//
+	// Clients in different namespaces do not read each other's entries, so
+	// results that could have been shared, such as builds of common
+	// dependencies, are stored once per namespace. The reverse proxy is not
+	// affected, and remains shared.
+	//
+	// A namespace is a slash-separated path such as "org/repo", and must not
+	// contain empty, "." or ".." elements.
+	Namespace string
+
+	// CacheSalt, if non-empty, starts a separate generation of build cache
+	// and module proxy entries. A digest of it is appended to the key prefix
+	// for those entries, after any namespace, so that changing it makes every
+	// lookup miss until the new generation is filled. Entries stored under
+	// another salt are not read, but remain in storage, so restoring the old
+	// salt goes back to them. Local cache entries stored under another salt
+	// are discarded at startup. The reverse proxy is not affected.
+	//
+	// This sets aside entries that may be wrong, for example after changing
+	// build flags that the Go cache keys do not account for, or after the
+	// cache was poisoned, without a new bucket.
+	CacheSalt string
+
+	// GoVersion, if non-empty, identifies the Go toolchain using the cache, and
+	// is appended to KeyPrefix for build cache keys. Toolchains with different
+	// versions then use separate namespaces in storage, and do not read each
+	// other's entries. Module proxy and reverse proxy keys are not affected,
+	// since their contents do not depend on the toolchain.
+	GoVersion string
+
+	// Disabled, if true, makes the build cache report a miss for every lookup
+	// and never store results in storage, for measuring build times without
+	// a cache. Results are still written to CacheDir, since the toolchain needs
+	// a local path for each output, but are never read back. The HTTP service
+	// and proxies are not affected.
+	Disabled bool
+
+	// RequireProtocol, if non-empty, is the build cache protocol version
+	// (ProtocolV1 or ProtocolV2) a client toolchain must use. A connection from
+	// a client found to use a different version, or to send a command the
+	// server does not support, is closed with an error. If empty, any version
+	// is accepted, and unsupported commands are logged.
+	RequireProtocol string
+
+	// VerifyBackend, if true, makes New check that the storage bucket (and the
+	// mirror, if any) exists and is accessible, and fail if not.
+	VerifyBackend bool
+
+	// HTTPAddr, if non-empty, is the address ([host]:port) of an HTTP service
+	// exporting /debug endpoints and the proxies enabled below. It is required
+	// if either proxy is enabled.
+	HTTPAddr string
+
+	// ModProxyAddr and RevProxyAddr, if non-empty, are addresses ([host]:port)
+	// at which the module proxy and the reverse proxy, respectively, are
+	// served instead of HTTPAddr, without the /debug endpoints. This keeps
+	// the proxies, which may be reachable by other hosts, apart from the
+	// administrative endpoints. If both have the same address, the proxies
+	// share a listener. Each requires its proxy to be enabled.
+	ModProxyAddr string
+	RevProxyAddr string
+
+	ModProxy   bool          // enable a Go module proxy at /mod/
+	SumDB      []string      // sum DB servers to proxy for (default sum.golang.org)
+	RevProxy   []string      // hosts to reverse proxy for (optional)
+	Revalidate time.Duration // revalidate local proxy cache entries after this age
+
+	// ModProxyMutableTTL, if positive, is the longest the module proxy serves
+	// a cached answer to a query that changes over time, such as "@latest" or
+	// "@v/list", before fetching it again. Such answers are not written to
+	// storage. If zero, they are cached indefinitely, like the files of
+	// specific module versions. See [modproxy.StorageCacher].
+	ModProxyMutableTTL time.Duration
+
+	// ModProxyReadableKeys, if true, stores module proxy objects under keys
+	// formed from the module path and version rather than a digest, so they
+	// can be inspected or purged by name. See [modproxy.StorageCacher].
+	ModProxyReadableKeys bool
+
+	// ModProxyRetries, if positive, is the number of times the module proxy
+	// retries a request to the upstream proxy or sum database that fails with
+	// a transient error, waiting ModProxyRetryBackoff (doubled each time)
+	// between attempts. See [modproxy.RetryTransport].
+	ModProxyRetries      int
+	ModProxyRetryBackoff time.Duration
+
+	// ModCacher, if non-nil, is the cacher used by the module proxy in place
+	// of the default [modproxy.StorageCacher], for example one that adds
+	// tiering or negative caching. The settings above that configure the
+	// default cacher are then ignored.
+	//
+	// If ModCacher has any of the methods
+	//
+	//	Close() error
+	//	Pending() int
+	//	Metrics() *expvar.Map
+	//	Handler(http.Handler) http.Handler
+	//
+	// they are used as the corresponding methods of [modproxy.StorageCacher]
+	// are by default: to clean up on shutdown, to report pending writes, to
+	// publish metrics under "modcache", and to wrap the proxy handler.
+	ModCacher goproxy.Cacher
+
+	// RevProxyGroups are additional groups of reverse proxy targets, each
+	// cached separately from the RevProxy targets and from other groups.
+	// A request is handled by the group whose targets include its host.
+	// A host may appear only once across RevProxy and all groups.
+	RevProxyGroups []RevProxyGroup
+
+	// RevProxyAllowBypass, if true, lets reverse proxy clients force a fetch
+	// from the origin that skips cached copies, by setting the request header
+	// "X-Cache-Bypass: 1" or "Cache-Control: no-cache".
+	RevProxyAllowBypass bool
+
+	// Settings for reverse proxy connections to its targets. If zero, the
+	// defaults of [http.DefaultTransport] are used. See the corresponding
+	// fields of [revproxy.Server].
+	RevProxyMaxConnsPerHost int           // maximum connections per target
+	RevProxyIdleConnTimeout time.Duration // how long to keep idle connections
+	RevProxyHeaderTimeout   time.Duration // maximum wait for response headers
+	RevProxyOriginTimeout   time.Duration // maximum time for a forwarded request
+	RevProxyDisableHTTP2    bool          // use only HTTP/1.1 to the targets
+
+	// RevProxyAuth, if non-nil, maps reverse proxy targets to a header sent
+	// with each request forwarded to that target, for example an API key.
+	// Each host must be a target in RevProxy or RevProxyGroups. See
+	// [revproxy.Server].
+	RevProxyAuth map[string]revproxy.AuthHeader
+
+	// RevProxySignAWS, if non-nil, maps reverse proxy targets to an AWS
+	// region, and each request forwarded to such a target is signed with AWS
+	// Signature Version 4 for S3 in that region, using the AWS credentials of
+	// the server (see S3Profile). This lets the proxy fetch from a private
+	// bucket served over HTTP. An empty region means the default region of
+	// the AWS configuration. Each host must be a target in RevProxy or
+	// RevProxyGroups, and must not also have an auth header in RevProxyAuth.
+	RevProxySignAWS map[string]string
+
+	// RevProxyNoTrustInstall, if true, prevents the reverse proxy from adding
+	// its signing certificate to the system trust store. The certificate is
+	// written to RevProxyCAFile instead, for the operator to distribute.
+	RevProxyNoTrustInstall bool
+
+	// RevProxyCAFile, if non-empty, is the path of a file where the reverse
+	// proxy writes its signing certificate, in PEM format. If empty and
+	// RevProxyNoTrustInstall is set, the certificate is written to
+	// "revproxy-ca.crt" in CacheDir.
+	RevProxyCAFile string
+
+	// RevProxyCAKeyFile, if non-empty, makes the signing certificate of the
+	// reverse proxy persistent: the certificate is read from RevProxyCAFile
+	// (by default "revproxy-ca.crt" in CacheDir) and its private key from
+	// this file, both in PEM format. If neither file exists, a new
+	// certificate is generated and saved to them, with the key file readable
+	// only by its owner. This keeps the certificate clients trust the same
+	// across restarts; the server certificates issued from it are still
+	// generated at each start.
+	RevProxyCAKeyFile string
+
+	// RevProxyTLSMinVersion is the minimum TLS version, "1.0" through "1.3",
+	// that the reverse proxy accepts from clients whose HTTPS connections it
+	// terminates. If empty, it uses DefaultTLSMinVersion.
+	RevProxyTLSMinVersion string
+
+	// RevProxyTLSCipherSuites, if non-empty, are the names of the cipher
+	// suites the reverse proxy accepts from clients for TLS 1.2 and earlier,
+	// as reported by tls.CipherSuiteName. Only suites without known security
+	// problems are allowed. The suites of TLS 1.3 are not configurable. If
+	// empty, the defaults of crypto/tls are used.
+	RevProxyTLSCipherSuites []string
+
+	// AdminToken, if non-empty, is the bearer token required by administrative
+	// HTTP endpoints. Requests to those endpoints must include the header
+	// "Authorization: Bearer <token>".
+	AdminToken string
+
+	// BrowseCache, if true, serves the contents of CacheDir read-only at
+	// /cache/, for inspecting staged files. It requires AdminToken.
+	BrowseCache bool
+
+	// ProxyAuthFile, if non-empty, is the path of a file listing the users
+	// and bearer tokens allowed to use the module and reverse proxies (see
+	// proxyAuth for the format). Requests without valid credentials are
+	// rejected. If empty, the proxies are open to any client that can reach
+	// them. The build cache is not affected.
+	ProxyAuthFile string
+
+	// DebugAuth, if true, makes the /debug endpoints require AdminToken, as
+	// the other administrative endpoints do. It is independent of
+	// ProxyAuthFile.
+	DebugAuth bool
+
+	// Logf, if non-nil, is used to write log messages. If nil, logs are
+	// discarded.
+	Logf func(string, ...any)
+
+	// Verbose, if true, enables verbose logging to Logf.
+	Verbose bool
+
+	// LogMissSample, if positive, logs every LogMissSample-th cache miss in
+	// the build cache and module proxy to Logf, regardless of Verbose.
+	LogMissSample int
+
+	// DebugLog is a bit mask of Debug* values enabling detailed (noisy)
+	// per-request debug logging for the corresponding components.
+	DebugLog int
+}
+
+// BuildKeyPrefix returns the key prefix for build cache objects in storage,
+// taking into account c.Namespace and c.GoVersion.
+func (c *Config) BuildKeyPrefix() string {
+	if c.GoVersion == "" {
+		return c.namespacePrefix()
+	}
+	// A development version has the form "devel go1.N-hash date...". Keep
+	// only the first two fields to avoid unwieldy keys.
+	fs := strings.Fields(c.GoVersion)
+	return path.Join(c.namespacePrefix(), strings.Join(fs[:min(len(fs), 2)], "-"))
+}
+
+// namespacePrefix returns the key prefix for objects in c.Namespace, under
+// the generation of c.CacheSalt, or c.KeyPrefix if neither is set.
+func (c *Config) namespacePrefix() string {
+	prefix := c.KeyPrefix
+	if c.Namespace != "" {
+		prefix = path.Join(prefix, "ns", c.Namespace)
+	}
+	if salt := c.saltDigest(); salt != "" {
+		prefix = path.Join(prefix, "salt", salt)
+	}
+	return prefix
+}
+
+// A RevProxyGroup is a group of reverse proxy targets whose responses are
+// cached apart from those of other targets. The group has its own local cache
+// directory, storage keys, and metrics, so it can be inspected, tuned, or
+// purged without affecting the rest.
+type RevProxyGroup struct {
+	// Name identifies the group. It must be a single path component of
+	// letters, digits, ".", "-", and "_". Responses are cached under
+	// "revproxy/group/<Name>" in CacheDir, and under the same path below
+	// KeyPrefix in storage. Metrics are published as "revcache_<Name>".
+	Name string
+
+	// Targets are the hosts in the group.
+	Targets []string
+
+	// Revalidate, if non-zero, replaces Config.Revalidate for the group.
+	// If negative, entries in the group are not revalidated.
+	Revalidate time.Duration
+
+	// Rules, if non-empty, override the caching policy of the targets for
+	// the requests they match. See [revproxy.CacheRule].
+	Rules []revproxy.CacheRule
+}
+
+// GoDownloadsGroup returns a preset reverse proxy group for downloads of the
+// Go toolchain from go.dev/dl. The release archives and their checksums on
+// dl.google.com are named by version and never change, so they are cached
+// as immutable whatever the server says. The release index served by
+// go.dev/dl (for example, "?mode=json") changes with each release, so it is
+// cached only in memory, for a few minutes. Other requests to these hosts,
+// including the redirects from go.dev/dl to dl.google.com, are cached as
+// their responses direct.
+//
+// Responses are stored as they were received, so the archives served from
+// the cache match their published checksums.
+func GoDownloadsGroup() RevProxyGroup {
+	return RevProxyGroup{
+		Name:    "godl",
+		Targets: []string{"go.dev", "dl.google.com"},
+		Rules: []revproxy.CacheRule{
+			{Host: "dl.google.com", Path: "/go/*", Immutable: true},
+			{Host: "go.dev", Path: "/dl/", MaxAge: 5 * time.Minute},
+		},
+	}
+}
+
+// revProxyTargets returns all the reverse proxy targets of c, from RevProxy
+// and each of RevProxyGroups.
+func (c *Config) revProxyTargets() []string {
+	out := slices.Clone(c.RevProxy)
+	for _, g := range c.RevProxyGroups {
+		out = append(out, g.Targets...)
+	}
+	return out
+}
+
+// checkRevProxyGroups reports an error if c.RevProxyGroups are not valid, or
+// if any target host is listed more than once.
+func (c *Config) checkRevProxyGroups() error {
+	names := make(map[string]bool)
+	for _, g := range c.RevProxyGroups {
+		if !validGroupName(g.Name) {
+			return fmt.Errorf("invalid reverse proxy group name %q", g.Name)
+		} else if names[g.Name] {
+			return fmt.Errorf("duplicate reverse proxy group %q", g.Name)
+		} else if len(g.Targets) == 0 {
+			return fmt.Errorf("reverse proxy group %q has no targets", g.Name)
+		}
+		names[g.Name] = true
+	}
+	seen := make(map[string]bool)
+	for _, host := range c.revProxyTargets() {
+		if seen[host] {
+			return fmt.Errorf("reverse proxy target %q is listed more than once", host)
+		}
+		seen[host] = true
+	}
+	return nil
+}
+
+// validGroupName reports whether name is a valid reverse proxy group name.
+func validGroupName(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune(".-_", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkNamespace reports an error if c.Namespace is not valid.
+func (c *Config) checkNamespace() error {
+	if c.Namespace != "" && (!fs.ValidPath(c.Namespace) || c.Namespace == ".") {
+		return fmt.Errorf("invalid cache namespace %q", c.Namespace)
+	}
+	return nil
+}
+
+// ActionManifestFile is the name of the action manifest in the local cache
+// directory, if Config.ActionManifest is enabled.
+const ActionManifestFile = "action-manifest.jsonl"
+
+// minUploadSizeWarning is the MinUploadSize above which the server warns that
+// the setting is probably a mistake. Few build outputs are this large, so with
+// a larger minimum almost nothing is uploaded to storage.
+const minUploadSizeWarning = 1 << 30
+
+// s3WriteEndpoint returns the S3 endpoint URL for requests other than reads
+// of object contents, or "" for the AWS default.
+func (c *Config) s3WriteEndpoint() string { return cmp.Or(c.S3WriteEndpoint, c.S3Endpoint) }
+
+// s3ReadEndpoint returns the S3 endpoint URL for reads of object contents, or
+// "" for the AWS default.
+func (c *Config) s3ReadEndpoint() string { return cmp.Or(c.S3ReadEndpoint, c.s3WriteEndpoint()) }
+
+// checkCacheLimits reports an error if the size and age limits for the build
+// cache in c are invalid.
+func (c *Config) checkCacheLimits() error {
+	if c.MinUploadSize < 0 {
+		return fmt.Errorf("minimum upload size must not be negative (got %d)", c.MinUploadSize)
+	} else if c.MaxUploadSize < 0 {
+		return fmt.Errorf("maximum upload size must not be negative (got %d)", c.MaxUploadSize)
+	} else if c.MaxUploadSize > 0 && c.MaxUploadSize < c.MinUploadSize {
+		return fmt.Errorf("maximum upload size %d is less than the minimum %d, so nothing would be uploaded",
+			c.MaxUploadSize, c.MinUploadSize)
+	} else if c.Expiration < 0 {
+		return fmt.Errorf("expiration period must not be negative (got %v)", c.Expiration)
+	}
+	return nil
+}
+
+// DefaultUploadBufferSize is the size of the buffer for each GCS upload if
+// Config.UploadBufferSize is zero. It is half the library default, which
+// costs little throughput on typical links.
+const DefaultUploadBufferSize = 8 << 20
+
+// Bits for Config.DebugLog.
+const (
+	DebugBuildCache = 1 << iota // Go build cache
+	DebugModProxy               // Go module proxy and sum database
+	DebugRevProxy               // HTTP reverse proxy
+)
+
+// Server is a cache server constructed by [New].
+type Server struct {
+	config Config
+
+	cache      *gocache.Server
+	closeCache func(context.Context) error
+	storage    revproxy.CacheClient
+	handler    http.Handler            // nil if HTTP is not enabled
+	services   []httpService           // HTTP services, starting with handler
+	closeMod   func()                  // clean up the module proxy
+	modCacher  *modproxy.StorageCacher // the module cacher, if it is the default
+	stopProxy  func()                  // stop the reverse proxy
+	pending    []func() int            // report background writes in progress
+	prefetch   prefetcher              // the build cache, if it can prefetch
+	upload     *byteLimiter            // limits transfers to storage
+	download   *byteLimiter            // limits transfers from storage
+	retries    *retrybudget.Budget     // limits retries; nil if unlimited
+	events     *eventlog.Log           // records cache events; nil if disabled
+	openFiles  *semaphore.Weighted     // limits open local files; nil if unlimited
+	protocol   protocolMetrics         // counts build cache protocol problems
+	proxyAuth  *proxyAuth              // checks proxy credentials; nil if open
+	tasks      taskgroup.Group
+	metrics    *expvar.Map
+}
+
+// New constructs a new cache server with the given configuration.
+// The context governs the initialization of storage clients.
+// The caller must call [Server.Shutdown] when the server is no longer needed.
+func New(ctx context.Context, config Config) (*Server, error) {
+	s := &Server{
+		config:    config,
+		closeMod:  func() {},
+		stopProxy: func() {},
+		metrics:   new(expvar.Map),
+		upload:    newByteLimiter(config.MaxUploadBPS),
+		download:  newByteLimiter(config.MaxDownloadBPS),
+		retries:   retrybudget.New(config.MaxRetryRate),
+	}
+	ioMetrics := new(expvar.Map)
+	s.upload.setMetrics(ioMetrics, "upload")
+	s.download.setMetrics(ioMetrics, "download")
+	s.metrics.Set("storage_io", ioMetrics)
+	if s.retries != nil {
+		s.metrics.Set("retry_budget", s.retries.Metrics())
+	}
+	if config.MaxOpenFiles > 0 {
+		s.openFiles = semaphore.NewWeighted(int64(config.MaxOpenFiles))
+	}
+	if config.HTTPAddr == "" {
+		if config.ModProxy {
+			return nil, errors.New("the module proxy requires an HTTP address")
+		} else if len(config.revProxyTargets()) != 0 {
+			return nil, errors.New("the reverse proxy requires an HTTP address")
+		} else if config.BrowseCache {
+			return nil, errors.New("browsing the cache requires an HTTP address")
+		}
+	}
+	if err := config.checkRevProxyGroups(); err != nil {
+		return nil, err
+	}
+	targets := config.revProxyTargets()
+	for host := range config.RevProxyAuth {
+		if !slices.Contains(targets, host) {
+			return nil, fmt.Errorf("reverse proxy auth header for %q, which is not a target", host)
+		}
+	}
+	for host := range config.RevProxySignAWS {
+		if !slices.Contains(targets, host) {
+			return nil, fmt.Errorf("reverse proxy signing for %q, which is not a target", host)
+		} else if _, ok := config.RevProxyAuth[host]; ok {
+			return nil, fmt.Errorf("reverse proxy target %q has both an auth header and signing", host)
+		}
+	}
+	if config.ModProxyAddr != "" && !config.ModProxy {
+		return nil, errors.New("a module proxy address requires the module proxy")
+	} else if config.RevProxyAddr != "" && len(targets) == 0 {
+		return nil, errors.New("a reverse proxy address requires reverse proxy targets")
+	}
+	if config.BrowseCache && config.AdminToken == "" {
+		return nil, errors.New("browsing the cache requires an admin token")
+	} else if config.DebugAuth && config.AdminToken == "" {
+		return nil, errors.New("debug endpoint auth requires an admin token")
+	}
+	if config.ProxyAuthFile != "" {
+		pa, err := loadProxyAuth(config.ProxyAuthFile)
+		if err != nil {
+			return nil, err
+		}
+		s.proxyAuth = pa
+		s.metrics.Set("proxy_auth", pa.metrics())
+	}
+	if err := config.checkNamespace(); err != nil {
+		return nil, err
+	}
+	if config.Namespace != "" {
+		ns := new(expvar.String)
+		ns.Set(config.Namespace)
+		s.metrics.Set("namespace", ns)
+	}
+	if salt := config.saltDigest(); salt != "" {
+		sv := new(expvar.String)
+		sv.Set(salt)
+		s.metrics.Set("cache_salt", sv)
+	}
+	if err := config.checkLocalFS(); err != nil {
+		return nil, err
+	}
+	switch config.RequireProtocol {
+	case "", ProtocolV1, ProtocolV2:
+	default:
+		return nil, fmt.Errorf("unknown protocol version %q", config.RequireProtocol)
+	}
+	protoMetrics := new(expvar.Map)
+	s.protocol.setMetrics(protoMetrics)
+	s.metrics.Set("protocol", protoMetrics)
+	if config.EventLog != "" {
+		events, err := eventlog.Open(config.EventLog, 0)
+		if err != nil {
+			return nil, fmt.Errorf("open event log: %w", err)
+		}
+		s.events = events
+		s.metrics.Set("event_log", events.Metrics())
+	}
+	if err := s.initCacheServer(ctx); err != nil {
+		s.events.Close()
+		return nil, err
+	}
+	if config.HTTPAddr == "" {
+		return s, nil
+	}
+
+	// If a module proxy is enabled, start it.
+	modProxy, err := s.initModProxy()
+	if err != nil {
+		s.closeCache(ctx)
+		return nil, fmt.Errorf("module proxy: %w", err)
+	}
+
+	// If a reverse proxy is enabled, start it.
+	revProxy, err := s.initRevProxy(ctx)
+	if err != nil {
+		s.closeMod()
+		s.closeCache(ctx)
+		return nil, fmt.Errorf("reverse proxy: %w", err)
+	}
+	var browse http.Handler
+	if config.BrowseCache {
+		browse = requireToken(config.AdminToken, http.StripPrefix("/cache/", newCacheBrowser(config.CacheDir)))
+	}
+	var prefetch http.Handler
+	if s.prefetch != nil {
+		prefetch = newPrefetchHandler(s.prefetch)
+	}
+	var pin http.Handler
+	if lc, ok := s.storage.(revproxy.ListClient); ok && config.AdminToken != "" {
+		pin = requireToken(config.AdminToken, newPinHandler(&s.config, lc))
+	}
+	s.initHTTP(modProxy, revProxy, browse, newKeysHandler(&s.config, s.modCacher), prefetch, pin)
+	return s, nil
+}
+
+// NewStorageClient returns a client for the storage bucket described by
+// config, for use by maintenance tools that operate on the bucket directly.
+// Only the storage settings of config are used. The caller must close the
+// client when it is no longer needed.
+func NewStorageClient(ctx context.Context, config Config) (revproxy.ListClient, error) {
+	if err := config.checkNamespace(); err != nil {
+		return nil, err
+	}
+	s := &Server{config: config}
+	switch {
+	case config.S3Bucket != "" && config.GCSBucket != "":
+		return nil, errors.New("you must provide only one bucket (GCS or S3)")
+	case config.GCSBucket != "":
+		client, err := s.initGCSClient(ctx, config.GCSBucket)
+		if err != nil {
+			return nil, fmt.Errorf("initialize GCS client: %w", err)
+		}
+		if err := s.verify(ctx, client); err != nil {
+			client.Close()
+			return nil, err
+		}
+		return gcsutil.NewGCSAdapter(client), nil
+	case config.S3Bucket != "":
+		client, err := s.initS3Client(ctx, config.S3Bucket, config.S3Region, config.s3ReadEndpoint(), config.s3WriteEndpoint(), config.S3PathStyle)
+		if err != nil {
+			return nil, fmt.Errorf("initialize S3 client: %w", err)
+		}
+		if err := s.verify(ctx, client); err != nil {
+			return nil, err
+		}
+		return s3util.NewS3Adapter(client), nil
+	default:
+		return nil, errors.New("invalid storage: no bucket provided")
+	}
+}
+
+// ServeConn serves the build cache protocol to a single client, reading
+// requests from r and writing responses to w, until the client closes the
+// session or ctx ends.
+func (s *Server) ServeConn(ctx context.Context, r io.Reader, w io.Writer) error {
+	return s.runCache(ctx, r, w)
+}
+
+// runCache runs the build cache protocol over r and w, inspecting the requests
+// to report the protocol version of the client.
+func (s *Server) runCache(ctx context.Context, r io.Reader, w io.Writer) error {
+	s.vlogf("serving build cache commands %v (require protocol %q)", knownCommands, s.config.RequireProtocol)
+	return s.cache.Run(ctx, &protocolReader{
+		r:       r,
+		require: s.config.RequireProtocol,
+		logf:    s.logf,
+		metrics: &s.protocol,
+	}, w)
+}
+
+// Serve accepts build cache client connections on lst and serves each
+// concurrently until ctx ends or lst is closed. If an HTTP address is
+// configured, Serve also runs the HTTP services, including proxies with
+// addresses of their own, for the same duration.
+// Serve closes lst and waits for active clients to finish before returning.
+func (s *Server) Serve(ctx context.Context, lst net.Listener) error {
+	var g taskgroup.Group
+	g.Run(func() {
+		<-ctx.Done()
+		s.logf("closing plugin listener")
+		lst.Close()
+	})
+
+	// If an HTTP server is enabled, start it up with debug routes
+	// and whatever other services were requested, and any proxies served
+	// separately.
+	for _, svc := range s.services {
+		srv := &http.Server{
+			Addr:    svc.addr,
+			Handler: svc.handler,
+		}
+		g.Go(srv.ListenAndServe)
+		s.vlogf("%s server listening at %q", svc.name, svc.addr)
+		g.Run(func() {
+			<-ctx.Done()
+			s.vlogf("stopping %s service", svc.name)
+			srv.Shutdown(context.Background())
+		})
+	}
+
+	for {
+		conn, err := lst.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logf("accept failed: %v, exiting server loop", err)
+			}
+			break
+		}
+		s.logf("new client connection")
+		g.Go(func() error {
+			defer func() {
+				s.logf("client connection closed")
+				conn.Close()
+			}()
+			return s.runCache(ctx, conn, conn)
+		})
+	}
+	s.logf("server loop exited, waiting for client exit")
+	g.Wait()
+	return nil
+}
+
+// Handler returns an HTTP handler for the debug endpoints and any proxies
+// enabled by the configuration, or nil if HTTP is not enabled.
+// The handler is the same one used by [Server.Serve] at the HTTP address.
+// It does not include proxies configured with addresses of their own.
+func (s *Server) Handler() http.Handler { return s.handler }
+
+// Shutdown stops the background services of s and waits for pending writes
+// to storage to complete. Progress is logged to the logger attached to ctx, if
+// any (see [gocache.WithLogf]).
+//
+// If ctx ends before the pending writes are complete, Shutdown logs the number
+// of writes abandoned and returns without waiting further. After Shutdown, s
+// must not be used.
+func (s *Server) Shutdown(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		err := s.closeCache(ctx)
+		s.stopProxy()
+		s.tasks.Wait()
+		s.closeMod()
+		done <- errors.Join(err, s.events.Close())
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		var n int
+		for _, pending := range s.pending {
+			n += pending()
+		}
+		s.logf("WARNING: shutdown interrupted, abandoning %d pending writes to storage", n)
+		return fmt.Errorf("drain pending writes: %w (%d abandoned)", ctx.Err(), n)
+	}
+}
+
+// Metrics returns a map of server metrics, keyed by component. The caller is
+// responsible for publishing these metrics as desired.
+func (s *Server) Metrics() *expvar.Map { return s.metrics }
+
+// CacheMetrics returns the metrics for the build cache server.
+func (s *Server) CacheMetrics() *expvar.Map { return s.cache.Metrics() }
+
+func (s *Server) logf(msg string, args ...any) {
+	if s.config.Logf != nil {
+		s.config.Logf(msg, args...)
+	}
+}
+
+// vlogf acts as logf if verbose or debug logging is enabled; otherwise it
+// discards its input.
+func (s *Server) vlogf(msg string, args ...any) {
+	if s.config.Verbose || s.config.DebugLog != 0 {
+		s.logf(msg, args...)
+	}
+}
@@ -0,0 +1,1040 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/creachadair/atomicfile"
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/cachedir"
+	"github.com/creachadair/mhttp/proxyconn"
+	"github.com/creachadair/taskgroup"
+	"github.com/creachadair/tlsutil"
+	"github.com/tailscale/go-cache-plugin/lib/gcsutil"
+	"github.com/tailscale/go-cache-plugin/lib/gobuild"
+	"github.com/tailscale/go-cache-plugin/lib/modproxy"
+	"github.com/tailscale/go-cache-plugin/lib/revproxy"
+	"github.com/tailscale/go-cache-plugin/lib/s3util"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+	"tailscale.com/tsweb"
+)
+
+// initCacheServer initializes the storage clients and the build cache server.
+func (s *Server) initCacheServer(ctx context.Context) error {
+	cfg := &s.config
+
+	// Validate required fields
+	if cfg.CacheDir == "" {
+		return errors.New("missing local cache directory")
+	} else if err := cfg.checkCacheLimits(); err != nil {
+		return err
+	} else if cfg.PartitionDepth < 0 || cfg.PartitionDepth > 8 {
+		// Keys are hex-encoded SHA256 digests, so the partition must be
+		// shorter than 64 digits; in practice more than a few is not useful.
+		return errors.New("key partition depth must be between 1 and 8")
+	}
+	if cfg.MinUploadSize > minUploadSizeWarning {
+		s.logf("WARNING: minimum upload size is %d bytes; objects smaller than this are not uploaded to storage",
+			cfg.MinUploadSize)
+	}
+
+	// Check that we can read the local cache directory before we use it.
+	if err := cfg.checkLayout(s.logf); err != nil {
+		return err
+	}
+	if err := cfg.checkSalt(s.logf); err != nil {
+		return fmt.Errorf("check cache salt: %w", err)
+	}
+
+	// Create the local cache directory
+	dir, err := cachedir.New(cfg.CacheDir)
+	if err != nil {
+		return fmt.Errorf("create local cache: %w", err)
+	}
+
+	s.vlogf("local cache directory: %s", cfg.CacheDir)
+
+	var large *cachedir.Dir
+	if cfg.CacheDirLarge != "" {
+		if cfg.LargeThreshold <= 0 {
+			return errors.New("a large object directory requires a positive size threshold")
+		}
+		large, err = cachedir.New(cfg.CacheDirLarge)
+		if err != nil {
+			return fmt.Errorf("create large object cache: %w", err)
+		}
+		s.vlogf("large object cache directory: %s (objects over %d bytes)", cfg.CacheDirLarge, cfg.LargeThreshold)
+	}
+
+	var manifest *gobuild.Manifest
+	if cfg.ActionManifest {
+		manifest, err = gobuild.OpenManifest(filepath.Join(cfg.CacheDir, ActionManifestFile))
+		if err != nil {
+			return fmt.Errorf("open action manifest: %w", err)
+		}
+		s.vlogf("recording actions in %s", ActionManifestFile)
+	}
+
+	var resumeDir string
+	if cfg.ResumeDownloads {
+		resumeDir = filepath.Join(cfg.CacheDir, "partial")
+		if cfg.sharedLocal() {
+			resumeDir = filepath.Join(resumeDir, hostScope())
+		}
+		if err := os.MkdirAll(resumeDir, 0755); err != nil {
+			return fmt.Errorf("create partial download directory: %w", err)
+		}
+	}
+
+	if cfg.S3Bucket != "" && cfg.GCSBucket != "" {
+		return errors.New("you must provide only one bucket (GCS or S3)")
+	}
+	admissionWindow, err := cfg.admissionWindow()
+	if err != nil {
+		return err
+	}
+
+	var etagDir string
+	if cfg.RevalidateOutputs && cfg.GCSBucket != "" {
+		etagDir = filepath.Join(cfg.CacheDir, "etag")
+		if err := os.MkdirAll(etagDir, 0755); err != nil {
+			return fmt.Errorf("create etag directory: %w", err)
+		}
+	}
+
+	// Metrics for the cache host, shared by the storage and cleanup.
+	hostMetrics := new(expvar.Map)
+	s.metrics.Set("gocache_host", hostMetrics)
+
+	var cache revproxy.Storage
+
+	var breaker *gobuild.Breaker
+	if cfg.BreakerThreshold > 0 {
+		breaker = &gobuild.Breaker{
+			Threshold: cfg.BreakerThreshold,
+			Window:    cfg.BreakerWindow,
+			Cooldown:  cfg.BreakerCooldown,
+			Logf:      s.logf,
+		}
+	}
+
+	// Initialize the storage client and cache implementation
+	if cfg.GCSBucket != "" {
+		bucket := cfg.GCSBucket
+		s.vlogf("GCS cache bucket: %s", bucket)
+
+		// Initialize GCS client
+		gcsClient, err := s.initGCSClient(ctx, bucket)
+		if err != nil {
+			return fmt.Errorf("initialize GCS client: %w", err)
+		}
+		if err := s.verify(ctx, gcsClient); err != nil {
+			return err
+		}
+
+		// Create storage adapter for revproxy
+		s.storage = gcsutil.NewGCSAdapter(gcsClient)
+		s.metrics.Set("gcs", gcsClient.Metrics())
+
+		// Create GCS cache for gocache
+		gcsCache := &gobuild.GCSCache{
+			Local:               dir,
+			LocalLarge:          large,
+			LargeThreshold:      cfg.LargeThreshold,
+			GCSClient:           gcsClient,
+			KeyPrefix:           cfg.BuildKeyPrefix(),
+			PartitionDepth:      cfg.PartitionDepth,
+			MinUploadSize:       cfg.MinUploadSize,
+			MaxUploadSize:       cfg.MaxUploadSize,
+			MaxClockSkew:        cfg.MaxClockSkew,
+			RemoteTTL:           cfg.RemoteTTL,
+			Retention:           cfg.ObjectRetention,
+			Logf:                s.logf,
+			LogMissSample:       cfg.LogMissSample,
+			UploadConcurrency:   cfg.GCSConcurrency,
+			UploadPacing:        cfg.UploadPacing,
+			RemoteFirst:         cfg.RemoteFirst,
+			DownloadConcurrency: cfg.DownloadConcurrency,
+			GetTimeout:          cfg.GetTimeout,
+			ResumeDir:           resumeDir,
+			SharedLocal:         cfg.sharedLocal(),
+			OpenFiles:           s.openFiles,
+			Breaker:             breaker,
+			StrictWrites:        cfg.StrictWrites,
+			SyncUploads:         cfg.SyncUploads,
+			InlineThreshold:     cfg.InlineThreshold,
+			CompressActions:     cfg.CompressActions,
+			VerifyUploads:       cfg.VerifyUploads,
+			VerifyDownloads:     cfg.VerifyDownloads,
+			VerifyMinSize:       cfg.VerifyMinSize,
+			NegCacheTTL:         cfg.NegCacheTTL,
+			NegCacheSize:        cfg.NegCacheSize,
+			AdmissionWindow:     admissionWindow,
+			PinVersions:         cfg.PinVersions,
+			MonotonicActions:    cfg.MonotonicActions,
+			SkipSameActions:     cfg.SkipSameActions,
+			Manifest:            manifest,
+			Events:              s.events,
+			ActionBatch:         cfg.GCSActionBatch,
+			ETagDir:             etagDir,
+			MirrorConcurrency:   cfg.MirrorConcurrency,
+		}
+		if cfg.MirrorBucket != "" {
+			s.vlogf("GCS mirror bucket: %s", cfg.MirrorBucket)
+			gcsCache.Mirror, err = s.initGCSClient(ctx, cfg.MirrorBucket)
+			if err != nil {
+				return fmt.Errorf("initialize GCS mirror client: %w", err)
+			}
+			if err := s.verify(ctx, gcsCache.Mirror); err != nil {
+				return fmt.Errorf("mirror: %w", err)
+			}
+		}
+		gcsCache.SetMetrics(ctx, hostMetrics)
+		cache = gcsCache
+	} else if cfg.S3Bucket != "" {
+		bucket := cfg.S3Bucket
+		s.vlogf("S3 cache bucket: %s", bucket)
+
+		// Initialize AWS S3 client
+		s3Client, err := s.initS3Client(ctx, bucket, cfg.S3Region, cfg.s3ReadEndpoint(), cfg.s3WriteEndpoint(), cfg.S3PathStyle)
+		if err != nil {
+			return fmt.Errorf("initialize S3 client: %w", err)
+		}
+		if err := s.verify(ctx, s3Client); err != nil {
+			return err
+		}
+
+		// Create storage adapter for revproxy
+		s.storage = s3util.NewS3Adapter(s3Client)
+
+		// Create S3 cache for gocache
+		s3Cache := &gobuild.S3Cache{
+			Local:               dir,
+			LocalLarge:          large,
+			LargeThreshold:      cfg.LargeThreshold,
+			S3Client:            s3Client,
+			StrictWrites:        cfg.StrictWrites,
+			SyncUploads:         cfg.SyncUploads,
+			InlineThreshold:     cfg.InlineThreshold,
+			CompressActions:     cfg.CompressActions,
+			NegCacheTTL:         cfg.NegCacheTTL,
+			NegCacheSize:        cfg.NegCacheSize,
+			AdmissionWindow:     admissionWindow,
+			PinVersions:         cfg.PinVersions,
+			Manifest:            manifest,
+			Events:              s.events,
+			KeyPrefix:           cfg.BuildKeyPrefix(),
+			PartitionDepth:      cfg.PartitionDepth,
+			MinUploadSize:       cfg.MinUploadSize,
+			MaxUploadSize:       cfg.MaxUploadSize,
+			MaxClockSkew:        cfg.MaxClockSkew,
+			RemoteTTL:           cfg.RemoteTTL,
+			Retention:           cfg.ObjectRetention,
+			Logf:                s.logf,
+			LogMissSample:       cfg.LogMissSample,
+			UploadConcurrency:   cfg.S3Concurrency,
+			UploadPacing:        cfg.UploadPacing,
+			RemoteFirst:         cfg.RemoteFirst,
+			DownloadConcurrency: cfg.DownloadConcurrency,
+			GetTimeout:          cfg.GetTimeout,
+			ResumeDir:           resumeDir,
+			SharedLocal:         cfg.sharedLocal(),
+			OpenFiles:           s.openFiles,
+			Breaker:             breaker,
+			MirrorConcurrency:   cfg.MirrorConcurrency,
+		}
+		if cfg.MirrorBucket != "" {
+			// The mirror is typically in a different region than the primary,
+			// so resolve its region separately.
+			s.vlogf("S3 mirror bucket: %s", cfg.MirrorBucket)
+			s3Cache.Mirror, err = s.initS3Client(ctx, cfg.MirrorBucket, "", "", cfg.s3WriteEndpoint(), cfg.S3PathStyle)
+			if err != nil {
+				return fmt.Errorf("initialize S3 mirror client: %w", err)
+			}
+			if err := s.verify(ctx, s3Cache.Mirror); err != nil {
+				return fmt.Errorf("mirror: %w", err)
+			}
+		}
+		s3Cache.SetMetrics(ctx, hostMetrics)
+		cache = s3Cache
+	} else {
+		return errors.New("invalid storage: no bucket provided")
+	}
+
+	if p, ok := cache.(interface{ Pending() int }); ok {
+		s.pending = append(s.pending, p.Pending)
+	}
+	if p, ok := cache.(prefetcher); ok && !cfg.Disabled {
+		s.prefetch = p
+	}
+
+	// If requested, stage the outputs of recent actions before serving, so the
+	// first build finds local hits.
+	if n := cfg.PrewarmRecent; n > 0 && !cfg.Disabled {
+		p := cache.(interface {
+			Prewarm(context.Context, int) (int, error)
+		})
+		start := time.Now()
+		staged, err := p.Prewarm(ctx, n)
+		if err != nil {
+			s.logf("prewarm: %v (continuing)", err)
+		}
+		s.vlogf("prewarmed %d of %d recent actions (%v elapsed)",
+			staged, n, time.Since(start).Round(time.Millisecond))
+	}
+
+	// Add directory cleanup if requested. If a cleanup interval is set, also
+	// sweep periodically in the background, and stop doing so before the final
+	// sweep at close.
+	s.closeCache = cache.Close
+	if cfg.Expiration > 0 {
+		cleaner := &gobuild.DirCleaner{
+			Dirs:       []*cachedir.Dir{dir, large},
+			Expiration: cfg.Expiration,
+		}
+		for _, dir := range []string{resumeDir, etagDir} {
+			if dir != "" {
+				cleaner.Scratch = append(cleaner.Scratch, dir)
+			}
+		}
+		cleaner.SetMetrics(ctx, hostMetrics)
+
+		stop := func() {}
+		if cfg.CleanupInterval > 0 {
+			s.vlogf("local cleanup interval: %v", cfg.CleanupInterval)
+			ctx, cancel := context.WithCancel(gocache.WithLogf(context.Background(), s.vlogf))
+			sweeps := taskgroup.Go(func() error {
+				cleaner.Run(ctx, cfg.CleanupInterval)
+				return nil
+			})
+			stop = func() { cancel(); sweeps.Wait() }
+		}
+		s.closeCache = func(ctx context.Context) error {
+			stop()
+			return errors.Join(cache.Close(ctx), cleaner.Sweep(ctx))
+		}
+	} else if cfg.CleanupInterval > 0 {
+		return errors.New("a cleanup interval requires an expiration period")
+	}
+	if manifest != nil {
+		// Close the manifest after pending writes have been recorded.
+		closeCache := s.closeCache
+		s.closeCache = func(ctx context.Context) error {
+			return errors.Join(closeCache(ctx), manifest.Close())
+		}
+	}
+
+	// Create the server with the appropriate callback functions. The cache is
+	// closed by Shutdown rather than by any single client session.
+	s.cache = &gocache.Server{
+		Get:         cache.Get,
+		Put:         cache.Put,
+		Close:       noopClose,
+		SetMetrics:  cache.SetMetrics,
+		MaxRequests: cfg.Concurrency,
+		Logf:        s.vlogf,
+		LogRequests: cfg.DebugLog&DebugBuildCache != 0,
+	}
+
+	// If the cache is disabled, every lookup misses, and outputs are written
+	// only locally, where the toolchain requires them.
+	if cfg.Disabled {
+		s.logf("WARNING: build cache is DISABLED: all lookups will miss and no results will be stored")
+		s.cache.Get = func(context.Context, string) (string, string, error) { return "", "", nil }
+		s.cache.Put = dir.Put
+	}
+	s.metrics.Set("gocache_server", s.cache.Metrics().Get("server"))
+	return nil
+}
+
+// verify checks that the bucket for the given client is accessible, if backend
+// verification is enabled.
+func (s *Server) verify(ctx context.Context, client interface{ Verify(context.Context) error }) error {
+	if !s.config.VerifyBackend {
+		return nil
+	}
+	start := time.Now()
+	if err := client.Verify(ctx); err != nil {
+		return fmt.Errorf("verify storage: %w", err)
+	}
+	s.vlogf("verified storage access (%v elapsed)", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// initGCSClient initializes a Google Cloud Storage client
+func (s *Server) initGCSClient(ctx context.Context, bucket string) (*gcsutil.Client, error) {
+	// Set up options for GCS client creation. These are constructed afresh
+	// whenever the client reconnects, so that it gets new credentials and a
+	// new transport.
+	newOpts := func(ctx context.Context) ([]option.ClientOption, error) {
+		opts := []option.ClientOption{option.WithScopes(storage.ScopeReadWrite)}
+		if s.config.GCSEndpoint != "" {
+			opts = append(opts, option.WithEndpoint(s.config.GCSEndpoint))
+		}
+		if s.config.gcsEmulated(os.Getenv) {
+			// An emulator does not check credentials, and there may be none.
+			opts = append(opts, option.WithoutAuthentication())
+		} else if s.config.GCSKeyFile != "" {
+			// If a key file is specified, use it for authentication
+			opts = append(opts, option.WithCredentialsFile(s.config.GCSKeyFile))
+		}
+
+		// Wrap our tuned transport with authentication, since a custom HTTP
+		// client replaces the one the library would otherwise construct.
+		// Without authentication, this returns the transport unchanged.
+		rt, err := htransport.NewTransport(ctx, s.storageTransport(), opts...)
+		if err != nil {
+			return nil, fmt.Errorf("create GCS transport: %w", err)
+		}
+		return append(opts, option.WithHTTPClient(&http.Client{Transport: rt})), nil
+	}
+
+	// Create the GCS client
+	client, err := gcsutil.NewClientFunc(ctx, bucket, newOpts)
+	if err != nil {
+		return nil, err
+	}
+	client.Tags = s.config.ObjectTags
+	client.ChunkSize = cmp.Or(s.config.UploadBufferSize, DefaultUploadBufferSize)
+	client.RetryBudget = s.retries
+	client.Logf = s.logf
+	if client.ACL, err = s.objectACL(bucket, gcsACLs); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// gcsEmulated reports whether the GCS client talks to an emulator rather than
+// to Google, in which case it does not authenticate. This is so if the
+// STORAGE_EMULATOR_HOST environment variable is set, as the GCS library
+// expects, or if GCSEndpoint is a plain HTTP URL, over which credentials must
+// not be sent anyway.
+func (c *Config) gcsEmulated(getenv func(string) string) bool {
+	return getenv("STORAGE_EMULATOR_HOST") != "" || strings.HasPrefix(c.GCSEndpoint, "http://")
+}
+
+// initS3Client initializes an Amazon S3 client. Writes and metadata requests
+// go to writeEndpoint, and reads of object contents go to readEndpoint. If an
+// endpoint is empty, the AWS default is used; if readEndpoint is empty or the
+// same as writeEndpoint, one client serves both.
+func (s *Server) initS3Client(ctx context.Context, bucket, region, readEndpoint, writeEndpoint string, pathStyle bool) (*s3util.Client, error) {
+	// If region is not specified, try to resolve it from the bucket
+	if region == "" {
+		var err error
+		region, err = s3util.BucketRegion(ctx, bucket, s.config.awsConfigOptions()...)
+		if err != nil {
+			return nil, fmt.Errorf("resolve region for bucket %q: %w", bucket, err)
+		}
+	}
+	s.vlogf("S3 region: %s", region)
+
+	// Load the AWS configuration
+	cfg, err := config.LoadDefaultConfig(ctx, append(s.config.awsConfigOptions(), config.WithRegion(region))...)
+	if err != nil {
+		return nil, fmt.Errorf("load AWS config: %w", err)
+	}
+
+	// Create the S3 client with appropriate options
+	opts := []func(*s3.Options){func(o *s3.Options) {
+		o.HTTPClient = &http.Client{Transport: s.storageTransport()}
+	}}
+	if s.retries != nil {
+		opts = append(opts, s3util.WithRetryBudget(s.retries))
+	}
+	if pathStyle {
+		s.vlogf("S3 path-style URLs enabled")
+		opts = append(opts, func(o *s3.Options) {
+			o.UsePathStyle = true
+		})
+	}
+	newClient := func(endpoint string) *s3.Client {
+		if endpoint == "" {
+			return s3.NewFromConfig(cfg, opts...)
+		}
+		return s3.NewFromConfig(cfg, append(opts, func(o *s3.Options) {
+			o.BaseEndpoint = aws.String(endpoint)
+		})...)
+	}
+	if writeEndpoint != "" {
+		s.vlogf("S3 endpoint URL: %s", writeEndpoint)
+	}
+	var readClient *s3.Client
+	if readEndpoint != "" && readEndpoint != writeEndpoint {
+		s.vlogf("S3 read endpoint URL: %s", readEndpoint)
+		readClient = newClient(readEndpoint)
+	}
+
+	acl, err := s.objectACL(bucket, s3ACLs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the S3 client wrapper
+	return &s3util.Client{
+		Client:        newClient(writeEndpoint),
+		ReadClient:    readClient,
+		Bucket:        bucket,
+		Tags:          s.config.ObjectTags,
+		RequesterPays: s.config.S3RequesterPays,
+		ACL:           types.ObjectCannedACL(acl),
+	}, nil
+}
+
+// Predefined object ACLs supported by each storage backend, indexed by a
+// normalized name (lowercase, without punctuation) so that either the S3 or
+// the GCS spelling of a name is accepted.
+var (
+	gcsACLs = map[string]string{
+		"authenticatedread":      "authenticatedRead",
+		"bucketownerfullcontrol": "bucketOwnerFullControl",
+		"bucketownerread":        "bucketOwnerRead",
+		"private":                "private",
+		"projectprivate":         "projectPrivate",
+		"publicread":             "publicRead",
+	}
+	s3ACLs = map[string]string{
+		"authenticatedread":      "authenticated-read",
+		"awsexecread":            "aws-exec-read",
+		"bucketownerfullcontrol": "bucket-owner-full-control",
+		"bucketownerread":        "bucket-owner-read",
+		"private":                "private",
+		"publicread":             "public-read",
+		"publicreadwrite":        "public-read-write",
+	}
+)
+
+// objectACL returns the name of the ACL for objects written to bucket, as
+// given by s.config.ObjectACL and spelled as in acls, or "" if none is set.
+// It warns if the ACL makes objects public.
+func (s *Server) objectACL(bucket string, acls map[string]string) (string, error) {
+	if s.config.ObjectACL == "" {
+		return "", nil
+	}
+	norm := strings.ToLower(strings.NewReplacer("-", "", "_", "").Replace(s.config.ObjectACL))
+	acl, ok := acls[norm]
+	if !ok {
+		return "", fmt.Errorf("object ACL %q is not supported for bucket %q", s.config.ObjectACL, bucket)
+	}
+	if strings.HasPrefix(norm, "public") {
+		s.logf("WARNING: objects written to bucket %q will be readable by anyone (ACL %s)", bucket, acl)
+	} else {
+		s.vlogf("object ACL for bucket %q: %s", bucket, acl)
+	}
+	return acl, nil
+}
+
+// awsConfigOptions returns options for loading the AWS configuration, other
+// than the region, based on the settings in c.
+func (c *Config) awsConfigOptions() []func(*config.LoadOptions) error {
+	var opts []func(*config.LoadOptions) error
+	if c.S3Profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(c.S3Profile))
+	}
+	return opts
+}
+
+// initModProxy initializes a Go module proxy if one is enabled. If not, it
+// returns a nil handler without error. If a proxy is started, s.closeMod is
+// updated to clean it up.
+func (s *Server) initModProxy() (http.Handler, error) {
+	cfg := &s.config
+	if !cfg.ModProxy {
+		return nil, nil // OK, proxy is disabled
+	}
+	cacher := cfg.ModCacher
+	if cacher == nil {
+		sc, err := s.newModCacher()
+		if err != nil {
+			return nil, err
+		}
+		cacher, s.modCacher = sc, sc
+	}
+
+	// Hook up the optional lifecycle methods of the cacher, if it has them.
+	if c, ok := cacher.(io.Closer); ok {
+		s.closeMod = func() { s.vlogf("close cacher (err=%v)", c.Close()) }
+	}
+	if p, ok := cacher.(interface{ Pending() int }); ok {
+		s.pending = append(s.pending, p.Pending)
+	}
+	if m, ok := cacher.(interface{ Metrics() *expvar.Map }); ok {
+		s.metrics.Set("modcache", m.Metrics())
+	}
+
+	// Retry transient failures of the upstream proxy, if enabled.
+	var upstream http.RoundTripper
+	if cfg.ModProxyRetries > 0 {
+		rt := &modproxy.RetryTransport{
+			MaxRetries: cfg.ModProxyRetries,
+			Backoff:    cfg.ModProxyRetryBackoff,
+			Budget:     s.retries,
+		}
+		s.metrics.Set("modproxy_upstream_retry", rt.Metrics())
+		upstream = rt
+	}
+
+	s.vlogf("enabling Go module proxy")
+	if len(cfg.SumDB) != 0 {
+		s.vlogf("enabling sum DB proxy for %s", strings.Join(cfg.SumDB, ", "))
+	}
+
+	// Compress text responses for clients that accept it.
+	gz := &modproxy.GzipHandler{Handler: modproxy.NewHandler(cacher, cfg.SumDB, upstream)}
+	s.metrics.Set("modproxy_gzip", gz.Metrics())
+	return http.StripPrefix("/mod", gz), nil
+}
+
+// newModCacher creates the default module cacher, which stores files in the
+// local cache directory backed by the storage client.
+func (s *Server) newModCacher() (*modproxy.StorageCacher, error) {
+	cfg := &s.config
+	modCachePath := filepath.Join(cfg.CacheDir, "module")
+	if err := os.MkdirAll(modCachePath, 0755); err != nil {
+		return nil, fmt.Errorf("create module cache: %w", err)
+	}
+	// The module cacher logs only in verbose mode, unless a sampled miss log
+	// was explicitly requested.
+	logf := s.vlogf
+	if cfg.LogMissSample > 0 {
+		logf = s.logf
+	}
+	var partialScope string
+	if cfg.sharedLocal() {
+		partialScope = hostScope()
+	}
+
+	return &modproxy.StorageCacher{
+		Local:           modCachePath,
+		Client:          s.storage,
+		KeyPrefix:       path.Join(cfg.namespacePrefix(), "module"),
+		PartitionDepth:  cfg.PartitionDepth,
+		RevalidateAfter: cfg.Revalidate,
+		Logf:            logf,
+		LogMissSample:   cfg.LogMissSample,
+		ResumeDownloads: cfg.ResumeDownloads,
+		PartialScope:    partialScope,
+		GetTimeout:      cfg.GetTimeout,
+		MutableTTL:      cfg.ModProxyMutableTTL,
+		ReadableKeys:    cfg.ModProxyReadableKeys,
+		OpenFiles:       s.openFiles,
+		SyncUploads:     cfg.SyncUploads,
+		CompressText:    cfg.CompressActions,
+		Events:          s.events,
+		ExposeKeys:      cfg.DebugLog&DebugModProxy != 0,
+	}, nil
+}
+
+// initRevProxy initializes a reverse proxy if one is enabled.  If not, it
+// returns nil, nil to indicate a proxy was not requested. Otherwise, it
+// returns a [http.Handler] to dispatch reverse proxy requests, and updates
+// s.stopProxy to stop the inner server.
+//
+// The reverse proxy runs two collaborating HTTP servers:
+//
+//   - The "inner" server is the proxy itself, which checks for cached values,
+//     forwards client requests to the remote origin (if necessary), and
+//     updates the cache with responses. The [revproxy.Server] is a lightweight
+//     wrapper around [net/http/httputil.ReverseProxy].
+//
+//   - The "outer" server is a bridge, that intercepts client requests.  The
+//     bridge forwards plain HTTP requests directly to the inner server.  For
+//     HTTPS CONNECT requests, the bridge hijacks the client connection and
+//     terminates TLS using a locally-signed certificate, and forwards the
+//     decrypted client requests to the inner caching proxy.
+//
+// The outer bridge is what receives requests routed by the main HTTP endpoint;
+// the inner server gets all its input via the bridge:
+//
+//	                          +------------+    +--------+
+//	client --[proxy-request]->|HTTP handler+--->| bridge +--CONNECT--+
+//	                          +------------+    +---+----+           |
+//	                                                |                |
+//	                                               HTTP              v
+//	                          +-------------+       |        +---------------+
+//	            [response]<---| cache proxy |<------+--------+ terminate TLS |
+//	                          +-------------+                +---------------+
+//
+// To the main HTTP listener, the bridge is an [http.Handler] that serves
+// requests routed to it. To the inner server, the bridge is a [net.Listener],
+// a source of client connections (with TLS terminated).
+//
+// If reverse proxy groups are configured, the cache proxy is a router that
+// hands each request to a separate [revproxy.Server] for the group of its
+// host. The bridge and the inner server are shared by all the groups.
+func (s *Server) initRevProxy(ctx context.Context) (http.Handler, error) {
+	cfg := &s.config
+	hosts := cfg.revProxyTargets()
+	if len(hosts) == 0 {
+		return nil, nil // OK, proxy is disabled
+	}
+	signers, err := s.revProxySigners(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Issue a server certificate so we can proxy HTTPS requests.
+	cert, err := s.initServerCert(hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	// The RevProxy targets, if any, form an unnamed default group.
+	groups := cfg.RevProxyGroups
+	if len(cfg.RevProxy) != 0 {
+		groups = append([]RevProxyGroup{{Targets: cfg.RevProxy}}, groups...)
+	}
+	var proxy http.Handler
+	route := make(revProxyRouter)
+	for _, g := range groups {
+		gp, err := s.newRevProxy(g, signers)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range g.Targets {
+			route[host] = gp
+		}
+		proxy = gp
+	}
+	if len(groups) > 1 {
+		proxy = route
+	}
+
+	bridge := &proxyconn.Bridge{
+		Addrs:   hosts,
+		Handler: proxy, // forward HTTP requests unencrypted to the proxy
+		Logf:    s.vlogf,
+
+		// Forward connections not matching Addrs directly to their targets.
+		ForwardConnect: true,
+	}
+	s.metrics.Set("proxyconn", bridge.Metrics())
+
+	// Run the proxy on its own separate server with TLS support.  This server
+	// does not listen on a real network; it receives connections forwarded by
+	// the bridge internally from successful CONNECT requests.
+	tlsConfig, err := cfg.proxyTLSConfig(cert)
+	if err != nil {
+		return nil, err
+	}
+	psrv := &http.Server{
+		TLSConfig: tlsConfig,
+
+		// Ordinarly HTTP proxy requests are delegated directly.
+		Handler: proxy,
+	}
+	s.tasks.Go(func() error { return psrv.ServeTLS(bridge, "", "") })
+	s.stopProxy = func() {
+		s.vlogf("stopping proxy bridge")
+		psrv.Shutdown(context.Background())
+	}
+
+	return bridge, nil
+}
+
+// revProxySigners returns signers for the reverse proxy targets whose
+// requests are signed with AWS credentials, or nil if there are none.
+func (s *Server) revProxySigners(ctx context.Context) (map[string]revproxy.RequestSigner, error) {
+	if len(s.config.RevProxySignAWS) == 0 {
+		return nil, nil
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, s.config.awsConfigOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("load AWS config: %w", err)
+	}
+	out := make(map[string]revproxy.RequestSigner)
+	for host, region := range s.config.RevProxySignAWS {
+		if region == "" && cfg.Region == "" {
+			return nil, fmt.Errorf("no AWS region to sign requests to %q", host)
+		}
+		out[host] = s3util.NewSigner(cfg, region)
+		s.vlogf("signing reverse proxy requests to %s with AWS credentials", host)
+	}
+	return out, nil
+}
+
+// newRevProxy creates a reverse proxy for the targets of g, and publishes
+// its metrics. Requests to hosts in signers are signed. The unnamed default
+// group is cached under "revproxy", and a named group under
+// "revproxy/group/<name>", in both the local directory and storage. Hash
+// prefixes are two characters, so they do not collide with the "group"
+// directory.
+func (s *Server) newRevProxy(g RevProxyGroup, signers map[string]revproxy.RequestSigner) (*revproxy.Server, error) {
+	cfg := &s.config
+	sub, metric := "revproxy", "revcache"
+	if g.Name != "" {
+		sub, metric = path.Join("revproxy", "group", g.Name), "revcache_"+g.Name
+	}
+	revCachePath := filepath.Join(cfg.CacheDir, filepath.FromSlash(sub))
+	if err := os.MkdirAll(revCachePath, 0755); err != nil {
+		return nil, fmt.Errorf("create revproxy cache: %w", err)
+	}
+
+	proxy := &revproxy.Server{
+		Targets:         g.Targets,
+		Local:           revCachePath,
+		Storage:         s.storage,
+		KeyPrefix:       path.Join(cfg.KeyPrefix, sub),
+		RevalidateAfter: cmp.Or(g.Revalidate, cfg.Revalidate),
+		AllowBypass:     cfg.RevProxyAllowBypass,
+		ExposeKeys:      cfg.DebugLog&DebugRevProxy != 0,
+		Logf:            s.vlogf,
+		LogRequests:     cfg.DebugLog&DebugRevProxy != 0,
+
+		MaxConnsPerHost:       cfg.RevProxyMaxConnsPerHost,
+		IdleConnTimeout:       cfg.RevProxyIdleConnTimeout,
+		ResponseHeaderTimeout: cfg.RevProxyHeaderTimeout,
+		OriginTimeout:         cfg.RevProxyOriginTimeout,
+		DisableHTTP2:          cfg.RevProxyDisableHTTP2,
+		AuthHeaders:           cfg.RevProxyAuth,
+		Signers:               signers,
+		Rules:                 g.Rules,
+	}
+	s.metrics.Set(metric, proxy.Metrics())
+	if g.Name == "" {
+		s.vlogf("enabling reverse proxy for %s", strings.Join(g.Targets, ", "))
+	} else {
+		s.vlogf("enabling reverse proxy group %q for %s", g.Name, strings.Join(g.Targets, ", "))
+	}
+	return proxy, nil
+}
+
+// revProxyRouter is an [http.Handler] that dispatches each reverse proxy
+// request to the proxy for the group whose targets include its host.
+type revProxyRouter map[string]*revproxy.Server
+
+func (rt revProxyRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	proxy, ok := rt[r.Host]
+	if !ok {
+		// As a revproxy.Server does for a host that is not one of its targets.
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// initServerCert creates a signed certificate advertising the specified host
+// names, for use in creating a TLS server. If RevProxyCAKeyFile is set, the
+// certificate is signed by the persistent CA in the configured files;
+// otherwise, by a new CA generated for this run.
+func (s *Server) initServerCert(hosts []string) (tls.Certificate, error) {
+	if keyPath := s.config.RevProxyCAKeyFile; keyPath != "" {
+		certPath := s.config.revProxyCAFile()
+		ca, created, err := loadOrCreateCA(certPath, keyPath)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		if created {
+			s.logf("generated reverse proxy signing cert in %s (key in %s)", certPath, keyPath)
+		} else {
+			s.vlogf("loaded reverse proxy signing cert from %s", certPath)
+		}
+		s.installCA(ca.certPEM)
+		return ca.serverCert(hosts, 24*time.Hour)
+	}
+
+	ca, err := tlsutil.NewSigningCert(24*time.Hour, &x509.Certificate{
+		Subject: pkix.Name{Organization: []string{"Tailscale build automation"}},
+	})
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generate signing cert: %w", err)
+	}
+	if path := s.config.revProxyCAFile(); path != "" {
+		if err := atomicfile.WriteData(path, ca.CertPEM(), 0644); err != nil {
+			return tls.Certificate{}, fmt.Errorf("write signing cert: %w", err)
+		}
+		s.logf("wrote reverse proxy signing cert to %s (clients must trust it, e.g., via SSL_CERT_FILE)", path)
+	}
+	s.installCA(ca.CertPEM())
+
+	sc, err := tlsutil.NewServerCert(24*time.Hour, ca, &x509.Certificate{
+		Subject:  pkix.Name{Organization: []string{"Go cache plugin reverse proxy"}},
+		DNSNames: hosts,
+	})
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generate server cert: %w", err)
+	}
+
+	return sc.TLSCertificate()
+}
+
+// installCA adds the signing certificate certPEM to the system trust store,
+// unless RevProxyNoTrustInstall is set. Failures are logged, not reported.
+func (s *Server) installCA(certPEM []byte) {
+	if s.config.RevProxyNoTrustInstall {
+		s.logf("not installing signing cert in system store")
+	} else if err := installSigningCert(certPEM); err != nil {
+		s.vlogf("WARNING: %v", err)
+	} else {
+		s.vlogf("installed signing cert in system store")
+	}
+}
+
+// revProxyCAFile returns the path where the reverse proxy signing certificate
+// should be written, or read if it is persistent, or "" if it should not be
+// written.
+func (c *Config) revProxyCAFile() string {
+	if c.RevProxyCAFile != "" {
+		return c.RevProxyCAFile
+	} else if c.RevProxyNoTrustInstall || c.RevProxyCAKeyFile != "" {
+		return filepath.Join(c.CacheDir, "revproxy-ca.crt")
+	}
+	return ""
+}
+
+// makeHandler returns an HTTP handler that dispatches requests to debug
+// handlers, or to the specified proxies and cache browser, if they are defined.
+// If keys is non-nil, it is served among the debug handlers at /debug/keys,
+// and likewise prefetch at /debug/prefetch and pin at /debug/pin.
+//
+// Requests to the proxies must satisfy auth, and requests to the debug
+// handlers must carry debugToken as a bearer token, if it is non-empty.
+func makeHandler(modProxy, revProxy, browse, keys, prefetch, pin http.Handler, auth *proxyAuth, debugToken string) http.HandlerFunc {
+	mux := http.NewServeMux()
+	debug := tsweb.Debugger(mux)
+	if keys != nil {
+		debug.Handle("keys", "Storage keys for build cache entries and module files", keys)
+	}
+	if prefetch != nil {
+		debug.Handle("prefetch", "Stage build actions into the local cache (POST action IDs)", prefetch)
+	}
+	if pin != nil {
+		debug.Handle("pin", "Protect build cache entries from deletion (POST to pin, DELETE to unpin)", pin)
+	}
+	var debugHandler http.Handler = mux
+	if debugToken != "" {
+		debugHandler = requireToken(debugToken, mux)
+	}
+	proxies := makeProxyHandler(modProxy, revProxy, auth)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isProxyRequest(r) {
+			path := r.URL.Path
+			if strings.HasPrefix(path, "/debug/") {
+				debugHandler.ServeHTTP(w, r)
+				return
+			}
+			if browse != nil && strings.HasPrefix(path, "/cache/") {
+				browse.ServeHTTP(w, r)
+				return
+			}
+		}
+		proxies(w, r)
+	}
+}
+
+// makeProxyHandler returns an HTTP handler that dispatches requests to the
+// specified proxies, if they are defined. It serves nothing else, so that the
+// proxies can be exposed on a listener of their own without the debug
+// handlers. Requests are served only if they satisfy auth.
+func makeProxyHandler(modProxy, revProxy http.Handler, auth *proxyAuth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !auth.authorize(w, r) {
+			return
+		}
+		if isProxyRequest(r) {
+			if revProxy != nil {
+				revProxy.ServeHTTP(w, r)
+				return
+			}
+			// We don't allow proxying in this configuration, bug off.
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+		if modProxy != nil && r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/mod/") {
+			modProxy.ServeHTTP(w, r)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	}
+}
+
+// isProxyRequest reports whether r asks the server to proxy for the caller.
+func isProxyRequest(r *http.Request) bool { return r.URL.Host != "" && r.URL.Host == r.Host }
+
+// An httpService is an HTTP handler and the address at which it is served.
+type httpService struct {
+	name    string // for logs, e.g., "module proxy"
+	addr    string
+	handler http.Handler
+}
+
+// initHTTP sets up the HTTP services of s for the given proxies, either of
+// which may be nil. The proxies are served with the debug handlers at
+// HTTPAddr, unless the configuration gives them an address of their own. Two
+// proxies given the same address share a listener.
+func (s *Server) initHTTP(modProxy, revProxy, browse, keys, prefetch, pin http.Handler) {
+	cfg := &s.config
+	modApart := modProxy != nil && cfg.ModProxyAddr != "" && cfg.ModProxyAddr != cfg.HTTPAddr
+	revApart := revProxy != nil && cfg.RevProxyAddr != "" && cfg.RevProxyAddr != cfg.HTTPAddr
+
+	mainMod, mainRev := modProxy, revProxy
+	if modApart {
+		mainMod = nil
+	}
+	if revApart {
+		mainRev = nil
+	}
+	var debugToken string
+	if cfg.DebugAuth {
+		debugToken = cfg.AdminToken
+	}
+	s.handler = makeHandler(mainMod, mainRev, browse, keys, prefetch, pin, s.proxyAuth, debugToken)
+	s.services = []httpService{{"HTTP", cfg.HTTPAddr, s.handler}}
+
+	if modApart && revApart && cfg.ModProxyAddr == cfg.RevProxyAddr {
+		s.services = append(s.services, httpService{"proxy", cfg.ModProxyAddr, makeProxyHandler(modProxy, revProxy, s.proxyAuth)})
+		return
+	}
+	if modApart {
+		s.services = append(s.services, httpService{"module proxy", cfg.ModProxyAddr, makeProxyHandler(modProxy, nil, s.proxyAuth)})
+	}
+	if revApart {
+		s.services = append(s.services, httpService{"reverse proxy", cfg.RevProxyAddr, makeProxyHandler(nil, revProxy, s.proxyAuth)})
+	}
+}
+
+// Admission policies accepted by Config.AdmissionPolicy.
+const (
+	AdmitAll     = "all"     // upload every build output
+	AdmitTinyLFU = "tinylfu" // upload build outputs written twice recently
+)
+
+// admissionWindow returns the admission window of the build cache for the
+// policy of c, or 0 if every output is admitted. It reports an error if the
+// policy is not known.
+func (c *Config) admissionWindow() (int, error) {
+	switch c.AdmissionPolicy {
+	case "", AdmitAll:
+		return 0, nil
+	case AdmitTinyLFU:
+		if c.AdmissionWindow > 0 {
+			return c.AdmissionWindow, nil
+		}
+		return gobuild.DefaultAdmissionWindow, nil
+	default:
+		return 0, fmt.Errorf("unknown admission policy %q (want %s or %s)", c.AdmissionPolicy, AdmitAll, AdmitTinyLFU)
+	}
+}
+
+func noopClose(context.Context) error { return nil }
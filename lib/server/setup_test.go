@@ -0,0 +1,294 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/tailscale/go-cache-plugin/lib/gobuild"
+)
+
+func TestAWSConfigOptions(t *testing.T) {
+	load := func(c Config) config.LoadOptions {
+		var lo config.LoadOptions
+		for _, opt := range c.awsConfigOptions() {
+			if err := opt(&lo); err != nil {
+				t.Fatalf("Apply option: %v", err)
+			}
+		}
+		return lo
+	}
+
+	if lo := load(Config{}); lo.SharedConfigProfile != "" {
+		t.Errorf("Default: got profile %q, want none", lo.SharedConfigProfile)
+	}
+	if lo := load(Config{S3Profile: "staging"}); lo.SharedConfigProfile != "staging" {
+		t.Errorf("Profile: got %q, want %q", lo.SharedConfigProfile, "staging")
+	}
+}
+
+func TestKeyPrefixes(t *testing.T) {
+	tests := []struct {
+		cfg         Config
+		build, ns   string
+		invalidName bool
+	}{
+		{Config{}, "", "", false},
+		{Config{KeyPrefix: "pfx"}, "pfx", "pfx", false},
+		{Config{KeyPrefix: "pfx", GoVersion: "go1.25.1"}, "pfx/go1.25.1", "pfx", false},
+		{Config{KeyPrefix: "pfx", Namespace: "org/repo"}, "pfx/ns/org/repo", "pfx/ns/org/repo", false},
+		{Config{Namespace: "repo", GoVersion: "devel go1.26-abc123 Mon Jan 1"}, "ns/repo/devel-go1.26-abc123", "ns/repo", false},
+		{Config{CacheSalt: "v2"}, "salt/07fd2d09ac0b7386", "salt/07fd2d09ac0b7386", false},
+		{Config{KeyPrefix: "pfx", Namespace: "repo", CacheSalt: "v2", GoVersion: "go1.25.1"},
+			"pfx/ns/repo/salt/07fd2d09ac0b7386/go1.25.1", "pfx/ns/repo/salt/07fd2d09ac0b7386", false},
+		{Config{Namespace: "../repo"}, "", "", true},
+		{Config{Namespace: "/repo"}, "", "", true},
+		{Config{Namespace: "org//repo"}, "", "", true},
+		{Config{Namespace: "."}, "", "", true},
+	}
+	for _, tc := range tests {
+		if err := tc.cfg.checkNamespace(); tc.invalidName {
+			if err == nil {
+				t.Errorf("Namespace %q: got nil error, want invalid", tc.cfg.Namespace)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("Namespace %q: unexpected error: %v", tc.cfg.Namespace, err)
+		}
+		if got := tc.cfg.BuildKeyPrefix(); got != tc.build {
+			t.Errorf("BuildKeyPrefix %+v: got %q, want %q", tc.cfg, got, tc.build)
+		}
+		if got := tc.cfg.namespacePrefix(); got != tc.ns {
+			t.Errorf("namespacePrefix %+v: got %q, want %q", tc.cfg, got, tc.ns)
+		}
+	}
+}
+
+func TestRevProxyGroups(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		ok   bool
+	}{
+		{"Empty", Config{}, true},
+		{"DefaultOnly", Config{RevProxy: []string{"a.com", "b.com"}}, true},
+		{"Groups", Config{
+			RevProxy: []string{"a.com"},
+			RevProxyGroups: []RevProxyGroup{
+				{Name: "pkgs", Targets: []string{"b.com", "c.com"}},
+				{Name: "img_2.x", Targets: []string{"d.com"}},
+			},
+		}, true},
+		{"BadName", Config{RevProxyGroups: []RevProxyGroup{{Name: "a/b", Targets: []string{"a.com"}}}}, false},
+		{"DotName", Config{RevProxyGroups: []RevProxyGroup{{Name: "..", Targets: []string{"a.com"}}}}, false},
+		{"NoName", Config{RevProxyGroups: []RevProxyGroup{{Targets: []string{"a.com"}}}}, false},
+		{"NoTargets", Config{RevProxyGroups: []RevProxyGroup{{Name: "x"}}}, false},
+		{"DupName", Config{RevProxyGroups: []RevProxyGroup{
+			{Name: "x", Targets: []string{"a.com"}},
+			{Name: "x", Targets: []string{"b.com"}},
+		}}, false},
+		{"DupHost", Config{
+			RevProxy:       []string{"a.com"},
+			RevProxyGroups: []RevProxyGroup{{Name: "x", Targets: []string{"a.com"}}},
+		}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.cfg.checkRevProxyGroups()
+			if tc.ok && err != nil {
+				t.Errorf("checkRevProxyGroups: unexpected error: %v", err)
+			} else if !tc.ok && err == nil {
+				t.Error("checkRevProxyGroups: got nil error, want error")
+			}
+		})
+	}
+}
+
+func TestRevProxyRouter(t *testing.T) {
+	cfg := Config{
+		CacheDir: t.TempDir(),
+		RevProxy: []string{"a.com"},
+		RevProxyGroups: []RevProxyGroup{
+			{Name: "pkgs", Targets: []string{"b.com", "c.com"}, Revalidate: time.Hour},
+		},
+		Revalidate: time.Minute,
+	}
+	s := &Server{config: cfg, metrics: new(expvar.Map)}
+	route := make(revProxyRouter)
+	for _, g := range append([]RevProxyGroup{{Targets: cfg.RevProxy}}, cfg.RevProxyGroups...) {
+		proxy, err := s.newRevProxy(g, nil)
+		if err != nil {
+			t.Fatalf("newRevProxy %q: unexpected error: %v", g.Name, err)
+		}
+		for _, host := range g.Targets {
+			route[host] = proxy
+		}
+	}
+
+	if p := route["a.com"]; p.Local != filepath.Join(cfg.CacheDir, "revproxy") || p.KeyPrefix != "revproxy" {
+		t.Errorf("Default group: got local %q, prefix %q", p.Local, p.KeyPrefix)
+	} else if p.RevalidateAfter != time.Minute {
+		t.Errorf("Default group: got revalidate %v, want %v", p.RevalidateAfter, time.Minute)
+	}
+	if p := route["b.com"]; p.Local != filepath.Join(cfg.CacheDir, "revproxy", "group", "pkgs") || p.KeyPrefix != "revproxy/group/pkgs" {
+		t.Errorf("Group pkgs: got local %q, prefix %q", p.Local, p.KeyPrefix)
+	} else if p.RevalidateAfter != time.Hour {
+		t.Errorf("Group pkgs: got revalidate %v, want %v", p.RevalidateAfter, time.Hour)
+	}
+	if route["b.com"] != route["c.com"] {
+		t.Error("Hosts of one group have different proxies")
+	}
+	for _, name := range []string{"revcache", "revcache_pkgs"} {
+		if s.metrics.Get(name) == nil {
+			t.Errorf("Metrics: %q not found", name)
+		}
+	}
+
+	// A host in no group is rejected without reaching any proxy.
+	rw := httptest.NewRecorder()
+	route.ServeHTTP(rw, httptest.NewRequest("GET", "http://d.com/x", nil))
+	if rw.Code != http.StatusBadGateway {
+		t.Errorf("Unknown host: got %d, want %d", rw.Code, http.StatusBadGateway)
+	}
+}
+
+func TestCacheLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want string // substring of the error, or "" for none
+	}{
+		{"Default", Config{}, ""},
+		{"Valid", Config{MinUploadSize: 1024, MaxUploadSize: 1 << 20, Expiration: time.Hour}, ""},
+		{"HugeMin", Config{MinUploadSize: 4 << 30}, ""}, // warned, not rejected
+		{"NegativeMin", Config{MinUploadSize: -1}, "minimum upload size must not be negative"},
+		{"NegativeMax", Config{MaxUploadSize: -5}, "maximum upload size must not be negative"},
+		{"MaxBelowMin", Config{MinUploadSize: 100, MaxUploadSize: 10}, "nothing would be uploaded"},
+		{"NegativeExpiration", Config{Expiration: -time.Hour}, "expiration period must not be negative"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.cfg.checkCacheLimits()
+			if tc.want == "" {
+				if err != nil {
+					t.Errorf("checkCacheLimits: unexpected error: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("checkCacheLimits: got %v, want error containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestAdmissionWindow(t *testing.T) {
+	tests := []struct {
+		cfg  Config
+		want int
+		ok   bool
+	}{
+		{Config{}, 0, true},
+		{Config{AdmissionPolicy: AdmitAll, AdmissionWindow: 100}, 0, true},
+		{Config{AdmissionPolicy: AdmitTinyLFU}, gobuild.DefaultAdmissionWindow, true},
+		{Config{AdmissionPolicy: AdmitTinyLFU, AdmissionWindow: 100}, 100, true},
+		{Config{AdmissionPolicy: "lru"}, 0, false},
+	}
+	for _, tc := range tests {
+		got, err := tc.cfg.admissionWindow()
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("admissionWindow(%q, %d): got (%d, %v), want %d, ok=%v",
+				tc.cfg.AdmissionPolicy, tc.cfg.AdmissionWindow, got, err, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestInitHTTP(t *testing.T) {
+	named := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(name)) })
+	}
+	modProxy, revProxy := named("mod"), named("rev")
+
+	// serve reports the body of the response of h to a request for url, or
+	// its status if it fails. An absolute URL is a proxy request; a path is
+	// sent to the server itself.
+	serve := func(h http.Handler, url string) string {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", url, nil)
+		if strings.HasPrefix(url, "/") {
+			req.Host = "localhost"
+		}
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			return http.StatusText(rec.Code)
+		}
+		return rec.Body.String()
+	}
+	const (
+		modURL   = "/mod/example.com/@v/list"
+		revURL   = "http://a.com/file"
+		debugURL = "/debug/"
+	)
+
+	tests := []struct {
+		name    string
+		modAddr string
+		revAddr string
+		want    map[string][]string // addr → responses for modURL, revURL
+	}{
+		{"Shared", "", "", map[string][]string{
+			":1": {"mod", "rev"},
+		}},
+		{"ModApart", ":2", "", map[string][]string{
+			":1": {"Not Found", "rev"},
+			":2": {"mod", "Bad Gateway"},
+		}},
+		{"RevApart", "", ":3", map[string][]string{
+			":1": {"mod", "Bad Gateway"},
+			":3": {"Not Found", "rev"},
+		}},
+		{"BothApart", ":2", ":3", map[string][]string{
+			":1": {"Not Found", "Bad Gateway"},
+			":2": {"mod", "Bad Gateway"},
+			":3": {"Not Found", "rev"},
+		}},
+		{"SameAddr", ":2", ":2", map[string][]string{
+			":1": {"Not Found", "Bad Gateway"},
+			":2": {"mod", "rev"},
+		}},
+		{"MainAddr", ":1", ":1", map[string][]string{
+			":1": {"mod", "rev"},
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{config: Config{HTTPAddr: ":1", ModProxyAddr: tc.modAddr, RevProxyAddr: tc.revAddr}}
+			s.initHTTP(modProxy, revProxy, nil, nil, nil, nil)
+			if len(s.services) != len(tc.want) {
+				t.Errorf("Got %d services, want %d", len(s.services), len(tc.want))
+			}
+			for _, svc := range s.services {
+				want, ok := tc.want[svc.addr]
+				if !ok {
+					t.Errorf("Unexpected service %q at %q", svc.name, svc.addr)
+					continue
+				}
+				got := []string{serve(svc.handler, modURL), serve(svc.handler, revURL)}
+				if got[0] != want[0] || got[1] != want[1] {
+					t.Errorf("Service at %q: got %q, want %q", svc.addr, got, want)
+				}
+
+				// Only the main service has the debug handlers.
+				if debug := serve(svc.handler, debugURL); (svc.addr == ":1") == (debug == "Not Found") {
+					t.Errorf("Service at %q: debug request got %q", svc.addr, debug)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// DefaultTLSMinVersion is the minimum TLS version accepted by the reverse
+// proxy if Config.RevProxyTLSMinVersion is not set.
+const DefaultTLSMinVersion = "1.2"
+
+// tlsVersions maps the TLS version names accepted in the configuration to
+// their protocol values.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// proxyTLSConfig returns the TLS configuration for the reverse proxy to
+// terminate client connections, serving cert, with the minimum version and
+// cipher suites set by c.
+func (c *Config) proxyTLSConfig(cert tls.Certificate) (*tls.Config, error) {
+	minVersion, err := parseTLSVersion(c.RevProxyTLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	suites, err := parseCipherSuites(c.RevProxyTLSCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+		CipherSuites: suites,
+	}, nil
+}
+
+// parseTLSVersion parses a TLS version name such as "1.2". An empty name means
+// DefaultTLSMinVersion.
+func parseTLSVersion(s string) (uint16, error) {
+	if s == "" {
+		s = DefaultTLSMinVersion
+	}
+	v, ok := tlsVersions[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q (want 1.0, 1.1, 1.2, or 1.3)", s)
+	}
+	return v, nil
+}
+
+// parseCipherSuites parses the names of TLS cipher suites, as reported by
+// [tls.CipherSuiteName]. Only suites without known security problems are
+// accepted. It returns nil if names is empty, meaning the default suites.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, cs := range tls.CipherSuites() {
+		known[cs.Name] = cs.ID
+	}
+	out := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure TLS cipher suite %q", name)
+		}
+		out = append(out, id)
+	}
+	return out, nil
+}
@@ -0,0 +1,97 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestProxyTLSConfig(t *testing.T) {
+	t.Run("Default", func(t *testing.T) {
+		var c Config
+		tc, err := c.proxyTLSConfig(tls.Certificate{})
+		if err != nil {
+			t.Fatalf("proxyTLSConfig: unexpected error: %v", err)
+		}
+		if tc.MinVersion != tls.VersionTLS12 {
+			t.Errorf("MinVersion: got %x, want %x", tc.MinVersion, tls.VersionTLS12)
+		}
+		if tc.CipherSuites != nil {
+			t.Errorf("CipherSuites: got %v, want nil", tc.CipherSuites)
+		}
+	})
+
+	t.Run("Suites", func(t *testing.T) {
+		c := Config{
+			RevProxyTLSMinVersion:   "1.3",
+			RevProxyTLSCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+		}
+		tc, err := c.proxyTLSConfig(tls.Certificate{})
+		if err != nil {
+			t.Fatalf("proxyTLSConfig: unexpected error: %v", err)
+		}
+		if tc.MinVersion != tls.VersionTLS13 {
+			t.Errorf("MinVersion: got %x, want %x", tc.MinVersion, tls.VersionTLS13)
+		}
+		want := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+		if !slices.Equal(tc.CipherSuites, want) {
+			t.Errorf("CipherSuites: got %v, want %v", tc.CipherSuites, want)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		tests := []struct {
+			name string
+			c    Config
+			want string
+		}{
+			{"Version", Config{RevProxyTLSMinVersion: "1.4"}, "unknown TLS version"},
+			{"Suite", Config{RevProxyTLSCipherSuites: []string{"TLS_BOGUS"}}, "unknown or insecure"},
+			{"Insecure", Config{RevProxyTLSCipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}, "unknown or insecure"},
+		}
+		for _, tc := range tests {
+			if _, err := tc.c.proxyTLSConfig(tls.Certificate{}); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("%s: got error %v, want %q", tc.name, err, tc.want)
+			}
+		}
+	})
+
+	t.Run("Handshake", func(t *testing.T) {
+		c := Config{RevProxyTLSMinVersion: "1.2"}
+		tc, err := c.proxyTLSConfig(tls.Certificate{})
+		if err != nil {
+			t.Fatalf("proxyTLSConfig: unexpected error: %v", err)
+		}
+		tc.Certificates = nil // filled in by StartTLS
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+		srv.TLS = tc
+		srv.StartTLS()
+		defer srv.Close()
+
+		dial := func(version uint16) error {
+			conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), &tls.Config{
+				InsecureSkipVerify: true,
+				MinVersion:         version,
+				MaxVersion:         version,
+			})
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}
+		if err := dial(tls.VersionTLS10); err == nil {
+			t.Error("TLS 1.0 handshake: got nil error, want rejection")
+		} else {
+			t.Logf("TLS 1.0 handshake: %v", err)
+		}
+		if err := dial(tls.VersionTLS12); err != nil {
+			t.Errorf("TLS 1.2 handshake: unexpected error: %v", err)
+		}
+	})
+}
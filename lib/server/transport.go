@@ -0,0 +1,34 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"net/http"
+	"runtime"
+)
+
+// httpTransport returns an HTTP transport for storage clients, with its
+// connection pool tuned according to c.
+//
+// Limits not set explicitly in c are scaled with the configured concurrency,
+// since all requests to a storage backend go to a small number of hosts, and
+// the standard library defaults (in particular, 2 idle connections per host)
+// cause a lot of connection churn when many requests are in flight.
+func (c *Config) httpTransport() *http.Transport {
+	n := max(c.Concurrency, c.S3Concurrency, c.GCSConcurrency, runtime.NumCPU())
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = max(t.MaxIdleConns, 2*n)
+	t.MaxIdleConnsPerHost = 2 * n
+	if c.MaxIdleConns > 0 {
+		t.MaxIdleConns = c.MaxIdleConns
+	}
+	if c.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	}
+	if c.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = c.IdleConnTimeout
+	}
+	return t
+}
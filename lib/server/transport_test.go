@@ -0,0 +1,37 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHTTPTransport(t *testing.T) {
+	t.Run("Explicit", func(t *testing.T) {
+		c := Config{
+			MaxIdleConns:        50,
+			MaxIdleConnsPerHost: 25,
+			IdleConnTimeout:     5 * time.Second,
+		}
+		tr := c.httpTransport()
+		if tr.MaxIdleConns != 50 || tr.MaxIdleConnsPerHost != 25 || tr.IdleConnTimeout != 5*time.Second {
+			t.Errorf("Transport: got (%d, %d, %v), want (50, 25, 5s)",
+				tr.MaxIdleConns, tr.MaxIdleConnsPerHost, tr.IdleConnTimeout)
+		}
+	})
+	t.Run("Scaled", func(t *testing.T) {
+		c := Config{Concurrency: 300}
+		tr := c.httpTransport()
+		if tr.MaxIdleConnsPerHost != 600 {
+			t.Errorf("MaxIdleConnsPerHost: got %d, want 600", tr.MaxIdleConnsPerHost)
+		}
+		if tr.MaxIdleConns < 600 {
+			t.Errorf("MaxIdleConns: got %d, want at least 600", tr.MaxIdleConns)
+		}
+		if tr.IdleConnTimeout <= 0 {
+			t.Errorf("IdleConnTimeout: got %v, want positive", tr.IdleConnTimeout)
+		}
+	})
+}